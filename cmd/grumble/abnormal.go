@@ -0,0 +1,91 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"mumble.info/grumble/pkg/ban"
+	"sync"
+	"time"
+)
+
+// An abnormalCounter counts the abnormal packets a client has sent
+// within the current window of the server's AbnormalPacketWindow.
+type abnormalCounter struct {
+	mutex sync.Mutex
+	start time.Time
+	count int
+}
+
+// Record that client sent an abnormal packet, such as a malformed voice
+// packet, described by what. Such packets are dropped, but a client that
+// sends more than AbnormalPacketLimit of them within AbnormalPacketWindow
+// seconds is disconnected by the server's handler, and banned if
+// AbnormalPacketBanDuration is set.
+//
+// Datagrams that fail to decrypt are counted too, in addition to the
+// crypt resync they trigger. The occasional lost or reordered datagram
+// stays well under the limit.
+//
+// Abnormal packets are reported by the UDP goroutines, so this is safe
+// to call from any goroutine.
+func (client *Client) reportAbnormalPacket(what string) {
+	cfg := client.server.cfg
+	limit := cfg.IntValue("AbnormalPacketLimit")
+	if limit <= 0 {
+		return
+	}
+	window := time.Duration(cfg.IntValue("AbnormalPacketWindow")) * time.Second
+
+	now := client.server.now()
+	counter := &client.abnormal
+	counter.mutex.Lock()
+	if now.Sub(counter.start) > window {
+		counter.start = now
+		counter.count = 0
+	}
+	counter.count++
+	exceeded := counter.count > limit
+	counter.mutex.Unlock()
+
+	if exceeded {
+		client.logRepeatedf("too many abnormal packets, last: %v", what)
+
+		// If the handler is busy, the client is handled on its
+		// next abnormal packet instead.
+		select {
+		case client.server.abnormalClients <- client:
+		default:
+		}
+	}
+}
+
+// Disconnect a client that sent too many abnormal packets, and ban its
+// address for AbnormalPacketBanDuration seconds, if set. Called on the
+// server's handler goroutine.
+func (server *Server) removeAbnormalClient(client *Client) {
+	if client.isDisconnected() {
+		return
+	}
+
+	reason := DisconnectKicked
+	duration := server.cfg.IntValue("AbnormalPacketBanDuration")
+	if duration > 0 {
+		reason = DisconnectBanned
+		server.banlock.Lock()
+		server.Bans = append(server.Bans, ban.Ban{
+			IP:       client.tcpaddr.IP,
+			Mask:     128,
+			Username: client.ShownName(),
+			CertHash: client.CertHash(),
+			Reason:   "Too many abnormal packets",
+			Start:    time.Now().Unix(),
+			Duration: uint32(duration),
+		})
+		server.UpdateFrozenBans(server.Bans)
+		server.banlock.Unlock()
+	}
+
+	client.disconnectWith(reason, "Too many abnormal packets")
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// Report n abnormal packets from client, and let the server handle the
+// client if it asks to. Returns whether it asked to.
+func reportTestAbnormalPackets(server *Server, client *Client, n int) bool {
+	for i := 0; i < n; i++ {
+		client.reportAbnormalPacket("test packet")
+	}
+	select {
+	case abnormal := <-server.abnormalClients:
+		server.removeAbnormalClient(abnormal)
+		return true
+	default:
+		return false
+	}
+}
+
+func TestAbnormalPacketLimit(t *testing.T) {
+	server := newTestServer(t)
+	server.cfg.Set("AbnormalPacketLimit", "5")
+	client, _ := newTestClient(server, "client")
+
+	if reportTestAbnormalPackets(server, client, 5) || client.isDisconnected() {
+		t.Fatalf("Expected client under the limit to stay connected")
+	}
+	if !reportTestAbnormalPackets(server, client, 1) || !client.isDisconnected() {
+		t.Fatalf("Expected client over the limit to be disconnected")
+	}
+	if len(server.Bans) != 0 {
+		t.Errorf("Expected no ban without a ban duration")
+	}
+}
+
+func TestAbnormalPacketWindow(t *testing.T) {
+	server := newTestServer(t)
+	server.cfg.Set("AbnormalPacketLimit", "5")
+	client, _ := newTestClient(server, "client")
+
+	reportTestAbnormalPackets(server, client, 5)
+	// Pretend the window started a minute ago; it is then over, and
+	// the count starts afresh.
+	client.abnormal.start = client.abnormal.start.Add(-time.Minute)
+	if reportTestAbnormalPackets(server, client, 5) || client.isDisconnected() {
+		t.Errorf("Expected abnormal packets in separate windows not to add up")
+	}
+}
+
+func TestAbnormalPacketBan(t *testing.T) {
+	server := newTestServer(t)
+	defer openTestFreezeLog(t, server)()
+	server.cfg.Set("AbnormalPacketLimit", "5")
+	server.cfg.Set("AbnormalPacketBanDuration", "60")
+	client, _ := newTestClient(server, "client")
+
+	if !reportTestAbnormalPackets(server, client, 6) || !client.isDisconnected() {
+		t.Fatalf("Expected client over the limit to be disconnected")
+	}
+	if len(server.Bans) != 1 {
+		t.Fatalf("Expected client to be banned, got %v", server.Bans)
+	}
+	b := server.Bans[0]
+	if !b.Match(client.tcpaddr.IP) || b.Duration != 60 || b.IsExpired() {
+		t.Errorf("Expected a 60 second ban of the client's address, got %+v", b)
+	}
+}
+
+func TestUndecryptableDatagrams(t *testing.T) {
+	server := newTestServer(t)
+	server.cfg.Set("AbnormalPacketLimit", "5")
+	client, _ := newTestClient(server, "client")
+	remote := setupTestUDPClient(t, server, client)
+	udpaddr := &net.UDPAddr{IP: client.tcpaddr.IP, Port: 50000}
+
+	// A datagram that decrypts ties the client to its UDP address.
+	server.handleUdpPacket(udpaddr, encryptTestDatagram(remote, []byte{0x20, 0x01}))
+	if server.hpclients[udpaddr.String()] != client {
+		t.Fatalf("Expected the client to be matched to its UDP address")
+	}
+
+	// Undecryptable datagrams count towards the limit.
+	for i := 0; i < 5; i++ {
+		server.handleUdpPacket(udpaddr, make([]byte, 16))
+	}
+	if reportTestAbnormalPackets(server, client, 0) {
+		t.Fatalf("Expected client under the limit to stay connected")
+	}
+	server.handleUdpPacket(udpaddr, make([]byte, 16))
+	if !reportTestAbnormalPackets(server, client, 0) || !client.isDisconnected() {
+		t.Errorf("Expected client over the limit to be disconnected")
+	}
+}
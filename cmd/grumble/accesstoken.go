@@ -0,0 +1,117 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// An accessToken is a temporary access token issued by the server's
+// operator. Clients that present the token among their access tokens
+// are members of its ACL group until the token expires.
+type accessToken struct {
+	group   string
+	expires time.Time
+}
+
+// Issue a temporary access token that grants membership of the named
+// ACL group for the given duration. The token is handed to a user out of
+// band, who adds it to their access tokens. Issued tokens are not saved,
+// so they do not survive a restart of the server.
+//
+// This is safe to call from any goroutine.
+func (server *Server) IssueAccessToken(group string, duration time.Duration) (string, error) {
+	if len(group) == 0 {
+		return "", errors.New("no group given")
+	}
+	if duration <= 0 {
+		return "", errors.New("duration must be positive")
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+
+	server.tokenlock.Lock()
+	defer server.tokenlock.Unlock()
+	if server.accessTokens == nil {
+		server.accessTokens = make(map[string]accessToken)
+	}
+	server.accessTokens[token] = accessToken{
+		group:   group,
+		expires: server.now().Add(duration),
+	}
+	return token, nil
+}
+
+// Get the ACL groups the client is a member of through the unexpired
+// temporary access tokens it has presented. Implements acl.GroupGrantee.
+func (client *Client) GrantedGroups() []string {
+	server := client.server
+	server.tokenlock.Lock()
+	defer server.tokenlock.Unlock()
+
+	groups := []string{}
+	now := server.now()
+	for _, token := range client.tokens {
+		if issued, ok := server.accessTokens[token]; ok && now.Before(issued.expires) {
+			groups = append(groups, issued.group)
+		}
+	}
+	return groups
+}
+
+// Remove the temporary access tokens that have expired, and re-evaluate
+// the permissions of the clients that presented them. Called once a
+// second on the server's handler goroutine.
+func (server *Server) sweepAccessTokens() {
+	expired := map[string]accessToken{}
+	now := server.now()
+	server.tokenlock.Lock()
+	for token, issued := range server.accessTokens {
+		if !now.Before(issued.expires) {
+			expired[token] = issued
+			delete(server.accessTokens, token)
+		}
+	}
+	server.tokenlock.Unlock()
+
+	if len(expired) == 0 {
+		return
+	}
+	for _, client := range server.clients {
+		if client.state != StateClientReady {
+			continue
+		}
+		granted := client.GrantedGroups()
+		current := len(granted)
+		for _, token := range client.tokens {
+			if issued, ok := expired[token]; ok {
+				granted = append(granted, issued.group)
+			}
+		}
+		if len(granted) > current {
+			before := &tokenHolder{client, granted}
+			server.updateClientTokens(client, server.visibleUsers(before))
+		}
+	}
+}
+
+// A tokenHolder stands in for a client in permission checks, as it was
+// before some of its access tokens expired: a member of the groups of
+// those tokens as well.
+type tokenHolder struct {
+	*Client
+	groups []string
+}
+
+func (holder *tokenHolder) GrantedGroups() []string {
+	return holder.groups
+}
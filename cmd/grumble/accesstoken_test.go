@@ -0,0 +1,98 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"github.com/golang/protobuf/proto"
+	"mumble.info/grumble/pkg/acl"
+	"mumble.info/grumble/pkg/mumbleproto"
+	"testing"
+	"time"
+)
+
+func TestIssuedAccessToken(t *testing.T) {
+	server := newTestServer(t)
+	stage := newTestChannel(server, server.RootChannel(), "Stage")
+	stage.ACL.ACLs = append(stage.ACL.ACLs, acl.ACL{
+		UserId:    -1,
+		Group:     "all",
+		ApplyHere: true,
+		Deny:      acl.Permission(acl.EnterPermission | acl.SpeakPermission),
+	}, acl.ACL{
+		UserId:    -1,
+		Group:     "event",
+		ApplyHere: true,
+		Allow:     acl.Permission(acl.EnterPermission | acl.SpeakPermission),
+	})
+
+	if _, err := server.IssueAccessToken("event", 0); err == nil {
+		t.Errorf("Expected token without a duration to be refused")
+	}
+	token, err := server.IssueAccessToken("event", time.Hour)
+	if err != nil {
+		t.Fatalf("unable to issue token: %v", err)
+	}
+
+	alice, alicePeer := newTestClient(server, "alice")
+	enterStage := newTestMessage(t, alice, &mumbleproto.UserState{
+		ChannelId: proto.Uint32(uint32(stage.Id)),
+	})
+	server.handleIncomingMessage(alice, enterStage)
+	if alice.Channel == stage {
+		t.Fatalf("Expected client without token to be denied entry")
+	}
+
+	// The token is not a token group of its own; only its ACL group
+	// grants entry.
+	server.handleIncomingMessage(alice, newTestMessage(t, alice, &mumbleproto.Authenticate{
+		Tokens: []string{"not-" + token},
+	}))
+	server.handleIncomingMessage(alice, enterStage)
+	if alice.Channel == stage {
+		t.Fatalf("Expected client with an unknown token to be denied entry")
+	}
+
+	server.handleIncomingMessage(alice, newTestMessage(t, alice, &mumbleproto.Authenticate{
+		Tokens: []string{token},
+	}))
+	server.handleIncomingMessage(alice, enterStage)
+	if alice.Channel != stage {
+		t.Fatalf("Expected issued token to grant entry")
+	}
+	if alice.Suppress {
+		t.Errorf("Expected client with issued token to be able to speak")
+	}
+
+	// Sweeping before the token expires changes nothing.
+	server.sweepAccessTokens()
+	if alice.Suppress {
+		t.Errorf("Expected unexpired token to be kept")
+	}
+
+	// Let the token expire.
+	server.tokenlock.Lock()
+	issued := server.accessTokens[token]
+	issued.expires = time.Now().Add(-time.Second)
+	server.accessTokens[token] = issued
+	server.tokenlock.Unlock()
+	if acl.HasPermission(&stage.ACL, alice, acl.EnterPermission) {
+		t.Errorf("Expected expired token not to grant its group")
+	}
+
+	// Drain the permission flushes sent so far.
+	alicePeer.expectNone(t, mumbleproto.MessageReject)
+	server.sweepAccessTokens()
+	if _, ok := server.accessTokens[token]; ok {
+		t.Errorf("Expected expired token to be swept")
+	}
+	flush := &mumbleproto.PermissionQuery{}
+	alicePeer.expect(t, mumbleproto.MessagePermissionQuery, flush)
+	if !flush.GetFlush() {
+		t.Errorf("Expected permissions to be flushed when the token expired")
+	}
+	if !alice.Suppress {
+		t.Errorf("Expected client to be suppressed once its token expired")
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"net"
+)
+
+// AddressInfo holds metadata about the address a client connects from.
+type AddressInfo struct {
+	// The country the address is located in, such as "DK".
+	Country string `json:"country,omitempty"`
+	// A free-form description of the address, such as the name of
+	// the network it belongs to.
+	Label string `json:"label,omitempty"`
+}
+
+// An AddressResolver looks up metadata about the addresses clients
+// connect from, for example in a GeoIP database.
+//
+// The server doesn't ship with a resolver; operators that want their
+// clients' addresses annotated set the server's AddressResolver to
+// their own. Resolvers are called on the connecting client's receiver
+// goroutine, so a slow lookup only delays that client's login.
+type AddressResolver interface {
+	ResolveAddress(ip net.IP) (AddressInfo, error)
+}
+
+// Look up metadata about the client's address using the server's
+// AddressResolver, if it has one.
+func (client *Client) resolveAddress() {
+	resolver := client.server.AddressResolver
+	if resolver == nil {
+		return
+	}
+
+	info, err := resolver.ResolveAddress(client.tcpaddr.IP)
+	if err != nil {
+		client.Printf("Unable to resolve address %v: %v", client.tcpaddr.IP, err)
+		return
+	}
+	client.addressInfo = info
+	client.Printf("Connecting from %v (country %q, %q)", client.tcpaddr.IP, info.Country, info.Label)
+}
+
+// Get the metadata about the client's address found by the server's
+// AddressResolver.
+func (client *Client) AddressInfo() AddressInfo {
+	return client.addressInfo
+}
@@ -0,0 +1,46 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// A fakeResolver labels loopback addresses.
+type fakeResolver struct{}
+
+func (fakeResolver) ResolveAddress(ip net.IP) (AddressInfo, error) {
+	if !ip.IsLoopback() {
+		return AddressInfo{}, errors.New("unknown address")
+	}
+	return AddressInfo{Country: "ZZ", Label: "loopback"}, nil
+}
+
+func TestAddressResolver(t *testing.T) {
+	server := newTestServer(t)
+	defer answerTestProbes(server)()
+	client, _ := newAuthenticatingClient(server, "client")
+
+	// Without a resolver, nothing is looked up.
+	client.resolveAddress()
+	if client.AddressInfo() != (AddressInfo{}) {
+		t.Errorf("Expected no address info without a resolver, got %+v", client.AddressInfo())
+	}
+
+	server.AddressResolver = fakeResolver{}
+	client.resolveAddress()
+	expected := AddressInfo{Country: "ZZ", Label: "loopback"}
+	if client.AddressInfo() != expected {
+		t.Errorf("Expected address info %+v, got %+v", expected, client.AddressInfo())
+	}
+
+	server.finishAuthenticate(client)
+	clients := server.Clients()
+	if len(clients) != 1 || clients[0].AddressInfo != expected {
+		t.Errorf("Expected client list to include the address info, got %+v", clients)
+	}
+}
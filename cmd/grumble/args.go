@@ -36,6 +36,11 @@ var usageTmpl = `usage: grumble [options]
      The global keypair lives in the root of the
      grumble data directory.
 
+ --metrics <addr>
+     Serve the metrics of all virtual servers at
+     http://<addr>/metrics, in the Prometheus text
+     format.
+
  --import-murmurdb <murmur-sqlite-path>
      Import a Murmur SQLite database into grumble.
 
@@ -49,6 +54,7 @@ type args struct {
 	DataDir   string
 	LogPath   string
 	RegenKeys bool
+	Metrics   string
 	SQLiteDB  string
 	CleanUp   bool
 }
@@ -91,6 +97,7 @@ func init() {
 	flag.StringVar(&Args.DataDir, "datadir", defaultDataDir(), "")
 	flag.StringVar(&Args.LogPath, "log", defaultLogPath(), "")
 	flag.BoolVar(&Args.RegenKeys, "regen-keys", false, "")
+	flag.StringVar(&Args.Metrics, "metrics", "", "")
 
 	flag.StringVar(&Args.SQLiteDB, "import-murmurdb", "", "")
 	flag.BoolVar(&Args.CleanUp, "cleanup", false, "")
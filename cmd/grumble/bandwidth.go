@@ -0,0 +1,128 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"github.com/golang/protobuf/proto"
+	"mumble.info/grumble/pkg/mumbleproto"
+)
+
+// The lowest per-client bandwidth, in bits per second, advertised when
+// the server shares a TotalBandwidth between its clients. Clients can't
+// send usable voice with less.
+const minClientBandwidth = 8000
+
+// How much the per-client bandwidth must change, relative to the value
+// last advertised, before connected clients are told about it.
+const bandwidthUpdateThreshold = 0.1
+
+// Get the bandwidth each client may use, in bits per second.
+//
+// This is normally MaxBandwidth. If TotalBandwidth is set, it is instead
+// TotalBandwidth shared evenly between the active speakers, but never
+// more than MaxBandwidth or less than minClientBandwidth.
+func (server *Server) clientBandwidth() uint32 {
+	max := server.cfg.Uint32Value("MaxBandwidth")
+	total := server.cfg.Uint32Value("TotalBandwidth")
+	if total == 0 {
+		return max
+	}
+
+	speakers := uint32(server.activeSpeakers())
+	if speakers == 0 {
+		speakers = 1
+	}
+	share := total / speakers
+	if share < minClientBandwidth {
+		share = minClientBandwidth
+	}
+	if max > 0 && share > max {
+		share = max
+	}
+	return share
+}
+
+// Get the per-client bandwidth to advertise to a client that is logging
+// in. Once clients have been told about a shared TotalBandwidth, logging
+// in clients are told the same value.
+func (server *Server) advertisedBandwidth() uint32 {
+	if server.cfg.Uint32Value("TotalBandwidth") == 0 || server.sentBandwidth == 0 {
+		return server.clientBandwidth()
+	}
+	return server.sentBandwidth
+}
+
+// Get the number of clients that have had voice relayed within the last
+// talkingTimeout.
+func (server *Server) activeSpeakers() int {
+	now := server.now()
+	speakers := 0
+	for _, client := range server.clients {
+		if !client.lastSpeech.IsZero() && now.Sub(client.lastSpeech) <= talkingTimeout {
+			speakers++
+		}
+	}
+	return speakers
+}
+
+// Check whether voice packet buf from speaker fits within the speaker's
+// share of the server's TotalBandwidth, and record the speaker as an
+// active speaker. A speaker that starts talking can lower everyone's
+// share, which is recomputed right away. The share allows bursts of up
+// to a second's worth of voice.
+//
+// Called on the server's handler goroutine.
+func (server *Server) allowSpeakerBandwidth(speaker *Client, buf []byte) bool {
+	if server.cfg.Uint32Value("TotalBandwidth") == 0 {
+		return true
+	}
+
+	now := server.now()
+	started := speaker.lastSpeech.IsZero() || now.Sub(speaker.lastSpeech) > talkingTimeout
+	speaker.lastSpeech = now
+	if started {
+		server.updateClientBandwidth()
+	}
+
+	bytesPerSec := float64(server.advertisedBandwidth()) / 8
+	return speaker.speechLimiter.allowN(now, float64(len(buf)), bytesPerSec, bytesPerSec)
+}
+
+// Recompute the per-client bandwidth after a client connected or
+// disconnected, or started or stopped speaking, if the server shares a
+// TotalBandwidth between its active speakers. If it changed by more than
+// bandwidthUpdateThreshold, it is sent to the clients that are logged
+// in, in a ServerConfig message.
+//
+// Called on the server's handler goroutine, which is the only one that
+// may touch sentBandwidth.
+func (server *Server) updateClientBandwidth() {
+	if server.cfg.Uint32Value("TotalBandwidth") == 0 {
+		server.sentBandwidth = 0
+		return
+	}
+
+	bandwidth := server.clientBandwidth()
+	last := server.sentBandwidth
+	if last != 0 {
+		change := float64(bandwidth) - float64(last)
+		if change < 0 {
+			change = -change
+		}
+		if change <= bandwidthUpdateThreshold*float64(last) {
+			return
+		}
+	}
+	server.sentBandwidth = bandwidth
+
+	err := server.broadcastProtoMessageWithPredicate(&mumbleproto.ServerConfig{
+		MaxBandwidth: proto.Uint32(bandwidth),
+	}, func(client *Client) bool {
+		return client.state == StateClientReady
+	})
+	if err != nil {
+		server.Printf("Unable to broadcast bandwidth update: %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"mumble.info/grumble/pkg/mumbleproto"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Relay a voice packet from client to its channel, and return whether it
+// was allowed within the client's bandwidth.
+func speakTestVoice(server *Server, client *Client, size int) bool {
+	buf := make([]byte, size)
+	buf[0] = mumbleproto.UDPMessageVoiceOpus << 5
+	return server.allowSpeakerBandwidth(client, buf)
+}
+
+func TestClientBandwidth(t *testing.T) {
+	server := newTestServer(t)
+	server.SetClock(newFakeClock())
+	if bw := server.clientBandwidth(); bw != 72000 {
+		t.Errorf("Expected MaxBandwidth without a TotalBandwidth, got %v", bw)
+	}
+
+	server.cfg.Set("TotalBandwidth", "100000")
+	clients := []*Client{}
+	for i := 0; i < 20; i++ {
+		client, _ := newTestClient(server, "client"+strconv.Itoa(i))
+		clients = append(clients, client)
+	}
+	if bw := server.clientBandwidth(); bw != 72000 {
+		t.Errorf("Expected the share to be capped at MaxBandwidth, got %v", bw)
+	}
+
+	// The total is shared between the clients that speak, not all
+	// the connected ones.
+	for _, client := range clients[:4] {
+		speakTestVoice(server, client, 10)
+	}
+	if bw := server.clientBandwidth(); bw != 25000 {
+		t.Errorf("Expected a quarter of the total for 4 speakers, got %v", bw)
+	}
+	for _, client := range clients[4:] {
+		speakTestVoice(server, client, 10)
+	}
+	if bw := server.clientBandwidth(); bw != minClientBandwidth {
+		t.Errorf("Expected the share not to drop below %v, got %v", minClientBandwidth, bw)
+	}
+}
+
+func TestAdaptiveBandwidth(t *testing.T) {
+	server := newTestServer(t)
+	defer openTestFreezeLog(t, server)()
+	clock := newFakeClock()
+	server.SetClock(clock)
+	server.cfg.Set("TotalBandwidth", "200000")
+
+	clients := []*Client{}
+	peers := []*testPeer{}
+	// Log in a new client, and check the bandwidth its ServerSync
+	// advertises.
+	login := func(expected uint32) {
+		client, peer := newAuthenticatingClient(server, "client"+strconv.Itoa(len(peers)))
+		server.finishAuthenticate(client)
+		sync := &mumbleproto.ServerSync{}
+		peer.expect(t, mumbleproto.MessageServerSync, sync)
+		if sync.GetMaxBandwidth() != expected {
+			t.Errorf("Expected client %v to be advertised %v, got %v", len(peers), expected, sync.GetMaxBandwidth())
+		}
+		// The ServerConfig of the login itself.
+		peer.expect(t, mumbleproto.MessageServerConfig, nil)
+		clients = append(clients, client)
+		peers = append(peers, peer)
+	}
+	// Check that each of the clients is sent a ServerConfig with the
+	// given bandwidth.
+	expectUpdate := func(expected uint32) {
+		for i, peer := range peers {
+			config := &mumbleproto.ServerConfig{}
+			peer.expect(t, mumbleproto.MessageServerConfig, config)
+			if config.GetMaxBandwidth() != expected {
+				t.Errorf("Expected client %v to be sent %v, got %v", i, expected, config.GetMaxBandwidth())
+			}
+		}
+	}
+
+	// Clients that don't speak don't use up the total.
+	for i := 0; i < 4; i++ {
+		login(72000)
+	}
+
+	speakTestVoice(server, clients[0], 10)
+	speakTestVoice(server, clients[1], 10)
+	// A third of the total is less than 10% below MaxBandwidth, so the
+	// advertised bandwidth stays the same.
+	speakTestVoice(server, clients[2], 10)
+	for _, peer := range peers {
+		peer.expectNone(t, mumbleproto.MessageServerConfig)
+	}
+	speakTestVoice(server, clients[3], 10)
+	expectUpdate(50000)
+
+	// The share grows again as speakers fall silent.
+	clock.advance(talkingTimeout / 2)
+	for _, client := range clients[:3] {
+		speakTestVoice(server, client, 10)
+	}
+	clock.advance(talkingTimeout/2 + time.Millisecond)
+	server.updateClientBandwidth()
+	expectUpdate(66666)
+}
+
+func TestSpeakerBandwidthEnforced(t *testing.T) {
+	server := newTestServer(t)
+	clock := newFakeClock()
+	server.SetClock(clock)
+	server.cfg.Set("TotalBandwidth", "8000")
+	speaker, _ := newTestClient(server, "speaker")
+
+	// The share of 8 kbit/s allows a second's worth of 1000 bytes at
+	// once, and refills as time passes.
+	if !speakTestVoice(server, speaker, 600) || !speakTestVoice(server, speaker, 400) {
+		t.Fatalf("Expected voice within the share to be relayed")
+	}
+	if speakTestVoice(server, speaker, 100) {
+		t.Errorf("Expected voice over the share to be dropped")
+	}
+	clock.advance(100 * time.Millisecond)
+	if !speakTestVoice(server, speaker, 100) {
+		t.Errorf("Expected voice to be relayed once the share refilled")
+	}
+}
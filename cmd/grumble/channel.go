@@ -7,6 +7,9 @@ package main
 import (
 	"encoding/hex"
 	"mumble.info/grumble/pkg/acl"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // A Mumble channel
@@ -15,11 +18,38 @@ type Channel struct {
 	Name     string
 	Position int
 
+	// The maximum number of users allowed in the channel.
+	// Zero means that the server's per-channel limit applies.
+	MaxUsers int
+
+	// A secret that clients must have presented as one of their
+	// access tokens to enter the channel. Empty if the channel
+	// is not restricted.
+	EnterToken string
+
+	// The number of text messages per minute each user may send to
+	// the channel. Zero means that the server's ChannelTextMessageLimit
+	// applies.
+	TextMessageLimit int
+
 	temporary bool
 	clients   map[uint32]*Client
 	parent    *Channel
 	children  map[int]*Channel
 
+	// The client that created the channel, if it is temporary.
+	creator *Client
+
+	// The time of the last voice packet of each client that is
+	// speaking in the channel, by session. Nil until someone speaks
+	// while the server has a MaxChannelSpeakers limit. Only accessed by
+	// the server's handler goroutine.
+	speakers map[uint32]time.Time
+
+	// Until when the voice of the users in the channel is paused.
+	// See Server.PauseVoice.
+	voicePausedUntil time.Time
+
 	// ACL
 	ACL acl.Context
 
@@ -64,6 +94,7 @@ func (channel *Channel) AddClient(client *Client) {
 // Remove client
 func (channel *Channel) RemoveClient(client *Client) {
 	delete(channel.clients, client.Session())
+	delete(channel.speakers, client.Session())
 	client.Channel = nil
 }
 
@@ -129,3 +160,91 @@ func (channel *Channel) IsTemporary() bool {
 func (channel *Channel) IsEmpty() bool {
 	return len(channel.clients) == 0
 }
+
+// Checks whether neither the channel nor any of its subchannels has
+// clients in it.
+func (channel *Channel) IsUnoccupied() bool {
+	if !channel.IsEmpty() {
+		return false
+	}
+	for _, child := range channel.children {
+		if !child.IsUnoccupied() {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks whether client is allowed to enter the channel. Entering requires
+// EnterPermission and, if the channel has an enter token, that the client has
+// presented it as an access token. A channel without an EnterToken of its
+// own takes it from the server's EnterTokens. Like token groups in ACLs, the
+// token check is case-insensitive.
+func (channel *Channel) CanEnter(client *Client) bool {
+	if !acl.HasPermission(&channel.ACL, client, acl.EnterPermission) {
+		return false
+	}
+	enterToken := channel.EnterToken
+	if len(enterToken) == 0 {
+		enterToken = client.server.enterTokens()[channel.Id]
+	}
+	if len(enterToken) == 0 || client.IsSuperUser() {
+		return true
+	}
+	for _, token := range client.Tokens() {
+		if strings.EqualFold(token, enterToken) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the enter tokens of the server's EnterTokens config key, by channel
+// id. Entries that can't be parsed are ignored. The key is parsed again
+// only when it has changed, since the tokens are looked up on every move.
+func (server *Server) enterTokens() map[int]string {
+	spec := server.cfg.StringValue("EnterTokens")
+
+	server.enterTokensLock.Lock()
+	defer server.enterTokensLock.Unlock()
+	if spec == server.enterTokensSpec {
+		return server.enterTokenMap
+	}
+
+	tokens := make(map[int]string)
+	if spec != "" {
+		for _, entry := range strings.Split(spec, ",") {
+			parts := strings.SplitN(entry, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			id, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+			token := strings.TrimSpace(parts[1])
+			if err != nil || id < 0 || len(token) == 0 {
+				continue
+			}
+			tokens[id] = token
+		}
+	}
+	server.enterTokensSpec = spec
+	server.enterTokenMap = tokens
+	return tokens
+}
+
+// Find the subchannel of channel with the given name, ignoring case.
+// Sibling channels can have names that only differ in case; if several
+// subchannels match, the one whose name matches exactly is returned, or
+// otherwise the one with the lowest id. Returns nil if no subchannel
+// matches.
+func (channel *Channel) ChildByName(name string) *Channel {
+	var found *Channel
+	for _, child := range channel.children {
+		if child.Name == name {
+			return child
+		}
+		if strings.EqualFold(child.Name, name) && (found == nil || child.Id < found.Id) {
+			found = child
+		}
+	}
+	return found
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestChannelTree(t *testing.T) {
+	root := NewChannel(0, "Root")
+	lobby := NewChannel(1, "Lobby")
+	games := NewChannel(2, "Games")
+	root.AddChild(lobby)
+	lobby.AddChild(games)
+
+	if lobby.parent != root || games.parent != lobby {
+		t.Fatalf("Expected channels to be linked to their parents")
+	}
+	if games.ACL.Parent != &lobby.ACL {
+		t.Errorf("Expected child ACL context to inherit from its parent's")
+	}
+
+	subs := root.AllSubChannels()
+	if len(subs) != 2 || subs[1] != lobby || subs[2] != games {
+		t.Errorf("Expected Lobby and Games as subchannels of Root, got %v", subs)
+	}
+
+	lobby.RemoveChild(games)
+	if games.parent != nil || games.ACL.Parent != nil {
+		t.Errorf("Expected removed channel to have no parent")
+	}
+	if _, ok := lobby.children[games.Id]; ok {
+		t.Errorf("Expected Games to be removed from Lobby")
+	}
+	if subs := root.AllSubChannels(); len(subs) != 1 {
+		t.Errorf("Expected only Lobby as a subchannel of Root, got %v", subs)
+	}
+}
+
+func TestChannelMembership(t *testing.T) {
+	server := newTestServer(t)
+	lobby := newTestChannel(server, server.RootChannel(), "Lobby")
+	client, _ := newTestClient(server, "client")
+
+	server.RootChannel().RemoveClient(client)
+	if client.Channel != nil || !server.RootChannel().IsEmpty() {
+		t.Fatalf("Expected client to have left Root")
+	}
+
+	lobby.AddClient(client)
+	if client.Channel != lobby {
+		t.Errorf("Expected client to be in Lobby")
+	}
+	if lobby.IsEmpty() || lobby.clients[client.Session()] != client {
+		t.Errorf("Expected Lobby to contain client")
+	}
+
+	lobby.RemoveClient(client)
+	if client.Channel != nil || !lobby.IsEmpty() {
+		t.Errorf("Expected Lobby to be empty")
+	}
+}
+
+func TestChannelAllLinks(t *testing.T) {
+	a := NewChannel(1, "A")
+	b := NewChannel(2, "B")
+	c := NewChannel(3, "C")
+	d := NewChannel(4, "D")
+
+	// A <-> B <-> C, D unlinked.
+	a.Links[b.Id] = b
+	b.Links[a.Id] = a
+	b.Links[c.Id] = c
+	c.Links[b.Id] = b
+
+	links := a.AllLinks()
+	for _, channel := range []*Channel{a, b, c} {
+		if links[channel.Id] != channel {
+			t.Errorf("Expected %v in A's link chain", channel.Name)
+		}
+	}
+	if _, ok := links[d.Id]; ok {
+		t.Errorf("Expected D not to be in A's link chain")
+	}
+	if len(d.AllLinks()) != 0 {
+		t.Errorf("Expected D to have no links")
+	}
+}
+
+func TestChannelFreeze(t *testing.T) {
+	channel := NewChannel(1, "Lobby")
+	channel.MaxUsers = 5
+	channel.EnterToken = "secret"
+	channel.TextMessageLimit = 10
+
+	fc, err := channel.Freeze()
+	if err != nil {
+		t.Fatalf("unable to freeze channel: %v", err)
+	}
+
+	thawed := NewChannel(1, "")
+	thawed.Unfreeze(fc)
+	if thawed.MaxUsers != 5 {
+		t.Errorf("Expected MaxUsers 5, got %v", thawed.MaxUsers)
+	}
+	if thawed.EnterToken != "secret" {
+		t.Errorf("Expected EnterToken %q, got %q", "secret", thawed.EnterToken)
+	}
+	if thawed.TextMessageLimit != 10 {
+		t.Errorf("Expected TextMessageLimit 10, got %v", thawed.TextMessageLimit)
+	}
+}
+
+func TestChannelCanEnter(t *testing.T) {
+	server := newTestServer(t)
+	channel := newTestChannel(server, server.RootChannel(), "Locked")
+	client, _ := newTestClient(server, "client")
+
+	if !channel.CanEnter(client) {
+		t.Errorf("Expected unrestricted channel to be enterable")
+	}
+
+	channel.EnterToken = "secret"
+	if channel.CanEnter(client) {
+		t.Errorf("Expected channel not to be enterable without its token")
+	}
+	client.tokens = []string{"wrong"}
+	if channel.CanEnter(client) {
+		t.Errorf("Expected channel not to be enterable with the wrong token")
+	}
+	client.tokens = []string{"wrong", "SECRET"}
+	if !channel.CanEnter(client) {
+		t.Errorf("Expected channel to be enterable with its token")
+	}
+}
+
+func TestChannelByPath(t *testing.T) {
+	server := newTestServer(t)
+	lobby := newTestChannel(server, server.RootChannel(), "Lobby")
+	games := newTestChannel(server, lobby, "Games")
+	newTestChannel(server, lobby, "games")
+
+	if server.ChannelByPath("/") != server.RootChannel() || server.ChannelByPath("") != server.RootChannel() {
+		t.Errorf("Expected empty path to be the root channel")
+	}
+	if server.ChannelByPath("/Lobby/Games") != games {
+		t.Errorf("Expected /Lobby/Games to be found")
+	}
+	if server.ChannelByPath("lobby/GAMES/") != games {
+		t.Errorf("Expected path lookup to ignore case, preferring the lowest id")
+	}
+	if server.ChannelByPath("/Lobby/Missing") != nil || server.ChannelByPath("/Games") != nil {
+		t.Errorf("Expected missing path not to be found")
+	}
+}
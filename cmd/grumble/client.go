@@ -7,9 +7,9 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"crypto/tls"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"github.com/golang/protobuf/proto"
 	"io"
 	"log"
@@ -19,11 +19,32 @@ import (
 	"mumble.info/grumble/pkg/packetdata"
 	"net"
 	"runtime"
+	"sync/atomic"
 	"time"
 )
 
 // A client connection
 type Client struct {
+	// The time (in seconds on the server's clock, see clock.go) at which
+	// the client last sent us a ping, either via its control channel or
+	// via UDP. Accessed atomically, since it is updated by both the
+	// server's handler and the UDP receiver. Kept as the first field to
+	// ensure 64-bit alignment.
+	lastPing int64
+	// The time (in seconds on the server's clock) at which we last
+	// received a valid UDP packet from the client. Accessed atomically,
+	// like lastPing.
+	lastUDP int64
+
+	// Voice packet counters. Follows lastUDP to ensure 64-bit alignment.
+	voiceStats VoiceStats
+
+	// The abnormal packets the client has recently sent.
+	abnormal abnormalCounter
+
+	// The log messages the client's packets have recently repeated.
+	repeats repeatLog
+
 	// Logging
 	*log.Logger
 	lf *clientLogForwarder
@@ -38,15 +59,39 @@ type Client struct {
 
 	udprecv chan []byte
 
-	disconnected bool
+	// Metadata about tcpaddr, from the server's AddressResolver.
+	addressInfo AddressInfo
+
+	// Set once the client has been disconnected. Written on the server's
+	// handler goroutine, but also read by the client's own goroutines and
+	// the UDP listener, so it is accessed atomically. See isDisconnected.
+	disconnected int32
+
+	// The time at which the client connected, and the reason it was
+	// disconnected, for the connection lifecycle events. The class of
+	// the disconnect labels the metrics' disconnect counter.
+	connectTime      time.Time
+	disconnectReason string
+	disconnectClass  string
 
 	lastResync   int64
 	crypt        cryptstate.CryptState
 	codecs       []int32
+	celt         bool
 	opus         bool
-	udp          bool
 	voiceTargets map[uint32]*VoiceTarget
 
+	// Non-zero while voice is sent to the client over UDP rather than
+	// tunneled over TCP. Set by the UDP listener, and cleared by the
+	// receiver and the handler, so it is accessed atomically. See
+	// usesUDP.
+	udp int32
+
+	// The voice target the client last whispered to, and when.
+	// Only accessed by the server's handler goroutine.
+	whisperTarget uint32
+	whisperTime   time.Time
+
 	// Ping stats
 	UdpPingAvg float32
 	UdpPingVar float32
@@ -66,6 +111,43 @@ type Client struct {
 	// 'ready' state.
 	clientReady chan bool
 
+	// The permissions last sent to the client, indexed by channel id.
+	permissionsSent map[int]acl.Permission
+
+	// Control message rate limiting. Only accessed by the server's
+	// handler goroutine.
+	msgLimiter leakyBucket
+	throttled  bool
+
+	// Channel creation rate limiting, for permanent and temporary
+	// channels. Only accessed by the server's handler goroutine.
+	channelLimiter     leakyBucket
+	tempChannelLimiter leakyBucket
+
+	// Text message rate limiting, by channel id. Only accessed by
+	// the server's handler goroutine.
+	textLimiters map[int]*leakyBucket
+
+	// VoiceTarget update rate limiting. Only accessed by the server's
+	// handler goroutine.
+	voiceTargetLimiter leakyBucket
+
+	// RequestBlob rate limiting. Only accessed by the server's handler
+	// goroutine.
+	blobLimiter leakyBucket
+
+	// Resync request rate limiting. Only accessed by the server's
+	// handler goroutine.
+	resyncLimiter leakyBucket
+
+	// Limits the bandwidth of the voice packets relayed to the
+	// client. Only accessed by the server's handler goroutine.
+	voiceLimiter leakyBucket
+
+	// Whether the client presented a strong certificate. Set once
+	// its TLS handshake is done.
+	strongCert bool
+
 	// Version
 	Version    uint32
 	ClientName string
@@ -89,6 +171,43 @@ type Client struct {
 	Recording       bool
 	PluginContext   []byte
 	PluginIdentity  string
+
+	// Whether a moderator has pinned the client to its channel, so
+	// it can't move itself elsewhere. Only accessed by the server's
+	// handler goroutine.
+	pinned bool
+
+	// Non-zero if the client is muted, self-muted or suppressed, and
+	// its voice packets are to be dropped. Kept up to date by the
+	// server's handler goroutine with updateVoiceMuted, and read by the
+	// client's UDP receiver.
+	voiceMuted int32
+
+	// Whether the client is suppressed until a moderator
+	// approves it. See Server.ApproveClient.
+	unapproved bool
+
+	// Whether the client is waiting in the server's queue channel
+	// for a slot. Only accessed by the server's handler goroutine.
+	queued bool
+
+	// When the client's last voice packet was relayed, and the channel
+	// it is talking in, or nil while it is silent. Only kept up to date
+	// if the server's TalkingNotifications are enabled, and only
+	// accessed by the server's handler goroutine.
+	lastVoice      time.Time
+	talkingChannel *Channel
+
+	// When the client's last voice packet was relayed, and the limit on
+	// the bandwidth of the voice it sends, if the server shares a
+	// TotalBandwidth between its speakers. Only accessed by the server's
+	// handler goroutine. See bandwidth.go.
+	lastSpeech    time.Time
+	speechLimiter leakyBucket
+
+	// Whether the client has asked to be told when users start and stop
+	// talking. Only accessed by the server's handler goroutine.
+	watchTalking bool
 }
 
 // Debugf implements debug-level printing for Clients.
@@ -114,7 +233,11 @@ func (client *Client) IsSuperUser() bool {
 	return client.user.Id == 0
 }
 
+// Get the ACL context of the client's channel, or nil if it isn't in one.
 func (client *Client) ACLContext() *acl.Context {
+	if client.Channel == nil {
+		return nil
+	}
 	return &client.Channel.ACL
 }
 
@@ -150,51 +273,171 @@ func (client *Client) ShownName() string {
 	return client.Username
 }
 
-// Check whether the client's certificate is
-// verified.
+// Check whether the client's certificate is a strong certificate,
+// signed by one of the server's client CAs. See strongcert.go.
 func (client *Client) IsVerified() bool {
-	tlsconn := client.conn.(*tls.Conn)
-	state := tlsconn.ConnectionState()
-	return len(state.VerifiedChains) > 0
+	return client.strongCert
+}
+
+// Record that the client has just sent us a ping.
+func (client *Client) touchPing() {
+	client.touchPingAt(client.server.now())
+}
+
+// Record that the client sent us a ping at t.
+func (client *Client) touchPingAt(t time.Time) {
+	atomic.StoreInt64(&client.lastPing, client.server.clockSeconds(t))
+}
+
+// Get the number of seconds since the client last sent us a ping.
+func (client *Client) secondsSincePing() int64 {
+	return client.server.clockSeconds(client.server.now()) - atomic.LoadInt64(&client.lastPing)
+}
+
+// Record that we have just received a valid UDP packet from the client.
+func (client *Client) touchUDP() {
+	atomic.StoreInt64(&client.lastUDP, client.server.clockSeconds(client.server.now()))
+}
+
+// Get the number of seconds since we last received a valid UDP packet
+// from the client.
+func (client *Client) secondsSinceUDP() int64 {
+	return client.server.clockSeconds(client.server.now()) - atomic.LoadInt64(&client.lastUDP)
 }
 
 // Log a panic and disconnect the client.
 func (client *Client) Panic(v ...interface{}) {
 	client.Print(v)
+	client.setDisconnectReason(fmt.Sprint(v...))
 	client.Disconnect()
 }
 
 // Log a formatted panic and disconnect the client.
 func (client *Client) Panicf(format string, v ...interface{}) {
 	client.Printf(format, v...)
+	client.setDisconnectReason(fmt.Sprintf(format, v...))
 	client.Disconnect()
 }
 
+// Check whether the client has been disconnected. May be called from any
+// goroutine.
+func (client *Client) isDisconnected() bool {
+	return atomic.LoadInt32(&client.disconnected) != 0
+}
+
 // Internal disconnect function
+//
+// Once the client has authenticated, it is known to the server's handler
+// goroutine, and only the handler may disconnect it. Before then, the
+// client is only known to its own goroutines, which disconnect it
+// themselves.
 func (client *Client) disconnect(kicked bool) {
-	if !client.disconnected {
-		client.disconnected = true
-		client.server.RemoveClient(client, kicked)
-
-		// Close the client's UDP reciever goroutine.
-		close(client.udprecv)
-
-		// If the client paniced during authentication, before reaching
-		// the ready state, the receiver goroutine will be waiting for
-		// a signal telling it that the client is ready to receive 'real'
-		// messages from the server.
-		//
-		// In case of a premature disconnect, close the channel so the
-		// receiver routine can exit correctly.
-		if client.state == StateClientSentVersion || client.state == StateClientAuthenticated {
-			close(client.clientReady)
+	if atomic.CompareAndSwapInt32(&client.disconnected, 0, 1) {
+		client.server.countDisconnect(client)
+		if client.state >= StateClientAuthenticated {
+			client.server.RemoveClient(client, kicked)
+		} else {
+			client.server.pool.Reclaim(client.Session())
 		}
+		client.closeDown(kicked)
+	}
+}
+
+// Stop the client's goroutines, log its disconnect and close its
+// connection, draining it first if kicked is set. Called once the
+// client has been marked as disconnected.
+func (client *Client) closeDown(kicked bool) {
+	// Close the client's UDP reciever goroutine.
+	close(client.udprecv)
+
+	// If the client paniced during authentication, before reaching
+	// the ready state, the receiver goroutine will be waiting for
+	// a signal telling it that the client is ready to receive 'real'
+	// messages from the server.
+	//
+	// In case of a premature disconnect, close the channel so the
+	// receiver routine can exit correctly.
+	if client.state == StateClientSentVersion || client.state == StateClientAuthenticated {
+		close(client.clientReady)
+	}
 
-		client.Printf("Disconnected")
+	client.flushRepeatedLogs()
+	client.Printf("Disconnected")
+	if client.disconnectReason == "" {
+		client.disconnectReason = "disconnected"
+	}
+	client.logEvent("disconnect", "reason", client.disconnectReason, "duration", client.server.now().Sub(client.connectTime).Round(time.Second))
+	if kicked {
+		client.drainAndClose()
+	} else {
 		client.conn.Close()
+	}
+}
+
+// The amount of time a kicked client is given to read the final messages
+// we've sent it before its connection is forcibly closed.
+const drainTimeout = 5 * time.Second
 
-		client.server.updateCodecVersions(nil)
+// Close the client's connection, while making sure that the messages we
+// have already written to it are delivered.
+//
+// Closing a TCP connection that has unread incoming data makes the OS
+// reset the connection, and the client may then never see messages such
+// as a Reject or a kick's UserRemove. Instead, shut down the write side of
+// the connection and let the receiver keep reading until the client has
+// closed its end (or until drainTimeout has passed).
+func (client *Client) drainAndClose() {
+	conn := client.conn
+	cw, ok := conn.(interface {
+		CloseWrite() error
+	})
+	if !ok || cw.CloseWrite() != nil {
+		conn.Close()
+		return
 	}
+	time.AfterFunc(drainTimeout, func() {
+		conn.Close()
+	})
+}
+
+// Handle an error returned when reading from the client's connection.
+// Called on the client's receiver goroutine.
+func (client *Client) handleReadError(err error) {
+	class, reason := "closed", "connection closed by client"
+	if err != io.EOF {
+		class, reason = "", err.Error()
+		client.Printf("%v", err)
+	}
+
+	// A ready client is disconnected by the server's handler.
+	if client.state == StateClientReady {
+		client.requestDisconnect(class, reason)
+		return
+	}
+
+	// A disconnected client is only read from while it drains the
+	// final messages we sent it, so there's nothing left to do but
+	// to close the connection.
+	if client.isDisconnected() {
+		client.conn.Close()
+		return
+	}
+
+	client.classifyDisconnect(class)
+	client.setDisconnectReason(reason)
+	client.Disconnect()
+}
+
+// Handle an error returned when writing to the client's connection.
+//
+// A connection that failed a write can't be used anymore, since part of
+// a message may have been written to it, so it is closed. This also stops
+// the receiver goroutine: its pending read fails, and it disconnects the
+// client as for any other read error. The client is thus disconnected
+// exactly once, by its receiver, whichever direction fails first.
+func (client *Client) handleWriteError(err error) {
+	client.setDisconnectReason(fmt.Sprintf("write error: %v", err))
+	client.conn.Close()
 }
 
 // Disconnect a client (client requested or server shutdown)
@@ -207,6 +450,35 @@ func (client *Client) ForceDisconnect() {
 	client.disconnect(true)
 }
 
+// A request to disconnect a client, made on a goroutine other than the
+// server's handler. The class and reason are recorded as by
+// classifyDisconnect and setDisconnectReason.
+type disconnectRequest struct {
+	client *Client
+	class  string
+	reason string
+}
+
+// Have the server's handler disconnect the client. Disconnecting a client
+// that has logged in changes state that only the handler may access, so
+// this is used in place of Disconnect on the goroutines that serve the
+// client, such as its receivers. Returns once the handler has taken the
+// request, or right away if the server is stopping, since it then
+// disconnects all of its clients itself.
+func (client *Client) requestDisconnect(class string, reason string) {
+	select {
+	case client.server.disconnectRequests <- disconnectRequest{client, class, reason}:
+	case <-client.server.bye:
+	}
+}
+
+// Log a formatted panic and have the server's handler disconnect the
+// client. See requestDisconnect.
+func (client *Client) requestPanicf(format string, v ...interface{}) {
+	client.Printf(format, v...)
+	client.requestDisconnect("", fmt.Sprintf(format, v...))
+}
+
 // Clear the client's caches
 func (client *Client) ClearCaches() {
 	for _, vt := range client.voiceTargets {
@@ -226,6 +498,12 @@ func (client *Client) RejectAuth(rejectType mumbleproto.Reject_RejectType, reaso
 		Reason: reasonString,
 	})
 
+	client.classifyDisconnect("rejected")
+	if len(reason) > 0 {
+		client.setDisconnectReason(fmt.Sprintf("rejected (%v): %v", rejectType, reason))
+	} else {
+		client.setDisconnectReason(fmt.Sprintf("rejected (%v)", rejectType))
+	}
 	client.ForceDisconnect()
 }
 
@@ -253,11 +531,13 @@ func (client *Client) readProtoMessage() (msg *Message, err error) {
 	if err != nil {
 		return
 	}
+	atomic.AddUint64(&client.server.bytesIn, uint64(6+length))
 
 	msg = &Message{
-		buf:    buf,
-		kind:   kind,
-		client: client,
+		buf:      buf,
+		kind:     kind,
+		client:   client,
+		received: client.server.now(),
 	}
 
 	return
@@ -298,6 +578,19 @@ func (c *Client) sendPermissionDenied(who *Client, where *Channel, what acl.Perm
 	}
 }
 
+// Send permission denied with a textual reason
+func (client *Client) sendPermissionDeniedText(text string) {
+	pd := &mumbleproto.PermissionDenied{
+		Type:   mumbleproto.PermissionDenied_Text.Enum(),
+		Reason: proto.String(text),
+	}
+	err := client.sendMessage(pd)
+	if err != nil {
+		client.Panicf("%v", err.Error())
+		return
+	}
+}
+
 // Send permission denied fallback
 func (client *Client) sendPermissionDeniedFallback(denyType mumbleproto.PermissionDenied_DenyType, version uint32, text string) {
 	pd := &mumbleproto.PermissionDenied{
@@ -315,11 +608,13 @@ func (client *Client) sendPermissionDeniedFallback(denyType mumbleproto.Permissi
 
 // UDP receive loop
 func (client *Client) udpRecvLoop() {
+	// The loop ends when the udprecv channel is closed, on disconnect.
 	for buf := range client.udprecv {
-		// Received a zero-valued buffer. This means that the udprecv
-		// channel was closed, so exit cleanly.
+		// An empty packet, such as an empty UDPTunnel message, has no
+		// header to tell its kind, so it is dropped.
 		if len(buf) == 0 {
-			return
+			client.reportAbnormalPacket("empty packet")
+			continue
 		}
 
 		kind := (buf[0] >> 5) & 0x07
@@ -331,63 +626,139 @@ func (client *Client) udpRecvLoop() {
 			fallthrough
 		case mumbleproto.UDPMessageVoiceCELTBeta:
 			if client.server.Opus {
-				return
+				continue
 			}
 			fallthrough
 		case mumbleproto.UDPMessageVoiceOpus:
-			target := buf[0] & 0x1f
-			var counter uint8
-			outbuf := make([]byte, 1024)
-
-			incoming := packetdata.New(buf[1 : 1+(len(buf)-1)])
-			outgoing := packetdata.New(outbuf[1 : 1+(len(outbuf)-1)])
-			_ = incoming.GetUint32()
-
-			if kind != mumbleproto.UDPMessageVoiceOpus {
-				for {
-					counter = incoming.Next8()
-					incoming.Skip(int(counter & 0x7f))
-					if !((counter&0x80) != 0 && incoming.IsValid()) {
-						break
-					}
-				}
-			} else {
-				size := int(incoming.GetUint16())
-				incoming.Skip(size & 0x1fff)
+			// Drop the voice of muted clients before doing any
+			// further work on it. The packet has already been
+			// decrypted, so the client's crypt state stays in sync.
+			if client.isVoiceMuted() {
+				continue
+			}
+
+			// Drop truncated or otherwise malformed packets before
+			// we attempt to relay them.
+			if !isValidVoicePacket(kind, buf[1:]) {
+				client.logRepeatedf("dropped malformed voice packet (%v bytes)", len(buf))
+				client.reportAbnormalPacket("malformed voice packet")
+				continue
 			}
 
-			outgoing.PutUint32(client.Session())
-			outgoing.PutBytes(buf[1 : 1+(len(buf)-1)])
-			outbuf[0] = buf[0] & 0xe0 // strip target
+			target := buf[0] & 0x1f
+			outbuf, ok := relayedVoicePacket(client.Session(), buf)
+			if !ok {
+				client.logRepeatedf("dropped oversized voice packet (%v bytes)", len(buf))
+				client.reportAbnormalPacket("oversized voice packet")
+				continue
+			}
+			client.countVoiceCodec(kind)
 
 			if target != 0x1f { // VoiceTarget
-				client.server.voicebroadcast <- &VoiceBroadcast{
+				select {
+				case client.server.voicebroadcast <- &VoiceBroadcast{
 					client: client,
-					buf:    outbuf[0 : 1+outgoing.Size()],
+					buf:    outbuf,
 					target: target,
+				}:
+				case <-client.server.bye:
 				}
 			} else { // Server loopback
-				buf := outbuf[0 : 1+outgoing.Size()]
-				err := client.SendUDP(buf)
+				client.countVoiceTarget(VoiceTargetLoopback)
+				err := client.SendUDP(outbuf)
 				if err != nil {
-					client.Panicf("Unable to send UDP message: %v", err.Error())
+					client.requestPanicf("Unable to send UDP message: %v", err.Error())
 				}
 			}
 
 		case mumbleproto.UDPMessagePing:
+			client.touchPing()
 			err := client.SendUDP(buf)
 			if err != nil {
-				client.Panicf("Unable to send UDP message: %v", err.Error())
+				client.requestPanicf("Unable to send UDP message: %v", err.Error())
 			}
 		}
 	}
 }
 
+// Record whether the client's voice is to be dropped, after its mute,
+// self-mute or suppressed state has changed. Called on the server's
+// handler goroutine.
+func (client *Client) updateVoiceMuted() {
+	muted := int32(0)
+	if client.Mute || client.SelfMute || client.Suppress {
+		muted = 1
+	}
+	atomic.StoreInt32(&client.voiceMuted, muted)
+}
+
+// Check whether the client's voice is to be dropped.
+func (client *Client) isVoiceMuted() bool {
+	return atomic.LoadInt32(&client.voiceMuted) != 0
+}
+
+// Check whether data, the contents of a voice packet following its
+// header byte, is well-formed for a voice packet of the given kind.
+// A well-formed packet holds a sequence number followed by one or more
+// complete audio frames that all lie within the bounds of data.
+func isValidVoicePacket(kind byte, data []byte) bool {
+	_, ok := voiceFramesEnd(kind, data)
+	return ok
+}
+
+// Get the offset in data, the contents of a voice packet following its
+// header byte, at which its audio frames end. Any data that follows is
+// the speaker's positional data. Returns false if data is malformed.
+func voiceFramesEnd(kind byte, data []byte) (int, bool) {
+	pds := packetdata.New(data)
+	_ = pds.GetUint64()
+
+	if kind == mumbleproto.UDPMessageVoiceOpus {
+		size := int(pds.GetUint16())
+		pds.Skip(size & 0x1fff)
+	} else {
+		for {
+			header := pds.Next8()
+			pds.Skip(int(header & 0x7f))
+			if header&0x80 == 0 || !pds.IsValid() {
+				break
+			}
+		}
+	}
+
+	return pds.Size(), pds.IsValid()
+}
+
+// Construct the voice packet that is relayed to other clients when the
+// client with the given session sends the voice packet buf. The relayed
+// packet has its target stripped and the sender's session inserted in
+// front of the payload.
+//
+// Returns false if the relayed packet does not fit in a single datagram.
+func relayedVoicePacket(session uint32, buf []byte) ([]byte, bool) {
+	outbuf := make([]byte, UDPPacketSize)
+	outgoing := packetdata.New(outbuf[1:])
+	outgoing.PutUint32(session)
+	outgoing.PutBytes(buf[1:])
+	if !outgoing.IsValid() {
+		return nil, false
+	}
+
+	outbuf[0] = buf[0] & 0xe0 // strip target
+	return outbuf[:1+outgoing.Size()], true
+}
+
+// Check whether voice is sent to the client over UDP. May be called from
+// any goroutine.
+func (client *Client) usesUDP() bool {
+	return atomic.LoadInt32(&client.udp) != 0
+}
+
 // Send buf as a UDP message. If the client does not have
 // an established UDP connection, the datagram will be tunelled
 // through the client's control channel (TCP).
 func (client *Client) SendUDP(buf []byte) error {
-	if client.udp {
+	if client.usesUDP() {
 		crypted := make([]byte, len(buf)+client.crypt.Overhead())
 		client.crypt.Encrypt(crypted, buf)
 		return client.server.SendUDP(crypted, client.udpaddr)
@@ -397,13 +768,45 @@ func (client *Client) SendUDP(buf []byte) error {
 	panic("unreachable")
 }
 
-// Send a Message to the client.  The Message in msg to the client's
-// buffered writer and flushes it when done.
+// Relay a voice packet from speaker to the client, unless doing so would
+// exceed the server's MaxSendBandwidth. Packets from priority speakers are
+// always relayed. The speaker's positional data is only relayed if the
+// client shares its plugin context. Called on the server's handler
+// goroutine.
+func (client *Client) sendVoice(speaker *Client, buf []byte) error {
+	if !client.sharesPluginContext(speaker) {
+		buf = stripPositionalData(buf)
+	}
+
+	limit := client.server.cfg.IntValue("MaxSendBandwidth")
+	if limit > 0 && !speaker.PrioritySpeaker {
+		// The limit is in bits per second, and allows bursts of
+		// up to a second's worth of packets.
+		bytesPerSec := float64(limit) / 8
+		if !client.voiceLimiter.allowN(client.server.now(), float64(len(buf)), bytesPerSec, bytesPerSec) {
+			return nil
+		}
+	}
+	return client.SendUDP(buf)
+}
+
+// Returned by sendMessage when the client has already been disconnected.
+var errClientDisconnected = errors.New("client: disconnected")
+
+// Send a Message to the client. The message in msg is framed into a
+// buffer, which is written to the client's connection in a single Write.
+//
+// Usually called on the server's handler goroutine. Since each message
+// is a single Write, and the connection serializes writes, messages sent
+// from other goroutines are never interleaved.
 //
-// This method should only be called from within the client's own
-// sender goroutine, since it serializes access to the underlying
-// buffered writer.
+// Sending to a client that has been disconnected returns
+// errClientDisconnected.
 func (client *Client) sendMessage(msg interface{}) error {
+	if client.isDisconnected() {
+		return errClientDisconnected
+	}
+
 	buf := new(bytes.Buffer)
 	var (
 		kind    uint16
@@ -421,7 +824,7 @@ func (client *Client) sendMessage(msg interface{}) error {
 		}
 		msgData, err = proto.Marshal(protoMsg)
 		if err != nil {
-			return err
+			return fmt.Errorf("client: internal error: unable to marshal %T: %v", protoMsg, err)
 		}
 	}
 
@@ -438,8 +841,10 @@ func (client *Client) sendMessage(msg interface{}) error {
 		return err
 	}
 
-	_, err = client.conn.Write(buf.Bytes())
+	n, err := client.conn.Write(buf.Bytes())
+	atomic.AddUint64(&client.server.bytesOut, uint64(n))
 	if err != nil {
+		client.handleWriteError(err)
 		return err
 	}
 
@@ -455,20 +860,25 @@ func (client *Client) tlsRecvLoop() {
 			// Try to read the next message in the pool
 			msg, err := client.readProtoMessage()
 			if err != nil {
-				if err == io.EOF {
-					client.Disconnect()
-				} else {
-					client.Panicf("%v", err)
-				}
+				client.handleReadError(err)
 				return
 			}
+			// A kicked client's connection is drained of any remaining
+			// data before being closed. Drop anything it sends meanwhile.
+			if client.isDisconnected() {
+				continue
+			}
 			// Special case UDPTunnel messages. They're high priority and shouldn't
 			// go through our synchronous path.
 			if msg.kind == mumbleproto.MessageUDPTunnel {
-				client.udp = false
+				atomic.StoreInt32(&client.udp, 0)
 				client.udprecv <- msg.buf
 			} else {
-				client.server.incoming <- msg
+				select {
+				case client.server.incoming <- msg:
+				case <-client.server.bye:
+					return
+				}
 			}
 		}
 
@@ -477,22 +887,20 @@ func (client *Client) tlsRecvLoop() {
 			// Try to read the next message in the pool
 			msg, err := client.readProtoMessage()
 			if err != nil {
-				if err == io.EOF {
-					client.Disconnect()
-				} else {
-					client.Panicf("%v", err)
-				}
+				client.handleReadError(err)
 				return
 			}
 
 			client.clientReady = make(chan bool)
-			go client.server.handleAuthenticate(client, msg)
+			client.server.goServe(func() {
+				client.server.handleAuthenticate(client, msg)
+			})
 			<-client.clientReady
 
 			// It's possible that the client has disconnected in the meantime.
 			// In that case, step out of the receiver, since there's nothing left
 			// to receive.
-			if client.disconnected {
+			if client.isDisconnected() {
 				return
 			}
 
@@ -504,6 +912,8 @@ func (client *Client) tlsRecvLoop() {
 		// information we must send it our version information so it knows
 		// what version of the protocol it should speak.
 		if client.state == StateClientConnected {
+			client.resolveAddress()
+
 			version := &mumbleproto.Version{
 				Version:     proto.Uint32(0x10205),
 				Release:     proto.String("Grumble"),
@@ -519,18 +929,19 @@ func (client *Client) tlsRecvLoop() {
 		} else if client.state == StateServerSentVersion {
 			msg, err := client.readProtoMessage()
 			if err != nil {
-				if err == io.EOF {
-					client.Disconnect()
-				} else {
-					client.Panicf("%v", err)
-				}
+				client.handleReadError(err)
+				return
+			}
+
+			// Anything else, such as voice, is not allowed before
+			// the client has authenticated.
+			if msg.kind != mumbleproto.MessageVersion {
+				client.Panic("Unexpected message. Expected Version.")
 				return
 			}
 
 			version := &mumbleproto.Version{}
-			err = proto.Unmarshal(msg.buf, version)
-			if err != nil {
-				client.Panicf("%v", err)
+			if !client.unmarshalMessage(msg, version) {
 				return
 			}
 
@@ -579,15 +990,63 @@ func (client *Client) tlsRecvLoop() {
 
 			client.CryptoMode = requestedMode
 			client.state = StateClientSentVersion
+			client.logEvent("handshake", "release", client.ClientName, "os", client.OSName, "crypto", client.CryptoMode)
 		}
 	}
 }
 
-func (client *Client) sendChannelList() {
-	client.sendChannelTree(client.server.RootChannel())
+// Send msg as part of the sequence of messages that completes the
+// client's login. Returns whether msg was sent. See syncFailed.
+func (client *Client) sendSyncMessage(msg interface{}) bool {
+	err := client.sendMessage(msg)
+	if err != nil {
+		client.syncFailed(err)
+		return false
+	}
+	return true
 }
 
-func (client *Client) sendChannelTree(channel *Channel) {
+// Handle a failure to send part of the login sequence. The client can't
+// complete its login without the full sequence, so instead of leaving it
+// half-synced, it is disconnected.
+func (client *Client) syncFailed(err error) {
+	if err == errClientDisconnected {
+		return
+	}
+	client.Panicf("Unable to complete login: %v", err)
+}
+
+// Resend the channel tree, the user list and its own state to a client
+// that has finished logging in, to recover a client whose view of the
+// server has gone out of sync. Clients treat ChannelState and UserState
+// messages for the channels and users they already know as updates, so
+// nothing is duplicated on the client's end. The client is also told to
+// discard the permissions it has been sent. Must be called on the server's
+// handler goroutine, so that the state sent is consistent.
+func (client *Client) resync() error {
+	server := client.server
+	if client.state != StateClientReady {
+		return errors.New("client is not logged in")
+	}
+
+	if err := client.sendChannelList(); err != nil {
+		return err
+	}
+	if err := client.sendMessage(server.userStateOf(client, client)); err != nil {
+		return err
+	}
+	if err := server.sendUserList(client); err != nil {
+		return err
+	}
+	server.flushPermissions(client)
+	return nil
+}
+
+func (client *Client) sendChannelList() error {
+	return client.sendChannelTree(client.server.RootChannel())
+}
+
+func (client *Client) sendChannelTree(channel *Channel) error {
 	chanstate := &mumbleproto.ChannelState{
 		ChannelId: proto.Uint32(uint32(channel.Id)),
 		Name:      proto.String(channel.Name),
@@ -597,14 +1056,15 @@ func (client *Client) sendChannelTree(channel *Channel) {
 	}
 
 	if channel.HasDescription() {
-		if client.Version >= 0x10202 {
+		buf, err := blobStore.Get(channel.DescriptionBlob)
+		if err != nil {
+			panic("Blobstore error.")
+		}
+		description := string(buf)
+		if client.Version >= 0x10202 && !client.server.inlineDescription(description) {
 			chanstate.DescriptionHash = channel.DescriptionBlobHashBytes()
 		} else {
-			buf, err := blobStore.Get(channel.DescriptionBlob)
-			if err != nil {
-				panic("Blobstore error.")
-			}
-			chanstate.Description = proto.String(string(buf))
+			chanstate.Description = proto.String(description)
 		}
 	}
 
@@ -614,6 +1074,10 @@ func (client *Client) sendChannelTree(channel *Channel) {
 
 	chanstate.Position = proto.Int32(int32(channel.Position))
 
+	if channel.MaxUsers != 0 {
+		chanstate.MaxUsers = proto.Uint32(uint32(channel.MaxUsers))
+	}
+
 	links := []uint32{}
 	for cid, _ := range channel.Links {
 		links = append(links, uint32(cid))
@@ -622,26 +1086,35 @@ func (client *Client) sendChannelTree(channel *Channel) {
 
 	err := client.sendMessage(chanstate)
 	if err != nil {
-		client.Panicf("%v", err)
+		return err
 	}
 
 	for _, subchannel := range channel.children {
-		client.sendChannelTree(subchannel)
+		err = client.sendChannelTree(subchannel)
+		if err != nil {
+			return err
+		}
 	}
+
+	return nil
 }
 
-// Try to do a crypto resync
+// Try to do a crypto resync. Called on the UDP listener goroutine that
+// received the packet that failed to decrypt.
 func (client *Client) cryptResync() {
-	client.Debugf("requesting crypt resync")
-	goodElapsed := time.Now().Unix() - client.crypt.LastGoodTime
-	if goodElapsed > 5 {
-		requestElapsed := time.Now().Unix() - client.lastResync
+	client.logRepeatedf("requesting crypt resync")
+	// Every packet that decrypts successfully touches lastUDP.
+	if client.secondsSinceUDP() > 5 {
+		now := client.server.clockSeconds(client.server.now())
+		requestElapsed := now - client.lastResync
 		if requestElapsed > 5 {
-			client.lastResync = time.Now().Unix()
+			client.lastResync = now
 			cryptsetup := &mumbleproto.CryptSetup{}
 			err := client.sendMessage(cryptsetup)
-			if err != nil {
-				client.Panicf("%v", err)
+			if err != nil && err != errClientDisconnected {
+				// A failed write closes the connection, after
+				// which the client's receiver disconnects it.
+				client.Printf("Unable to request crypt resync: %v", err)
 			}
 		}
 	}
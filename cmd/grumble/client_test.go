@@ -0,0 +1,711 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/golang/protobuf/proto"
+	"io"
+	"log"
+	"math/rand"
+	"mumble.info/grumble/pkg/mumbleproto"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestValidVoicePacket(t *testing.T) {
+	// Sequence 1, a single 3-byte CELT frame with the
+	// continuation bit clear.
+	celt := []byte{0x01, 0x03, 0xaa, 0xbb, 0xcc}
+	if !isValidVoicePacket(mumbleproto.UDPMessageVoiceCELTAlpha, celt) {
+		t.Errorf("Expected CELT packet to be valid")
+	}
+
+	// Sequence 1, a 2-byte Opus frame.
+	opus := []byte{0x01, 0x02, 0xaa, 0xbb}
+	if !isValidVoicePacket(mumbleproto.UDPMessageVoiceOpus, opus) {
+		t.Errorf("Expected Opus packet to be valid")
+	}
+}
+
+func TestTruncatedVoicePacket(t *testing.T) {
+	// The frame header claims 0x7f bytes, but only two follow.
+	celt := []byte{0x01, 0x7f, 0xaa, 0xbb}
+	if isValidVoicePacket(mumbleproto.UDPMessageVoiceCELTAlpha, celt) {
+		t.Errorf("Expected truncated CELT packet to be invalid")
+	}
+
+	// The continuation bit is set on the last frame.
+	celt = []byte{0x01, 0x81, 0xaa}
+	if isValidVoicePacket(mumbleproto.UDPMessageVoiceCELTBeta, celt) {
+		t.Errorf("Expected CELT packet with dangling continuation to be invalid")
+	}
+
+	opus := []byte{0x01, 0x40, 0x10, 0xaa}
+	if isValidVoicePacket(mumbleproto.UDPMessageVoiceOpus, opus) {
+		t.Errorf("Expected truncated Opus packet to be invalid")
+	}
+
+	if isValidVoicePacket(mumbleproto.UDPMessageVoiceOpus, []byte{}) {
+		t.Errorf("Expected empty packet to be invalid")
+	}
+}
+
+func TestRandomVoicePackets(t *testing.T) {
+	kinds := []byte{
+		mumbleproto.UDPMessageVoiceCELTAlpha,
+		mumbleproto.UDPMessageVoiceSpeex,
+		mumbleproto.UDPMessageVoiceCELTBeta,
+		mumbleproto.UDPMessageVoiceOpus,
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		buf := make([]byte, rng.Intn(UDPPacketSize))
+		rng.Read(buf)
+		for _, kind := range kinds {
+			// Must not panic, regardless of the contents of buf.
+			isValidVoicePacket(kind, buf)
+		}
+	}
+}
+
+func TestRelayedVoicePacket(t *testing.T) {
+	buf := []byte{0x83, 0x01, 0x02, 0xaa, 0xbb}
+	out, ok := relayedVoicePacket(5, buf)
+	if !ok {
+		t.Fatalf("Expected packet to be relayed")
+	}
+
+	expected := []byte{0x80, 0x05, 0x01, 0x02, 0xaa, 0xbb}
+	if string(out) != string(expected) {
+		t.Errorf("Unexpected relayed packet. Got %v, expected %v", out, expected)
+	}
+}
+
+func TestRelayedVoicePacketNearFull(t *testing.T) {
+	// The relayed packet adds a single byte (a session that fits in a
+	// one-byte varint), so this is the largest packet that can be relayed.
+	buf := make([]byte, UDPPacketSize-1)
+	buf[0] = 0x80
+	for i := 1; i < len(buf); i++ {
+		buf[i] = byte(i)
+	}
+
+	out, ok := relayedVoicePacket(1, buf)
+	if !ok {
+		t.Fatalf("Expected full-size packet to be relayed")
+	}
+	if len(out) != UDPPacketSize {
+		t.Errorf("Unexpected relayed packet length. Got %v, expected %v", len(out), UDPPacketSize)
+	}
+	if string(out[2:]) != string(buf[1:]) {
+		t.Errorf("Relayed payload does not match the original payload")
+	}
+
+	buf = append(buf, 0xff)
+	if _, ok := relayedVoicePacket(1, buf); ok {
+		t.Errorf("Expected oversized packet to be dropped")
+	}
+}
+
+func TestKickDrainsConnection(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer ln.Close()
+
+	peerConn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("unable to dial: %v", err)
+	}
+	defer peerConn.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("unable to accept: %v", err)
+	}
+
+	server := newTestServer(t)
+	client := addTestClient(server, "kicked", conn)
+
+	// Leave data that the server never reads in its receive buffer.
+	// Closing the connection outright would make the OS reset it.
+	if _, err := peerConn.Write(make([]byte, 64*1024)); err != nil {
+		t.Fatalf("unable to write: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	client.sendMessage(&mumbleproto.Reject{})
+	client.ForceDisconnect()
+
+	// Only start reading once the server is done with the connection.
+	time.Sleep(50 * time.Millisecond)
+	peerConn.SetReadDeadline(time.Now().Add(time.Second))
+
+	// An empty Reject message is just its 6 byte header.
+	frame := make([]byte, 6)
+	if _, err := io.ReadFull(peerConn, frame); err != nil {
+		t.Fatalf("unable to read Reject message: %v", err)
+	}
+	if kind := binary.BigEndian.Uint16(frame); kind != mumbleproto.MessageReject {
+		t.Errorf("Expected message kind %v, got %v", mumbleproto.MessageReject, kind)
+	}
+	if _, err := peerConn.Read(frame); err != io.EOF {
+		t.Errorf("Expected the connection to be shut down cleanly, got %v", err)
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	server := newTestServer(t)
+	conn, peerConn := net.Pipe()
+	sender := addTestClient(server, "sender", conn)
+	receiver := addTestClient(server, "receiver", peerConn)
+
+	sent := &mumbleproto.TextMessage{
+		Actor:     proto.Uint32(sender.Session()),
+		ChannelId: []uint32{0},
+		Message:   proto.String("hello"),
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- sender.sendMessage(sent)
+	}()
+
+	msg, err := receiver.readProtoMessage()
+	if err != nil {
+		t.Fatalf("unable to read message: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("unable to send message: %v", err)
+	}
+	if msg.client != receiver {
+		t.Errorf("Expected message to belong to the receiving client")
+	}
+	received := &mumbleproto.TextMessage{}
+	decodeTestMessage(t, msg, mumbleproto.MessageTextMessage, received)
+	if !proto.Equal(sent, received) {
+		t.Errorf("Expected %v, got %v", sent, received)
+	}
+}
+
+func TestReadProtoMessage(t *testing.T) {
+	server := newTestServer(t)
+	client, peer := newTestClient(server, "client")
+
+	buf := encodeTestMessage(t, &mumbleproto.Ping{Timestamp: proto.Uint64(42)})
+	go peer.conn.Write(buf)
+
+	msg, err := client.readProtoMessage()
+	if err != nil {
+		t.Fatalf("unable to read message: %v", err)
+	}
+	ping := &mumbleproto.Ping{}
+	decodeTestMessage(t, msg, mumbleproto.MessagePing, ping)
+	if ping.GetTimestamp() != 42 {
+		t.Errorf("Expected timestamp 42, got %v", ping.GetTimestamp())
+	}
+}
+
+func TestReadTruncatedProtoMessage(t *testing.T) {
+	server := newTestServer(t)
+	client, peer := newTestClient(server, "client")
+
+	buf := encodeTestMessage(t, &mumbleproto.Ping{Timestamp: proto.Uint64(42)})
+	go func() {
+		peer.conn.Write(buf[:len(buf)-1])
+		peer.conn.Close()
+	}()
+
+	if _, err := client.readProtoMessage(); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+}
+
+func TestSendUDPTunnel(t *testing.T) {
+	server := newTestServer(t)
+	client, peer := newTestClient(server, "client")
+
+	voice := []byte{0x80, 0x01, 0x02, 0x03}
+	if err := client.sendMessage(voice); err != nil {
+		t.Fatalf("unable to send message: %v", err)
+	}
+	select {
+	case msg := <-peer.msgs:
+		if msg.kind != mumbleproto.MessageUDPTunnel {
+			t.Fatalf("Expected message kind %v, got %v", mumbleproto.MessageUDPTunnel, msg.kind)
+		}
+		if !bytes.Equal(msg.buf, voice) {
+			t.Errorf("Expected %v, got %v", voice, msg.buf)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for UDPTunnel message")
+	}
+}
+
+func TestSendVoiceBandwidthLimit(t *testing.T) {
+	server := newTestServer(t)
+	// 1000 bytes per second, in bursts of up to 1000 bytes.
+	server.cfg.Set("MaxSendBandwidth", "8000")
+	speaker, _ := newTestClient(server, "speaker")
+	listener, peer := newTestClient(server, "listener")
+
+	// Send packets of 100 bytes, and count how many the listener receives.
+	send := func(n int) int {
+		voice := make([]byte, 100)
+		voice[0] = 0x80
+		for i := 0; i < n; i++ {
+			if err := listener.sendVoice(speaker, voice); err != nil {
+				t.Fatalf("unable to send voice: %v", err)
+			}
+		}
+		received := 0
+		for {
+			select {
+			case msg := <-peer.msgs:
+				if msg.kind == mumbleproto.MessageUDPTunnel {
+					received++
+				}
+				continue
+			case <-time.After(50 * time.Millisecond):
+			}
+			return received
+		}
+	}
+
+	if received := send(20); received != 10 {
+		t.Errorf("Expected 10 packets within the budget to be relayed, got %v", received)
+	}
+
+	// Priority speakers are exempt.
+	speaker.PrioritySpeaker = true
+	if received := send(5); received != 5 {
+		t.Errorf("Expected all packets from a priority speaker to be relayed, got %v", received)
+	}
+}
+
+func TestSendAfterDisconnect(t *testing.T) {
+	server := newTestServer(t)
+	client, peer := newTestClient(server, "client")
+	newTestClient(server, "other")
+
+	client.Disconnect()
+
+	err := client.sendMessage(&mumbleproto.Ping{})
+	if err != errClientDisconnected {
+		t.Errorf("Expected %v, got %v", errClientDisconnected, err)
+	}
+	if err := client.sendChannelList(); err != errClientDisconnected {
+		t.Errorf("Expected %v from sendChannelList, got %v", errClientDisconnected, err)
+	}
+	if err := server.sendUserList(client); err != errClientDisconnected {
+		t.Errorf("Expected %v from sendUserList, got %v", errClientDisconnected, err)
+	}
+	peer.expectNone(t, mumbleproto.MessagePing)
+}
+
+// A connection whose writes fail, while its reads still work.
+type failingWriteConn struct {
+	net.Conn
+}
+
+func (conn *failingWriteConn) Write(b []byte) (int, error) {
+	return 0, io.ErrShortWrite
+}
+
+func TestWriteErrorStopsReceiver(t *testing.T) {
+	server := newTestServer(t)
+	server.disconnectRequests = make(chan disconnectRequest, 1)
+	conn, peerConn := net.Pipe()
+	defer peerConn.Close()
+	client := addTestClient(server, "client", &failingWriteConn{conn})
+
+	done := make(chan bool)
+	go func() {
+		client.tlsRecvLoop()
+		close(done)
+	}()
+
+	if err := client.sendMessage(&mumbleproto.Ping{}); err != io.ErrShortWrite {
+		t.Fatalf("Expected %v, got %v", io.ErrShortWrite, err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the receiver to stop after a write error")
+	}
+
+	// The receiver leaves disconnecting the client to the handler.
+	server.handleDisconnectRequest(<-server.disconnectRequests)
+	if !client.isDisconnected() {
+		t.Errorf("Expected client to be disconnected")
+	}
+	if _, ok := server.clients[client.Session()]; ok {
+		t.Errorf("Expected client to be removed from the server")
+	}
+	if !strings.HasPrefix(client.disconnectReason, "write error") {
+		t.Errorf("Expected the write error as the disconnect reason, got %q", client.disconnectReason)
+	}
+}
+
+func TestBroadcastSkipsDisconnectedClients(t *testing.T) {
+	server := newTestServer(t)
+	gone, _ := newTestClient(server, "gone")
+	_, peer := newTestClient(server, "present")
+
+	// Simulate a client that has been disconnected, but that is
+	// still known to the server.
+	atomic.StoreInt32(&gone.disconnected, 1)
+
+	err := server.broadcastProtoMessage(&mumbleproto.Ping{})
+	if err != nil {
+		t.Fatalf("unable to broadcast: %v", err)
+	}
+	peer.expect(t, mumbleproto.MessagePing, &mumbleproto.Ping{})
+}
+
+func TestSyncMessageMarshalFailure(t *testing.T) {
+	server := newTestServer(t)
+	logbuf := new(bytes.Buffer)
+	server.Logger = log.New(logbuf, "", 0)
+	client, peer := newAuthenticatingClient(server, "client")
+
+	// UserRemove can't be marshalled without its required session field.
+	if client.sendSyncMessage(&mumbleproto.UserRemove{}) {
+		t.Fatalf("Expected unserializable message not to be sent")
+	}
+	if !client.isDisconnected() {
+		t.Errorf("Expected client to be disconnected")
+	}
+	if !strings.Contains(logbuf.String(), "internal error") {
+		t.Errorf("Expected internal error to be logged, got %q", logbuf.String())
+	}
+	peer.expectNone(t, mumbleproto.MessageUserRemove)
+
+	// Sending the rest of the sequence to the disconnected
+	// client does not log further errors.
+	logbuf.Reset()
+	if client.sendSyncMessage(&mumbleproto.ServerSync{}) {
+		t.Errorf("Expected message to a disconnected client not to be sent")
+	}
+	if logbuf.Len() != 0 {
+		t.Errorf("Expected nothing to be logged, got %q", logbuf.String())
+	}
+}
+
+func TestVoiceBeforeAuthentication(t *testing.T) {
+	for _, state := range []int{StateServerSentVersion, StateClientSentVersion} {
+		server := newTestServer(t)
+		server.voicebroadcast = make(chan *VoiceBroadcast, 1)
+		client, peer := newTestClient(server, "client")
+		client.state = state
+
+		done := make(chan bool)
+		go func() {
+			client.tlsRecvLoop()
+			close(done)
+		}()
+
+		voice := []byte{mumbleproto.UDPMessageVoiceOpus << 5, 0x01, 0x00}
+		frame := make([]byte, 6+len(voice))
+		binary.BigEndian.PutUint16(frame, mumbleproto.MessageUDPTunnel)
+		binary.BigEndian.PutUint32(frame[2:], uint32(len(voice)))
+		copy(frame[6:], voice)
+		if _, err := peer.conn.Write(frame); err != nil {
+			t.Fatalf("unable to write voice: %v", err)
+		}
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for receiver to stop")
+		}
+		if !client.isDisconnected() || !strings.Contains(client.disconnectReason, "Unexpected message") {
+			t.Errorf("Expected client sending voice in state %v to be disconnected, got reason %q", state, client.disconnectReason)
+		}
+		if len(server.voicebroadcast) != 0 {
+			t.Errorf("Expected voice sent in state %v to be dropped", state)
+		}
+	}
+}
+
+func TestEmptyMessages(t *testing.T) {
+	server := newTestServer(t)
+	server.incoming = make(chan *Message, 1)
+	client, peer := newTestClient(server, "client")
+	go client.tlsRecvLoop()
+	go client.udpRecvLoop()
+	defer client.Disconnect()
+
+	writeFrame := func(kind uint16, buf []byte) {
+		frame := make([]byte, 6+len(buf))
+		binary.BigEndian.PutUint16(frame, kind)
+		binary.BigEndian.PutUint32(frame[2:], uint32(len(buf)))
+		copy(frame[6:], buf)
+		if _, err := peer.conn.Write(frame); err != nil {
+			t.Fatalf("unable to write message: %v", err)
+		}
+	}
+
+	// A Ping without any fields marshals to an empty body.
+	writeFrame(mumbleproto.MessagePing, nil)
+	select {
+	case msg := <-server.incoming:
+		if msg.kind != mumbleproto.MessagePing || len(msg.buf) != 0 {
+			t.Fatalf("Expected an empty Ping, got kind %v with %v bytes", msg.kind, len(msg.buf))
+		}
+		server.handleIncomingMessage(client, msg)
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the empty Ping to be received")
+	}
+	peer.expect(t, mumbleproto.MessagePing, nil)
+
+	// An empty UDPTunnel message is dropped, but the UDP receiver
+	// keeps handling the packets that follow it.
+	writeFrame(mumbleproto.MessageUDPTunnel, nil)
+	ping := []byte{mumbleproto.UDPMessagePing << 5, 0x01}
+	writeFrame(mumbleproto.MessageUDPTunnel, ping)
+	msg := peer.expect(t, mumbleproto.MessageUDPTunnel, nil)
+	if !bytes.Equal(msg.buf, ping) {
+		t.Errorf("Expected the UDP ping to be echoed, got %v", msg.buf)
+	}
+	if client.isDisconnected() {
+		t.Errorf("Expected client to stay connected")
+	}
+}
+
+func TestUDPBeforeAuthentication(t *testing.T) {
+	server := newTestServer(t)
+	client, _ := newTestClient(server, "client")
+	client.udprecv = make(chan []byte, 1)
+	host := client.tcpaddr.IP.String()
+	server.hclients[host] = append(server.hclients[host], client)
+
+	// The client hasn't been given a key, so the datagram can't be
+	// from it.
+	addr := &net.UDPAddr{IP: client.tcpaddr.IP, Port: 50000}
+	server.handleUdpPacket(addr, make([]byte, 32))
+	if len(client.udprecv) != 0 || client.udpaddr != nil {
+		t.Errorf("Expected datagram to a client without a key to be dropped")
+	}
+}
+
+func TestClientResync(t *testing.T) {
+	server := newTestServer(t)
+	lobby := newTestChannel(server, server.RootChannel(), "Lobby")
+	alice, alicePeer := newTestClient(server, "alice")
+	bob, bobPeer := newTestClient(server, "bob")
+	bob.SelfMute = true
+	bob.Deaf = true
+	server.userEnterChannel(bob, lobby, &mumbleproto.UserState{})
+
+	// Collect the messages sent to peer by a resync, which ends by
+	// flushing the client's permissions.
+	expectResync := func(peer *testPeer) (channels map[uint32]bool, users map[uint32]*mumbleproto.UserState) {
+		channels = make(map[uint32]bool)
+		users = make(map[uint32]*mumbleproto.UserState)
+		for {
+			select {
+			case msg := <-peer.msgs:
+				switch msg.kind {
+				case mumbleproto.MessageChannelState:
+					chanstate := &mumbleproto.ChannelState{}
+					if err := proto.Unmarshal(msg.buf, chanstate); err != nil {
+						t.Fatalf("unable to unmarshal ChannelState: %v", err)
+					}
+					if channels[chanstate.GetChannelId()] {
+						t.Errorf("Channel %v sent twice", chanstate.GetChannelId())
+					}
+					channels[chanstate.GetChannelId()] = true
+				case mumbleproto.MessageUserState:
+					userstate := &mumbleproto.UserState{}
+					if err := proto.Unmarshal(msg.buf, userstate); err != nil {
+						t.Fatalf("unable to unmarshal UserState: %v", err)
+					}
+					if users[userstate.GetSession()] != nil {
+						t.Errorf("User %v sent twice", userstate.GetSession())
+					}
+					users[userstate.GetSession()] = userstate
+				case mumbleproto.MessagePermissionQuery:
+					query := &mumbleproto.PermissionQuery{}
+					if err := proto.Unmarshal(msg.buf, query); err != nil {
+						t.Fatalf("unable to unmarshal PermissionQuery: %v", err)
+					}
+					if query.GetFlush() {
+						return
+					}
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("timed out waiting for resync")
+			}
+		}
+	}
+
+	server.handleContextAction(alice, newTestMessage(t, alice, &mumbleproto.ContextAction{
+		Action: proto.String("grumble.resync"),
+	}))
+	channels, users := expectResync(alicePeer)
+	if len(channels) != len(server.Channels) {
+		t.Errorf("Expected %v channels, got %v", len(server.Channels), len(channels))
+	}
+	if len(users) != 2 || users[alice.Session()] == nil {
+		t.Fatalf("Expected alice and bob, got %v", users)
+	}
+	userstate := users[bob.Session()]
+	if userstate.GetChannelId() != uint32(lobby.Id) || !userstate.GetSelfMute() || !userstate.GetDeaf() {
+		t.Errorf("Expected bob's full state, got %v", userstate)
+	}
+
+	// Another resync right away is ignored.
+	server.handleContextAction(alice, newTestMessage(t, alice, &mumbleproto.ContextAction{
+		Action: proto.String("grumble.resync"),
+	}))
+	alicePeer.expectNone(t, mumbleproto.MessageChannelState)
+
+	// Resyncing someone else takes an admin.
+	server.handleContextAction(alice, newTestMessage(t, alice, &mumbleproto.ContextAction{
+		Action:  proto.String("grumble.resyncuser"),
+		Session: proto.Uint32(bob.Session()),
+	}))
+	alicePeer.expect(t, mumbleproto.MessagePermissionDenied, nil)
+	bobPeer.expectNone(t, mumbleproto.MessageChannelState)
+
+	admin, _ := newTestSuperUser(t, server)
+	server.handleContextAction(admin, newTestMessage(t, admin, &mumbleproto.ContextAction{
+		Action:  proto.String("grumble.resyncuser"),
+		Session: proto.Uint32(bob.Session()),
+	}))
+	channels, users = expectResync(bobPeer)
+	if len(channels) != len(server.Channels) || len(users) != 3 {
+		t.Errorf("Expected bob to be sent all channels and users, got %v and %v", channels, users)
+	}
+}
+
+func TestPluginContext(t *testing.T) {
+	server := newTestServer(t)
+	alice, _ := newTestClient(server, "alice")
+	bob, bobPeer := newTestClient(server, "bob")
+
+	context := []byte("Manual placement\x00server")
+	server.handleUserStateMessage(alice, newTestMessage(t, alice, &mumbleproto.UserState{
+		PluginContext:  context,
+		PluginIdentity: proto.String("alice"),
+	}))
+
+	userstate := &mumbleproto.UserState{}
+	bobPeer.expect(t, mumbleproto.MessageUserState, userstate)
+	if userstate.GetSession() != alice.Session() {
+		t.Fatalf("Expected UserState for session %v, got %v", alice.Session(), userstate.GetSession())
+	}
+	if !bytes.Equal(userstate.PluginContext, context) || userstate.GetPluginIdentity() != "alice" {
+		t.Errorf("Expected the plugin context and identity to be broadcast, got %q and %q", userstate.PluginContext, userstate.GetPluginIdentity())
+	}
+
+	// Setting the same context again is not broadcast.
+	server.handleUserStateMessage(alice, newTestMessage(t, alice, &mumbleproto.UserState{
+		PluginContext: context,
+	}))
+	bobPeer.expectNone(t, mumbleproto.MessageUserState)
+
+	if alice.sharesPluginContext(bob) {
+		t.Errorf("Expected clients with different plugin contexts not to be positional-compatible")
+	}
+	bob.PluginContext = append([]byte(nil), context...)
+	if !alice.sharesPluginContext(bob) || !bob.sharesPluginContext(alice) {
+		t.Errorf("Expected clients with matching plugin contexts to be positional-compatible")
+	}
+}
+
+func TestStripPositionalData(t *testing.T) {
+	// An Opus frame of two bytes, followed by three floats of positional data.
+	positional := make([]byte, 12)
+	voice := append([]byte{0x80, 0x01, 0x02, 0xaa, 0xbb}, positional...)
+	relayed, ok := relayedVoicePacket(5, voice)
+	if !ok {
+		t.Fatalf("unable to construct relayed voice packet")
+	}
+
+	stripped := stripPositionalData(relayed)
+	if !bytes.Equal(stripped, relayed[:len(relayed)-len(positional)]) {
+		t.Errorf("Expected positional data to be stripped, got %v", stripped)
+	}
+	if again := stripPositionalData(stripped); !bytes.Equal(again, stripped) {
+		t.Errorf("Expected packet without positional data to be unchanged, got %v", again)
+	}
+}
+
+func TestMutedVoiceDropped(t *testing.T) {
+	server := newTestServer(t)
+	client, _ := newTestClient(server, "client")
+	server.voicebroadcast = make(chan *VoiceBroadcast, 2)
+
+	done := make(chan bool)
+	go func() {
+		client.udpRecvLoop()
+		close(done)
+	}()
+
+	voice := []byte{mumbleproto.UDPMessageVoiceOpus << 5, 0x01, 0x02, 0xaa, 0xbb}
+	client.Mute = true
+	client.updateVoiceMuted()
+	client.udprecv <- voice
+	client.Mute = false
+	client.updateVoiceMuted()
+	client.udprecv <- voice
+	close(client.udprecv)
+	<-done
+
+	if n := len(server.voicebroadcast); n != 1 {
+		t.Errorf("Expected only the packet sent while unmuted to be relayed, got %v", n)
+	}
+	if n := client.VoiceStats().Codec(mumbleproto.UDPMessageVoiceOpus); n != 1 {
+		t.Errorf("Expected the muted packet not to be counted, got %v", n)
+	}
+}
+
+// Measure the cost of handling a voice packet in the UDP receiver,
+// for a client that is muted or not.
+func benchmarkUDPRecvVoice(b *testing.B, muted bool) {
+	server := new(Server)
+	server.voicebroadcast = make(chan *VoiceBroadcast, 64)
+	client := &Client{server: server, udprecv: make(chan []byte, 64)}
+	client.Mute = muted
+	client.updateVoiceMuted()
+
+	go func() {
+		for range server.voicebroadcast {
+		}
+	}()
+	done := make(chan bool)
+	go func() {
+		client.udpRecvLoop()
+		close(done)
+	}()
+
+	voice := make([]byte, 64)
+	voice[0] = mumbleproto.UDPMessageVoiceOpus << 5
+	voice[1] = 0x01
+	voice[2] = 0x3c
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		client.udprecv <- voice
+	}
+	close(client.udprecv)
+	<-done
+	b.StopTimer()
+	close(server.voicebroadcast)
+}
+
+func BenchmarkUDPRecvVoice(b *testing.B) {
+	benchmarkUDPRecvVoice(b, false)
+}
+
+func BenchmarkUDPRecvMutedVoice(b *testing.B) {
+	benchmarkUDPRecvVoice(b, true)
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// A ClientInfo is a snapshot of the state of a connected client.
+type ClientInfo struct {
+	Session   uint32 `json:"session"`
+	UserId    int    `json:"userid"`
+	Username  string `json:"username"`
+	ChannelId int    `json:"channel"`
+	Address   string `json:"address"`
+
+	// Metadata about Address, from the server's AddressResolver.
+	AddressInfo AddressInfo `json:"addressinfo"`
+
+	Mute     bool `json:"mute"`
+	Deaf     bool `json:"deaf"`
+	SelfMute bool `json:"selfmute"`
+	SelfDeaf bool `json:"selfdeaf"`
+	Suppress bool `json:"suppress"`
+
+	// The CELT bitstream versions the client supports, and
+	// whether it supports Opus.
+	Codecs []int32 `json:"codecs"`
+	Opus   bool    `json:"opus"`
+}
+
+// Get a snapshot of the clients that are connected to the server and
+// have finished logging in, ordered by session. The returned slice is a
+// copy, so it can be kept and modified by the caller.
+//
+// The snapshot is taken by the server's handler. Returns nil if the
+// server isn't running, or its handler doesn't answer within
+// healthProbeTimeout.
+func (server *Server) Clients() []ClientInfo {
+	server.stopLock.RLock()
+	defer server.stopLock.RUnlock()
+	if server.stopping || server.clientsProbe == nil {
+		return nil
+	}
+	reply := make(chan []ClientInfo, 1)
+	select {
+	case server.clientsProbe <- reply:
+		return <-reply
+	case <-time.After(healthProbeTimeout):
+		return nil
+	}
+}
+
+// Like Clients, but called on the server's handler goroutine.
+func (server *Server) clientInfos() []ClientInfo {
+	infos := []ClientInfo{}
+	for _, hostclients := range server.hclients {
+		for _, client := range hostclients {
+			info := ClientInfo{
+				Session:     client.Session(),
+				UserId:      client.UserId(),
+				Username:    client.ShownName(),
+				ChannelId:   -1,
+				Address:     client.tcpaddr.String(),
+				AddressInfo: client.addressInfo,
+				Mute:        client.Mute,
+				Deaf:        client.Deaf,
+				SelfMute:    client.SelfMute,
+				SelfDeaf:    client.SelfDeaf,
+				Suppress:    client.Suppress,
+				Codecs:      append([]int32(nil), client.codecs...),
+				Opus:        client.opus,
+			}
+			if client.Channel != nil {
+				info.ChannelId = client.Channel.Id
+			}
+			infos = append(infos, info)
+		}
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Session < infos[j].Session
+	})
+	return infos
+}
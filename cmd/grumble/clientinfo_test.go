@@ -0,0 +1,64 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestClients(t *testing.T) {
+	server := newTestServer(t)
+	defer answerTestProbes(server)()
+	if len(server.Clients()) != 0 {
+		t.Fatalf("Expected no clients on a new server")
+	}
+
+	alice, _ := newAuthenticatingClient(server, "alice")
+	alice.codecs = []int32{CeltCompatBitstream}
+	alice.opus = true
+	server.finishAuthenticate(alice)
+	bob, _ := newAuthenticatingClient(server, "bob")
+	server.finishAuthenticate(bob)
+	bob.SelfMute = true
+
+	clients := server.Clients()
+	if len(clients) != 2 {
+		t.Fatalf("Expected 2 clients, got %v", len(clients))
+	}
+	info := clients[0]
+	if info.Session != alice.Session() || info.Username != "alice" || info.UserId != -1 {
+		t.Errorf("Expected alice first, got %+v", info)
+	}
+	if info.ChannelId != 0 || info.Address != "127.0.0.1:64738" {
+		t.Errorf("Expected alice in root from 127.0.0.1:64738, got %+v", info)
+	}
+	if !info.Opus || len(info.Codecs) != 1 || info.Codecs[0] != CeltCompatBitstream {
+		t.Errorf("Expected alice's codecs, got %+v", info)
+	}
+	if clients[1].Session != bob.Session() || !clients[1].SelfMute {
+		t.Errorf("Expected self-muted bob second, got %+v", clients[1])
+	}
+
+	// The snapshot is a copy.
+	clients[0].Codecs[0] = 0
+	if alice.codecs[0] != CeltCompatBitstream {
+		t.Errorf("Expected modifying the snapshot to leave the client alone")
+	}
+
+	alice.Disconnect()
+	clients = server.Clients()
+	if len(clients) != 1 || clients[0].Session != bob.Session() {
+		t.Errorf("Expected only bob after alice disconnected, got %+v", clients)
+	}
+}
+
+func TestClientsStopped(t *testing.T) {
+	server := newTestServer(t)
+	newTestClient(server, "alice")
+	server.cleanPerLaunchData()
+	if clients := server.Clients(); clients != nil {
+		t.Errorf("Expected no snapshot from a stopped server, got %+v", clients)
+	}
+}
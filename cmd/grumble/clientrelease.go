@@ -0,0 +1,112 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// A clientMatcher matches the client builds described by one entry of
+// the AllowedClients or DeniedClients config lists.
+//
+// An entry is either a version, such as 1.2.4, an inclusive range of
+// versions, such as 1.2.4-1.2.19, a range that is open at one end, such
+// as 1.3.0- or -1.2.19, or otherwise a glob pattern that is matched
+// against the release string the client sent in its Version message,
+// such as "1.4.0-rc*".
+type clientMatcher struct {
+	// The inclusive range of protocol versions matched, if glob is empty.
+	min, max uint32
+	glob     string
+}
+
+// Parse a single entry of a client list.
+func parseClientMatcher(entry string) clientMatcher {
+	if version, err := parseVersion(entry); err == nil {
+		return clientMatcher{min: version, max: version}
+	}
+
+	if i := strings.Index(entry, "-"); i >= 0 {
+		lower, upper := strings.TrimSpace(entry[:i]), strings.TrimSpace(entry[i+1:])
+		m := clientMatcher{min: 0, max: ^uint32(0)}
+		var err error
+		if len(lower) > 0 {
+			m.min, err = parseVersion(lower)
+		}
+		if err == nil && len(upper) > 0 {
+			m.max, err = parseVersion(upper)
+		}
+		if err == nil && (len(lower) > 0 || len(upper) > 0) {
+			return m
+		}
+	}
+
+	return clientMatcher{glob: entry}
+}
+
+// Check whether the matcher matches a client with the given protocol
+// version and release string.
+func (m clientMatcher) match(version uint32, release string) bool {
+	if len(m.glob) > 0 {
+		ok, _ := path.Match(m.glob, release)
+		return ok
+	}
+	return version >= m.min && version <= m.max
+}
+
+// Parse a comma-separated list of client matchers. Empty entries are
+// ignored.
+func parseClientList(str string) []clientMatcher {
+	matchers := []clientMatcher{}
+	for _, entry := range strings.Split(str, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) > 0 {
+			matchers = append(matchers, parseClientMatcher(entry))
+		}
+	}
+	return matchers
+}
+
+// Check whether any of matchers matches a client with the given protocol
+// version and release string.
+func matchClientList(matchers []clientMatcher, version uint32, release string) bool {
+	for _, m := range matchers {
+		if m.match(version, release) {
+			return true
+		}
+	}
+	return false
+}
+
+// Format a protocol version as major.minor.patch.
+func formatVersion(version uint32) string {
+	return fmt.Sprintf("%v.%v.%v", version>>16, (version>>8)&0xff, version&0xff)
+}
+
+// Check whether the client's build, as described by its Version message,
+// is allowed on the server by the AllowedClients and DeniedClients config
+// lists. If AllowedClients is set, only the builds it matches are allowed.
+// Builds matched by DeniedClients are never allowed. If the client is not
+// allowed, the returned string holds the reason to show its user.
+func (server *Server) checkClientRelease(client *Client) (string, bool) {
+	desc := formatVersion(client.Version)
+	if len(client.ClientName) > 0 {
+		desc = fmt.Sprintf("%v (%v)", client.ClientName, desc)
+	}
+
+	allowed := server.cfg.StringValue("AllowedClients")
+	if len(allowed) > 0 && !matchClientList(parseClientList(allowed), client.Version, client.ClientName) {
+		return fmt.Sprintf("Your client, %v, is not allowed on this server. Allowed clients: %v", desc, allowed), false
+	}
+
+	denied := server.cfg.StringValue("DeniedClients")
+	if matchClientList(parseClientList(denied), client.Version, client.ClientName) {
+		return fmt.Sprintf("Your client, %v, is not allowed on this server. Please use a different version.", desc), false
+	}
+
+	return "", true
+}
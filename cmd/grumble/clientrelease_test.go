@@ -0,0 +1,103 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"mumble.info/grumble/pkg/mumbleproto"
+	"strings"
+	"testing"
+)
+
+// Authenticate a client that sent the given version and release string
+// in its Version message. Returns the rejection sent to the client, or
+// nil if it was authenticated.
+func authenticateTestRelease(t *testing.T, server *Server, version string, release string) *mumbleproto.Reject {
+	client, peer := newHandshakenTestClient(server)
+	v, err := parseVersion(version)
+	if err != nil {
+		t.Fatalf("invalid version %q: %v", version, err)
+	}
+	client.Version = v
+	client.ClientName = release
+
+	if sendTestAuthenticate(t, server, client, "alice") {
+		return nil
+	}
+	reject := &mumbleproto.Reject{}
+	peer.expect(t, mumbleproto.MessageReject, reject)
+	return reject
+}
+
+func TestClientListMatch(t *testing.T) {
+	matchers := parseClientList("1.2.4, 1.2.10-1.2.12, 1.3.0-, -1.1.0, 1.4.0-rc*")
+	for _, c := range []struct {
+		version string
+		release string
+		match   bool
+	}{
+		{"1.2.4", "1.2.4", true},
+		{"1.2.5", "1.2.5", false},
+		{"1.2.10", "1.2.10", true},
+		{"1.2.12", "1.2.12", true},
+		{"1.2.13", "1.2.13", false},
+		{"1.3.5", "1.3.5", true},
+		{"1.0.0", "1.0.0", true},
+		{"1.2.19", "1.4.0-rc2", true},
+	} {
+		version, _ := parseVersion(c.version)
+		if matchClientList(matchers, version, c.release) != c.match {
+			t.Errorf("Expected match of %v (%v) to be %v", c.release, c.version, c.match)
+		}
+	}
+}
+
+func TestAllowedClientRelease(t *testing.T) {
+	server := newTestServer(t)
+	server.cfg.Set("AllowedClients", "1.2.4-1.2.19")
+	server.cfg.Set("DeniedClients", "1.2.8")
+
+	if reject := authenticateTestRelease(t, server, "1.2.10", "1.2.10"); reject != nil {
+		t.Errorf("Expected allowed build to be accepted, got %v", reject.GetReason())
+	}
+}
+
+func TestDeniedClientRelease(t *testing.T) {
+	server := newTestServer(t)
+	server.cfg.Set("DeniedClients", "1.2.8, *-beta")
+
+	for _, release := range []string{"1.2.8", "1.3.0-beta"} {
+		reject := authenticateTestRelease(t, server, "1.2.8", release)
+		if reject == nil {
+			t.Errorf("Expected denied build %v to be rejected", release)
+			continue
+		}
+		if reject.GetType() != mumbleproto.Reject_WrongVersion {
+			t.Errorf("Expected WrongVersion rejection, got %v", reject.GetType())
+		}
+		if !strings.Contains(reject.GetReason(), release) {
+			t.Errorf("Expected the reason to name the client's release, got %q", reject.GetReason())
+		}
+	}
+
+	if reject := authenticateTestRelease(t, server, "1.2.9", "1.2.9"); reject != nil {
+		t.Errorf("Expected build that isn't denied to be accepted, got %v", reject.GetReason())
+	}
+}
+
+func TestClientReleaseOutsideAllowedRange(t *testing.T) {
+	server := newTestServer(t)
+	server.cfg.Set("AllowedClients", "1.2.4-1.2.19")
+
+	reject := authenticateTestRelease(t, server, "1.3.0", "1.3.0")
+	if reject == nil {
+		t.Fatalf("Expected build outside the allowed range to be rejected")
+	}
+	if reject.GetType() != mumbleproto.Reject_WrongVersion {
+		t.Errorf("Expected WrongVersion rejection, got %v", reject.GetType())
+	}
+	if !strings.Contains(reject.GetReason(), "1.2.4-1.2.19") {
+		t.Errorf("Expected the reason to list the allowed clients, got %q", reject.GetReason())
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"time"
+)
+
+// A Clock is the source of time for a server's internal timers, such as
+// the ping and UDP timeouts and the rate limiters.
+//
+// Durations are always measured as the difference between two times
+// returned by Now. The default clock returns times with a monotonic
+// reading, so adjustments to the wall clock, for example by NTP, do not
+// affect them.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// Set the clock used by the server's internal timers. The clock must be
+// set before the server is started, since the timestamps recorded for
+// connected clients are relative to the clock it was started with.
+func (server *Server) SetClock(clock Clock) {
+	server.clock = clock
+	server.epoch = clock.Now()
+}
+
+// Get the current time from the server's clock.
+func (server *Server) now() time.Time {
+	if server.clock == nil {
+		return time.Now()
+	}
+	return server.clock.Now()
+}
+
+// Get the number of whole seconds between the time the server's clock
+// was set and t. Used for the timestamps that are accessed atomically.
+func (server *Server) clockSeconds(t time.Time) int64 {
+	return int64(t.Sub(server.epoch) / time.Second)
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"github.com/golang/protobuf/proto"
+	"mumble.info/grumble/pkg/mumbleproto"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A Clock that only moves when it is told to.
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (clock *fakeClock) Now() time.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	return clock.now
+}
+
+func (clock *fakeClock) advance(d time.Duration) {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	clock.now = clock.now.Add(d)
+}
+
+func TestFakeClockPingTimeout(t *testing.T) {
+	server := newTestServer(t)
+	clock := newFakeClock()
+	server.SetClock(clock)
+	server.cfg.Set("Timeout", "30")
+
+	client, peer := newTestClient(server, "alice")
+
+	clock.advance(20 * time.Second)
+	if n := client.secondsSincePing(); n != 20 {
+		t.Errorf("Expected 20 seconds since the last ping, got %v", n)
+	}
+	server.removeTimedOutClients()
+	if client.isDisconnected() {
+		t.Fatalf("Client was disconnected before the timeout")
+	}
+
+	// The reply echoes the client's timestamp as is, and the ping is
+	// recorded at the time it was received.
+	server.handleIncomingMessage(client, newTestMessage(t, client, &mumbleproto.Ping{
+		Timestamp: proto.Uint64(123456789),
+	}))
+	reply := &mumbleproto.Ping{}
+	peer.expect(t, mumbleproto.MessagePing, reply)
+	if reply.GetTimestamp() != 123456789 {
+		t.Errorf("Expected the ping timestamp to be echoed, got %v", reply.GetTimestamp())
+	}
+	if n := client.secondsSincePing(); n != 0 {
+		t.Errorf("Expected the ping to be recorded, got %v seconds since it", n)
+	}
+
+	clock.advance(29 * time.Second)
+	server.removeTimedOutClients()
+	if client.isDisconnected() {
+		t.Fatalf("Client was disconnected before the timeout")
+	}
+
+	clock.advance(2 * time.Second)
+	server.removeTimedOutClients()
+	if !client.isDisconnected() {
+		t.Errorf("Expected client to time out")
+	}
+}
+
+func TestFakeClockUptime(t *testing.T) {
+	server := newTestServer(t)
+	clock := newFakeClock()
+	server.SetClock(clock)
+
+	server.running = true
+	server.startTime = server.now()
+	clock.advance(90 * time.Minute)
+	if uptime := server.Uptime(); uptime != 90*time.Minute {
+		t.Errorf("Expected an uptime of 90m, got %v", uptime)
+	}
+}
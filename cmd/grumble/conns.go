@@ -0,0 +1,58 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"net"
+)
+
+// A trackedConn is a connection accepted on the TCP port, which the
+// server keeps track of until it is closed, so Stop can close the
+// connections of clients it doesn't know of yet.
+type trackedConn struct {
+	net.Conn
+	server *Server
+}
+
+func (conn *trackedConn) Close() error {
+	conn.server.connlock.Lock()
+	delete(conn.server.conns, conn)
+	conn.server.connlock.Unlock()
+	return conn.Conn.Close()
+}
+
+// Keep track of conn, a connection accepted on the TCP port, until it is
+// closed. Returns the connection to use in its place.
+func (server *Server) trackConn(conn net.Conn) net.Conn {
+	tracked := &trackedConn{conn, server}
+	server.connlock.Lock()
+	if server.conns == nil {
+		server.conns = make(map[*trackedConn]bool)
+	}
+	server.conns[tracked] = true
+	server.connlock.Unlock()
+	return tracked
+}
+
+// Close all the connections accepted on the TCP port that are still open.
+func (server *Server) closeConns() {
+	server.connlock.Lock()
+	conns := server.conns
+	server.conns = nil
+	server.connlock.Unlock()
+	for conn := range conns {
+		conn.Conn.Close()
+	}
+}
+
+// Run f on a goroutine of its own, as one of the goroutines serving a
+// connection or its client, which Stop waits for.
+func (server *Server) goServe(f func()) {
+	server.connwg.Add(1)
+	go func() {
+		defer server.connwg.Done()
+		f()
+	}()
+}
@@ -0,0 +1,256 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"github.com/golang/protobuf/proto"
+	"mumble.info/grumble/pkg/acl"
+	"mumble.info/grumble/pkg/mumbleproto"
+)
+
+// This file implements the server-provided context actions.
+//
+// Context actions are entries that the server adds to the context
+// menus of its clients. When a user picks one of them, the client
+// sends a ContextAction message naming the action along with the
+// user or channel it was invoked on.
+
+type ContextAction struct {
+	// The name of the action, as sent over the wire.
+	Name string
+	// The text shown in the client's context menu.
+	Text string
+	// Where the action is shown (server, channel and/or user menus).
+	Context mumbleproto.ContextActionModify_Context
+	// The permission a client must have in the root channel for the
+	// action to be added to its context menus.
+	Permission acl.Permission
+	// The handler is invoked on the server's handler goroutine when
+	// a client triggers the action.
+	Handler func(server *Server, actor *Client, action *mumbleproto.ContextAction)
+}
+
+var contextActions = []*ContextAction{
+	{
+		Name:       "grumble.moveall",
+		Text:       "Move all users here",
+		Context:    mumbleproto.ContextActionModify_Channel,
+		Permission: acl.MovePermission,
+		Handler:    handleMoveAllAction,
+	},
+	{
+		Name:       "grumble.approve",
+		Text:       "Approve user",
+		Context:    mumbleproto.ContextActionModify_User,
+		Permission: acl.MuteDeafenPermission,
+		Handler:    handleApproveAction,
+	},
+	{
+		Name:       "grumble.resync",
+		Text:       "Resynchronize with server",
+		Context:    mumbleproto.ContextActionModify_Server,
+		Permission: acl.TraversePermission,
+		Handler:    handleResyncAction,
+	},
+	{
+		Name:       "grumble.resyncuser",
+		Text:       "Resynchronize user",
+		Context:    mumbleproto.ContextActionModify_User,
+		Permission: acl.KickPermission,
+		Handler:    handleResyncUserAction,
+	},
+	{
+		Name:       "grumble.pin",
+		Text:       "Pin user to channel",
+		Context:    mumbleproto.ContextActionModify_User,
+		Permission: acl.MovePermission,
+		Handler:    handlePinAction,
+	},
+	{
+		Name:       "grumble.unpin",
+		Text:       "Release pinned user",
+		Context:    mumbleproto.ContextActionModify_User,
+		Permission: acl.MovePermission,
+		Handler:    handleUnpinAction,
+	},
+	{
+		Name:       "grumble.pausevoice",
+		Text:       "Pause voice",
+		Context:    mumbleproto.ContextActionModify_Server | mumbleproto.ContextActionModify_Channel,
+		Permission: acl.MuteDeafenPermission,
+		Handler:    handlePauseVoiceAction,
+	},
+	{
+		Name:       "grumble.resumevoice",
+		Text:       "Resume voice",
+		Context:    mumbleproto.ContextActionModify_Server | mumbleproto.ContextActionModify_Channel,
+		Permission: acl.MuteDeafenPermission,
+		Handler:    handleResumeVoiceAction,
+	},
+	{
+		Name:       "grumble.watchtalking",
+		Text:       "Show who is talking",
+		Context:    mumbleproto.ContextActionModify_Server,
+		Permission: acl.MuteDeafenPermission,
+		Handler:    handleWatchTalkingAction,
+	},
+	{
+		Name:       "grumble.unwatchtalking",
+		Text:       "Stop showing who is talking",
+		Context:    mumbleproto.ContextActionModify_Server,
+		Permission: acl.MuteDeafenPermission,
+		Handler:    handleUnwatchTalkingAction,
+	},
+}
+
+// Look up the context action with the given name.
+func lookupContextAction(name string) *ContextAction {
+	for _, action := range contextActions {
+		if action.Name == name {
+			return action
+		}
+	}
+	return nil
+}
+
+// Add the context actions the client has permission to use to the
+// client's context menus.
+func (server *Server) sendContextActions(client *Client) error {
+	rootChan := server.RootChannel()
+	for _, action := range contextActions {
+		if !acl.HasPermission(&rootChan.ACL, client, action.Permission) {
+			continue
+		}
+		err := client.sendMessage(&mumbleproto.ContextActionModify{
+			Action:    proto.String(action.Name),
+			Text:      proto.String(action.Text),
+			Context:   proto.Uint32(uint32(action.Context)),
+			Operation: mumbleproto.ContextActionModify_Add.Enum(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Move all users in the actor's current channel to the channel the
+// action was invoked on.
+func handleMoveAllAction(server *Server, actor *Client, action *mumbleproto.ContextAction) {
+	if action.ChannelId == nil {
+		return
+	}
+	dest, ok := server.Channels[int(*action.ChannelId)]
+	if !ok {
+		return
+	}
+	source := actor.Channel
+
+	if !acl.HasPermission(&source.ACL, actor, acl.MovePermission) {
+		actor.sendPermissionDenied(actor, source, acl.MovePermission)
+		return
+	}
+	if !acl.HasPermission(&dest.ACL, actor, acl.MovePermission) {
+		actor.sendPermissionDenied(actor, dest, acl.MovePermission)
+		return
+	}
+
+	moved := server.MoveAll(source, dest, actor)
+	actor.Printf("Moved %v users from channel %v to channel %v", moved, source.Id, dest.Id)
+}
+
+// Approve the user the action was invoked on, allowing them
+// to speak. See the SuppressNewUsers config key.
+func handleApproveAction(server *Server, actor *Client, action *mumbleproto.ContextAction) {
+	if action.Session == nil {
+		return
+	}
+	target, ok := server.clients[*action.Session]
+	if !ok {
+		return
+	}
+
+	if !acl.HasPermission(&target.Channel.ACL, actor, acl.MuteDeafenPermission) {
+		actor.sendPermissionDenied(actor, target.Channel, acl.MuteDeafenPermission)
+		return
+	}
+
+	if target.unapproved {
+		server.ApproveClient(target)
+		actor.Printf("Approved user %v", target.Session())
+	}
+}
+
+// Resend the server's state to the actor, whose view of the server
+// may have gone out of sync. Resending it is expensive, so this is
+// limited to once per ResyncInterval.
+func handleResyncAction(server *Server, actor *Client, action *mumbleproto.ContextAction) {
+	if !server.allowResync(actor) {
+		return
+	}
+	if err := actor.resync(); err != nil && err != errClientDisconnected {
+		actor.Panicf("Unable to resync: %v", err)
+	}
+}
+
+// Resend the server's state to the user the action was invoked on.
+func handleResyncUserAction(server *Server, actor *Client, action *mumbleproto.ContextAction) {
+	if action.Session == nil {
+		return
+	}
+	target, ok := server.clients[*action.Session]
+	if !ok {
+		return
+	}
+
+	rootChan := server.RootChannel()
+	if !acl.HasPermission(&rootChan.ACL, actor, acl.KickPermission) {
+		actor.sendPermissionDenied(actor, rootChan, acl.KickPermission)
+		return
+	}
+
+	if err := target.resync(); err != nil && err != errClientDisconnected {
+		target.Panicf("Unable to resync: %v", err)
+		return
+	}
+	actor.Printf("Resynced user %v", target.Session())
+}
+
+// Pin the user the action was invoked on to its current channel, so it
+// can't leave until it is released. Moderators can still move it.
+func handlePinAction(server *Server, actor *Client, action *mumbleproto.ContextAction) {
+	setPinnedAction(server, actor, action, true)
+}
+
+// Release a user pinned by handlePinAction.
+func handleUnpinAction(server *Server, actor *Client, action *mumbleproto.ContextAction) {
+	setPinnedAction(server, actor, action, false)
+}
+
+// Pin or release the user the action was invoked on. The actor needs
+// permission to move the user out of its current channel.
+func setPinnedAction(server *Server, actor *Client, action *mumbleproto.ContextAction, pinned bool) {
+	if action.Session == nil {
+		return
+	}
+	target, ok := server.clients[*action.Session]
+	if !ok {
+		return
+	}
+
+	if !acl.HasPermission(&target.Channel.ACL, actor, acl.MovePermission) {
+		actor.sendPermissionDenied(actor, target.Channel, acl.MovePermission)
+		return
+	}
+
+	if target.pinned != pinned {
+		target.pinned = pinned
+		if pinned {
+			actor.Printf("Pinned user %v to channel %v", target.Session(), target.Channel.Id)
+		} else {
+			actor.Printf("Released user %v", target.Session())
+		}
+	}
+}
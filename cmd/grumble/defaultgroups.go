@@ -0,0 +1,115 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"mumble.info/grumble/pkg/acl"
+	"strconv"
+	"strings"
+)
+
+// An entry of the DefaultGroups config key. The channel is -1 if the
+// entry doesn't name one.
+type defaultGroup struct {
+	group     string
+	channel   int
+	criterion string
+}
+
+// Parse an entry of the DefaultGroups config key, group=criterion or
+// group@channel=criterion. The channel is -1 if the entry doesn't name one.
+func parseDefaultGroup(entry string) (group string, channel int, criterion string, ok bool) {
+	parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+	if len(parts) != 2 {
+		return "", 0, "", false
+	}
+	group, criterion = strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	channel = -1
+	if i := strings.LastIndex(group, "@"); i != -1 {
+		id, err := strconv.Atoi(group[i+1:])
+		if err != nil || id < 0 {
+			return "", 0, "", false
+		}
+		group, channel = group[:i], id
+	}
+	return group, channel, criterion, len(group) > 0
+}
+
+// Check whether client meets criterion, the criterion of an entry of the
+// DefaultGroups config key.
+func (client *Client) meetsDefaultGroupCriterion(criterion string) bool {
+	switch criterion {
+	case "all":
+		return true
+	case "registered":
+		return client.IsRegistered()
+	case "strongcert":
+		return client.strongCert
+	}
+	return false
+}
+
+// Get the groups client is a member of by default in ctx, through the
+// server's DefaultGroups. Entries that can't be parsed, or that name a
+// channel that doesn't exist, are ignored. Implements
+// acl.ContextGroupGrantee.
+func (client *Client) GrantedGroupsIn(ctx *acl.Context) []string {
+	server := client.server
+	entries := server.defaultGroups()
+	if len(entries) == 0 {
+		return nil
+	}
+
+	groups := []string{}
+	for _, entry := range entries {
+		if !client.meetsDefaultGroupCriterion(entry.criterion) {
+			continue
+		}
+		if entry.channel != -1 {
+			channel, ok := server.Channels[entry.channel]
+			if !ok || !isContextWithin(ctx, &channel.ACL) {
+				continue
+			}
+		}
+		groups = append(groups, entry.group)
+	}
+	return groups
+}
+
+// Get the entries of the server's DefaultGroups config key that can be
+// parsed. The key is parsed again only when it has changed, since the
+// entries are looked up on every permission check.
+func (server *Server) defaultGroups() []defaultGroup {
+	spec := server.cfg.StringValue("DefaultGroups")
+
+	server.defaultGroupsLock.Lock()
+	defer server.defaultGroupsLock.Unlock()
+	if spec == server.defaultGroupsSpec {
+		return server.defaultGroupEntries
+	}
+
+	entries := []defaultGroup{}
+	if spec != "" {
+		for _, entry := range strings.Split(spec, ",") {
+			group, channel, criterion, ok := parseDefaultGroup(entry)
+			if ok {
+				entries = append(entries, defaultGroup{group, channel, criterion})
+			}
+		}
+	}
+	server.defaultGroupsSpec = spec
+	server.defaultGroupEntries = entries
+	return entries
+}
+
+// Check whether ctx is ancestor or one of its descendants.
+func isContextWithin(ctx *acl.Context, ancestor *acl.Context) bool {
+	for ; ctx != nil; ctx = ctx.Parent {
+		if ctx == ancestor {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"mumble.info/grumble/pkg/acl"
+	"strconv"
+	"testing"
+)
+
+func TestParseDefaultGroup(t *testing.T) {
+	group, channel, criterion, ok := parseDefaultGroup(" members = registered ")
+	if !ok || group != "members" || channel != -1 || criterion != "registered" {
+		t.Errorf("Unexpected parse: %v %v %v %v", group, channel, criterion, ok)
+	}
+	group, channel, criterion, ok = parseDefaultGroup("verified@5=strongcert")
+	if !ok || group != "verified" || channel != 5 || criterion != "strongcert" {
+		t.Errorf("Unexpected parse: %v %v %v %v", group, channel, criterion, ok)
+	}
+	for _, invalid := range []string{"", "members", "=all", "members@x=all", "@5=all"} {
+		if _, _, _, ok := parseDefaultGroup(invalid); ok {
+			t.Errorf("Expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestDefaultGroups(t *testing.T) {
+	server := newTestServer(t)
+	stage := newTestChannel(server, server.RootChannel(), "Stage")
+	stage.ACL.InheritACL = true
+	stage.ACL.ACLs = append(stage.ACL.ACLs, acl.ACL{
+		UserId:    -1,
+		Group:     "all",
+		ApplyHere: true,
+		Deny:      acl.Permission(acl.EnterPermission),
+	}, acl.ACL{
+		UserId:    -1,
+		Group:     "members",
+		ApplyHere: true,
+		Allow:     acl.Permission(acl.EnterPermission),
+	})
+	lobby := newTestChannel(server, server.RootChannel(), "Lobby")
+
+	registered, _ := newTestClient(server, "registered")
+	registered.user = addTestUser(t, server, 1, "registered")
+	guest, _ := newTestClient(server, "guest")
+
+	if stage.CanEnter(registered) {
+		t.Fatalf("Expected a user outside the members group to be denied entry")
+	}
+
+	server.cfg.Set("DefaultGroups", "members=registered")
+	if !stage.CanEnter(registered) {
+		t.Errorf("Expected a registered user to be a member of the default group")
+	}
+	if entries := server.defaultGroups(); len(entries) != 1 || &entries[0] != &server.defaultGroups()[0] {
+		t.Errorf("Expected the parsed default groups to be reused")
+	}
+	if stage.CanEnter(guest) {
+		t.Errorf("Expected an unregistered user not to be a member of the default group")
+	}
+
+	// Default groups that apply to another part of the channel tree
+	// don't grant membership here.
+	server.cfg.Set("DefaultGroups", "members@"+strconv.Itoa(lobby.Id)+"=registered")
+	if stage.CanEnter(registered) {
+		t.Errorf("Expected a default group of another channel not to apply")
+	}
+	server.cfg.Set("DefaultGroups", "members@"+strconv.Itoa(stage.Id)+"=all")
+	if !stage.CanEnter(guest) {
+		t.Errorf("Expected a default group of the channel to apply")
+	}
+
+	// Groups that remove a user take precedence.
+	group := acl.EmptyGroupWithName("members")
+	group.Remove[registered.UserId()] = true
+	stage.ACL.Groups["members"] = group
+	if stage.CanEnter(registered) {
+		t.Errorf("Expected a user removed from the group not to be a member")
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"mumble.info/grumble/pkg/mumbleproto"
+	"sync/atomic"
+)
+
+// The reasons the server disconnects a client for. Each reason decides
+// the final message the client is sent before its connection is closed.
+type DisconnectReason int
+
+const (
+	// Kicked by the server. Sent as a UserRemove, which is also
+	// broadcast to the other users.
+	DisconnectKicked DisconnectReason = iota
+	// Banned by the server. Like DisconnectKicked, but the UserRemove
+	// has its ban flag set.
+	DisconnectBanned
+	// The server has no room for the client. Sent as a Reject.
+	DisconnectServerFull
+	// The server is shutting down. Sent as a TextMessage.
+	DisconnectShutdown
+	// The client hasn't pinged the server in time. Sent as a TextMessage.
+	DisconnectIdleTimeout
+	// The client's version is not allowed. Sent as a Reject.
+	DisconnectWrongVersion
+)
+
+var disconnectReasonNames = map[DisconnectReason]string{
+	DisconnectKicked:       "kicked",
+	DisconnectBanned:       "banned",
+	DisconnectServerFull:   "server-full",
+	DisconnectShutdown:     "shutdown",
+	DisconnectIdleTimeout:  "idle-timeout",
+	DisconnectWrongVersion: "version",
+}
+
+func (reason DisconnectReason) String() string {
+	if name, ok := disconnectReasonNames[reason]; ok {
+		return name
+	}
+	return fmt.Sprintf("DisconnectReason(%d)", int(reason))
+}
+
+// The Reject type used for reason, for clients that haven't finished
+// logging in.
+func (reason DisconnectReason) rejectType() mumbleproto.Reject_RejectType {
+	switch reason {
+	case DisconnectServerFull:
+		return mumbleproto.Reject_ServerFull
+	case DisconnectWrongVersion:
+		return mumbleproto.Reject_WrongVersion
+	}
+	return mumbleproto.Reject_None
+}
+
+// Disconnect the client for the given reason, after sending it a final
+// message that explains why, with text as the human-readable details.
+// The connection is drained before it is closed, so the client gets to
+// read the message.
+//
+// Clients that haven't finished logging in are sent a Reject. Logged in
+// clients that are kicked or banned are removed with a UserRemove that
+// carries text, which the other users see as well. Otherwise, they are
+// sent text in a TextMessage.
+//
+// Called on the server's handler goroutine, or once it has stopped.
+func (client *Client) disconnectWith(reason DisconnectReason, text string) {
+	if client.isDisconnected() {
+		return
+	}
+
+	client.Printf("Disconnecting (%v): %v", reason, text)
+	client.classifyDisconnect(reason.String())
+	if client.state < StateClientReady {
+		client.RejectAuth(reason.rejectType(), text)
+		return
+	}
+	client.setDisconnectReason(fmt.Sprintf("%v: %v", reason, text))
+
+	server := client.server
+	userremove := &mumbleproto.UserRemove{
+		Session: proto.Uint32(client.Session()),
+	}
+	switch reason {
+	case DisconnectKicked, DisconnectBanned:
+		userremove.Reason = proto.String(text)
+		if reason == DisconnectBanned {
+			userremove.Ban = proto.Bool(true)
+		}
+	default:
+		err := client.sendMessage(&mumbleproto.TextMessage{
+			Session: []uint32{client.Session()},
+			Message: proto.String(text),
+		})
+		if err != nil && err != errClientDisconnected {
+			client.Printf("Unable to send disconnect message: %v", err)
+		}
+	}
+
+	if err := server.broadcastProtoMessageWithPredicate(userremove, server.userStateRecipients(client, nil)); err != nil {
+		server.Printf("Unable to broadcast UserRemove message: %v", err)
+	}
+	client.ForceDisconnect()
+}
+
+// Disconnect the client as the server shuts down, after sending it text
+// in a TextMessage, or a Reject if it hasn't finished logging in. Unlike
+// disconnectWith, nothing is broadcast, since every other client is
+// disconnected as well, and the client isn't removed from the server's
+// state, which is torn down as a whole. Only the channel a registered
+// user was last in is recorded.
+//
+// Called once the server's handler has stopped.
+func (client *Client) shutdown(text string) {
+	if client.isDisconnected() {
+		return
+	}
+
+	client.Printf("Disconnecting (%v): %v", DisconnectShutdown, text)
+	client.classifyDisconnect(DisconnectShutdown.String())
+	client.setDisconnectReason(fmt.Sprintf("%v: %v", DisconnectShutdown, text))
+	client.server.countDisconnect(client)
+
+	var err error
+	if client.state < StateClientReady {
+		err = client.sendMessage(&mumbleproto.Reject{
+			Type:   DisconnectShutdown.rejectType().Enum(),
+			Reason: proto.String(text),
+		})
+	} else {
+		err = client.sendMessage(&mumbleproto.TextMessage{
+			Session: []uint32{client.Session()},
+			Message: proto.String(text),
+		})
+	}
+	if err != nil && err != errClientDisconnected {
+		client.Printf("Unable to send disconnect message: %v", err)
+	}
+
+	atomic.StoreInt32(&client.disconnected, 1)
+	if client.IsRegistered() && client.Channel != nil {
+		client.server.UpdateFrozenUserLastChannel(client)
+	}
+	client.closeDown(false)
+}
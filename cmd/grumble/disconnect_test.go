@@ -0,0 +1,154 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"mumble.info/grumble/pkg/mumbleproto"
+	"strings"
+	"testing"
+)
+
+// Check that a logged in client disconnected for reason is removed with
+// a UserRemove carrying text, which other users see too.
+func testDisconnectUserRemove(t *testing.T, reason DisconnectReason, ban bool) {
+	server := newTestServer(t)
+	defer openTestFreezeLog(t, server)()
+	alice, alicePeer := newTestClient(server, "alice")
+	_, bobPeer := newTestClient(server, "bob")
+
+	alice.disconnectWith(reason, "Behave")
+	if !alice.isDisconnected() {
+		t.Fatalf("Expected client to be disconnected")
+	}
+	for _, peer := range []*testPeer{alicePeer, bobPeer} {
+		userremove := &mumbleproto.UserRemove{}
+		peer.expect(t, mumbleproto.MessageUserRemove, userremove)
+		if userremove.GetSession() != alice.Session() || userremove.GetReason() != "Behave" || userremove.GetBan() != ban {
+			t.Errorf("Expected UserRemove for %v with reason and ban %v, got %v", reason, ban, userremove)
+		}
+	}
+	if !strings.HasPrefix(alice.disconnectReason, reason.String()) {
+		t.Errorf("Expected disconnect reason to start with %v, got %q", reason, alice.disconnectReason)
+	}
+}
+
+func TestDisconnectKicked(t *testing.T) {
+	testDisconnectUserRemove(t, DisconnectKicked, false)
+}
+
+func TestDisconnectBanned(t *testing.T) {
+	testDisconnectUserRemove(t, DisconnectBanned, true)
+}
+
+// Check that a logged in client disconnected for reason is sent text in a
+// TextMessage, and that other users see it leave.
+func testDisconnectTextMessage(t *testing.T, reason DisconnectReason, disconnect func(server *Server, client *Client)) {
+	server := newTestServer(t)
+	defer openTestFreezeLog(t, server)()
+	alice, alicePeer := newTestClient(server, "alice")
+	_, bobPeer := newTestClient(server, "bob")
+
+	disconnect(server, alice)
+	if !alice.isDisconnected() {
+		t.Fatalf("Expected client to be disconnected")
+	}
+	txtmsg := &mumbleproto.TextMessage{}
+	alicePeer.expect(t, mumbleproto.MessageTextMessage, txtmsg)
+	if len(txtmsg.Session) != 1 || txtmsg.Session[0] != alice.Session() || len(txtmsg.GetMessage()) == 0 {
+		t.Errorf("Expected a TextMessage to alice explaining the %v, got %v", reason, txtmsg)
+	}
+	userremove := &mumbleproto.UserRemove{}
+	bobPeer.expect(t, mumbleproto.MessageUserRemove, userremove)
+	if userremove.GetSession() != alice.Session() {
+		t.Errorf("Expected UserRemove for alice, got %v", userremove)
+	}
+	bobPeer.expectNone(t, mumbleproto.MessageTextMessage)
+	if !strings.HasPrefix(alice.disconnectReason, reason.String()) {
+		t.Errorf("Expected disconnect reason to start with %v, got %q", reason, alice.disconnectReason)
+	}
+}
+
+func TestDisconnectShutdown(t *testing.T) {
+	testDisconnectTextMessage(t, DisconnectShutdown, func(server *Server, client *Client) {
+		client.disconnectWith(DisconnectShutdown, "The server is shutting down")
+	})
+}
+
+func TestShutdownClient(t *testing.T) {
+	server := newTestServer(t)
+	defer openTestFreezeLog(t, server)()
+	games := newTestChannel(server, server.RootChannel(), "Games")
+	user := addTestUser(t, server, 1, "alice")
+	alice, alicePeer := newTestClient(server, "alice")
+	alice.user = user
+	server.userEnterChannel(alice, games, &mumbleproto.UserState{})
+	user.LastChannelId = 0
+	_, bobPeer := newTestClient(server, "bob")
+
+	alice.shutdown("The server is shutting down")
+	if !alice.isDisconnected() {
+		t.Fatalf("Expected client to be disconnected")
+	}
+	txtmsg := &mumbleproto.TextMessage{}
+	alicePeer.expect(t, mumbleproto.MessageTextMessage, txtmsg)
+	if txtmsg.GetMessage() != "The server is shutting down" {
+		t.Errorf("Expected a TextMessage to alice about the shutdown, got %v", txtmsg)
+	}
+	if user.LastChannelId != games.Id {
+		t.Errorf("Expected last channel %v, got %v", games.Id, user.LastChannelId)
+	}
+
+	// The others are going away as well, so they aren't told.
+	bobPeer.expectNone(t, mumbleproto.MessageUserRemove)
+	if server.clients[alice.Session()] != alice {
+		t.Errorf("Expected the client to be left in the server's state")
+	}
+}
+
+func TestDisconnectIdleTimeout(t *testing.T) {
+	testDisconnectTextMessage(t, DisconnectIdleTimeout, func(server *Server, client *Client) {
+		server.cfg.Set("Timeout", "30")
+		client.lastPing -= 60
+		server.removeTimedOutClients()
+	})
+}
+
+func TestDisconnectServerFull(t *testing.T) {
+	server := newTestServer(t)
+	defer openTestFreezeLog(t, server)()
+	server.cfg.Set("MaxUsers", "1")
+	newTestClient(server, "alice")
+
+	bob, bobPeer := newAuthenticatingClient(server, "bob")
+	server.finishAuthenticate(bob)
+	if !bob.isDisconnected() {
+		t.Fatalf("Expected client to be rejected from a full server")
+	}
+	reject := &mumbleproto.Reject{}
+	bobPeer.expect(t, mumbleproto.MessageReject, reject)
+	if reject.GetType() != mumbleproto.Reject_ServerFull || len(reject.GetReason()) == 0 {
+		t.Errorf("Expected ServerFull rejection with a reason, got %v", reject)
+	}
+
+	// SuperUser can always log in.
+	admin, _ := newAuthenticatingClient(server, "SuperUser")
+	admin.user = addTestUser(t, server, 0, "SuperUser")
+	server.finishAuthenticate(admin)
+	if admin.isDisconnected() {
+		t.Errorf("Expected SuperUser to log in to a full server")
+	}
+}
+
+func TestDisconnectWrongVersion(t *testing.T) {
+	server := newTestServer(t)
+	client, peer := newAuthenticatingClient(server, "alice")
+	client.disconnectWith(DisconnectWrongVersion, "Please upgrade")
+
+	reject := &mumbleproto.Reject{}
+	peer.expect(t, mumbleproto.MessageReject, reject)
+	if reject.GetType() != mumbleproto.Reject_WrongVersion || reject.GetReason() != "Please upgrade" {
+		t.Errorf("Expected WrongVersion rejection, got %v", reject)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+)
+
+// A StateDump is a snapshot of a server's channel tree and clients, as
+// returned by Server.DumpState.
+type StateDump struct {
+	Root    ChannelDump  `json:"root"`
+	Clients []ClientInfo `json:"clients"`
+}
+
+// A ChannelDump describes a channel and, in turn, its subchannels.
+type ChannelDump struct {
+	Id        int    `json:"id"`
+	Name      string `json:"name"`
+	Position  int    `json:"position"`
+	MaxUsers  int    `json:"maxusers,omitempty"`
+	Temporary bool   `json:"temporary,omitempty"`
+
+	// The sessions of the clients in the channel, and the ids of
+	// the channels it is linked to, in ascending order.
+	Occupants []uint32 `json:"occupants"`
+	Links     []int    `json:"links"`
+
+	InheritACL bool         `json:"inheritacl"`
+	ACLs       []ACLSummary `json:"acls"`
+	// The names of the groups defined in the channel, in order.
+	Groups []string `json:"groups"`
+
+	// Ordered by id.
+	Children []ChannelDump `json:"children"`
+}
+
+// An ACLSummary describes a single ACL entry of a channel. Entries
+// apply either to a user, or to a group if UserId is -1.
+type ACLSummary struct {
+	UserId    int    `json:"userid"`
+	Group     string `json:"group,omitempty"`
+	ApplyHere bool   `json:"applyhere"`
+	ApplySubs bool   `json:"applysubs"`
+	Allow     uint32 `json:"allow"`
+	Deny      uint32 `json:"deny"`
+}
+
+// Take a snapshot of the server's channel tree, with the occupants, links
+// and ACLs of each channel, and of its clients, as Clients does. Like
+// Clients, the snapshot is taken by the server's handler. Returns nil if
+// the server isn't running, or its handler doesn't answer within
+// healthProbeTimeout.
+func (server *Server) State() *StateDump {
+	server.stopLock.RLock()
+	defer server.stopLock.RUnlock()
+	if server.stopping || server.stateProbe == nil {
+		return nil
+	}
+	reply := make(chan *StateDump, 1)
+	select {
+	case server.stateProbe <- reply:
+		return <-reply
+	case <-time.After(healthProbeTimeout):
+		return nil
+	}
+}
+
+// Like State, but called on the server's handler goroutine.
+func (server *Server) state() *StateDump {
+	return &StateDump{
+		Root:    dumpChannel(server.RootChannel()),
+		Clients: server.clientInfos(),
+	}
+}
+
+// Get a snapshot of the server's state, as taken by State, formatted
+// as indented JSON for support requests and debugging.
+func (server *Server) DumpState() ([]byte, error) {
+	state := server.State()
+	if state == nil {
+		return nil, errors.New("server not running, or not responding")
+	}
+	return json.MarshalIndent(state, "", "\t")
+}
+
+func dumpChannel(channel *Channel) ChannelDump {
+	dump := ChannelDump{
+		Id:         channel.Id,
+		Name:       channel.Name,
+		Position:   channel.Position,
+		MaxUsers:   channel.MaxUsers,
+		Temporary:  channel.IsTemporary(),
+		Occupants:  []uint32{},
+		Links:      []int{},
+		InheritACL: channel.ACL.InheritACL,
+		ACLs:       []ACLSummary{},
+		Groups:     []string{},
+		Children:   []ChannelDump{},
+	}
+
+	for session := range channel.clients {
+		dump.Occupants = append(dump.Occupants, session)
+	}
+	sort.Slice(dump.Occupants, func(i, j int) bool {
+		return dump.Occupants[i] < dump.Occupants[j]
+	})
+
+	for id := range channel.Links {
+		dump.Links = append(dump.Links, id)
+	}
+	sort.Ints(dump.Links)
+
+	for _, entry := range channel.ACL.ACLs {
+		dump.ACLs = append(dump.ACLs, ACLSummary{
+			UserId:    entry.UserId,
+			Group:     entry.Group,
+			ApplyHere: entry.ApplyHere,
+			ApplySubs: entry.ApplySubs,
+			Allow:     uint32(entry.Allow),
+			Deny:      uint32(entry.Deny),
+		})
+	}
+
+	for name := range channel.ACL.Groups {
+		dump.Groups = append(dump.Groups, name)
+	}
+	sort.Strings(dump.Groups)
+
+	for _, child := range channel.children {
+		dump.Children = append(dump.Children, dumpChannel(child))
+	}
+	sort.Slice(dump.Children, func(i, j int) bool {
+		return dump.Children[i].Id < dump.Children[j].Id
+	})
+
+	return dump
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"encoding/json"
+	"mumble.info/grumble/pkg/acl"
+	"mumble.info/grumble/pkg/mumbleproto"
+	"testing"
+)
+
+func TestDumpState(t *testing.T) {
+	server := newTestServer(t)
+	defer answerTestProbes(server)()
+	root := server.RootChannel()
+	lobby := newTestChannel(server, root, "Lobby")
+	games := newTestChannel(server, lobby, "Games")
+	music := newTestChannel(server, root, "Music")
+	server.LinkChannels(lobby, music)
+	lobby.ACL.ACLs = append(lobby.ACL.ACLs, acl.ACL{
+		UserId:    -1,
+		Group:     "all",
+		ApplyHere: true,
+		Deny:      acl.Permission(acl.EnterPermission),
+	})
+	games.ACL.Groups["players"] = acl.EmptyGroupWithName("players")
+
+	alice, _ := newAuthenticatingClient(server, "alice")
+	server.finishAuthenticate(alice)
+	server.userEnterChannel(alice, lobby, &mumbleproto.UserState{})
+
+	buf, err := server.DumpState()
+	if err != nil {
+		t.Fatalf("unable to dump state: %v", err)
+	}
+	dump := &StateDump{}
+	if err := json.Unmarshal(buf, dump); err != nil {
+		t.Fatalf("unable to parse dump: %v", err)
+	}
+
+	if dump.Root.Id != root.Id || len(dump.Root.Children) != 2 {
+		t.Fatalf("Expected root with two children, got %+v", dump.Root)
+	}
+	lobbyDump := dump.Root.Children[0]
+	if lobbyDump.Name != "Lobby" || dump.Root.Children[1].Name != "Music" {
+		t.Fatalf("Expected Lobby and Music, in order, got %+v", dump.Root.Children)
+	}
+	if len(lobbyDump.Occupants) != 1 || lobbyDump.Occupants[0] != alice.Session() {
+		t.Errorf("Expected alice in Lobby, got %v", lobbyDump.Occupants)
+	}
+	if len(lobbyDump.Links) != 1 || lobbyDump.Links[0] != music.Id {
+		t.Errorf("Expected Lobby to be linked to Music, got %v", lobbyDump.Links)
+	}
+	if len(lobbyDump.ACLs) != 1 || lobbyDump.ACLs[0].Group != "all" || lobbyDump.ACLs[0].Deny != uint32(acl.EnterPermission) {
+		t.Errorf("Expected Lobby's ACL entry, got %+v", lobbyDump.ACLs)
+	}
+	if len(lobbyDump.Children) != 1 {
+		t.Fatalf("Expected Lobby to have one child, got %+v", lobbyDump.Children)
+	}
+	gamesDump := lobbyDump.Children[0]
+	if gamesDump.Id != games.Id || len(gamesDump.Groups) != 1 || gamesDump.Groups[0] != "players" {
+		t.Errorf("Expected Games with group players, got %+v", gamesDump)
+	}
+
+	if len(dump.Clients) != 1 || dump.Clients[0].Session != alice.Session() || dump.Clients[0].ChannelId != lobby.Id {
+		t.Errorf("Expected alice in the client list, in Lobby, got %+v", dump.Clients)
+	}
+}
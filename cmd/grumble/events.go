@@ -0,0 +1,45 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Log a connection lifecycle event for client, if the LogConnectionEvents
+// config key is enabled.
+//
+// Events are logged as a list of key=value fields, starting with the name
+// of the event and the client's session, so they can be parsed by log
+// processing tools. fields holds the event's remaining keys and values,
+// in turn. Values that are empty or contain spaces, quotes or equal
+// signs are quoted.
+func (client *Client) logEvent(event string, fields ...interface{}) {
+	if !client.server.cfg.BoolValue("LogConnectionEvents") {
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "event=%v session=%v", event, client.Session())
+	for i := 0; i+1 < len(fields); i += 2 {
+		value := fmt.Sprint(fields[i+1])
+		if value == "" || strings.ContainsAny(value, " \t\"=") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(buf, " %v=%v", fields[i], value)
+	}
+	client.Print(buf.String())
+}
+
+// Record why the client is about to be disconnected, for the disconnect
+// event. Only the first reason given is kept.
+func (client *Client) setDisconnectReason(reason string) {
+	if client.disconnectReason == "" {
+		client.disconnectReason = reason
+	}
+}
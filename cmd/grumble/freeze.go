@@ -30,7 +30,7 @@ func (server *Server) FreezeToFile() error {
 		return err
 	}
 
-	if server.running {
+	if server.isRunning() {
 		// Re-open the freeze log.
 		err = server.openFreezeLog()
 		if err != nil {
@@ -140,6 +140,9 @@ func (s *Server) UnfreezeBanList(fblist *freezer.BanList) {
 		if fb.Duration != nil {
 			ban.Duration = *fb.Duration
 		}
+		if fb.Actor != nil {
+			ban.Actor = *fb.Actor
+		}
 
 		s.Bans = append(s.Bans, ban)
 	}
@@ -157,6 +160,7 @@ func FreezeBan(ban ban.Ban) (fb *freezer.Ban) {
 	fb.Reason = proto.String(ban.Reason)
 	fb.Start = proto.Int64(ban.Start)
 	fb.Duration = proto.Uint32(ban.Duration)
+	fb.Actor = proto.String(ban.Actor)
 	return
 }
 
@@ -171,6 +175,9 @@ func (channel *Channel) Freeze() (fc *freezer.Channel, err error) {
 		fc.ParentId = proto.Uint32(uint32(channel.parent.Id))
 	}
 	fc.Position = proto.Int64(int64(channel.Position))
+	fc.MaxUsers = proto.Uint32(uint32(channel.MaxUsers))
+	fc.EnterToken = proto.String(channel.EnterToken)
+	fc.TextMessageLimit = proto.Uint32(uint32(channel.TextMessageLimit))
 	fc.InheritAcl = proto.Bool(channel.ACL.InheritACL)
 
 	// Freeze the channel's ACLs
@@ -217,6 +224,15 @@ func (c *Channel) Unfreeze(fc *freezer.Channel) {
 	if fc.Position != nil {
 		c.Position = int(*fc.Position)
 	}
+	if fc.MaxUsers != nil {
+		c.MaxUsers = int(*fc.MaxUsers)
+	}
+	if fc.EnterToken != nil {
+		c.EnterToken = *fc.EnterToken
+	}
+	if fc.TextMessageLimit != nil {
+		c.TextMessageLimit = int(*fc.TextMessageLimit)
+	}
 	if fc.InheritAcl != nil {
 		c.ACL.InheritACL = *fc.InheritAcl
 	}
@@ -301,6 +317,7 @@ func (user *User) Freeze() (fu *freezer.User, err error) {
 	fu.CommentBlob = proto.String(user.CommentBlob)
 	fu.LastChannelId = proto.Uint32(uint32(user.LastChannelId))
 	fu.LastActive = proto.Uint64(user.LastActive)
+	fu.Approved = proto.Bool(user.Approved)
 
 	return
 }
@@ -328,6 +345,9 @@ func (u *User) Unfreeze(fu *freezer.User) {
 	if fu.LastActive != nil {
 		u.LastActive = *fu.LastActive
 	}
+	if fu.Approved != nil {
+		u.Approved = *fu.Approved
+	}
 }
 
 // Freeze a ChannelACL into it a flattened protobuf-based structure
@@ -716,15 +736,19 @@ func (server *Server) UpdateFrozenUser(client *Client, state *mumbleproto.UserSt
 	server.numLogOps += 1
 }
 
-// Update a user's last active channel
+// Update a user's last active channel. Like all writes to the freeze
+// log, this must happen on the server's handler goroutine, or once the
+// handler has stopped.
 func (server *Server) UpdateFrozenUserLastChannel(client *Client) {
 	if client.IsRegistered() {
 		user := client.user
+		user.LastChannelId = client.Channel.Id
+		user.LastActive = uint64(time.Now().Unix())
 
 		fu := &freezer.User{}
 		fu.Id = proto.Uint32(user.Id)
 		fu.LastChannelId = proto.Uint32(uint32(client.Channel.Id))
-		fu.LastActive = proto.Uint64(uint64(time.Now().Unix()))
+		fu.LastActive = proto.Uint64(user.LastActive)
 
 		err := server.freezelog.Put(fu)
 		if err != nil {
@@ -766,7 +790,10 @@ func (server *Server) UpdateFrozenChannel(channel *Channel, state *mumbleproto.C
 	if state.Position != nil {
 		fc.Position = proto.Int64(int64(*state.Position))
 	}
-	if len(state.DescriptionHash) > 0 {
+	if state.MaxUsers != nil {
+		fc.MaxUsers = state.MaxUsers
+	}
+	if state.Description != nil || len(state.DescriptionHash) > 0 {
 		fc.DescriptionBlob = proto.String(channel.DescriptionBlob)
 	}
 	err := server.freezelog.Put(fc)
@@ -776,6 +803,30 @@ func (server *Server) UpdateFrozenChannel(channel *Channel, state *mumbleproto.C
 	server.numLogOps += 1
 }
 
+// Write a channel's text message limit to the datastore.
+func (server *Server) UpdateFrozenChannelTextMessageLimit(channel *Channel) {
+	fc := &freezer.Channel{}
+	fc.Id = proto.Uint32(uint32(channel.Id))
+	fc.TextMessageLimit = proto.Uint32(uint32(channel.TextMessageLimit))
+	err := server.freezelog.Put(fc)
+	if err != nil {
+		server.Fatal(err)
+	}
+	server.numLogOps += 1
+}
+
+// Write a channel's enter token to the datastore.
+func (server *Server) UpdateFrozenChannelEnterToken(channel *Channel) {
+	fc := &freezer.Channel{}
+	fc.Id = proto.Uint32(uint32(channel.Id))
+	fc.EnterToken = proto.String(channel.EnterToken)
+	err := server.freezelog.Put(fc)
+	if err != nil {
+		server.Fatal(err)
+	}
+	server.numLogOps += 1
+}
+
 // Write a channel's ACL and Group data to disk. Mumble doesn't support
 // incremental ACL updates and as such we must write all ACLs and groups
 // to the datastore on each change.
@@ -859,3 +910,15 @@ func (server *Server) ResetConfig(key string) {
 	}
 	server.numLogOps += 1
 }
+
+// Update a user's approved state
+func (server *Server) UpdateFrozenUserApproved(user *User) {
+	fu := &freezer.User{}
+	fu.Id = proto.Uint32(user.Id)
+	fu.Approved = proto.Bool(user.Approved)
+	err := server.freezelog.Put(fu)
+	if err != nil {
+		server.Fatal(err)
+	}
+	server.numLogOps += 1
+}
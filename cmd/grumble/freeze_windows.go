@@ -19,6 +19,7 @@ func (server *Server) freezeToFile() (err error) {
 		if err != nil {
 			return err
 		}
+		server.freezelog = nil
 	}
 
 	// Make sure the whole server is synced to disk
@@ -13,8 +13,13 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sync"
+	"time"
 )
 
+// How long each server has to shut down when the process exits.
+const shutdownTimeout = 10 * time.Second
+
 var servers map[int64]*Server
 var blobStore blobstore.BlobStore
 
@@ -211,6 +216,14 @@ func main() {
 		}
 	}
 
+	// Serve the metrics of the servers, if enabled.
+	if Args.Metrics != "" {
+		err = startMetrics(Args.Metrics, servers)
+		if err != nil {
+			log.Printf("Unable to start metrics endpoint: %v", err)
+		}
+	}
+
 	// If any servers were loaded, launch the signal
 	// handler goroutine and sleep...
 	if len(servers) > 0 {
@@ -218,3 +231,22 @@ func main() {
 		select {}
 	}
 }
+
+// Shut down all running servers, at the same time, before the process
+// exits.
+func shutdownServers() {
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		if !server.isRunning() {
+			continue
+		}
+		wg.Add(1)
+		go func(server *Server) {
+			defer wg.Done()
+			if err := server.Shutdown(shutdownTimeout); err != nil {
+				log.Printf("Unable to shut down server %v: %v", server.Id, err)
+			}
+		}(server)
+	}
+	wg.Wait()
+}
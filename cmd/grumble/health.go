@@ -0,0 +1,79 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// How long a health check waits for the server's handler to respond.
+const healthProbeTimeout = 1 * time.Second
+
+// Start the server's health check endpoint, if the HealthCheckPort config
+// key is set. The endpoint is a plain HTTP server, meant for load
+// balancers and proxies, that answers every request with 200 OK while
+// the server is accepting connections and its handler is responsive, and
+// with 503 Service Unavailable otherwise.
+func (server *Server) startHealthCheck() error {
+	port := server.cfg.IntValue("HealthCheckPort")
+	if port == 0 {
+		return nil
+	}
+
+	l, err := net.Listen("tcp", net.JoinHostPort(server.HostAddress(), strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	server.healthsrv = &http.Server{
+		Handler: http.HandlerFunc(server.serveHealthCheck),
+	}
+	go server.healthsrv.Serve(l)
+
+	server.Printf("Health check listening on %v", l.Addr())
+	return nil
+}
+
+// Stop the server's health check endpoint, once the requests it is
+// serving have been answered.
+func (server *Server) stopHealthCheck() {
+	if server.healthsrv == nil {
+		return
+	}
+	err := server.healthsrv.Shutdown(context.Background())
+	if err != nil {
+		server.Printf("Unable to stop health check: %v", err)
+	}
+	server.healthsrv = nil
+}
+
+func (server *Server) serveHealthCheck(w http.ResponseWriter, r *http.Request) {
+	if !server.isHealthy() {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// Check whether the server is running, not shutting down, and its
+// handler goroutine is responsive. Called on the health check's
+// goroutines.
+func (server *Server) isHealthy() bool {
+	server.stopLock.RLock()
+	defer server.stopLock.RUnlock()
+	if server.stopping || server.healthProbe == nil {
+		return false
+	}
+	select {
+	case server.healthProbe <- struct{}{}:
+		return true
+	case <-time.After(healthProbeTimeout):
+		return false
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestHealthCheck(t *testing.T) {
+	defer setupTestDataDir(t)()
+
+	server := newTestServer(t)
+	healthPort := freeTestPort(t)
+	server.cfg.Set("Address", "127.0.0.1")
+	server.cfg.Set("Port", strconv.Itoa(freeTestPort(t)))
+	server.cfg.Set("HealthCheckPort", strconv.Itoa(healthPort))
+	url := "http://" + net.JoinHostPort("127.0.0.1", strconv.Itoa(healthPort)) + "/"
+
+	if err := server.Start(); err != nil {
+		t.Fatalf("unable to start server: %v", err)
+	}
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("unable to query health check: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected running server to be healthy, got %v", resp.Status)
+	}
+
+	// What the endpoint reports while Stop is shutting the server down.
+	server.stopLock.Lock()
+	server.stopping = true
+	server.stopLock.Unlock()
+	resp, err = http.Get(url)
+	if err != nil {
+		t.Fatalf("unable to query health check: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected stopping server to be unhealthy, got %v", resp.Status)
+	}
+
+	if err := server.Stop(); err != nil {
+		t.Fatalf("unable to stop server: %v", err)
+	}
+	if resp, err := http.Get(url); err == nil {
+		resp.Body.Close()
+		t.Errorf("Expected health check to stop with the server")
+	}
+}
+
+func TestHealthCheckDisabled(t *testing.T) {
+	server := newTestServer(t)
+	if err := server.startHealthCheck(); err != nil {
+		t.Fatalf("unable to start health check: %v", err)
+	}
+	if server.healthsrv != nil {
+		t.Errorf("Expected health check to be disabled by default")
+	}
+}
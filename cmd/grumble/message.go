@@ -5,7 +5,7 @@
 package main
 
 import (
-	"crypto/aes"
+	"bytes"
 	"crypto/tls"
 	"fmt"
 	"github.com/golang/protobuf/proto"
@@ -14,6 +14,7 @@ import (
 	"mumble.info/grumble/pkg/freezer"
 	"mumble.info/grumble/pkg/mumbleproto"
 	"net"
+	"strings"
 	"time"
 )
 
@@ -21,6 +22,10 @@ type Message struct {
 	buf    []byte
 	kind   uint16
 	client *Client
+
+	// The time at which the message was read from the client, on
+	// the server's clock.
+	received time.Time
 }
 
 type VoiceBroadcast struct {
@@ -32,45 +37,60 @@ type VoiceBroadcast struct {
 	buf []byte
 }
 
+// Unmarshal the body of msg, a message from client, into pb. If the body
+// is malformed, the client is disconnected and false is returned, in which
+// case the handler must drop the message.
+func (client *Client) unmarshalMessage(msg *Message, pb proto.Message) bool {
+	err := proto.Unmarshal(msg.buf, pb)
+	if err != nil {
+		name := strings.TrimPrefix(proto.MessageName(pb), "mumbleproto.")
+		client.Panicf("Unable to unmarshal %v message: %v", name, err)
+		return false
+	}
+	return true
+}
+
 func (server *Server) handleCryptSetup(client *Client, msg *Message) {
 	cs := &mumbleproto.CryptSetup{}
-	err := proto.Unmarshal(msg.buf, cs)
-	if err != nil {
-		client.Panic(err)
+	if !client.unmarshalMessage(msg, cs) {
 		return
 	}
 
 	// No client nonce. This means the client
-	// is requesting that we re-sync our nonces.
+	// is requesting that we re-sync our nonces. It is sent the
+	// nonce we encrypt with; that nonce is only ever incremented,
+	// so it is never reused.
 	if len(cs.ClientNonce) == 0 {
 		client.Printf("Requested crypt-nonce resync")
-		cs.ClientNonce = make([]byte, aes.BlockSize)
-		if copy(cs.ClientNonce, client.crypt.EncryptIV[0:]) != aes.BlockSize {
-			return
+		err := client.sendMessage(&mumbleproto.CryptSetup{
+			ServerNonce: append([]byte(nil), client.crypt.EncryptIV...),
+		})
+		if err != nil && err != errClientDisconnected {
+			client.Panicf("Unable to send crypt nonce: %v", err)
 		}
-		client.sendMessage(cs)
 	} else {
+		// The client tells us the nonce it encrypts with. Only
+		// our decrypt nonce follows it.
 		client.Printf("Received client nonce")
-		if len(cs.ClientNonce) != aes.BlockSize {
+		if err := client.crypt.SetDecryptIV(cs.ClientNonce); err != nil {
 			return
 		}
-
 		client.crypt.Resync += 1
-		if copy(client.crypt.DecryptIV[0:], cs.ClientNonce) != aes.BlockSize {
-			return
-		}
 		client.Printf("Crypt re-sync successful")
 	}
 }
 
 func (server *Server) handlePingMessage(client *Client, msg *Message) {
 	ping := &mumbleproto.Ping{}
-	err := proto.Unmarshal(msg.buf, ping)
-	if err != nil {
-		client.Panic(err)
+	if !client.unmarshalMessage(msg, ping) {
 		return
 	}
 
+	// The reply echoes the client's timestamp, which is on the
+	// client's clock, so only the time the ping was received is
+	// taken from ours.
+	client.touchPingAt(msg.received)
+
 	if ping.Good != nil {
 		client.crypt.RemoteGood = uint32(*ping.Good)
 	}
@@ -115,9 +135,7 @@ func (server *Server) handlePingMessage(client *Client, msg *Message) {
 
 func (server *Server) handleChannelRemoveMessage(client *Client, msg *Message) {
 	chanremove := &mumbleproto.ChannelRemove{}
-	err := proto.Unmarshal(msg.buf, chanremove)
-	if err != nil {
-		client.Panic(err)
+	if !client.unmarshalMessage(msg, chanremove) {
 		return
 	}
 
@@ -146,9 +164,7 @@ func (server *Server) handleChannelRemoveMessage(client *Client, msg *Message) {
 // Handle channel state change.
 func (server *Server) handleChannelStateMessage(client *Client, msg *Message) {
 	chanstate := &mumbleproto.ChannelState{}
-	err := proto.Unmarshal(msg.buf, chanstate)
-	if err != nil {
-		client.Panic(err)
+	if !client.unmarshalMessage(msg, chanstate) {
 		return
 	}
 
@@ -174,14 +190,10 @@ func (server *Server) handleChannelStateMessage(client *Client, msg *Message) {
 		}
 	}
 
-	// The server can't receive links through the links field in the ChannelState message,
-	// because clients are supposed to send modifications to a channel's link state through
-	// the links_add and links_remove fields.
-	// Make sure the links field is clear so we can transmit the channel's link state in our reply.
-	chanstate.Links = nil
-
 	var name string
 	var description string
+	var update *mumbleproto.ChannelState
+	var err error
 
 	// Extract the description and perform sanity checks.
 	if chanstate.Description != nil {
@@ -190,26 +202,42 @@ func (server *Server) handleChannelStateMessage(client *Client, msg *Message) {
 			client.sendPermissionDeniedType(mumbleproto.PermissionDenied_TextTooLong)
 			return
 		}
+		max := server.cfg.IntValue("MaxChannelDescriptionLength")
+		if max > 0 && len(description) > max {
+			client.sendPermissionDeniedType(mumbleproto.PermissionDenied_TextTooLong)
+			return
+		}
 	}
 
 	// Extract the the name of channel and check whether it's valid.
 	// A valid channel name is a name that:
 	//  a) Isn't already used by a channel at the same level as the channel itself (that is, channels
 	//     that have a common parent can't have the same name.
-	//  b) A name must be a valid name on the server (it must pass the channel name regexp)
+	//  b) A name must be a valid name on the server (it must pass the channel name regexp, and
+	//     must not be longer than the server's maximum channel name length)
 	if chanstate.Name != nil {
 		name = *chanstate.Name
 
 		// We don't allow renames for the root channel.
-		if channel != nil && channel.Id != 0 {
+		if channel == nil || channel.Id != 0 {
+			if !server.isValidChannelName(name) {
+				client.sendPermissionDeniedType(mumbleproto.PermissionDenied_ChannelName)
+				return
+			}
+
 			// Pick a parent. If the name change is part of a re-parent (a channel move),
 			// we must evaluate the parent variable. Since we're explicitly exlcuding the root
 			// channel from renames, channels that are the target of renames are guaranteed to have
-			// a parent.
+			// a parent. Channels that are being created must have one, too; if they don't, the
+			// create operation is denied below.
 			evalp := parent
-			if evalp == nil {
+			if evalp == nil && channel != nil {
 				evalp = channel.parent
 			}
+			if evalp == nil {
+				client.sendPermissionDeniedText("Channels must be created in an existing channel")
+				return
+			}
 			for _, iter := range evalp.children {
 				if iter.Name == name {
 					client.sendPermissionDeniedType(mumbleproto.PermissionDenied_ChannelName)
@@ -221,13 +249,19 @@ func (server *Server) handleChannelStateMessage(client *Client, msg *Message) {
 
 	// If the channel does not exist already, the ChannelState message is a create operation.
 	if channel == nil {
-		if parent == nil || len(name) == 0 {
+		// The root channel is the only channel without a parent, and it
+		// is owned by the server.
+		if parent == nil {
+			client.sendPermissionDeniedText("Channels must be created in an existing channel")
+			return
+		}
+		if len(name) == 0 {
 			return
 		}
 
 		// Check whether the client has permission to create the channel in parent.
 		perm := acl.Permission(acl.NonePermission)
-		if *chanstate.Temporary {
+		if chanstate.GetTemporary() {
 			perm = acl.Permission(acl.TempChannelPermission)
 		} else {
 			perm = acl.Permission(acl.MakeChannelPermission)
@@ -243,12 +277,31 @@ func (server *Server) handleChannelStateMessage(client *Client, msg *Message) {
 			return
 		}
 
-		// We can't add channels to a temporary channel
-		if parent.IsTemporary() {
+		if !server.canNestChannel(parent, chanstate.GetTemporary()) {
 			client.sendPermissionDeniedType(mumbleproto.PermissionDenied_TemporaryChannel)
 			return
 		}
 
+		// Enforce the server's channel limits. Temporary channels are
+		// also limited per creator, so that a single user can't use up
+		// all of the server's channels.
+		maxChannels := server.cfg.IntValue("MaxChannels")
+		if maxChannels > 0 && len(server.Channels) >= maxChannels {
+			client.sendPermissionDeniedText("Channel count limit reached")
+			return
+		}
+		if chanstate.GetTemporary() {
+			maxTemp := server.cfg.IntValue("MaxTemporaryChannelsPerUser")
+			if maxTemp > 0 && server.temporaryChannelCount(client) >= maxTemp {
+				client.sendPermissionDeniedText("Temporary channel limit reached")
+				return
+			}
+		}
+		if !server.allowChannelCreate(client, chanstate.GetTemporary()) {
+			client.sendPermissionDeniedText("Channel creation rate limit reached")
+			return
+		}
+
 		key := ""
 		if len(description) > 0 {
 			key, err = blobStore.Put([]byte(description))
@@ -260,8 +313,12 @@ func (server *Server) handleChannelStateMessage(client *Client, msg *Message) {
 		// Add the new channel
 		channel = server.AddChannel(name)
 		channel.DescriptionBlob = key
-		channel.temporary = *chanstate.Temporary
-		channel.Position = int(*chanstate.Position)
+		channel.temporary = chanstate.GetTemporary()
+		if channel.temporary {
+			channel.creator = client
+		}
+		channel.Position = int(chanstate.GetPosition())
+		channel.MaxUsers = int(chanstate.GetMaxUsers())
 		parent.AddChild(channel)
 
 		// Add the creator to the channel's admin group
@@ -280,6 +337,7 @@ func (server *Server) handleChannelStateMessage(client *Client, msg *Message) {
 			if client.IsRegistered() {
 				aclEntry.UserId = client.UserId()
 			} else {
+				aclEntry.UserId = -1
 				aclEntry.Group = "$" + client.CertHash()
 			}
 			aclEntry.Deny = acl.Permission(acl.NonePermission)
@@ -290,29 +348,35 @@ func (server *Server) handleChannelStateMessage(client *Client, msg *Message) {
 			server.ClearCaches()
 		}
 
-		chanstate.ChannelId = proto.Uint32(uint32(channel.Id))
+		// Describe the new channel. Only the fields the channel was
+		// created with are sent, rather than what the client sent us.
+		update = &mumbleproto.ChannelState{
+			ChannelId: proto.Uint32(uint32(channel.Id)),
+			Parent:    proto.Uint32(uint32(parent.Id)),
+			Name:      proto.String(channel.Name),
+			Position:  proto.Int32(int32(channel.Position)),
+		}
+		if channel.temporary {
+			update.Temporary = proto.Bool(true)
+		}
+		if channel.MaxUsers != 0 {
+			update.MaxUsers = proto.Uint32(uint32(channel.MaxUsers))
+		}
+		if channel.HasDescription() {
+			update.Description = proto.String(description)
+		}
 
 		// Broadcast channel add
-		server.broadcastProtoMessageWithPredicate(chanstate, func(client *Client) bool {
-			return client.Version < 0x10202
-		})
-
-		// Remove description if client knows how to handle blobs.
-		if chanstate.Description != nil && channel.HasDescription() {
-			chanstate.Description = nil
-			chanstate.DescriptionHash = channel.DescriptionBlobHashBytes()
-		}
-		server.broadcastProtoMessageWithPredicate(chanstate, func(client *Client) bool {
-			return client.Version >= 0x10202
-		})
+		server.broadcastChannelUpdate(channel, update)
 
 		// If it's a temporary channel, move the creator in there.
 		if channel.IsTemporary() {
 			userstate := &mumbleproto.UserState{}
 			userstate.Session = proto.Uint32(client.Session())
 			userstate.ChannelId = proto.Uint32(uint32(channel.Id))
+			oldchan := client.Channel
 			server.userEnterChannel(client, channel, userstate)
-			server.broadcastProtoMessage(userstate)
+			server.broadcastProtoMessageWithPredicate(userstate, server.userStateRecipients(client, oldchan))
 		}
 	} else {
 		// Edit existing channel.
@@ -344,13 +408,21 @@ func (server *Server) handleChannelStateMessage(client *Client, msg *Message) {
 			}
 		}
 
-		// Parent change (channel move)
-		if parent != nil {
-			// No-op?
-			if parent == channel.parent {
+		// User limit change
+		if chanstate.MaxUsers != nil {
+			if !acl.HasPermission(&channel.ACL, client, acl.WritePermission) {
+				client.sendPermissionDenied(client, channel, acl.WritePermission)
 				return
 			}
+		}
+
+		// Moving a channel to its current parent is a no-op.
+		if parent == channel.parent {
+			parent = nil
+		}
 
+		// Parent change (channel move)
+		if parent != nil {
 			// Make sure that channel we're operating on is not a parent of the new parent.
 			iter := parent
 			for iter != nil {
@@ -361,8 +433,7 @@ func (server *Server) handleChannelStateMessage(client *Client, msg *Message) {
 				iter = iter.parent
 			}
 
-			// A temporary channel must not have any subchannels, so deny it.
-			if parent.IsTemporary() {
+			if !server.canNestChannel(parent, channel.IsTemporary()) {
 				client.sendPermissionDeniedType(mumbleproto.PermissionDenied_TemporaryChannel)
 				return
 			}
@@ -417,74 +488,123 @@ func (server *Server) handleChannelStateMessage(client *Client, msg *Message) {
 
 		// Permission checks done!
 
+		// Only the fields that actually change are sent to the other
+		// clients, which apply them to their copy of the channel.
+		update = &mumbleproto.ChannelState{
+			ChannelId: proto.Uint32(uint32(channel.Id)),
+		}
+		changed := false
+
 		// Channel move
 		if parent != nil {
 			channel.parent.RemoveChild(channel)
 			parent.AddChild(channel)
+			update.Parent = proto.Uint32(uint32(parent.Id))
+			changed = true
 		}
 
 		// Rename
-		if chanstate.Name != nil {
-			channel.Name = *chanstate.Name
+		if chanstate.Name != nil && name != channel.Name {
+			channel.Name = name
+			update.Name = proto.String(name)
+			changed = true
 		}
 
 		// Description change
 		if chanstate.Description != nil {
-			if len(description) == 0 {
-				channel.DescriptionBlob = ""
-			} else {
-				key, err := blobStore.Put([]byte(description))
+			key := ""
+			if len(description) > 0 {
+				key, err = blobStore.Put([]byte(description))
 				if err != nil {
 					server.Panicf("Blobstore error: %v", err)
 				}
+			}
+			if key != channel.DescriptionBlob {
 				channel.DescriptionBlob = key
+				update.Description = proto.String(description)
+				changed = true
 			}
 		}
 
 		// Position change
-		if chanstate.Position != nil {
+		if chanstate.Position != nil && int(*chanstate.Position) != channel.Position {
 			channel.Position = int(*chanstate.Position)
+			update.Position = chanstate.Position
+			changed = true
+		}
+
+		// User limit change
+		if chanstate.MaxUsers != nil && int(*chanstate.MaxUsers) != channel.MaxUsers {
+			channel.MaxUsers = int(*chanstate.MaxUsers)
+			update.MaxUsers = chanstate.MaxUsers
+			changed = true
 		}
 
 		// Add links
 		for _, iter := range linkadd {
+			if _, linked := channel.Links[iter.Id]; linked {
+				continue
+			}
 			server.LinkChannels(channel, iter)
+			update.LinksAdd = append(update.LinksAdd, uint32(iter.Id))
+			changed = true
 		}
 
 		// Remove links
 		for _, iter := range linkremove {
+			if _, linked := channel.Links[iter.Id]; !linked {
+				continue
+			}
 			server.UnlinkChannels(channel, iter)
+			update.LinksRemove = append(update.LinksRemove, uint32(iter.Id))
+			changed = true
+		}
+
+		if !changed {
+			return
 		}
 
 		// Broadcast the update
-		server.broadcastProtoMessageWithPredicate(chanstate, func(client *Client) bool {
-			return client.Version < 0x10202
-		})
+		server.broadcastChannelUpdate(channel, update)
 
-		// Remove description blob when sending to 1.2.2 >= users. Only send the blob hash.
-		if channel.HasDescription() {
-			chanstate.Description = nil
-			chanstate.DescriptionHash = channel.DescriptionBlobHashBytes()
+		// The moved channels now inherit ACLs and groups from
+		// their new parent, and voice targets may have cached
+		// them as subchannels of their old one.
+		if parent != nil {
+			server.ClearCaches()
+			server.flushChannelPermissions(channel)
 		}
-		chanstate.DescriptionHash = channel.DescriptionBlobHashBytes()
-		server.broadcastProtoMessageWithPredicate(chanstate, func(client *Client) bool {
-			return client.Version >= 0x10202
-		})
 	}
 
 	// Update channel in datastore
 	if !channel.IsTemporary() {
-		server.UpdateFrozenChannel(channel, chanstate)
+		server.UpdateFrozenChannel(channel, update)
 	}
 }
 
+// Broadcast update, a ChannelState describing changes to channel, to all
+// clients. Clients that know how to handle description blobs are only sent
+// the hash of a description that is too long to send inline; they request
+// the description itself when they need it.
+func (server *Server) broadcastChannelUpdate(channel *Channel, update *mumbleproto.ChannelState) {
+	server.broadcastProtoMessageWithPredicate(update, func(client *Client) bool {
+		return client.Version < 0x10202
+	})
+
+	if update.Description != nil && channel.HasDescription() && !server.inlineDescription(*update.Description) {
+		update.Description = nil
+		update.DescriptionHash = channel.DescriptionBlobHashBytes()
+	}
+	server.broadcastProtoMessageWithPredicate(update, func(client *Client) bool {
+		return client.Version >= 0x10202
+	})
+}
+
 // Handle a user remove packet. This can either be a client disconnecting, or a
 // user kicking or kick-banning another player.
 func (server *Server) handleUserRemoveMessage(client *Client, msg *Message) {
 	userremove := &mumbleproto.UserRemove{}
-	err := proto.Unmarshal(msg.buf, userremove)
-	if err != nil {
-		client.Panic(err)
+	if !client.unmarshalMessage(msg, userremove) {
 		return
 	}
 
@@ -522,6 +642,7 @@ func (server *Server) handleUserRemoveMessage(client *Client, msg *Message) {
 		ban.CertHash = removeClient.CertHash()
 		ban.Start = time.Now().Unix()
 		ban.Duration = 0
+		ban.Actor = client.ShownName()
 
 		server.banlock.Lock()
 		server.Bans = append(server.Bans, ban)
@@ -530,7 +651,7 @@ func (server *Server) handleUserRemoveMessage(client *Client, msg *Message) {
 	}
 
 	userremove.Actor = proto.Uint32(uint32(client.Session()))
-	if err = server.broadcastProtoMessage(userremove); err != nil {
+	if err := server.broadcastProtoMessageWithPredicate(userremove, server.userStateRecipients(removeClient, nil)); err != nil {
 		server.Panicf("Unable to broadcast UserRemove message")
 		return
 	}
@@ -541,15 +662,27 @@ func (server *Server) handleUserRemoveMessage(client *Client, msg *Message) {
 		client.Printf("Kicked %v (%v)", removeClient.ShownName(), removeClient.Session())
 	}
 
+	reason := "kicked"
+	if isBan {
+		reason = "banned"
+	}
+	reason = fmt.Sprintf("%v by %v (%v)", reason, client.ShownName(), client.Session())
+	if userremove.Reason != nil && len(*userremove.Reason) > 0 {
+		reason += ": " + *userremove.Reason
+	}
+	removeClient.setDisconnectReason(reason)
+	if isBan {
+		removeClient.classifyDisconnect(DisconnectBanned.String())
+	} else {
+		removeClient.classifyDisconnect(DisconnectKicked.String())
+	}
 	removeClient.ForceDisconnect()
 }
 
 // Handle user state changes
 func (server *Server) handleUserStateMessage(client *Client, msg *Message) {
 	userstate := &mumbleproto.UserState{}
-	err := proto.Unmarshal(msg.buf, userstate)
-	if err != nil {
-		client.Panic(err)
+	if !client.unmarshalMessage(msg, userstate) {
 		return
 	}
 
@@ -578,22 +711,44 @@ func (server *Server) handleUserStateMessage(client *Client, msg *Message) {
 			return
 		}
 
-		// If the user and the actor aren't the same, check whether the actor has MovePermission on
-		// the user's curent channel.
+		// Pinned users can't move themselves, and queued users can't
+		// leave the queue channel. Their client may already show them
+		// in dstChan, so they are snapped back.
+		if actor == target && (target.pinned || target.queued) && dstChan != target.Channel {
+			if target.queued {
+				client.sendPermissionDeniedText("You are waiting for a free slot on the server")
+			} else {
+				client.sendPermissionDeniedText("You have been pinned to your channel by a moderator")
+			}
+			err := client.sendMessage(&mumbleproto.UserState{
+				Session:   proto.Uint32(target.Session()),
+				ChannelId: proto.Uint32(uint32(target.Channel.Id)),
+			})
+			if err != nil && err != errClientDisconnected {
+				client.Panicf("%v", err)
+			}
+			return
+		}
+
+		// Queued users are let in as slots free up, not by moderators.
+		if actor != target && target.queued && dstChan != target.Channel {
+			client.sendPermissionDeniedText("That user is waiting for a free slot on the server")
+			return
+		}
+
+		// A user moving someone else needs MovePermission on the
+		// user's current channel. Either way, the moved user must be
+		// allowed to enter dstChan.
 		if actor != target && !acl.HasPermission(&target.Channel.ACL, actor, acl.MovePermission) {
 			client.sendPermissionDenied(actor, target.Channel, acl.MovePermission)
 			return
 		}
-
-		// Check whether the actor has MovePermission on dstChan.  Check whether user has EnterPermission
-		// on dstChan.
-		if !acl.HasPermission(&dstChan.ACL, actor, acl.MovePermission) && !acl.HasPermission(&dstChan.ACL, target, acl.EnterPermission) {
+		if !dstChan.CanEnter(target) {
 			client.sendPermissionDenied(target, dstChan, acl.EnterPermission)
 			return
 		}
 
-		maxChannelUsers := server.cfg.IntValue("MaxChannelUsers")
-		if maxChannelUsers != 0 && len(dstChan.clients) >= maxChannelUsers {
+		if server.IsChannelFull(dstChan) {
 			client.sendPermissionDeniedFallback(mumbleproto.PermissionDenied_ChannelFull,
 				0x010201, "Channel is full")
 			return
@@ -678,6 +833,10 @@ func (server *Server) handleUserStateMessage(client *Client, msg *Message) {
 			client.sendPermissionDeniedTypeUser(mumbleproto.PermissionDenied_MissingCertificate, target)
 			return
 		}
+		if server.cfg.BoolValue("RegisterRequiresStrongCertificate") && !target.IsVerified() {
+			client.sendPermissionDeniedText("Registration requires a certificate signed by a trusted CA")
+			return
+		}
 	}
 
 	// Prevent self-targetting state changes to be applied to other users
@@ -732,11 +891,21 @@ func (server *Server) handleUserStateMessage(client *Client, msg *Message) {
 	}
 
 	if userstate.PluginContext != nil {
-		target.PluginContext = userstate.PluginContext
+		if !bytes.Equal(target.PluginContext, userstate.PluginContext) {
+			target.PluginContext = userstate.PluginContext
+			broadcast = true
+		} else {
+			userstate.PluginContext = nil
+		}
 	}
 
 	if userstate.PluginIdentity != nil {
-		target.PluginIdentity = *userstate.PluginIdentity
+		if target.PluginIdentity != *userstate.PluginIdentity {
+			target.PluginIdentity = *userstate.PluginIdentity
+			broadcast = true
+		} else {
+			userstate.PluginIdentity = nil
+		}
 	}
 
 	if userstate.Comment != nil && target.user != nil {
@@ -776,6 +945,7 @@ func (server *Server) handleUserStateMessage(client *Client, msg *Message) {
 		}
 		broadcast = true
 	}
+	target.updateVoiceMuted()
 
 	if userstate.Recording != nil && *userstate.Recording != target.Recording {
 		target.Recording = *userstate.Recording
@@ -789,7 +959,7 @@ func (server *Server) handleUserStateMessage(client *Client, msg *Message) {
 		}
 
 		server.broadcastProtoMessageWithPredicate(txtmsg, func(client *Client) bool {
-			return client.Version < 0x10203
+			return client.Version < 0x10203 && server.canSeeUser(client, target)
 		})
 
 		broadcast = true
@@ -797,27 +967,39 @@ func (server *Server) handleUserStateMessage(client *Client, msg *Message) {
 
 	userRegistrationChanged := false
 	if userstate.UserId != nil {
+		seen := server.visibleUsers(target)
 		uid, err := server.RegisterClient(target)
 		if err != nil {
 			client.Printf("Unable to register: %v", err)
 			userstate.UserId = nil
 		} else {
 			userstate.UserId = proto.Uint32(uid)
-			client.user = server.Users[uid]
+			target.user = server.Users[uid]
 			userRegistrationChanged = true
+
+			// ACL entries can name the user by its user id, so
+			// it may see more, or less, than before.
+			server.refreshView(target, seen)
 		}
 		broadcast = true
 	}
 
+	// Clients that couldn't see target before it moved are sent its full
+	// state instead of the update.
+	oldchan := target.Channel
 	if userstate.ChannelId != nil {
 		channel, ok := server.Channels[int(*userstate.ChannelId)]
 		if ok {
+			channel = server.talkRoomFor(channel)
+			userstate.ChannelId = proto.Uint32(uint32(channel.Id))
 			server.userEnterChannel(target, channel, userstate)
 			broadcast = true
 		}
 	}
 
 	if broadcast {
+		recipients := server.userStateRecipients(target, oldchan)
+
 		// This variable denotes the length of a zlib-encoded "old-style" texture.
 		// Mumble and Murmur used qCompress and qUncompress from Qt to compress
 		// textures that were sent over the wire. We can use this to determine
@@ -832,7 +1014,7 @@ func (server *Server) handleUserStateMessage(client *Client, msg *Message) {
 			// we send to pre-1.2.2 clients.
 			userstate.Texture = nil
 			err := server.broadcastProtoMessageWithPredicate(userstate, func(client *Client) bool {
-				return client.Version < 0x10202
+				return client.Version < 0x10202 && recipients(client)
 			})
 			if err != nil {
 				server.Panic("Unable to broadcast UserState")
@@ -842,7 +1024,7 @@ func (server *Server) handleUserStateMessage(client *Client, msg *Message) {
 		} else {
 			// Old style texture.  We can send the message as-is.
 			err := server.broadcastProtoMessageWithPredicate(userstate, func(client *Client) bool {
-				return client.Version < 0x10202
+				return client.Version < 0x10202 && recipients(client)
 			})
 			if err != nil {
 				server.Panic("Unable to broadcast UserState")
@@ -869,12 +1051,15 @@ func (server *Server) handleUserStateMessage(client *Client, msg *Message) {
 			userstate.CommentHash = nil
 		}
 
+		// Registration puts the user in the auth group, and ACL
+		// entries can name it by its user id.
 		if userRegistrationChanged {
 			server.ClearCaches()
+			server.flushPermissions(target)
 		}
 
 		err := server.broadcastProtoMessageWithPredicate(userstate, func(client *Client) bool {
-			return client.Version >= 0x10203
+			return client.Version >= 0x10203 && recipients(client)
 		})
 		if err != nil {
 			server.Panic("Unable to broadcast UserState")
@@ -888,9 +1073,7 @@ func (server *Server) handleUserStateMessage(client *Client, msg *Message) {
 
 func (server *Server) handleBanListMessage(client *Client, msg *Message) {
 	banlist := &mumbleproto.BanList{}
-	err := proto.Unmarshal(msg.buf, banlist)
-	if err != nil {
-		client.Panic(err)
+	if !client.unmarshalMessage(msg, banlist) {
 		return
 	}
 
@@ -924,7 +1107,10 @@ func (server *Server) handleBanListMessage(client *Client, msg *Message) {
 		server.banlock.Lock()
 		defer server.banlock.Unlock()
 
-		server.Bans = server.Bans[0:0]
+		// Clients don't know who created each ban, so keep the actor
+		// of the bans that are resubmitted.
+		oldBans := server.Bans
+		server.Bans = nil
 		for _, entry := range banlist.Bans {
 			ban := ban.Ban{}
 			ban.IP = entry.Address
@@ -944,6 +1130,13 @@ func (server *Server) handleBanListMessage(client *Client, msg *Message) {
 			if entry.Duration != nil {
 				ban.Duration = *entry.Duration
 			}
+			ban.Actor = client.ShownName()
+			for _, old := range oldBans {
+				if old.SameTarget(ban) {
+					ban.Actor = old.Actor
+					break
+				}
+			}
 			server.Bans = append(server.Bans, ban)
 		}
 
@@ -956,9 +1149,7 @@ func (server *Server) handleBanListMessage(client *Client, msg *Message) {
 // Broadcast text messages
 func (server *Server) handleTextMessage(client *Client, msg *Message) {
 	txtmsg := &mumbleproto.TextMessage{}
-	err := proto.Unmarshal(msg.buf, txtmsg)
-	if err != nil {
-		client.Panic(err)
+	if !client.unmarshalMessage(msg, txtmsg) {
 		return
 	}
 
@@ -983,6 +1174,10 @@ func (server *Server) handleTextMessage(client *Client, msg *Message) {
 				client.sendPermissionDenied(client, channel, acl.TextMessagePermission)
 				return
 			}
+			if !server.allowChannelText(client, channel) {
+				client.sendPermissionDeniedText("You are sending messages to " + channel.Name + " too quickly. Wait a moment and try again.")
+				return
+			}
 			for _, target := range channel.clients {
 				clients[target.Session()] = target
 			}
@@ -996,6 +1191,10 @@ func (server *Server) handleTextMessage(client *Client, msg *Message) {
 				client.sendPermissionDenied(client, channel, acl.TextMessagePermission)
 				return
 			}
+			if !server.allowChannelText(client, channel) {
+				client.sendPermissionDeniedText("You are sending messages to " + channel.Name + " too quickly. Wait a moment and try again.")
+				return
+			}
 			for _, target := range channel.clients {
 				clients[target.Session()] = target
 			}
@@ -1013,6 +1212,14 @@ func (server *Server) handleTextMessage(client *Client, msg *Message) {
 		}
 	}
 
+	filtered, ok := server.runTextFilters(client, txtmsg.GetMessage())
+	if !ok {
+		return
+	}
+	txtmsg.Message = proto.String(filtered)
+
+	server.logTextMessage(client, txtmsg)
+
 	// Remove ourselves
 	delete(clients, client.Session())
 
@@ -1027,9 +1234,7 @@ func (server *Server) handleTextMessage(client *Client, msg *Message) {
 // ACL set/query
 func (server *Server) handleAclMessage(client *Client, msg *Message) {
 	pacl := &mumbleproto.ACL{}
-	err := proto.Unmarshal(msg.buf, pacl)
-	if err != nil {
-		client.Panic(err)
+	if !client.unmarshalMessage(msg, pacl) {
 		return
 	}
 
@@ -1105,7 +1310,7 @@ func (server *Server) handleAclMessage(client *Client, msg *Message) {
 
 			group, hasgroup = channel.ACL.Groups[name]
 			if parent != nil {
-				pgroup, haspgroup = parent.ACL.Groups[name]
+				pgroup, haspgroup = parent.ACL.LookupGroup(name)
 			}
 
 			mpgroup := &mumbleproto.ACL_ChanGroup{}
@@ -1127,17 +1332,13 @@ func (server *Server) handleAclMessage(client *Client, msg *Message) {
 			// This is used later on in this function to send the client a QueryUsers
 			// message that maps user ids to usernames.
 			if hasgroup {
-				toadd := map[int]bool{}
 				for uid, _ := range group.Add {
 					users[uid] = true
-					toadd[uid] = true
+					mpgroup.Add = append(mpgroup.Add, uint32(uid))
 				}
 				for uid, _ := range group.Remove {
 					users[uid] = true
-					delete(toadd, uid)
-				}
-				for uid, _ := range toadd {
-					mpgroup.Add = append(mpgroup.Add, uint32(uid))
+					mpgroup.Remove = append(mpgroup.Remove, uint32(uid))
 				}
 			}
 			if haspgroup {
@@ -1172,6 +1373,8 @@ func (server *Server) handleAclMessage(client *Client, msg *Message) {
 
 		// Set new groups and ACLs
 	} else {
+		// What each client can see may change with the ACLs.
+		views := server.allVisibleUsers()
 
 		// Get old temporary members
 		oldtmp := map[string]map[int]bool{}
@@ -1184,19 +1387,19 @@ func (server *Server) handleAclMessage(client *Client, msg *Message) {
 		channel.ACL.Groups = map[string]acl.Group{}
 
 		// Add the received groups to the channel.
-		channel.ACL.InheritACL = *pacl.InheritAcls
+		channel.ACL.InheritACL = pacl.GetInheritAcls()
 		for _, pbgrp := range pacl.Groups {
-			changroup := acl.EmptyGroupWithName(*pbgrp.Name)
+			changroup := acl.EmptyGroupWithName(pbgrp.GetName())
 
-			changroup.Inherit = *pbgrp.Inherit
-			changroup.Inheritable = *pbgrp.Inheritable
+			changroup.Inherit = pbgrp.GetInherit()
+			changroup.Inheritable = pbgrp.GetInheritable()
 			for _, uid := range pbgrp.Add {
 				changroup.Add[int(uid)] = true
 			}
 			for _, uid := range pbgrp.Remove {
 				changroup.Remove[int(uid)] = true
 			}
-			if temp, ok := oldtmp[*pbgrp.Name]; ok {
+			if temp, ok := oldtmp[pbgrp.GetName()]; ok {
 				changroup.Temporary = temp
 			}
 
@@ -1205,15 +1408,16 @@ func (server *Server) handleAclMessage(client *Client, msg *Message) {
 		// Add the received ACLs to the channel.
 		for _, pbacl := range pacl.Acls {
 			chanacl := acl.ACL{}
-			chanacl.ApplyHere = *pbacl.ApplyHere
-			chanacl.ApplySubs = *pbacl.ApplySubs
+			chanacl.ApplyHere = pbacl.GetApplyHere()
+			chanacl.ApplySubs = pbacl.GetApplySubs()
 			if pbacl.UserId != nil {
 				chanacl.UserId = int(*pbacl.UserId)
 			} else {
-				chanacl.Group = *pbacl.Group
+				chanacl.UserId = -1
+				chanacl.Group = pbacl.GetGroup()
 			}
-			chanacl.Deny = acl.Permission(*pbacl.Deny & acl.AllPermissions)
-			chanacl.Allow = acl.Permission(*pbacl.Grant & acl.AllPermissions)
+			chanacl.Deny = acl.Permission(pbacl.GetDeny() & acl.AllPermissions)
+			chanacl.Allow = acl.Permission(pbacl.GetGrant() & acl.AllPermissions)
 
 			channel.ACL.ACLs = append(channel.ACL.ACLs, chanacl)
 		}
@@ -1222,13 +1426,14 @@ func (server *Server) handleAclMessage(client *Client, msg *Message) {
 		server.ClearCaches()
 
 		// Regular user?
-		if !acl.HasPermission(&channel.ACL, client, acl.WritePermission) && client.IsRegistered() || client.HasCertificate() {
+		if !acl.HasPermission(&channel.ACL, client, acl.WritePermission) && (client.IsRegistered() || client.HasCertificate()) {
 			chanacl := acl.ACL{}
 			chanacl.ApplyHere = true
 			chanacl.ApplySubs = false
 			if client.IsRegistered() {
 				chanacl.UserId = client.UserId()
 			} else if client.HasCertificate() {
+				chanacl.UserId = -1
 				chanacl.Group = "$" + client.CertHash()
 			}
 			chanacl.Deny = acl.Permission(acl.NonePermission)
@@ -1241,15 +1446,16 @@ func (server *Server) handleAclMessage(client *Client, msg *Message) {
 
 		// Update freezer
 		server.UpdateFrozenChannelACLs(channel)
+
+		server.flushChannelPermissions(channel)
+		server.refreshViews(views)
 	}
 }
 
 // User query
 func (server *Server) handleQueryUsers(client *Client, msg *Message) {
 	query := &mumbleproto.QueryUsers{}
-	err := proto.Unmarshal(msg.buf, query)
-	if err != nil {
-		client.Panic(err)
+	if !client.unmarshalMessage(msg, query) {
 		return
 	}
 
@@ -1283,9 +1489,7 @@ func (server *Server) handleQueryUsers(client *Client, msg *Message) {
 // user right clicks a user and selects 'User Information'.
 func (server *Server) handleUserStatsMessage(client *Client, msg *Message) {
 	stats := &mumbleproto.UserStats{}
-	err := proto.Unmarshal(msg.buf, stats)
-	if err != nil {
-		client.Panic(err)
+	if !client.unmarshalMessage(msg, stats) {
 		return
 	}
 
@@ -1328,13 +1532,13 @@ func (server *Server) handleUserStatsMessage(client *Client, msg *Message) {
 	stats.Session = proto.Uint32(target.Session())
 
 	if details {
-		if tlsconn := target.conn.(*tls.Conn); tlsconn != nil {
+		if tlsconn, ok := target.conn.(*tls.Conn); ok {
 			state := tlsconn.ConnectionState()
 			for i := len(state.PeerCertificates) - 1; i >= 0; i-- {
 				stats.Certificates = append(stats.Certificates, state.PeerCertificates[i].Raw)
 			}
-			stats.StrongCertificate = proto.Bool(target.IsVerified())
 		}
+		stats.StrongCertificate = proto.Bool(target.IsVerified())
 	}
 
 	if local {
@@ -1389,9 +1593,7 @@ func (server *Server) handleUserStatsMessage(client *Client, msg *Message) {
 // Voice target message
 func (server *Server) handleVoiceTarget(client *Client, msg *Message) {
 	vt := &mumbleproto.VoiceTarget{}
-	err := proto.Unmarshal(msg.buf, vt)
-	if err != nil {
-		client.Panic(err.Error())
+	if !client.unmarshalMessage(msg, vt) {
 		return
 	}
 
@@ -1401,15 +1603,20 @@ func (server *Server) handleVoiceTarget(client *Client, msg *Message) {
 
 	id := *vt.Id
 	if id < 1 || id >= 0x1f {
+		client.logRepeatedf("ignored voice target with invalid id %v", id)
 		return
 	}
-
-	if len(vt.Targets) == 0 {
+	if !server.allowVoiceTargetUpdate(client) {
+		// The client no longer talks to the target it had before, but
+		// we don't know what it asked for instead, so the target is
+		// dropped rather than left to reach its old recipients.
 		delete(client.voiceTargets, id)
+		return
 	}
 
+	// The entries of the message together make up the voice target.
+	newTarget := &VoiceTarget{}
 	for _, target := range vt.Targets {
-		newTarget := &VoiceTarget{}
 		for _, session := range target.Session {
 			newTarget.AddSession(session)
 		}
@@ -1429,20 +1636,38 @@ func (server *Server) handleVoiceTarget(client *Client, msg *Message) {
 			}
 			newTarget.AddChannel(chanid, subchannels, links, group)
 		}
-		if newTarget.IsEmpty() {
-			delete(client.voiceTargets, id)
-		} else {
-			client.voiceTargets[id] = newTarget
+	}
+	if newTarget.IsEmpty() {
+		delete(client.voiceTargets, id)
+		return
+	}
+
+	// Voice sent to the target is relayed by the handler, so bound
+	// how many clients it can fan out to, and how many entries it
+	// holds, which may repeat a channel. The client's previous
+	// definition of the target is dropped as well.
+	maxSize := server.cfg.IntValue("MaxVoiceTargetSize")
+	if maxSize > 0 && (newTarget.Size(server) > maxSize || len(newTarget.sessions)+len(newTarget.channels) > maxSize) {
+		delete(client.voiceTargets, id)
+		client.sendPermissionDeniedText("Voice target too large")
+		return
+	}
+
+	// Bound how many targets the client can define.
+	if _, exists := client.voiceTargets[id]; !exists {
+		max := server.cfg.IntValue("MaxVoiceTargets")
+		if max > 0 && len(client.voiceTargets) >= max {
+			client.sendPermissionDeniedText("Too many voice targets")
+			return
 		}
 	}
+	client.voiceTargets[id] = newTarget
 }
 
 // Permission query
 func (server *Server) handlePermissionQuery(client *Client, msg *Message) {
 	query := &mumbleproto.PermissionQuery{}
-	err := proto.Unmarshal(msg.buf, query)
-	if err != nil {
-		client.Panic(err)
+	if !client.unmarshalMessage(msg, query) {
 		return
 	}
 
@@ -1450,18 +1675,25 @@ func (server *Server) handlePermissionQuery(client *Client, msg *Message) {
 		return
 	}
 
-	channel := server.Channels[int(*query.ChannelId)]
-	server.sendClientPermissions(client, channel)
+	channel, ok := server.Channels[int(*query.ChannelId)]
+	if !ok {
+		return
+	}
+	server.sendClientPermissions(client, channel, true)
 }
 
 // Request big blobs from the server
 func (server *Server) handleRequestBlob(client *Client, msg *Message) {
 	blobreq := &mumbleproto.RequestBlob{}
-	err := proto.Unmarshal(msg.buf, blobreq)
-	if err != nil {
-		client.Panic(err)
+	if !client.unmarshalMessage(msg, blobreq) {
 		return
 	}
+	if !server.allowBlobRequest(client) {
+		return
+	}
+	if dropped := limitBlobRequest(blobreq, server.cfg.IntValue("MaxBlobsPerRequest")); dropped > 0 {
+		client.logRepeatedf("ignored %v blobs over the limit of a blob request", dropped)
+	}
 
 	userstate := &mumbleproto.UserState{}
 
@@ -1540,12 +1772,43 @@ func (server *Server) handleRequestBlob(client *Client, msg *Message) {
 	}
 }
 
+// Cut blobreq down to the first max blobs it requests: user textures
+// first, then user comments, then channel descriptions. Returns the
+// number of blobs that were cut. A max of zero means no limit.
+func limitBlobRequest(blobreq *mumbleproto.RequestBlob, max int) int {
+	if max <= 0 {
+		return 0
+	}
+	dropped := 0
+	for _, ids := range []*[]uint32{&blobreq.SessionTexture, &blobreq.SessionComment, &blobreq.ChannelDescription} {
+		if len(*ids) > max {
+			dropped += len(*ids) - max
+			*ids = (*ids)[:max]
+		}
+		max -= len(*ids)
+	}
+	return dropped
+}
+
+// Context action invoked by a client
+func (server *Server) handleContextAction(client *Client, msg *Message) {
+	action := &mumbleproto.ContextAction{}
+	if !client.unmarshalMessage(msg, action) {
+		return
+	}
+
+	ca := lookupContextAction(action.GetAction())
+	if ca == nil {
+		client.Printf("Unknown context action: %v", action.GetAction())
+		return
+	}
+	ca.Handler(server, client, action)
+}
+
 // User list query, user rename, user de-register
 func (server *Server) handleUserList(client *Client, msg *Message) {
 	userlist := &mumbleproto.UserList{}
-	err := proto.Unmarshal(msg.buf, userlist)
-	if err != nil {
-		client.Panic(err)
+	if !client.unmarshalMessage(msg, userlist) {
 		return
 	}
 
@@ -1562,10 +1825,16 @@ func (server *Server) handleUserList(client *Client, msg *Message) {
 			if uid == 0 {
 				continue
 			}
-			userlist.Users = append(userlist.Users, &mumbleproto.UserList_User{
-				UserId: proto.Uint32(uid),
-				Name:   proto.String(user.Name),
-			})
+			listUser := &mumbleproto.UserList_User{
+				UserId:      proto.Uint32(uid),
+				Name:        proto.String(user.Name),
+				LastChannel: proto.Uint32(uint32(user.LastChannelId)),
+			}
+			if user.LastActive != 0 {
+				lastSeen := time.Unix(int64(user.LastActive), 0).UTC()
+				listUser.LastSeen = proto.String(lastSeen.Format("2006-01-02T15:04:05"))
+			}
+			userlist.Users = append(userlist.Users, listUser)
 		}
 		if err := client.sendMessage(userlist); err != nil {
 			client.Panic(err)
@@ -1584,15 +1853,29 @@ func (server *Server) handleUserList(client *Client, msg *Message) {
 				if ok {
 					if listUser.Name == nil {
 						// De-register
-						server.RemoveRegistration(uid)
-						err := tx.Put(&freezer.UserRemove{Id: listUser.UserId})
+						err := server.RemoveRegistration(uid)
+						if err != nil {
+							server.Panicf("Unable to remove registration: %v", err)
+							continue
+						}
+						err = tx.Put(&freezer.UserRemove{Id: listUser.UserId})
 						if err != nil {
 							server.Fatal(err)
 						}
 					} else {
 						// Rename user
-						// todo(mkrautz): Validate name.
-						user.Name = *listUser.Name
+						name := *listUser.Name
+						if !server.isValidUserName(name) || isReservedUserName(name) {
+							client.sendPermissionDeniedType(mumbleproto.PermissionDenied_UserName)
+							continue
+						}
+						if _, taken := server.UserNameMap[name]; taken {
+							client.sendPermissionDeniedType(mumbleproto.PermissionDenied_UserName)
+							continue
+						}
+						delete(server.UserNameMap, user.Name)
+						user.Name = name
+						server.UserNameMap[name] = user
 						err := tx.Put(&freezer.User{Id: listUser.UserId, Name: listUser.Name})
 						if err != nil {
 							server.Fatal(err)
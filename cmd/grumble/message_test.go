@@ -0,0 +1,1253 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"github.com/golang/protobuf/proto"
+	"io/ioutil"
+	"log"
+	"math"
+	"mumble.info/grumble/pkg/acl"
+	"mumble.info/grumble/pkg/mumbleproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Register a user with the given id and name on server.
+func addTestUser(t *testing.T, server *Server, id uint32, name string) *User {
+	user, err := NewUser(id, name)
+	if err != nil {
+		t.Fatalf("unable to create user: %v", err)
+	}
+	server.Users[id] = user
+	server.UserNameMap[name] = user
+	return user
+}
+
+// Add a connected client logged in as SuperUser.
+func newTestSuperUser(t *testing.T, server *Server) (*Client, *testPeer) {
+	client, peer := newTestClient(server, "SuperUser")
+	client.user = server.Users[0]
+	if client.user == nil {
+		client.user = addTestUser(t, server, 0, "SuperUser")
+	}
+	return client, peer
+}
+
+func TestUserListQuery(t *testing.T) {
+	server := newTestServer(t)
+	lobby := newTestChannel(server, server.RootChannel(), "Lobby")
+	admin, adminPeer := newTestSuperUser(t, server)
+
+	alice := addTestUser(t, server, 1, "alice")
+	alice.LastChannelId = lobby.Id
+	alice.LastActive = 1700000000
+	addTestUser(t, server, 2, "bob")
+
+	server.handleUserList(admin, newTestMessage(t, admin, &mumbleproto.UserList{}))
+
+	userlist := &mumbleproto.UserList{}
+	adminPeer.expect(t, mumbleproto.MessageUserList, userlist)
+	users := map[uint32]*mumbleproto.UserList_User{}
+	for _, user := range userlist.Users {
+		users[user.GetUserId()] = user
+	}
+	if len(users) != 2 {
+		t.Fatalf("Expected 2 users (SuperUser excluded), got %v", userlist.Users)
+	}
+	if users[1].GetName() != "alice" || users[1].GetLastChannel() != uint32(lobby.Id) {
+		t.Errorf("Unexpected entry for alice: %v", users[1])
+	}
+	if users[1].GetLastSeen() != "2023-11-14T22:13:20" {
+		t.Errorf("Unexpected last seen time for alice: %v", users[1].GetLastSeen())
+	}
+	if users[2].GetName() != "bob" || users[2].LastSeen != nil {
+		t.Errorf("Unexpected entry for bob: %v", users[2])
+	}
+}
+
+func TestUserListQueryPermission(t *testing.T) {
+	server := newTestServer(t)
+	client, peer := newTestClient(server, "client")
+	addTestUser(t, server, 1, "alice")
+
+	server.handleUserList(client, newTestMessage(t, client, &mumbleproto.UserList{}))
+
+	peer.expect(t, mumbleproto.MessagePermissionDenied, &mumbleproto.PermissionDenied{})
+	peer.expectNone(t, mumbleproto.MessageUserList)
+}
+
+func TestUserListDeregister(t *testing.T) {
+	server := newTestServer(t)
+	defer openTestFreezeLog(t, server)()
+	admin, adminPeer := newTestSuperUser(t, server)
+
+	alice := addTestUser(t, server, 1, "alice")
+	addTestUser(t, server, 2, "bob")
+	online, _ := newTestClient(server, "alice")
+	online.user = alice
+
+	server.handleUserList(admin, newTestMessage(t, admin, &mumbleproto.UserList{
+		Users: []*mumbleproto.UserList_User{{UserId: proto.Uint32(1)}},
+	}))
+
+	if _, ok := server.Users[1]; ok {
+		t.Errorf("Expected alice to be deregistered")
+	}
+	if _, ok := server.UserNameMap["alice"]; ok {
+		t.Errorf("Expected alice to be removed from the name map")
+	}
+	if _, ok := server.Users[2]; !ok {
+		t.Errorf("Expected bob to stay registered")
+	}
+
+	// The online client keeps its session, but loses its registration.
+	if server.clients[online.Session()] != online {
+		t.Errorf("Expected deregistered client to stay connected")
+	}
+	if online.IsRegistered() {
+		t.Errorf("Expected deregistered client to no longer be registered")
+	}
+	userstate := &mumbleproto.UserState{}
+	adminPeer.expect(t, mumbleproto.MessageUserState, userstate)
+	if userstate.GetSession() != online.Session() || userstate.GetUserId() != math.MaxUint32 {
+		t.Errorf("Unexpected UserState for deregistered client: %v", userstate)
+	}
+}
+
+func TestValidChannelNames(t *testing.T) {
+	server := newTestServer(t)
+	server.cfg.Set("MaxChannelNameLength", "16")
+
+	valid := []string{"Lobby", "AFK - [away]", "Room #2 (quiet)", "Café Ørsted", "Игры"}
+	for _, name := range valid {
+		if !server.isValidChannelName(name) {
+			t.Errorf("Expected %q to be a valid channel name", name)
+		}
+	}
+	invalid := []string{"", "a/b", "<b>bold</b>", "tab\there", "This name is much too long"}
+	for _, name := range invalid {
+		if server.isValidChannelName(name) {
+			t.Errorf("Expected %q to be an invalid channel name", name)
+		}
+	}
+
+	// The regex is configurable.
+	server.cfg.Set("ChannelNameRegex", "[a-z]+")
+	if server.isValidChannelName("Lobby") || !server.isValidChannelName("lobby") {
+		t.Errorf("Expected channel names to follow the configured regex")
+	}
+
+	// It is compiled once for each pattern.
+	if server.nameRegexp("ChannelNameRegex") != server.nameRegexp("ChannelNameRegex") {
+		t.Errorf("Expected the compiled regex to be reused")
+	}
+	server.cfg.Set("ChannelNameRegex", "[a-z")
+	if server.isValidChannelName("lobby") {
+		t.Errorf("Expected an invalid regex to reject all names")
+	}
+}
+
+func TestCreateChannelName(t *testing.T) {
+	server := newTestServer(t)
+	defer openTestFreezeLog(t, server)()
+	server.cfg.Set("MaxChannelNameLength", "16")
+	admin, adminPeer := newTestSuperUser(t, server)
+
+	// Try to create a channel named name in the root channel, and
+	// return the number of channels with that name afterwards.
+	create := func(name string) int {
+		server.handleChannelStateMessage(admin, newTestMessage(t, admin, &mumbleproto.ChannelState{
+			Parent: proto.Uint32(0),
+			Name:   proto.String(name),
+		}))
+		count := 0
+		for _, channel := range server.Channels {
+			if channel.Name == name {
+				count++
+			}
+		}
+		return count
+	}
+
+	if create("Lobby") != 1 {
+		t.Errorf("Expected channel with a valid name to be created")
+	}
+	adminPeer.expect(t, mumbleproto.MessageChannelState, &mumbleproto.ChannelState{})
+
+	// An invalid character, an over-length name, and the name of an
+	// existing sibling are all denied.
+	denials := []struct {
+		name  string
+		count int
+	}{
+		{"a/b", 0},
+		{"This name is much too long", 0},
+		{"Lobby", 1},
+	}
+	for _, test := range denials {
+		name := test.name
+		if create(name) != test.count {
+			t.Errorf("Expected channel %q not to be created", name)
+		}
+		denied := &mumbleproto.PermissionDenied{}
+		adminPeer.expect(t, mumbleproto.MessagePermissionDenied, denied)
+		if denied.GetType() != mumbleproto.PermissionDenied_ChannelName {
+			t.Errorf("Expected ChannelName denial for %q, got %v", name, denied.GetType())
+		}
+	}
+}
+
+func TestCreateChannelWithoutParent(t *testing.T) {
+	server := newTestServer(t)
+	defer openTestFreezeLog(t, server)()
+	admin, adminPeer := newTestSuperUser(t, server)
+
+	for _, chanstate := range []*mumbleproto.ChannelState{
+		{Name: proto.String("Root")},
+		{},
+	} {
+		server.handleChannelStateMessage(admin, newTestMessage(t, admin, chanstate))
+		if len(server.Channels) != 1 {
+			t.Fatalf("Expected a channel without a parent not to be created")
+		}
+		denied := &mumbleproto.PermissionDenied{}
+		adminPeer.expect(t, mumbleproto.MessagePermissionDenied, denied)
+		if denied.GetType() != mumbleproto.PermissionDenied_Text {
+			t.Errorf("Expected Text denial, got %v", denied.GetType())
+		}
+	}
+	if admin.isDisconnected() {
+		t.Errorf("Expected client to stay connected")
+	}
+}
+
+func TestRenameChannelName(t *testing.T) {
+	server := newTestServer(t)
+	defer openTestFreezeLog(t, server)()
+	admin, adminPeer := newTestSuperUser(t, server)
+	lobby := newTestChannel(server, server.RootChannel(), "Lobby")
+
+	server.handleChannelStateMessage(admin, newTestMessage(t, admin, &mumbleproto.ChannelState{
+		ChannelId: proto.Uint32(uint32(lobby.Id)),
+		Name:      proto.String("in|valid?"),
+	}))
+	if lobby.Name != "Lobby" {
+		t.Errorf("Expected rename to an invalid name to be denied")
+	}
+	denied := &mumbleproto.PermissionDenied{}
+	adminPeer.expect(t, mumbleproto.MessagePermissionDenied, denied)
+	if denied.GetType() != mumbleproto.PermissionDenied_ChannelName {
+		t.Errorf("Expected ChannelName denial, got %v", denied.GetType())
+	}
+
+	server.handleChannelStateMessage(admin, newTestMessage(t, admin, &mumbleproto.ChannelState{
+		ChannelId: proto.Uint32(uint32(lobby.Id)),
+		Name:      proto.String("Main Hall"),
+	}))
+	if lobby.Name != "Main Hall" {
+		t.Errorf("Expected rename to a valid name to succeed")
+	}
+}
+
+func TestChannelUpdateIsMinimal(t *testing.T) {
+	server := newTestServer(t)
+	defer openTestFreezeLog(t, server)()
+	admin, _ := newTestSuperUser(t, server)
+	_, bobPeer := newTestClient(server, "bob")
+	lobby := newTestChannel(server, server.RootChannel(), "Lobby")
+	lobby.Position = 3
+
+	// The client repeats the channel's parent and position; only
+	// the name actually changes.
+	server.handleChannelStateMessage(admin, newTestMessage(t, admin, &mumbleproto.ChannelState{
+		ChannelId: proto.Uint32(uint32(lobby.Id)),
+		Parent:    proto.Uint32(0),
+		Name:      proto.String("Main Hall"),
+		Position:  proto.Int32(3),
+	}))
+	if lobby.Name != "Main Hall" {
+		t.Fatalf("Expected rename to succeed")
+	}
+	chanstate := &mumbleproto.ChannelState{}
+	bobPeer.expect(t, mumbleproto.MessageChannelState, chanstate)
+	expected := &mumbleproto.ChannelState{
+		ChannelId: proto.Uint32(uint32(lobby.Id)),
+		Name:      proto.String("Main Hall"),
+	}
+	if !proto.Equal(chanstate, expected) {
+		t.Errorf("Expected rename broadcast %v, got %v", expected, chanstate)
+	}
+
+	// A ChannelState that changes nothing isn't broadcast.
+	server.handleChannelStateMessage(admin, newTestMessage(t, admin, &mumbleproto.ChannelState{
+		ChannelId: proto.Uint32(uint32(lobby.Id)),
+		Position:  proto.Int32(3),
+	}))
+	bobPeer.expectNone(t, mumbleproto.MessageChannelState)
+}
+
+func TestUserListRename(t *testing.T) {
+	server := newTestServer(t)
+	defer openTestFreezeLog(t, server)()
+	admin, adminPeer := newTestSuperUser(t, server)
+	alice := addTestUser(t, server, 1, "alice")
+	addTestUser(t, server, 2, "bob")
+
+	rename := func(name string) {
+		server.handleUserList(admin, newTestMessage(t, admin, &mumbleproto.UserList{
+			Users: []*mumbleproto.UserList_User{{UserId: proto.Uint32(1), Name: proto.String(name)}},
+		}))
+	}
+
+	for _, name := range []string{"bob", "SuperUser", "superuser", "a b"} {
+		rename(name)
+		if alice.Name != "alice" {
+			t.Fatalf("Expected rename to %q to be denied", name)
+		}
+		denied := &mumbleproto.PermissionDenied{}
+		adminPeer.expect(t, mumbleproto.MessagePermissionDenied, denied)
+		if denied.GetType() != mumbleproto.PermissionDenied_UserName {
+			t.Errorf("Expected UserName denial for %q, got %v", name, denied.GetType())
+		}
+	}
+
+	rename("carol")
+	if alice.Name != "carol" || server.UserNameMap["carol"] != alice {
+		t.Errorf("Expected alice to be renamed to carol")
+	}
+	if _, ok := server.UserNameMap["alice"]; ok {
+		t.Errorf("Expected the old name to be released")
+	}
+}
+
+func TestRememberRegisteredUserChannel(t *testing.T) {
+	server := newTestServer(t)
+	defer openTestFreezeLog(t, server)()
+	lobby := newTestChannel(server, server.RootChannel(), "Lobby")
+	games := newTestChannel(server, server.RootChannel(), "Games")
+	server.cfg.Set("DefaultChannel", strconv.Itoa(lobby.Id))
+	if err := server.FreezeToFile(); err != nil {
+		t.Fatalf("unable to freeze server: %v", err)
+	}
+	if err := server.openFreezeLog(); err != nil {
+		t.Fatalf("unable to open freeze log: %v", err)
+	}
+
+	admin, _ := newTestSuperUser(t, server)
+	alice, _ := newTestClient(server, "alice")
+	alice.certHash = "a1ce"
+
+	// Register alice, and move her to Games.
+	server.handleUserStateMessage(admin, newTestMessage(t, admin, &mumbleproto.UserState{
+		Session: proto.Uint32(alice.Session()),
+		UserId:  proto.Uint32(0),
+	}))
+	if !alice.IsRegistered() {
+		t.Fatalf("Expected alice to be registered")
+	}
+	if admin.UserId() != 0 {
+		t.Errorf("Expected registering another user to leave the actor's registration alone")
+	}
+	server.handleUserStateMessage(admin, newTestMessage(t, admin, &mumbleproto.UserState{
+		Session:   proto.Uint32(alice.Session()),
+		ChannelId: proto.Uint32(uint32(games.Id)),
+	}))
+	uid := uint32(alice.UserId())
+	alice.Disconnect()
+
+	// Load the server from the store, as if it had been restarted.
+	server.freezelog.Close()
+	server.freezelog = nil
+	server, err := NewServerFromFrozen("1")
+	if err != nil {
+		t.Fatalf("unable to load server: %v", err)
+	}
+	server.Logger = log.New(ioutil.Discard, "", 0)
+	server.initPerLaunchData()
+	if err := server.openFreezeLog(); err != nil {
+		t.Fatalf("unable to open freeze log: %v", err)
+	}
+	defer server.freezelog.Close()
+
+	user := server.UserCertMap["a1ce"]
+	if user == nil || user.Id != uid {
+		t.Fatalf("Expected registration to be persisted")
+	}
+
+	alice, _ = newAuthenticatingClient(server, "alice")
+	alice.user = user
+	server.finishAuthenticate(alice)
+	if alice.Channel.Id != games.Id {
+		t.Errorf("Expected alice to rejoin Games, got channel %v", alice.Channel.Id)
+	}
+
+	// Unregistered users still join the default channel.
+	bob, _ := newAuthenticatingClient(server, "bob")
+	server.finishAuthenticate(bob)
+	if bob.Channel.Id != lobby.Id {
+		t.Errorf("Expected unregistered user to join the default channel, got channel %v", bob.Channel.Id)
+	}
+}
+
+// Send a PermissionQuery for channel on behalf of client, and return
+// the permissions sent in reply.
+func queryTestPermissions(t *testing.T, server *Server, client *Client, peer *testPeer, channel *Channel) acl.Permission {
+	server.handlePermissionQuery(client, newTestMessage(t, client, &mumbleproto.PermissionQuery{
+		ChannelId: proto.Uint32(uint32(channel.Id)),
+	}))
+	reply := &mumbleproto.PermissionQuery{}
+	peer.expect(t, mumbleproto.MessagePermissionQuery, reply)
+	if reply.GetChannelId() != uint32(channel.Id) {
+		t.Fatalf("Expected permissions for channel %v, got %v", channel.Id, reply.GetChannelId())
+	}
+	return acl.Permission(reply.GetPermissions())
+}
+
+func TestPermissionQuery(t *testing.T) {
+	server := newTestServer(t)
+	lobby := newTestChannel(server, server.RootChannel(), "Lobby")
+	lobby.ACL.InheritACL = true
+	lobby.ACL.ACLs = append(lobby.ACL.ACLs, acl.ACL{
+		UserId:    -1,
+		Group:     "all",
+		ApplyHere: true,
+		Deny:      acl.Permission(acl.EnterPermission | acl.SpeakPermission),
+	})
+	alice, alicePeer := newTestClient(server, "alice")
+
+	for _, channel := range []*Channel{server.RootChannel(), lobby} {
+		perm := queryTestPermissions(t, server, alice, alicePeer, channel)
+		for bit := acl.Permission(1); bit <= acl.AllPermissions; bit <<= 1 {
+			if bit&acl.AllPermissions == 0 {
+				continue
+			}
+			if (perm&bit != 0) != acl.HasPermission(&channel.ACL, alice, bit) {
+				t.Errorf("Permission %#x in channel %v does not match the ACL", uint32(bit), channel.Name)
+			}
+		}
+	}
+
+	if perm := queryTestPermissions(t, server, alice, alicePeer, lobby); perm&acl.EnterPermission != 0 {
+		t.Errorf("Expected enter to be denied in Lobby")
+	}
+	if perm := queryTestPermissions(t, server, alice, alicePeer, server.RootChannel()); perm&acl.EnterPermission == 0 {
+		t.Errorf("Expected enter to be granted in Root")
+	}
+
+	// After a flush, the client is sent its permissions in its
+	// current channel again.
+	server.flushClientPermissions()
+	flush := &mumbleproto.PermissionQuery{}
+	alicePeer.expect(t, mumbleproto.MessagePermissionQuery, flush)
+	if !flush.GetFlush() {
+		t.Fatalf("Expected a flush")
+	}
+	reply := &mumbleproto.PermissionQuery{}
+	alicePeer.expect(t, mumbleproto.MessagePermissionQuery, reply)
+	if reply.GetChannelId() != uint32(alice.Channel.Id) || reply.GetFlush() {
+		t.Errorf("Expected permissions for the current channel after a flush")
+	}
+}
+
+func TestACLQueryGroups(t *testing.T) {
+	server := newTestServer(t)
+	lobby := newTestChannel(server, server.RootChannel(), "Lobby")
+	games := newTestChannel(server, lobby, "Games")
+	admin, adminPeer := newTestSuperUser(t, server)
+	addTestUser(t, server, 1, "alice")
+	addTestUser(t, server, 2, "bob")
+
+	rootgroup := acl.EmptyGroupWithName("admin")
+	rootgroup.Inherit = true
+	rootgroup.Inheritable = true
+	rootgroup.Add[1] = true
+	server.RootChannel().ACL.Groups["admin"] = rootgroup
+
+	gamesgroup := acl.EmptyGroupWithName("admin")
+	gamesgroup.Inherit = true
+	gamesgroup.Inheritable = true
+	gamesgroup.Add[2] = true
+	gamesgroup.Remove[1] = true
+	games.ACL.Groups["admin"] = gamesgroup
+
+	server.handleAclMessage(admin, newTestMessage(t, admin, &mumbleproto.ACL{
+		ChannelId: proto.Uint32(uint32(games.Id)),
+		Query:     proto.Bool(true),
+	}))
+	reply := &mumbleproto.ACL{}
+	adminPeer.expect(t, mumbleproto.MessageACL, reply)
+
+	if len(reply.Groups) != 1 {
+		t.Fatalf("Expected 1 group, got %v", len(reply.Groups))
+	}
+	group := reply.Groups[0]
+	if group.GetName() != "admin" || !group.GetInherited() {
+		t.Errorf("Expected inherited group admin, got %v", group)
+	}
+	if len(group.Add) != 1 || group.Add[0] != 2 {
+		t.Errorf("Expected added member 2, got %v", group.Add)
+	}
+	if len(group.Remove) != 1 || group.Remove[0] != 1 {
+		t.Errorf("Expected removed member 1, got %v", group.Remove)
+	}
+	// The group is inherited from the root channel, through Lobby.
+	if len(group.InheritedMembers) != 1 || group.InheritedMembers[0] != 1 {
+		t.Errorf("Expected inherited member 1, got %v", group.InheritedMembers)
+	}
+}
+
+// Ask the server to create a channel in the root channel on behalf of
+// client, and return the new channel, or nil if it was not created.
+func createTestChannel(t *testing.T, server *Server, client *Client, name string, temporary bool) *Channel {
+	server.handleChannelStateMessage(client, newTestMessage(t, client, &mumbleproto.ChannelState{
+		Parent:    proto.Uint32(0),
+		Name:      proto.String(name),
+		Temporary: proto.Bool(temporary),
+	}))
+	for _, channel := range server.Channels {
+		if channel.Name == name {
+			return channel
+		}
+	}
+	return nil
+}
+
+func expectChannelLimitDenied(t *testing.T, peer *testPeer) {
+	denied := &mumbleproto.PermissionDenied{}
+	peer.expect(t, mumbleproto.MessagePermissionDenied, denied)
+	if denied.GetType() != mumbleproto.PermissionDenied_Text {
+		t.Errorf("Expected a textual denial, got %v", denied.GetType())
+	}
+}
+
+func TestMaxChannels(t *testing.T) {
+	server := newTestServer(t)
+	defer openTestFreezeLog(t, server)()
+	newTestChannel(server, server.RootChannel(), "Lobby")
+	server.cfg.Set("MaxChannels", "3")
+	admin, adminPeer := newTestSuperUser(t, server)
+
+	if createTestChannel(t, server, admin, "Games", false) == nil {
+		t.Fatalf("Expected channel to be created below the limit")
+	}
+	if createTestChannel(t, server, admin, "Music", false) != nil {
+		t.Errorf("Expected channel not to be created at the limit")
+	}
+	expectChannelLimitDenied(t, adminPeer)
+
+	// There is no limit by default.
+	server.cfg.Reset("MaxChannels")
+	if createTestChannel(t, server, admin, "Music", false) == nil {
+		t.Errorf("Expected channel to be created without a limit")
+	}
+}
+
+func TestMaxTemporaryChannelsPerUser(t *testing.T) {
+	server := newTestServer(t)
+	defer openTestFreezeLog(t, server)()
+	server.cfg.Set("MaxTemporaryChannelsPerUser", "2")
+	alice, alicePeer := newTestSuperUser(t, server)
+	bob, _ := newTestSuperUser(t, server)
+
+	// Each of alice's channels is kept alive by a guest, since she
+	// leaves it when she creates the next one.
+	for _, name := range []string{"Alice 1", "Alice 2"} {
+		channel := createTestChannel(t, server, alice, name, true)
+		if channel == nil {
+			t.Fatalf("Expected temporary channel %q to be created", name)
+		}
+		guest, _ := newTestClient(server, "guest")
+		server.userEnterChannel(guest, channel, &mumbleproto.UserState{})
+	}
+
+	if createTestChannel(t, server, alice, "Alice 3", true) != nil {
+		t.Errorf("Expected alice's third temporary channel not to be created")
+	}
+	expectChannelLimitDenied(t, alicePeer)
+
+	// The limit is per user, and does not apply to permanent channels.
+	if createTestChannel(t, server, bob, "Bob 1", true) == nil {
+		t.Errorf("Expected bob's temporary channel to be created")
+	}
+	if createTestChannel(t, server, alice, "Permanent", false) == nil {
+		t.Errorf("Expected alice's permanent channel to be created")
+	}
+}
+
+func TestChannelCreateRateLimit(t *testing.T) {
+	server := newTestServer(t)
+	defer openTestFreezeLog(t, server)()
+	clock := newFakeClock()
+	server.SetClock(clock)
+	server.cfg.Set("ChannelCreateLimit", "3")
+	server.cfg.Set("TemporaryChannelCreateLimit", "1")
+	server.cfg.Set("ChannelCreateInterval", "60")
+	alice, alicePeer := newTestSuperUser(t, server)
+	bob, _ := newTestSuperUser(t, server)
+
+	for i := 1; i <= 3; i++ {
+		if createTestChannel(t, server, alice, "Alice "+strconv.Itoa(i), false) == nil {
+			t.Fatalf("Expected channel %v to be created", i)
+		}
+	}
+	if createTestChannel(t, server, alice, "Alice 4", false) != nil {
+		t.Errorf("Expected the rate limit to deny the fourth channel")
+	}
+	expectChannelLimitDenied(t, alicePeer)
+
+	// Temporary channels and other clients have their own limits.
+	if createTestChannel(t, server, alice, "Alice temporary", true) == nil {
+		t.Errorf("Expected alice's temporary channel to be created")
+	}
+	if createTestChannel(t, server, bob, "Bob 1", false) == nil {
+		t.Errorf("Expected bob's channel to be created")
+	}
+
+	// One creation is allowed again after a third of the interval.
+	clock.advance(20 * time.Second)
+	if createTestChannel(t, server, alice, "Alice 5", false) == nil {
+		t.Errorf("Expected a channel to be allowed again after 20 seconds")
+	}
+	if createTestChannel(t, server, alice, "Alice 6", false) != nil {
+		t.Errorf("Expected the rate limit to deny the sixth channel")
+	}
+}
+
+func TestTokenUpdateAfterLogin(t *testing.T) {
+	server := newTestServer(t)
+	vault := newTestChannel(server, server.RootChannel(), "Vault")
+	vault.ACL.ACLs = append(vault.ACL.ACLs, acl.ACL{
+		UserId:    -1,
+		Group:     "all",
+		ApplyHere: true,
+		Deny:      acl.Permission(acl.EnterPermission | acl.SpeakPermission),
+	}, acl.ACL{
+		UserId:    -1,
+		Group:     "#key",
+		ApplyHere: true,
+		Allow:     acl.Permission(acl.EnterPermission | acl.SpeakPermission),
+	})
+
+	alice, alicePeer := newTestClient(server, "alice")
+	_, bobPeer := newTestClient(server, "bob")
+	enterVault := newTestMessage(t, alice, &mumbleproto.UserState{
+		ChannelId: proto.Uint32(uint32(vault.Id)),
+	})
+	server.handleIncomingMessage(alice, enterVault)
+	if alice.Channel == vault {
+		t.Fatalf("Expected client without token to be denied entry")
+	}
+	alicePeer.expect(t, mumbleproto.MessagePermissionDenied, nil)
+
+	server.handleIncomingMessage(alice, newTestMessage(t, alice, &mumbleproto.Authenticate{
+		Tokens: []string{"Key"},
+	}))
+	flush := &mumbleproto.PermissionQuery{}
+	alicePeer.expect(t, mumbleproto.MessagePermissionQuery, flush)
+	if !flush.GetFlush() {
+		t.Errorf("Expected permissions to be flushed after a token update")
+	}
+
+	server.handleIncomingMessage(alice, enterVault)
+	if alice.Channel != vault {
+		t.Fatalf("Expected token update to grant entry")
+	}
+	if alice.Suppress {
+		t.Errorf("Expected client with token to be able to speak")
+	}
+
+	// Dropping the token suppresses the client in its current channel.
+	server.handleIncomingMessage(alice, newTestMessage(t, alice, &mumbleproto.Authenticate{}))
+	if !alice.Suppress {
+		t.Fatalf("Expected client to be suppressed after dropping its token")
+	}
+	for {
+		userstate := &mumbleproto.UserState{}
+		bobPeer.expect(t, mumbleproto.MessageUserState, userstate)
+		if userstate.GetSession() == alice.Session() && userstate.Suppress != nil {
+			if !userstate.GetSuppress() {
+				t.Errorf("Expected suppression to be broadcast")
+			}
+			break
+		}
+	}
+}
+
+func TestACLChangeTakesEffect(t *testing.T) {
+	server := newTestServer(t)
+	defer openTestFreezeLog(t, server)()
+	lobby := newTestChannel(server, server.RootChannel(), "Lobby")
+	other := newTestChannel(server, server.RootChannel(), "Other")
+	lobby.ACL.InheritACL = true
+	lobby.ACL.ACLs = append(lobby.ACL.ACLs, acl.ACL{
+		UserId:    -1,
+		Group:     "all",
+		ApplyHere: true,
+		Deny:      acl.Permission(acl.EnterPermission),
+	})
+	admin, _ := newTestSuperUser(t, server)
+	alice, alicePeer := newTestClient(server, "alice")
+	bob, bobPeer := newTestClient(server, "bob")
+	server.userEnterChannel(bob, other, &mumbleproto.UserState{})
+	bobPeer.expect(t, mumbleproto.MessagePermissionQuery, nil)
+	bobPeer.expect(t, mumbleproto.MessagePermissionQuery, nil)
+
+	if perm := queryTestPermissions(t, server, alice, alicePeer, lobby); perm&acl.EnterPermission != 0 {
+		t.Fatalf("Expected enter to be denied in Lobby")
+	}
+
+	server.handleAclMessage(admin, newTestMessage(t, admin, &mumbleproto.ACL{
+		ChannelId:   proto.Uint32(uint32(lobby.Id)),
+		InheritAcls: proto.Bool(true),
+		Acls: []*mumbleproto.ACL_ChanACL{{
+			Group:     proto.String("all"),
+			ApplyHere: proto.Bool(true),
+			Grant:     proto.Uint32(uint32(acl.EnterPermission)),
+		}},
+	}))
+
+	// Alice has been sent her permissions in Lobby, so she is told
+	// to discard them. Bob hasn't, so he is left alone.
+	flush := &mumbleproto.PermissionQuery{}
+	alicePeer.expect(t, mumbleproto.MessagePermissionQuery, flush)
+	if !flush.GetFlush() {
+		t.Errorf("Expected a flush after the ACL change")
+	}
+	alicePeer.expect(t, mumbleproto.MessagePermissionQuery, nil)
+	bobPeer.expectNone(t, mumbleproto.MessagePermissionQuery)
+
+	if perm := queryTestPermissions(t, server, alice, alicePeer, lobby); perm&acl.EnterPermission == 0 {
+		t.Errorf("Expected enter to be granted in Lobby")
+	}
+	server.handleUserStateMessage(alice, newTestMessage(t, alice, &mumbleproto.UserState{
+		ChannelId: proto.Uint32(uint32(lobby.Id)),
+	}))
+	if alice.Channel != lobby {
+		t.Errorf("Expected ACL change to take effect without a reconnect")
+	}
+}
+
+func TestChannelMoveFlushesPermissions(t *testing.T) {
+	server := newTestServer(t)
+	defer openTestFreezeLog(t, server)()
+	locked := newTestChannel(server, server.RootChannel(), "Locked")
+	vault := newTestChannel(server, locked, "Vault")
+	locked.ACL.ACLs = append(locked.ACL.ACLs, acl.ACL{
+		UserId:    -1,
+		Group:     "all",
+		ApplyHere: true,
+		ApplySubs: true,
+		Deny:      acl.Permission(acl.EnterPermission),
+	})
+	vault.ACL.InheritACL = true
+	admin, _ := newTestSuperUser(t, server)
+	alice, alicePeer := newTestClient(server, "alice")
+
+	if perm := queryTestPermissions(t, server, alice, alicePeer, vault); perm&acl.EnterPermission != 0 {
+		t.Fatalf("Expected enter to be denied in Vault")
+	}
+
+	server.handleChannelStateMessage(admin, newTestMessage(t, admin, &mumbleproto.ChannelState{
+		ChannelId: proto.Uint32(uint32(vault.Id)),
+		Parent:    proto.Uint32(uint32(server.RootChannel().Id)),
+	}))
+	if vault.parent != server.RootChannel() {
+		t.Fatalf("Expected Vault to be moved to Root")
+	}
+
+	flush := &mumbleproto.PermissionQuery{}
+	alicePeer.expect(t, mumbleproto.MessagePermissionQuery, flush)
+	if !flush.GetFlush() {
+		t.Errorf("Expected a flush after the move")
+	}
+	alicePeer.expect(t, mumbleproto.MessagePermissionQuery, nil)
+	if perm := queryTestPermissions(t, server, alice, alicePeer, vault); perm&acl.EnterPermission == 0 {
+		t.Errorf("Expected enter to be granted in Vault once it no longer inherits from Locked")
+	}
+}
+
+func TestMoveUser(t *testing.T) {
+	server := newTestServer(t)
+	root := server.RootChannel()
+	lobby := newTestChannel(server, root, "Lobby")
+	locked := newTestChannel(server, root, "Locked")
+	lobby.ACL.InheritACL = true
+	locked.ACL.InheritACL = true
+	locked.ACL.ACLs = append(locked.ACL.ACLs, acl.ACL{
+		UserId:    -1,
+		Group:     "all",
+		ApplyHere: true,
+		Deny:      acl.Permission(acl.EnterPermission),
+	})
+	root.ACL.ACLs = append(root.ACL.ACLs, acl.ACL{
+		UserId:    -1,
+		Group:     "#mod",
+		ApplyHere: true,
+		ApplySubs: true,
+		Allow:     acl.Permission(acl.MovePermission),
+	})
+	moveTestUser := func(actor, target *Client, channel *Channel) {
+		server.handleUserStateMessage(actor, newTestMessage(t, actor, &mumbleproto.UserState{
+			Session:   proto.Uint32(target.Session()),
+			ChannelId: proto.Uint32(uint32(channel.Id)),
+		}))
+	}
+	expectDenied := func(peer *testPeer, perm acl.Permission) {
+		denied := &mumbleproto.PermissionDenied{}
+		peer.expect(t, mumbleproto.MessagePermissionDenied, denied)
+		if denied.GetPermission() != uint32(perm) {
+			t.Errorf("Expected permission %#x to be denied, got %#x", uint32(perm), denied.GetPermission())
+		}
+	}
+
+	alice, alicePeer := newTestClient(server, "alice")
+	mod, modPeer := newTestClient(server, "mod")
+	_, bobPeer := newTestClient(server, "bob")
+
+	// Users moving themselves only need to be allowed to enter.
+	moveTestUser(alice, alice, locked)
+	if alice.Channel != root {
+		t.Errorf("Expected self-move into Locked to be denied")
+	}
+	expectDenied(alicePeer, acl.EnterPermission)
+	moveTestUser(alice, alice, lobby)
+	if alice.Channel != lobby {
+		t.Fatalf("Expected self-move into Lobby to succeed")
+	}
+	moveTestUser(alice, alice, root)
+
+	// Moving someone else requires MovePermission.
+	moveTestUser(mod, alice, lobby)
+	if alice.Channel != root {
+		t.Errorf("Expected move without MovePermission to be denied")
+	}
+	expectDenied(modPeer, acl.MovePermission)
+
+	mod.tokens = []string{"mod"}
+	moveTestUser(mod, alice, lobby)
+	if alice.Channel != lobby {
+		t.Fatalf("Expected move by a moderator to succeed")
+	}
+	for {
+		userstate := &mumbleproto.UserState{}
+		bobPeer.expect(t, mumbleproto.MessageUserState, userstate)
+		if userstate.GetSession() == alice.Session() && userstate.GetActor() == mod.Session() {
+			if userstate.GetChannelId() != uint32(lobby.Id) {
+				t.Errorf("Expected alice to be moved to Lobby, got %v", userstate.GetChannelId())
+			}
+			break
+		}
+	}
+
+	// The moved user must still be allowed to enter the destination.
+	moveTestUser(mod, alice, locked)
+	if alice.Channel != lobby {
+		t.Errorf("Expected move into a channel alice can't enter to be denied")
+	}
+	expectDenied(modPeer, acl.EnterPermission)
+}
+
+func TestPinnedUser(t *testing.T) {
+	server := newTestServer(t)
+	root := server.RootChannel()
+	timeout := newTestChannel(server, root, "Timeout")
+	lobby := newTestChannel(server, root, "Lobby")
+	timeout.ACL.InheritACL = true
+	lobby.ACL.InheritACL = true
+
+	admin, adminPeer := newTestSuperUser(t, server)
+	alice, alicePeer := newTestClient(server, "alice")
+	pin := func(actor *Client, name string) {
+		server.handleContextAction(actor, newTestMessage(t, actor, &mumbleproto.ContextAction{
+			Action:  proto.String(name),
+			Session: proto.Uint32(alice.Session()),
+		}))
+	}
+	move := func(actor *Client, channel *Channel) {
+		server.handleUserStateMessage(actor, newTestMessage(t, actor, &mumbleproto.UserState{
+			Session:   proto.Uint32(alice.Session()),
+			ChannelId: proto.Uint32(uint32(channel.Id)),
+		}))
+	}
+
+	// Users can't pin themselves.
+	pin(alice, "grumble.pin")
+	if alice.pinned {
+		t.Fatalf("Expected a user without move permission not to be able to pin")
+	}
+	alicePeer.expect(t, mumbleproto.MessagePermissionDenied, nil)
+
+	move(admin, timeout)
+	pin(admin, "grumble.pin")
+	if !alice.pinned {
+		t.Fatalf("Expected the admin to pin alice")
+	}
+	alicePeer.expectNone(t, mumbleproto.MessageReject)
+	adminPeer.expectNone(t, mumbleproto.MessageReject)
+
+	// A self-move is refused, and alice is snapped back.
+	move(alice, lobby)
+	if alice.Channel != timeout {
+		t.Fatalf("Expected a pinned user's self-move to be refused")
+	}
+	alicePeer.expect(t, mumbleproto.MessagePermissionDenied, nil)
+	snap := &mumbleproto.UserState{}
+	alicePeer.expect(t, mumbleproto.MessageUserState, snap)
+	if snap.GetSession() != alice.Session() || snap.GetChannelId() != uint32(timeout.Id) {
+		t.Errorf("Expected alice to be snapped back to the timeout channel, got %v", snap)
+	}
+	adminPeer.expectNone(t, mumbleproto.MessageUserState)
+
+	// Admins can still move a pinned user.
+	move(admin, root)
+	if alice.Channel != root {
+		t.Errorf("Expected the admin to be able to move a pinned user")
+	}
+
+	pin(admin, "grumble.unpin")
+	move(alice, lobby)
+	if alice.Channel != lobby {
+		t.Errorf("Expected a released user to be able to move")
+	}
+}
+
+func TestTemporarySubchannels(t *testing.T) {
+	server := newTestServer(t)
+	defer openTestFreezeLog(t, server)()
+	alice, alicePeer := newTestSuperUser(t, server)
+	createSubchannel := func(parent *Channel, name string, temporary bool) *Channel {
+		server.handleChannelStateMessage(alice, newTestMessage(t, alice, &mumbleproto.ChannelState{
+			Parent:    proto.Uint32(uint32(parent.Id)),
+			Name:      proto.String(name),
+			Temporary: proto.Bool(temporary),
+		}))
+		return parent.ChildByName(name)
+	}
+	expectDenied := func() {
+		denied := &mumbleproto.PermissionDenied{}
+		alicePeer.expect(t, mumbleproto.MessagePermissionDenied, denied)
+		if denied.GetType() != mumbleproto.PermissionDenied_TemporaryChannel {
+			t.Errorf("Expected a temporary channel denial, got %v", denied.GetType())
+		}
+	}
+
+	party := createTestChannel(t, server, alice, "Party", true)
+	if party == nil {
+		t.Fatalf("Expected temporary channel to be created")
+	}
+
+	// The parent may vanish, so permanent children are never allowed.
+	if createSubchannel(party, "Permanent", false) != nil {
+		t.Errorf("Expected permanent channel under a temporary one to be rejected")
+	}
+	expectDenied()
+	if createSubchannel(party, "Nested", true) != nil {
+		t.Errorf("Expected nested temporary channel to be rejected by default")
+	}
+	expectDenied()
+
+	server.cfg.Set("AllowTemporarySubchannels", "true")
+	if createSubchannel(party, "Permanent", false) != nil {
+		t.Errorf("Expected permanent channel under a temporary one to be rejected")
+	}
+	expectDenied()
+	nested := createSubchannel(party, "Nested", true)
+	if nested == nil {
+		t.Fatalf("Expected nested temporary channel to be created")
+	}
+
+	// Alice followed her new channel. Party is kept while she is in
+	// Nested, and both go once she leaves.
+	if alice.Channel != nested {
+		t.Fatalf("Expected alice to be in Nested")
+	}
+	select {
+	case channel := <-server.tempRemove:
+		t.Fatalf("Expected occupied channel %v to be kept", channel.Name)
+	default:
+	}
+	server.userEnterChannel(alice, server.RootChannel(), &mumbleproto.UserState{})
+	server.removeTemporaryChannel(<-server.tempRemove)
+	if _, ok := server.Channels[nested.Id]; ok {
+		t.Errorf("Expected Nested to be removed")
+	}
+	if _, ok := server.Channels[party.Id]; ok {
+		t.Errorf("Expected Party to be removed along with Nested")
+	}
+}
+
+func TestTalkRooms(t *testing.T) {
+	server := newTestServer(t)
+	rooms := newTestChannel(server, server.RootChannel(), "Talk rooms")
+	rooms.ACL.InheritACL = true
+	server.cfg.Set("TalkRoomChannel", strconv.Itoa(rooms.Id))
+
+	alice, alicePeer := newTestClient(server, "alice")
+	bob, bobPeer := newTestClient(server, "bob")
+	enterRooms := func(client *Client) {
+		server.handleUserStateMessage(client, newTestMessage(t, client, &mumbleproto.UserState{
+			ChannelId: proto.Uint32(uint32(rooms.Id)),
+		}))
+	}
+
+	enterRooms(alice)
+	room := alice.Channel
+	if room == rooms || room.parent != rooms || !room.IsTemporary() || room.Name != "Room 1" {
+		t.Fatalf("Expected alice to be placed in a fresh temporary Room 1, got %v", room.Name)
+	}
+	chanstate := &mumbleproto.ChannelState{}
+	bobPeer.expect(t, mumbleproto.MessageChannelState, chanstate)
+	if chanstate.GetChannelId() != uint32(room.Id) || chanstate.GetParent() != uint32(rooms.Id) || !chanstate.GetTemporary() {
+		t.Errorf("Expected the new room to be broadcast, got %v", chanstate)
+	}
+	userstate := &mumbleproto.UserState{}
+	alicePeer.expect(t, mumbleproto.MessageUserState, userstate)
+	if userstate.GetChannelId() != uint32(room.Id) {
+		t.Errorf("Expected alice's move into the room to be broadcast, got %v", userstate)
+	}
+
+	enterRooms(bob)
+	if bob.Channel == room || bob.Channel.Name != "Room 2" {
+		t.Errorf("Expected bob to get a separate room, got %v", bob.Channel.Name)
+	}
+
+	// Rooms are removed once they're empty.
+	server.userEnterChannel(alice, server.RootChannel(), &mumbleproto.UserState{})
+	server.removeTemporaryChannel(<-server.tempRemove)
+	if _, ok := server.Channels[room.Id]; ok {
+		t.Errorf("Expected the empty room to be removed")
+	}
+
+	// Without a TalkRoomChannel, users just enter the channel.
+	server.cfg.Set("TalkRoomChannel", "")
+	enterRooms(alice)
+	if alice.Channel != rooms {
+		t.Errorf("Expected alice to enter the channel itself once talk rooms are disabled")
+	}
+}
+
+func TestChannelTextMessageLimit(t *testing.T) {
+	server := newTestServer(t)
+	defer openTestFreezeLog(t, server)()
+	clock := newFakeClock()
+	server.SetClock(clock)
+	server.cfg.Set("ChannelTextMessageLimit", "2")
+	root := server.RootChannel()
+	lobby := newTestChannel(server, root, "Lobby")
+	lobby.ACL.InheritACL = true
+
+	alice, alicePeer := newTestClient(server, "alice")
+	bob, bobPeer := newTestClient(server, "bob")
+	admin, _ := newTestSuperUser(t, server)
+
+	// Send a text message from client to channel, and report whether
+	// the listener received it.
+	send := func(client *Client, channel *Channel, listener *testPeer) bool {
+		server.handleTextMessage(client, newTestMessage(t, client, &mumbleproto.TextMessage{
+			ChannelId: []uint32{uint32(channel.Id)},
+			Message:   proto.String("spam"),
+		}))
+		timeout := time.After(50 * time.Millisecond)
+		for {
+			select {
+			case msg := <-listener.msgs:
+				if msg.kind == mumbleproto.MessageTextMessage {
+					return true
+				}
+			case <-timeout:
+				return false
+			}
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if !send(alice, root, bobPeer) {
+			t.Fatalf("Expected message %v within the limit to be relayed", i+1)
+		}
+	}
+	if send(alice, root, bobPeer) {
+		t.Errorf("Expected alice's third message to be dropped")
+	}
+	denied := &mumbleproto.PermissionDenied{}
+	alicePeer.expect(t, mumbleproto.MessagePermissionDenied, denied)
+	if denied.GetType() != mumbleproto.PermissionDenied_Text {
+		t.Errorf("Expected a textual cooldown notice, got %v", denied.GetType())
+	}
+
+	// Other users, and admins, are not throttled.
+	if !send(bob, root, alicePeer) {
+		t.Errorf("Expected bob's message to be relayed")
+	}
+	for i := 0; i < 5; i++ {
+		if !send(admin, root, alicePeer) {
+			t.Fatalf("Expected the admin's message %v to be relayed", i+1)
+		}
+		bobPeer.expect(t, mumbleproto.MessageTextMessage, nil)
+	}
+
+	// The limit is per channel, and channels can override it.
+	server.SetChannelTextMessageLimit(lobby, 3)
+	carol, carolPeer := newTestClient(server, "carol")
+	root.RemoveClient(carol)
+	lobby.AddClient(carol)
+	for i := 0; i < 3; i++ {
+		if !send(alice, lobby, carolPeer) {
+			t.Fatalf("Expected message %v to the lobby to be relayed", i+1)
+		}
+	}
+	if send(alice, lobby, carolPeer) {
+		t.Errorf("Expected the lobby's limit to apply")
+	}
+
+	// Alice may send again once enough time has passed.
+	clock.advance(30 * time.Second)
+	if !send(alice, root, bobPeer) {
+		t.Errorf("Expected alice's message to be relayed after cooling down")
+	}
+}
+
+func TestChannelDescriptionLimits(t *testing.T) {
+	server := newTestServer(t)
+	defer openTestFreezeLog(t, server)()
+	defer openTestBlobStore(t)()
+
+	server.cfg.Set("MaxChannelDescriptionLength", "1000")
+	server.cfg.Set("ChannelDescriptionInlineThreshold", "128")
+	admin, adminPeer := newTestSuperUser(t, server)
+	admin.Version = 0x10202
+	bob, bobPeer := newTestClient(server, "bob")
+	bob.Version = 0x10202
+
+	// Set the root channel's description, and get the ChannelState bob
+	// is sent for it.
+	describe := func(description string) *mumbleproto.ChannelState {
+		server.handleChannelStateMessage(admin, newTestMessage(t, admin, &mumbleproto.ChannelState{
+			ChannelId:   proto.Uint32(0),
+			Description: proto.String(description),
+		}))
+		chanstate := &mumbleproto.ChannelState{}
+		bobPeer.expect(t, mumbleproto.MessageChannelState, chanstate)
+		return chanstate
+	}
+	// Get the ChannelState of the root channel a logging in client is
+	// sent.
+	channelList := func() *mumbleproto.ChannelState {
+		if err := bob.sendChannelTree(server.RootChannel()); err != nil {
+			t.Fatalf("unable to send channel tree: %v", err)
+		}
+		chanstate := &mumbleproto.ChannelState{}
+		bobPeer.expect(t, mumbleproto.MessageChannelState, chanstate)
+		return chanstate
+	}
+
+	short := "A short description"
+	for _, chanstate := range []*mumbleproto.ChannelState{describe(short), channelList()} {
+		if chanstate.GetDescription() != short || len(chanstate.DescriptionHash) != 0 {
+			t.Errorf("Expected a short description to be sent inline, got %v", chanstate)
+		}
+	}
+
+	medium := strings.Repeat("A longer description. ", 20)
+	for _, chanstate := range []*mumbleproto.ChannelState{describe(medium), channelList()} {
+		if chanstate.Description != nil || len(chanstate.DescriptionHash) == 0 {
+			t.Errorf("Expected a medium description to be sent as a hash, got %v", chanstate)
+		}
+	}
+	server.handleRequestBlob(bob, newTestMessage(t, bob, &mumbleproto.RequestBlob{
+		ChannelDescription: []uint32{0},
+	}))
+	chanstate := &mumbleproto.ChannelState{}
+	bobPeer.expect(t, mumbleproto.MessageChannelState, chanstate)
+	if chanstate.GetDescription() != medium {
+		t.Errorf("Expected the description blob to be served, got %q", chanstate.GetDescription())
+	}
+
+	// Descriptions over the limit are rejected, and the channel keeps its
+	// description.
+	adminPeer.expect(t, mumbleproto.MessageChannelState, nil)
+	adminPeer.expect(t, mumbleproto.MessageChannelState, nil)
+	server.handleChannelStateMessage(admin, newTestMessage(t, admin, &mumbleproto.ChannelState{
+		ChannelId:   proto.Uint32(0),
+		Description: proto.String(strings.Repeat("x", 1001)),
+	}))
+	denied := &mumbleproto.PermissionDenied{}
+	adminPeer.expect(t, mumbleproto.MessagePermissionDenied, denied)
+	if denied.GetType() != mumbleproto.PermissionDenied_TextTooLong {
+		t.Errorf("Expected TextTooLong, got %v", denied.GetType())
+	}
+	bobPeer.expectNone(t, mumbleproto.MessageChannelState)
+	buf, err := blobStore.Get(server.RootChannel().DescriptionBlob)
+	if err != nil || string(buf) != medium {
+		t.Errorf("Expected the description to be unchanged, got %q (%v)", buf, err)
+	}
+}
+
+func TestRequestBlobLimits(t *testing.T) {
+	defer openTestBlobStore(t)()
+
+	server := newTestServer(t)
+	clock := newFakeClock()
+	server.SetClock(clock)
+	server.cfg.Set("MaxBlobsPerRequest", "4")
+	server.cfg.Set("RequestBlobLimit", "1")
+	server.cfg.Set("RequestBlobBurst", "2")
+	alice, alicePeer := newTestClient(server, "alice")
+
+	// Ten channels with descriptions stored as blobs.
+	key, err := blobStore.Put([]byte(strings.Repeat("A long description. ", 20)))
+	if err != nil {
+		t.Fatalf("unable to store blob: %v", err)
+	}
+	ids := []uint32{}
+	for i := 0; i < 10; i++ {
+		channel := newTestChannel(server, server.RootChannel(), "Channel "+strconv.Itoa(i))
+		channel.DescriptionBlob = key
+		ids = append(ids, uint32(channel.Id))
+	}
+	request := func() {
+		server.handleRequestBlob(alice, newTestMessage(t, alice, &mumbleproto.RequestBlob{
+			ChannelDescription: ids,
+		}))
+	}
+
+	// Only the first MaxBlobsPerRequest blobs are served.
+	request()
+	chanstate := &mumbleproto.ChannelState{}
+	for _, id := range ids[:4] {
+		alicePeer.expect(t, mumbleproto.MessageChannelState, chanstate)
+		if chanstate.GetChannelId() != id {
+			t.Errorf("Expected the description of channel %v, got %v", id, chanstate.GetChannelId())
+		}
+	}
+	alicePeer.expectNone(t, mumbleproto.MessageChannelState)
+
+	// Requests over the rate limit are ignored.
+	request()
+	for range ids[:4] {
+		alicePeer.expect(t, mumbleproto.MessageChannelState, nil)
+	}
+	request()
+	alicePeer.expectNone(t, mumbleproto.MessageChannelState)
+	clock.advance(time.Second)
+	request()
+	alicePeer.expect(t, mumbleproto.MessageChannelState, nil)
+}
+
+func TestLimitBlobRequest(t *testing.T) {
+	blobreq := &mumbleproto.RequestBlob{
+		SessionTexture:     []uint32{1, 2},
+		SessionComment:     []uint32{3, 4},
+		ChannelDescription: []uint32{5, 6},
+	}
+	if dropped := limitBlobRequest(blobreq, 3); dropped != 3 {
+		t.Errorf("Expected 3 blobs to be dropped, got %v", dropped)
+	}
+	if len(blobreq.SessionTexture) != 2 || len(blobreq.SessionComment) != 1 || len(blobreq.ChannelDescription) != 0 {
+		t.Errorf("Expected the first 3 blobs to be kept, got %v", blobreq)
+	}
+}
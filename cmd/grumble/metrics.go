@@ -0,0 +1,168 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// The gauges of a virtual server, which are read by its handler
+// goroutine.
+type serverGauges struct {
+	users    int
+	channels int
+}
+
+// Get the server's gauges. Only called by the handler goroutine.
+func (server *Server) gauges() serverGauges {
+	return serverGauges{
+		users:    len(server.clients),
+		channels: len(server.Channels),
+	}
+}
+
+// Ask the server's handler for its gauges. Returns false if the server
+// isn't running, or its handler doesn't answer within healthProbeTimeout.
+func (server *Server) probeGauges() (serverGauges, bool) {
+	server.stopLock.RLock()
+	defer server.stopLock.RUnlock()
+	if server.stopping || server.gaugeProbe == nil {
+		return serverGauges{}, false
+	}
+	reply := make(chan serverGauges, 1)
+	select {
+	case server.gaugeProbe <- reply:
+		return <-reply, true
+	case <-time.After(healthProbeTimeout):
+		return serverGauges{}, false
+	}
+}
+
+// Record the class of the client's disconnect, which labels the
+// disconnect counter. Only the first class given is kept; clients that
+// are never classified are counted as errors.
+func (client *Client) classifyDisconnect(class string) {
+	if client.disconnectClass == "" {
+		client.disconnectClass = class
+	}
+}
+
+// Count the disconnect of client.
+func (server *Server) countDisconnect(client *Client) {
+	class := client.disconnectClass
+	if class == "" {
+		class = "error"
+	}
+	server.disconnectsMutex.Lock()
+	if server.disconnects == nil {
+		server.disconnects = make(map[string]uint64)
+	}
+	server.disconnects[class] += 1
+	server.disconnectsMutex.Unlock()
+}
+
+// Get the number of disconnects counted so far, by class.
+func (server *Server) Disconnects() map[string]uint64 {
+	server.disconnectsMutex.Lock()
+	defer server.disconnectsMutex.Unlock()
+	counts := make(map[string]uint64, len(server.disconnects))
+	for class, count := range server.disconnects {
+		counts[class] = count
+	}
+	return counts
+}
+
+// Start the metrics endpoint on addr. It serves the metrics of servers,
+// the virtual servers, at /metrics, in the Prometheus text format.
+func startMetrics(addr string, servers map[int64]*Server) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler(servers))
+	go http.Serve(l, mux)
+
+	log.Printf("Metrics listening on %v", l.Addr())
+	return nil
+}
+
+// Get the handler that serves the metrics of servers. The map must not
+// be modified while the handler is in use.
+func metricsHandler(servers map[int64]*Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		list := make([]*Server, 0, len(servers))
+		for _, server := range servers {
+			list = append(list, server)
+		}
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].Id < list[j].Id
+		})
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w, list)
+	})
+}
+
+// Write the metrics of servers to w, in the Prometheus text format.
+// Each metric is labeled with the id of the virtual server it belongs
+// to. Gauges are left out for servers that aren't running.
+func writeMetrics(w io.Writer, servers []*Server) {
+	gauges := make([]serverGauges, len(servers))
+	running := make([]bool, len(servers))
+	for i, server := range servers {
+		gauges[i], running[i] = server.probeGauges()
+	}
+
+	family := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+	}
+
+	family("grumble_users", "gauge", "Number of connected users.")
+	for i, server := range servers {
+		if running[i] {
+			fmt.Fprintf(w, "grumble_users{server=\"%v\"} %v\n", server.Id, gauges[i].users)
+		}
+	}
+
+	family("grumble_channels", "gauge", "Number of channels.")
+	for i, server := range servers {
+		if running[i] {
+			fmt.Fprintf(w, "grumble_channels{server=\"%v\"} %v\n", server.Id, gauges[i].channels)
+		}
+	}
+
+	family("grumble_voice_packets_total", "counter", "Voice packets received from clients, by codec.")
+	for _, server := range servers {
+		for _, codec := range voiceCodecs {
+			fmt.Fprintf(w, "grumble_voice_packets_total{server=\"%v\",codec=\"%v\"} %v\n", server.Id, codec.name, server.VoiceStats().Codec(codec.kind))
+		}
+	}
+
+	family("grumble_bandwidth_bytes_total", "counter", "Bytes received from and sent to clients, over TCP and UDP.")
+	for _, server := range servers {
+		fmt.Fprintf(w, "grumble_bandwidth_bytes_total{server=\"%v\",dir=\"in\"} %v\n", server.Id, atomic.LoadUint64(&server.bytesIn))
+		fmt.Fprintf(w, "grumble_bandwidth_bytes_total{server=\"%v\",dir=\"out\"} %v\n", server.Id, atomic.LoadUint64(&server.bytesOut))
+	}
+
+	family("grumble_disconnects_total", "counter", "Client disconnects, by reason.")
+	for _, server := range servers {
+		counts := server.Disconnects()
+		classes := make([]string, 0, len(counts))
+		for class := range counts {
+			classes = append(classes, class)
+		}
+		sort.Strings(classes)
+		for _, class := range classes {
+			fmt.Fprintf(w, "grumble_disconnects_total{server=\"%v\",reason=\"%v\"} %v\n", server.Id, class, counts[class])
+		}
+	}
+}
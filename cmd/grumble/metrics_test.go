@@ -0,0 +1,84 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"mumble.info/grumble/pkg/mumbleproto"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	defer setupTestDataDir(t)()
+
+	server := newTestServer(t)
+	server.cfg.Set("Address", "127.0.0.1")
+	server.cfg.Set("Port", strconv.Itoa(freeTestPort(t)))
+	if err := server.Start(); err != nil {
+		t.Fatalf("unable to start server: %v", err)
+	}
+	defer server.Stop()
+
+	server.voiceStats.countCodec(mumbleproto.UDPMessageVoiceOpus)
+	server.voiceStats.countCodec(mumbleproto.UDPMessageVoiceOpus)
+	server.countDisconnect(&Client{disconnectClass: "kicked"})
+	server.countDisconnect(&Client{})
+
+	ts := httptest.NewServer(metricsHandler(map[int64]*Server{server.Id: server}))
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("unable to scrape metrics: %v", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unable to read metrics: %v", err)
+	}
+
+	metrics := string(body)
+	for _, want := range []string{
+		"# TYPE grumble_users gauge\n",
+		"# TYPE grumble_voice_packets_total counter\n",
+		"# TYPE grumble_bandwidth_bytes_total counter\n",
+		`grumble_users{server="1"} 0` + "\n",
+		`grumble_channels{server="1"} 1` + "\n",
+		`grumble_voice_packets_total{server="1",codec="opus"} 2` + "\n",
+		`grumble_voice_packets_total{server="1",codec="speex"} 0` + "\n",
+		`grumble_bandwidth_bytes_total{server="1",dir="in"} `,
+		`grumble_bandwidth_bytes_total{server="1",dir="out"} `,
+		`grumble_disconnects_total{server="1",reason="error"} 1` + "\n",
+		`grumble_disconnects_total{server="1",reason="kicked"} 1` + "\n",
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("Expected metrics to contain %q, got:\n%v", want, metrics)
+		}
+	}
+}
+
+func TestDisconnectClasses(t *testing.T) {
+	server := newTestServer(t)
+	server.disconnectRequests = make(chan disconnectRequest, 1)
+	alice, _ := newTestClient(server, "alice")
+	bob, _ := newTestClient(server, "bob")
+	carol, _ := newTestClient(server, "carol")
+
+	alice.disconnectWith(DisconnectBanned, "Behave")
+	bob.handleReadError(io.EOF)
+	server.handleDisconnectRequest(<-server.disconnectRequests)
+	carol.Panicf("protocol violation")
+
+	counts := server.Disconnects()
+	for class, want := range map[string]uint64{"banned": 1, "closed": 1, "error": 1} {
+		if counts[class] != want {
+			t.Errorf("Expected %v %v disconnects, got %v", want, class, counts[class])
+		}
+	}
+}
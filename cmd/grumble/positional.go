@@ -0,0 +1,46 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"bytes"
+	"mumble.info/grumble/pkg/packetdata"
+)
+
+// Check whether client and other are positional-compatible, that is,
+// whether both have set the same, non-empty plugin context. Positional
+// audio plugins set the context to identify the game (and usually the
+// game server) a user is in, so positional data is only meaningful to
+// clients in the same context.
+func (client *Client) sharesPluginContext(other *Client) bool {
+	return len(client.PluginContext) > 0 && bytes.Equal(client.PluginContext, other.PluginContext)
+}
+
+// The size of the positional data that may follow the audio frames of a
+// voice packet: the speaker's position, as three float32s.
+const positionalDataSize = 3 * 4
+
+// Strip the positional data from buf, a voice packet as relayed by the
+// server. Returns buf unchanged if it holds no positional data, or if it
+// cannot be parsed.
+func stripPositionalData(buf []byte) []byte {
+	if len(buf) < 1 {
+		return buf
+	}
+
+	pds := packetdata.New(buf[1:])
+	_ = pds.GetUint32() // session
+	if !pds.IsValid() {
+		return buf
+	}
+	offset := 1 + pds.Size()
+
+	kind := (buf[0] >> 5) & 0x07
+	end, ok := voiceFramesEnd(kind, buf[offset:])
+	if !ok || len(buf)-(offset+end) != positionalDataSize {
+		return buf
+	}
+	return buf[:offset+end]
+}
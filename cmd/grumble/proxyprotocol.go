@@ -0,0 +1,179 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long a trusted proxy has to send the PROXY protocol header of a
+// connection it accepted.
+const proxyHeaderTimeout = 2 * time.Second
+
+// The longest PROXY protocol v1 header, including its CRLF.
+const proxyV1MaxLength = 107
+
+// The signature that starts a PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// A proxiedConn is a connection accepted from a trusted proxy, whose
+// remote address is that of the client the proxy relays.
+type proxiedConn struct {
+	*peekedConn
+	remote *net.TCPAddr
+}
+
+func (conn *proxiedConn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+// Check whether addr is one of the peers listed in the TrustedProxies
+// config key, as an IP address or a CIDR network.
+func (server *Server) isTrustedProxy(addr net.Addr) bool {
+	tcpaddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, entry := range strings.Split(server.cfg.StringValue("TrustedProxies"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if network.Contains(tcpaddr.IP) {
+				return true
+			}
+		} else if ip := net.ParseIP(entry); ip != nil && ip.Equal(tcpaddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Read the PROXY protocol header, version 1 or 2, that a trusted proxy
+// sends in front of the connections it relays, and return a connection
+// whose remote address is the client's. Connections from peers that
+// aren't trusted proxies are returned as they are. Returns an error if
+// the header is malformed, in which case the connection must be closed.
+//
+// Called on the connection's own goroutine, so a proxy that is slow to
+// send the header only holds up that connection.
+func (server *Server) readProxyHeader(conn net.Conn) (net.Conn, error) {
+	if !server.isTrustedProxy(conn.RemoteAddr()) {
+		return conn, nil
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	reader := bufio.NewReaderSize(conn, 256)
+	remote, err := parseProxyHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	if remote == nil {
+		remote = conn.RemoteAddr().(*net.TCPAddr)
+	}
+	return &proxiedConn{&peekedConn{conn, reader}, remote}, nil
+}
+
+// Parse a PROXY protocol header from reader. Returns the client address
+// it carries, or nil if the proxy sent the connection on its own behalf,
+// or for a protocol other than TCP.
+func parseProxyHeader(reader *bufio.Reader) (*net.TCPAddr, error) {
+	sig, err := reader.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return parseProxyV2Header(reader)
+	}
+	return parseProxyV1Header(reader)
+}
+
+// Parse a human-readable PROXY protocol v1 header, such as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 64738\r\n".
+func parseProxyV1Header(reader *bufio.Reader) (*net.TCPAddr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("proxy: malformed v1 header")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errors.New("proxy: malformed v1 header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if (fields[1] != "TCP4" && fields[1] != "TCP6") || len(fields) != 6 {
+		return nil, errors.New("proxy: malformed v1 header")
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || net.ParseIP(fields[3]) == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, errors.New("proxy: malformed v1 address")
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errors.New("proxy: malformed v1 port")
+	}
+	if _, err := strconv.ParseUint(fields[5], 10, 16); err != nil {
+		return nil, errors.New("proxy: malformed v1 port")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// Parse a binary PROXY protocol v2 header.
+func parseProxyV2Header(reader *bufio.Reader) (*net.TCPAddr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, errors.New("proxy: unsupported v2 version")
+	}
+	command := header[12] & 0x0f
+	if command > 1 {
+		return nil, errors.New("proxy: unsupported v2 command")
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+
+	// LOCAL connections are made by the proxy itself, such as health
+	// checks, and carry no client address.
+	if command == 0 {
+		return nil, nil
+	}
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, errors.New("proxy: short v2 address")
+		}
+		return &net.TCPAddr{IP: net.IPv4(body[0], body[1], body[2], body[3]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, errors.New("proxy: short v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mumble.info/grumble/pkg/ban"
+	"net"
+	"testing"
+	"time"
+)
+
+// Dial l and send data. Returns the dialed connection, and the one l
+// accepted for it, or nil if l rejected it.
+func dialTestProxy(t *testing.T, l *tuningListener, accepted chan net.Conn, data string) (net.Conn, net.Conn) {
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("unable to dial: %v", err)
+	}
+	if _, err := client.Write([]byte(data)); err != nil {
+		t.Fatalf("unable to write: %v", err)
+	}
+	select {
+	case conn := <-accepted:
+		return client, conn
+	case <-time.After(500 * time.Millisecond):
+		return client, nil
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	server := newTestServer(t)
+	server.cfg.Set("TrustedProxies", "10.0.0.0/8, 127.0.0.1")
+	server.Bans = []ban.Ban{{IP: net.ParseIP("192.0.2.1"), Mask: 128}}
+
+	l, accepted := newTestProbeListener(t, server)
+	defer l.Close()
+
+	// The client address in the header replaces the proxy's, and is
+	// what bans are matched against.
+	client, conn := dialTestProxy(t, l, accepted, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 64738\r\nhello")
+	defer client.Close()
+	if conn == nil {
+		t.Fatalf("Expected the proxied connection to be accepted")
+	}
+	defer conn.Close()
+	addr := conn.RemoteAddr().(*net.TCPAddr)
+	if !addr.IP.Equal(net.ParseIP("192.0.2.1")) || addr.Port != 56324 {
+		t.Errorf("Expected the client's address, got %v", addr)
+	}
+	if !server.IsConnectionBanned(conn) {
+		t.Errorf("Expected the ban on the client's address to match")
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("Expected the data after the header, got %q (%v)", buf, err)
+	}
+
+	// Malformed headers are rejected.
+	client, conn = dialTestProxy(t, l, accepted, "PROXY TCP4 192.0.2.1\r\n")
+	defer client.Close()
+	if conn != nil {
+		conn.Close()
+		t.Errorf("Expected a malformed header to be rejected")
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(buf); err != io.EOF {
+		t.Errorf("Expected the rejected connection to be closed, got %v", err)
+	}
+
+	// Peers that aren't trusted proxies are taken at their word.
+	server.cfg.Set("TrustedProxies", "10.0.0.1")
+	client, conn = dialTestProxy(t, l, accepted, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 64738\r\n")
+	defer client.Close()
+	if conn == nil {
+		t.Fatalf("Expected the direct connection to be accepted")
+	}
+	defer conn.Close()
+	if addr := conn.RemoteAddr().(*net.TCPAddr); !addr.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("Expected the peer's own address, got %v", addr)
+	}
+}
+
+func TestParseProxyV2Header(t *testing.T) {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x21, 0x11, 0, 12)
+	header = append(header, 192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0xfd, 0x22)
+	addr, err := parseProxyHeader(bufio.NewReader(bytes.NewReader(header)))
+	if err != nil {
+		t.Fatalf("unable to parse header: %v", err)
+	}
+	if !addr.IP.Equal(net.ParseIP("192.0.2.1")) || addr.Port != 56324 {
+		t.Errorf("Expected the client's address, got %v", addr)
+	}
+
+	// LOCAL connections carry no address.
+	local := append([]byte{}, proxyV2Signature...)
+	local = append(local, 0x20, 0x00, 0, 0)
+	addr, err = parseProxyHeader(bufio.NewReader(bytes.NewReader(local)))
+	if err != nil || addr != nil {
+		t.Errorf("Expected no address for a LOCAL connection, got %v (%v)", addr, err)
+	}
+
+	bad := append([]byte{}, proxyV2Signature...)
+	bad = append(bad, 0x31, 0x11, 0, 0)
+	if _, err := parseProxyHeader(bufio.NewReader(bytes.NewReader(bad))); err == nil {
+		t.Errorf("Expected an unsupported version to be rejected")
+	}
+}
+
+func TestProxyHeaderSilentConnection(t *testing.T) {
+	server := newTestServer(t)
+	server.cfg.Set("TrustedProxies", "127.0.0.1")
+	server.cfg.Set("StatsProbe", "true")
+
+	tcpl, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	l := &tuningListener{tcpl, server}
+	defer l.Close()
+	go server.acceptLoop(l)
+
+	// A proxy connection that sends no header is read on its own
+	// goroutine, so a connection after it is served without waiting for
+	// it to time out.
+	silent, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("unable to dial: %v", err)
+	}
+	defer silent.Close()
+
+	start := time.Now()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("unable to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 64738\r\n"))
+	conn.Write(make([]byte, pingRequestSize))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	reply, err := io.ReadAll(conn)
+	if err != nil || len(reply) != 24 {
+		t.Fatalf("Expected a 24-byte probe reply, got %v bytes (%v)", len(reply), err)
+	}
+	if elapsed := time.Since(start); elapsed >= proxyHeaderTimeout {
+		t.Errorf("Expected the probe to be answered right away, took %v", elapsed)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"mumble.info/grumble/pkg/acl"
+	"mumble.info/grumble/pkg/mumbleproto"
+	"sync/atomic"
+	"time"
+)
+
+// A leakyBucket limits the rate of events.
+//
+// Each event fills the bucket by its cost, and the bucket drains at a
+// constant rate. Events that would overflow the bucket are rejected. This
+// allows short bursts of events, up to the size of the bucket, as long as
+// the average rate stays below the drain rate.
+type leakyBucket struct {
+	level float64
+	last  time.Time
+}
+
+// Record an event that happened at now, given a drain rate of rate events
+// per second and a bucket size of burst events. Returns false if the event
+// exceeds the limit, in which case it is not recorded.
+func (lb *leakyBucket) allow(now time.Time, rate int, burst int) bool {
+	return lb.allowN(now, 1, float64(rate), float64(burst))
+}
+
+// Like allow, but for an event that costs n units, given a drain rate of
+// rate units per second and a bucket size of burst units.
+func (lb *leakyBucket) allowN(now time.Time, n float64, rate float64, burst float64) bool {
+	if !lb.last.IsZero() {
+		lb.level -= now.Sub(lb.last).Seconds() * rate
+		if lb.level < 0 {
+			lb.level = 0
+		}
+	}
+	lb.last = now
+
+	if lb.level+n > burst {
+		return false
+	}
+	lb.level += n
+	return true
+}
+
+// Check whether a control message of the given kind, received from client
+// at now, is within the server's message rate limit. Pings and
+// authentication are exempt. Called on the handler goroutine.
+func (server *Server) allowMessage(client *Client, kind uint16, now time.Time) bool {
+	if kind == mumbleproto.MessagePing || kind == mumbleproto.MessageAuthenticate {
+		return true
+	}
+
+	rate := server.cfg.IntValue("MessageLimit")
+	burst := server.cfg.IntValue("MessageBurst")
+	if rate <= 0 || burst <= 0 {
+		return true
+	}
+
+	if client.msgLimiter.allow(now, rate, burst) {
+		client.throttled = false
+		return true
+	}
+
+	if !client.throttled {
+		client.throttled = true
+		atomic.AddUint64(&server.throttleEvents, 1)
+		client.Printf("Exceeded the control message rate limit. Ignoring messages.")
+	}
+	return false
+}
+
+// Check whether client may create another permanent or temporary channel
+// within the server's channel creation rate limit, and record it if so.
+// Called on the handler goroutine.
+func (server *Server) allowChannelCreate(client *Client, temporary bool) bool {
+	limiter := &client.channelLimiter
+	limit := server.cfg.IntValue("ChannelCreateLimit")
+	if temporary {
+		limiter = &client.tempChannelLimiter
+		limit = server.cfg.IntValue("TemporaryChannelCreateLimit")
+	}
+	interval := server.cfg.IntValue("ChannelCreateInterval")
+	if limit <= 0 || interval <= 0 {
+		return true
+	}
+
+	if limiter.allowN(server.now(), 1, float64(limit)/float64(interval), float64(limit)) {
+		return true
+	}
+	client.Printf("Exceeded the channel creation rate limit (temporary=%v)", temporary)
+	return false
+}
+
+// Check whether client may send another text message to channel within
+// the channel's text message rate limit, and record it if so. Clients
+// with write permission on the channel are exempt. Called on the handler
+// goroutine.
+func (server *Server) allowChannelText(client *Client, channel *Channel) bool {
+	limit := channel.TextMessageLimit
+	if limit == 0 {
+		limit = server.cfg.IntValue("ChannelTextMessageLimit")
+	}
+	if limit <= 0 || acl.HasPermission(&channel.ACL, client, acl.WritePermission) {
+		return true
+	}
+
+	if client.textLimiters == nil {
+		client.textLimiters = make(map[int]*leakyBucket)
+	}
+	limiter, ok := client.textLimiters[channel.Id]
+	if !ok {
+		limiter = &leakyBucket{}
+		client.textLimiters[channel.Id] = limiter
+	}
+	if limiter.allowN(server.now(), 1, float64(limit)/60, float64(limit)) {
+		return true
+	}
+	client.Printf("Exceeded the text message rate limit of channel %v", channel.Id)
+	return false
+}
+
+// Check whether client may update one of its voice targets within the
+// server's VoiceTargetLimit, and record it if so. Called on the handler
+// goroutine.
+func (server *Server) allowVoiceTargetUpdate(client *Client) bool {
+	rate := server.cfg.IntValue("VoiceTargetLimit")
+	burst := server.cfg.IntValue("VoiceTargetBurst")
+	if rate <= 0 || burst <= 0 {
+		return true
+	}
+	if client.voiceTargetLimiter.allow(server.now(), rate, burst) {
+		return true
+	}
+	client.logRepeatedf("Exceeded the voice target update rate limit")
+	return false
+}
+
+// Check whether client may send another RequestBlob within the server's
+// RequestBlobLimit, and record it if so. Called on the handler goroutine.
+func (server *Server) allowBlobRequest(client *Client) bool {
+	rate := server.cfg.IntValue("RequestBlobLimit")
+	burst := server.cfg.IntValue("RequestBlobBurst")
+	if rate <= 0 || burst <= 0 {
+		return true
+	}
+	if client.blobLimiter.allow(server.now(), rate, burst) {
+		return true
+	}
+	client.logRepeatedf("Exceeded the blob request rate limit")
+	return false
+}
+
+// Check whether client may have the server's state resent to it within
+// the server's ResyncInterval, and record it if so. Called on the handler
+// goroutine.
+func (server *Server) allowResync(client *Client) bool {
+	interval := server.cfg.IntValue("ResyncInterval")
+	if interval <= 0 {
+		return true
+	}
+	if client.resyncLimiter.allowN(server.now(), 1, 1/float64(interval), 1) {
+		return true
+	}
+	client.logRepeatedf("Exceeded the resync rate limit")
+	return false
+}
+
+// Get the number of times a client has exceeded the server's control
+// message rate limit. A client that is throttled again after its rate
+// dropped back under the limit counts again.
+func (server *Server) ThrottleEvents() uint64 {
+	return atomic.LoadUint64(&server.throttleEvents)
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Move the running server to addr, a host:port, without disconnecting
+// its clients, whose connections are left as they are. An empty host
+// keeps the server's current Address.
+//
+// The server's sockets are opened on addr first. If any of them can't
+// be, they are closed again and the server stays where it is. Otherwise,
+// new clients are accepted on addr from then on. The old TCP listener
+// keeps accepting clients for drain, for clients that still connect to
+// the old address, and is then closed; a drain of zero closes it right
+// away. The old UDP sockets are closed right away, and clients connected
+// through the old port fall back to tunneling their voice over TCP.
+//
+// The Address and Port config keys are updated to addr, so the server
+// listens on it after a restart as well. Rebind waits for a concurrent
+// Start or Stop to finish, and fails if the server has stopped.
+func (server *Server) Rebind(addr string, drain time.Duration) error {
+	server.runLock.Lock()
+	defer server.runLock.Unlock()
+	if !server.running {
+		return errors.New("server not running")
+	}
+
+	host, portstr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		host = server.HostAddress()
+	} else if net.ParseIP(host) == nil {
+		return errors.New("invalid host address " + host)
+	}
+	port, err := strconv.Atoi(portstr)
+	if err != nil || port < 1 || port > 65535 {
+		return errors.New("invalid port " + portstr)
+	}
+
+	udpconns, err := server.listenUDP(host, port)
+	if err != nil {
+		return err
+	}
+	tcpl, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP(host), Port: port})
+	if err != nil {
+		for _, conn := range udpconns {
+			conn.Close()
+		}
+		return err
+	}
+	server.stopLock.Lock()
+	oldtcpl := server.tcpl
+	server.tcpl = tcpl
+	server.stopLock.Unlock()
+	server.udplock.Lock()
+	oldudpconns := server.udpconns
+	server.udpconns = udpconns
+	server.udplock.Unlock()
+	server.startNetworkLoops(&tuningListener{tcpl, server}, udpconns)
+
+	for _, conn := range oldudpconns {
+		conn.Close()
+	}
+	if drain > 0 {
+		server.drainlock.Lock()
+		server.draining = append(server.draining, oldtcpl)
+		server.drainlock.Unlock()
+		time.AfterFunc(drain, func() {
+			server.closeDrainingListener(oldtcpl)
+		})
+	} else {
+		oldtcpl.Close()
+	}
+
+	server.cfg.Set("Address", host)
+	server.sendConfigUpdate(&KeyValuePair{Key: "Address", Value: host})
+	server.cfg.Set("Port", strconv.Itoa(port))
+	server.sendConfigUpdate(&KeyValuePair{Key: "Port", Value: strconv.Itoa(port)})
+
+	server.Printf("Moved: listening on %v", tcpl.Addr())
+	return nil
+}
+
+// Close l, a listener Rebind left open, unless it has been closed
+// already.
+func (server *Server) closeDrainingListener(l net.Listener) {
+	server.drainlock.Lock()
+	defer server.drainlock.Unlock()
+	for i, draining := range server.draining {
+		if draining == l {
+			l.Close()
+			server.draining = append(server.draining[:i], server.draining[i+1:]...)
+			return
+		}
+	}
+}
+
+// Close all the listeners Rebind left open.
+func (server *Server) closeDrainingListeners() {
+	server.drainlock.Lock()
+	defer server.drainlock.Unlock()
+	for _, l := range server.draining {
+		l.Close()
+	}
+	server.draining = nil
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"crypto/tls"
+	"github.com/golang/protobuf/proto"
+	"mumble.info/grumble/pkg/mumbleproto"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRebind(t *testing.T) {
+	defer setupTestDataDir(t)()
+
+	server := newTestServer(t)
+	oldPort := freeTestPort(t)
+	newPort := freeTestPort(t)
+	server.cfg.Set("Address", "127.0.0.1")
+	server.cfg.Set("Port", strconv.Itoa(oldPort))
+	if err := server.Start(); err != nil {
+		t.Fatalf("unable to start server: %v", err)
+	}
+
+	login := func(port int, name string) (*tls.Conn, *testPeer) {
+		conn, err := tls.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("unable to connect: %v", err)
+		}
+		peer := &testPeer{conn: conn, msgs: make(chan *Message, 64)}
+		go peer.readLoop()
+		peer.expect(t, mumbleproto.MessageVersion, nil)
+		peer.send(t, &mumbleproto.Version{Version: proto.Uint32(0x10205)})
+		peer.send(t, &mumbleproto.Authenticate{Username: proto.String(name)})
+		peer.expect(t, mumbleproto.MessageServerSync, nil)
+		return conn, peer
+	}
+	hangUp := func(conn *tls.Conn, peer *testPeer) {
+		conn.CloseWrite()
+		for range peer.msgs {
+		}
+		conn.Close()
+	}
+
+	aliceConn, alicePeer := login(oldPort, "alice")
+
+	if err := server.Rebind("127.0.0.1:not-a-port", 0); err == nil {
+		t.Errorf("Expected an invalid address to be rejected")
+	}
+
+	// A port that is taken leaves the server where it is.
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	if err := server.Rebind(taken.Addr().String(), 0); err == nil {
+		t.Errorf("Expected rebinding to a port in use to fail")
+	}
+	taken.Close()
+	if server.CurrentPort() != oldPort {
+		t.Errorf("Expected a failed rebind to leave the server on port %v, got %v", oldPort, server.CurrentPort())
+	}
+
+	// The port can be looked up while the server moves.
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				server.CurrentPort()
+			}
+		}
+	}()
+	err = server.Rebind(net.JoinHostPort("", strconv.Itoa(newPort)), 0)
+	close(done)
+	if err != nil {
+		t.Fatalf("unable to rebind: %v", err)
+	}
+	if server.CurrentPort() != newPort || server.Port() != newPort {
+		t.Errorf("Expected the server on port %v, got %v (configured %v)", newPort, server.CurrentPort(), server.Port())
+	}
+	if conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(oldPort)), time.Second); err == nil {
+		conn.Close()
+		t.Errorf("Expected the old port to be closed")
+	}
+
+	// New clients connect on the new port, and alice, still connected
+	// through the old one, is told about them.
+	bobConn, bobPeer := login(newPort, "bob")
+	userstate := &mumbleproto.UserState{}
+	alicePeer.expect(t, mumbleproto.MessageUserState, userstate)
+	if userstate.GetName() != "bob" {
+		t.Errorf("Expected alice to see bob join, got %v", userstate)
+	}
+
+	hangUp(bobConn, bobPeer)
+	hangUp(aliceConn, alicePeer)
+	if err := server.Stop(); err != nil {
+		t.Fatalf("unable to stop server: %v", err)
+	}
+	if err := server.Rebind(net.JoinHostPort("127.0.0.1", strconv.Itoa(newPort)), 0); err == nil {
+		t.Errorf("Expected rebinding a stopped server to fail")
+	}
+}
+
+func TestRebindDrain(t *testing.T) {
+	defer setupTestDataDir(t)()
+
+	server := newTestServer(t)
+	oldPort := freeTestPort(t)
+	server.cfg.Set("Address", "127.0.0.1")
+	server.cfg.Set("Port", strconv.Itoa(oldPort))
+	if err := server.Start(); err != nil {
+		t.Fatalf("unable to start server: %v", err)
+	}
+
+	// The old listener keeps accepting until the drain is over, or the
+	// server is stopped.
+	if err := server.Rebind(net.JoinHostPort("127.0.0.1", strconv.Itoa(freeTestPort(t))), time.Hour); err != nil {
+		t.Fatalf("unable to rebind: %v", err)
+	}
+	oldAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(oldPort))
+	conn, err := tls.Dial("tcp", oldAddr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Expected the old port to accept clients while draining: %v", err)
+	}
+	peer := &testPeer{conn: conn, msgs: make(chan *Message, 16)}
+	go peer.readLoop()
+	peer.expect(t, mumbleproto.MessageVersion, nil)
+	conn.CloseWrite()
+	for range peer.msgs {
+	}
+	conn.Close()
+
+	if err := server.Stop(); err != nil {
+		t.Fatalf("unable to stop server: %v", err)
+	}
+	if conn, err := net.Dial("tcp", oldAddr); err == nil {
+		conn.Close()
+		t.Errorf("Expected stopping the server to close the draining listener")
+	}
+}
@@ -12,8 +12,10 @@ import (
 	"crypto/tls"
 	"encoding/hex"
 	"encoding/xml"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"time"
 )
 
 type Register struct {
@@ -33,6 +35,33 @@ type Register struct {
 
 const registerUrl = "https://mumble.hive.no/register.cgi"
 
+// The interval between regular registration updates, and the upper
+// bound for the delay between retries of failed registrations.
+const registerInterval = time.Hour
+
+// Determine how long to wait before retrying a public server registration
+// after the given number of consecutive failures. The delay starts at a
+// minute and doubles for each failure, up to registerInterval.
+func registerBackoff(failures int) time.Duration {
+	backoff := time.Minute
+	for i := 1; i < failures && backoff < registerInterval; i++ {
+		backoff *= 2
+	}
+	if backoff > registerInterval {
+		backoff = registerInterval
+	}
+	return backoff
+}
+
+// Get a channel that delivers the time once d has passed, for the
+// handler's registration schedule.
+func (server *Server) registerAfter(d time.Duration) <-chan time.Time {
+	if server.registerTimer == nil {
+		return time.After(d)
+	}
+	return server.registerTimer(d)
+}
+
 // Determines whether a server is public by checking whether the
 // config values required for public registration are set.
 //
@@ -59,6 +88,10 @@ func (server *Server) IsPublic() bool {
 // When a Mumble server connects to the master server
 // for registration, it connects using its server certificate
 // as a client certificate for authentication purposes.
+//
+// The outcome of the registration is reported back to the server's
+// handler goroutine via the registerResult channel, which uses it to
+// schedule retries of failed registrations.
 func (server *Server) RegisterPublicServer() {
 	if !server.IsPublic() {
 		return
@@ -100,27 +133,40 @@ func (server *Server) RegisterPublicServer() {
 	}
 
 	// Post registration XML data to server asynchronously in its own goroutine
+	result := server.registerResult
 	go func() {
-		tr := &http.Transport{
-			TLSClientConfig: config,
-		}
-		client := &http.Client{Transport: tr}
-		r, err := client.Post(registerUrl, "text/xml", ioutil.NopCloser(buf))
+		err := server.postRegistration(config, buf)
 		if err != nil {
-			server.Printf("register: unable to post registration request: %v", err)
-			return
+			server.Printf("register: %v", err)
 		}
-		bodyBytes, err := ioutil.ReadAll(r.Body)
-		if err == nil {
-			registerMsg := string(bodyBytes)
-			if r.StatusCode == 200 {
-				server.Printf("register: %v", registerMsg)
-			} else {
-				server.Printf("register: (status %v) %v", r.StatusCode, registerMsg)
-			}
-		} else {
-			server.Printf("register: unable to read post response: %v", err)
-			return
+		select {
+		case result <- err:
+		default:
 		}
 	}()
 }
+
+// Post the registration XML document in buf to the public server list.
+func (server *Server) postRegistration(config *tls.Config, buf *bytes.Buffer) error {
+	tr := &http.Transport{
+		TLSClientConfig: config,
+	}
+	client := &http.Client{Transport: tr}
+	r, err := client.Post(registerUrl, "text/xml", ioutil.NopCloser(buf))
+	if err != nil {
+		return fmt.Errorf("unable to post registration request: %v", err)
+	}
+	defer r.Body.Close()
+
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return fmt.Errorf("unable to read post response: %v", err)
+	}
+	registerMsg := string(bodyBytes)
+	if r.StatusCode != 200 {
+		return fmt.Errorf("(status %v) %v", r.StatusCode, registerMsg)
+	}
+
+	server.Printf("register: %v", registerMsg)
+	return nil
+}
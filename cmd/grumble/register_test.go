@@ -0,0 +1,107 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRegisterBackoff(t *testing.T) {
+	expected := []time.Duration{
+		time.Minute,
+		2 * time.Minute,
+		4 * time.Minute,
+		8 * time.Minute,
+		16 * time.Minute,
+		32 * time.Minute,
+		time.Hour,
+		time.Hour,
+	}
+	for i, backoff := range expected {
+		if got := registerBackoff(i + 1); got != backoff {
+			t.Errorf("Unexpected backoff after %v failures. Got %v, expected %v", i+1, got, backoff)
+		}
+	}
+}
+
+func TestServerIsPublic(t *testing.T) {
+	server := newTestServer(t)
+	if server.IsPublic() {
+		t.Errorf("Expected public registration to be off by default")
+	}
+
+	server.cfg.Set("RegisterName", "Test")
+	server.cfg.Set("RegisterHost", "mumble.example.com")
+	server.cfg.Set("RegisterPassword", "secret")
+	server.cfg.Set("RegisterWebUrl", "https://example.com")
+	if !server.IsPublic() {
+		t.Errorf("Expected server to be public once registration is configured")
+	}
+}
+
+// A registration timer requested by the server's handler.
+type testRegisterTimer struct {
+	d    time.Duration
+	fire chan time.Time
+}
+
+func TestRegisterRetry(t *testing.T) {
+	server := newTestServer(t)
+	timers := make(chan testRegisterTimer, 10)
+	server.registerTimer = func(d time.Duration) <-chan time.Time {
+		timer := testRegisterTimer{d, make(chan time.Time)}
+		timers <- timer
+		return timer.fire
+	}
+
+	done := make(chan bool)
+	go func() {
+		server.handlerLoop()
+		close(done)
+	}()
+	defer func() {
+		close(server.bye)
+		<-done
+	}()
+
+	next := func(expected time.Duration) testRegisterTimer {
+		select {
+		case timer := <-timers:
+			if timer.d != expected {
+				t.Fatalf("Expected a registration in %v, got %v", expected, timer.d)
+			}
+			return timer
+		case <-time.After(time.Second):
+			t.Fatalf("Expected a registration to be scheduled")
+		}
+		return testRegisterTimer{}
+	}
+
+	// The first registration is followed by the hourly update.
+	first := next(time.Minute)
+	first.fire <- time.Now()
+	hourly := next(registerInterval)
+
+	// Failures are retried with backoff, in place of the hourly update.
+	server.registerResult <- errors.New("unreachable")
+	next(time.Minute)
+	server.registerResult <- errors.New("unreachable")
+	retry := next(2 * time.Minute)
+	select {
+	case hourly.fire <- time.Now():
+		t.Errorf("Expected the hourly update not to be pending during a retry")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The retry is followed by the hourly update again, and a success
+	// resets the backoff.
+	retry.fire <- time.Now()
+	next(registerInterval)
+	server.registerResult <- nil
+	server.registerResult <- errors.New("unreachable")
+	next(time.Minute)
+}
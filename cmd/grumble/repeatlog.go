@@ -0,0 +1,89 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How long log messages that a client repeats are collapsed for.
+const repeatedLogWindow = 10 * time.Second
+
+// A repeatLog collapses the log messages a client repeats, such as the
+// errors caused by each packet of a broken or malicious client, so they
+// don't drown out the rest of the log. Messages are keyed by their format.
+type repeatLog struct {
+	mutex   sync.Mutex
+	entries map[string]*repeatedMessage
+}
+
+// A message a client has logged within the current repeatedLogWindow.
+type repeatedMessage struct {
+	start time.Time
+	count int
+	last  string
+}
+
+// Get the line that reports the messages that were left out of the log.
+func (msg *repeatedMessage) summary() string {
+	return fmt.Sprintf("%v (%v similar messages suppressed)", msg.last, msg.count)
+}
+
+// Log a message, like Printf, unless the client has logged one with the
+// same format within repeatedLogWindow. The first message is logged right
+// away. Repeats are counted instead, and reported on a single line when
+// the window has passed, or when the client disconnects.
+//
+// Called from the UDP goroutines as well as the server's handler.
+func (client *Client) logRepeatedf(format string, v ...interface{}) {
+	now := client.server.now()
+	text := fmt.Sprintf(format, v...)
+
+	repeats := &client.repeats
+	repeats.mutex.Lock()
+	if repeats.entries == nil {
+		repeats.entries = make(map[string]*repeatedMessage)
+	}
+	msg, ok := repeats.entries[format]
+	if ok && now.Sub(msg.start) < repeatedLogWindow {
+		msg.count++
+		msg.last = text
+		repeats.mutex.Unlock()
+		return
+	}
+	summary := ""
+	if ok && msg.count > 0 {
+		summary = msg.summary()
+	}
+	repeats.entries[format] = &repeatedMessage{start: now}
+	repeats.mutex.Unlock()
+
+	if summary != "" {
+		client.Print(summary)
+	}
+	client.Print(text)
+}
+
+// Log the repeated messages that have been left out of the log so far.
+func (client *Client) flushRepeatedLogs() {
+	repeats := &client.repeats
+	repeats.mutex.Lock()
+	summaries := []string{}
+	for _, msg := range repeats.entries {
+		if msg.count > 0 {
+			summaries = append(summaries, msg.summary())
+		}
+	}
+	repeats.entries = nil
+	repeats.mutex.Unlock()
+
+	sort.Strings(summaries)
+	for _, summary := range summaries {
+		client.Print(summary)
+	}
+}
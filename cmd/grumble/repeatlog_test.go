@@ -0,0 +1,80 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRepeatedLogCollapsed(t *testing.T) {
+	server := newTestServer(t)
+	clock := newFakeClock()
+	server.SetClock(clock)
+	buf := new(bytes.Buffer)
+	server.Logger = log.New(buf, "", 0)
+	client, _ := newTestClient(server, "client")
+
+	lines := func() []string {
+		text := strings.TrimSpace(buf.String())
+		buf.Reset()
+		if text == "" {
+			return nil
+		}
+		return strings.Split(text, "\n")
+	}
+
+	for i := 0; i < 1000; i++ {
+		client.logRepeatedf("dropped malformed voice packet (%v bytes)", i)
+	}
+	logged := lines()
+	if len(logged) != 1 || !strings.HasSuffix(logged[0], "dropped malformed voice packet (0 bytes)") {
+		t.Fatalf("Expected only the first message to be logged, got %q", logged)
+	}
+
+	// Other messages aren't held back by the repeated one.
+	client.logRepeatedf("requesting crypt resync")
+	if logged := lines(); len(logged) != 1 {
+		t.Errorf("Expected a different message to be logged, got %q", logged)
+	}
+
+	// Once the window has passed, the repeats are reported along with
+	// the next message.
+	clock.advance(repeatedLogWindow)
+	client.logRepeatedf("dropped malformed voice packet (%v bytes)", 1000)
+	logged = lines()
+	if len(logged) != 2 || !strings.HasSuffix(logged[0], "dropped malformed voice packet (999 bytes) (999 similar messages suppressed)") ||
+		!strings.HasSuffix(logged[1], "dropped malformed voice packet (1000 bytes)") {
+		t.Errorf("Expected a summary followed by the new message, got %q", logged)
+	}
+
+	// Repeats that are pending when the client disconnects are reported.
+	client.logRepeatedf("dropped malformed voice packet (%v bytes)", 1001)
+	client.Disconnect()
+	if !strings.Contains(buf.String(), "dropped malformed voice packet (1001 bytes) (1 similar messages suppressed)") {
+		t.Errorf("Expected the pending repeats to be reported on disconnect, got %q", lines())
+	}
+}
+
+func TestRepeatedLogWindow(t *testing.T) {
+	server := newTestServer(t)
+	clock := newFakeClock()
+	server.SetClock(clock)
+	buf := new(bytes.Buffer)
+	server.Logger = log.New(buf, "", 0)
+	client, _ := newTestClient(server, "client")
+
+	// A message repeated less often than the window is always logged.
+	for i := 0; i < 3; i++ {
+		client.logRepeatedf("unable to decrypt incoming packet")
+		clock.advance(repeatedLogWindow + time.Second)
+	}
+	if n := strings.Count(buf.String(), "unable to decrypt incoming packet"); n != 3 {
+		t.Errorf("Expected 3 messages to be logged, got %v", n)
+	}
+}
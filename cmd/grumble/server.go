@@ -10,13 +10,16 @@ import (
 	"crypto/rand"
 	"crypto/sha1"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/golang/protobuf/proto"
 	"hash"
+	"html"
 	"log"
+	"math"
 	"mumble.info/grumble/pkg/acl"
 	"mumble.info/grumble/pkg/ban"
 	"mumble.info/grumble/pkg/freezer"
@@ -26,10 +29,15 @@ import (
 	"mumble.info/grumble/pkg/serverconf"
 	"mumble.info/grumble/pkg/sessionpool"
 	"net"
+	"net/http"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
 // The default port a Murmur server listens on
@@ -57,18 +65,120 @@ type KeyValuePair struct {
 type Server struct {
 	Id int64
 
-	tcpl    *net.TCPListener
-	tlsl    net.Listener
-	udpconn *net.UDPConn
-	tlscfg  *tls.Config
-	bye     chan bool
-	netwg   sync.WaitGroup
-	running bool
+	// Voice packet counters. Follows Id to ensure 64-bit alignment.
+	voiceStats VoiceStats
+	// The number of times a client has exceeded the control message
+	// rate limit. Accessed atomically. Follows voiceStats to ensure
+	// 64-bit alignment.
+	throttleEvents uint64
+	// The bytes received from and sent to clients, over TCP and UDP.
+	// Accessed atomically. Follow throttleEvents to ensure 64-bit
+	// alignment.
+	bytesIn  uint64
+	bytesOut uint64
+
+	// The number of clients that have finished logging in, for the
+	// replies to pings, which are answered off the handler goroutine.
+	// Accessed atomically.
+	readyUsers int32
+
+	tcpl   *net.TCPListener
+	tlscfg *tls.Config
+	bye    chan bool
+	netwg  sync.WaitGroup
+
+	// The CAs that strong client certificates are signed by. Nil
+	// means the system's CAs.
+	clientCAs *x509.CertPool
+
+	// The server's UDP sockets. See udpconns.go. Replaced under
+	// udplock by Rebind.
+	udplock  sync.RWMutex
+	udpconns []*net.UDPConn
+
+	// Listeners left open by Rebind for a while after the server
+	// moved. See rebind.go.
+	drainlock sync.Mutex
+	draining  []net.Listener
+
+	// The connections accepted on the TCP port that are still open, and
+	// the goroutines serving them and their clients. See conns.go.
+	connlock sync.Mutex
+	conns    map[*trackedConn]bool
+	connwg   sync.WaitGroup
+
+	// Closed when the handler goroutine has ended.
+	handlerDone chan struct{}
+
+	// The time at which the server was last started.
+	startTime time.Time
+
+	// The per-client bandwidth last sent to clients, if they share
+	// a TotalBandwidth. See bandwidth.go.
+	sentBandwidth uint32
+
+	// The rate limit of stats probes on the TCP port. Protected by
+	// probeLock, since each connection is sniffed on its own goroutine.
+	probeLock    sync.Mutex
+	probeLimiter leakyBucket
+
+	// The source of time for the server's internal timers, and the time
+	// it was set at. See clock.go.
+	clock Clock
+	epoch time.Time
+
+	// The health check endpoint, if enabled. Stopping marks the server
+	// unhealthy while it shuts down.
+	healthsrv   *http.Server
+	healthProbe chan struct{}
+
+	// Serializes Start and Stop, which may be called concurrently, for
+	// example by the operator and by a worker that keeps panicking.
+	runLock sync.Mutex
+
+	// Protects running and stopping, tcpl while the server is running,
+	// and the channels that goroutines other than the handler probe it
+	// through: healthProbe, gaugeProbe, clientsProbe, stateProbe,
+	// whispersProbe and broadcasts. Probes hold it for reading until the
+	// handler has taken their request, so that Stop doesn't begin to
+	// shut the handler down while one is being handed over. Running and
+	// tcpl are only written with runLock held as well, so Start, Stop
+	// and Rebind read them directly.
+	stopLock sync.RWMutex
+	running  bool
+	stopping bool
+
+	// Requests for the server's gauges, answered by the handler, and
+	// the number of disconnects by class. See metrics.go.
+	gaugeProbe       chan chan serverGauges
+	disconnectsMutex sync.Mutex
+	disconnects      map[string]uint64
+
+	// Requests for a snapshot of the server's clients, of its whole
+	// state, or of its whispers, answered by the handler. See
+	// clientinfo.go, dumpstate.go and voicetarget.go.
+	clientsProbe  chan chan []ClientInfo
+	stateProbe    chan chan *StateDump
+	whispersProbe chan chan []Whisper
 
 	incoming       chan *Message
 	voicebroadcast chan *VoiceBroadcast
 	cfgUpdate      chan *KeyValuePair
+	banUpdate      chan bool
+	broadcasts     chan string
 	tempRemove     chan *Channel
+	registerResult chan error
+
+	// Schedules the server's public registrations. Replaced by tests;
+	// nil means time.After. See register.go.
+	registerTimer func(time.Duration) <-chan time.Time
+
+	// Clients that have sent too many abnormal packets.
+	abnormalClients chan *Client
+
+	// Clients to be disconnected, as asked for by goroutines other than
+	// the handler. See Client.requestDisconnect.
+	disconnectRequests chan disconnectRequest
 
 	// Signals to the server that a client has been successfully
 	// authenticated.
@@ -77,9 +187,29 @@ type Server struct {
 	// Server configuration
 	cfg *serverconf.Config
 
+	// The compiled name regexes, by config key. See isValidName.
+	nameRegexLock sync.Mutex
+	nameRegexes   map[string]*nameRegex
+
+	// The parsed DefaultGroups config key, and the value it was parsed
+	// from. See defaultgroups.go.
+	defaultGroupsLock   sync.Mutex
+	defaultGroupsSpec   string
+	defaultGroupEntries []defaultGroup
+
+	// The parsed EnterTokens config key, and the value it was parsed
+	// from. See channel.go.
+	enterTokensLock sync.Mutex
+	enterTokensSpec string
+	enterTokenMap   map[int]string
+
 	// Clients
 	clients map[uint32]*Client
 
+	// Clients waiting in the queue channel for a slot, in the order
+	// they arrived. They are also in clients.
+	queue []*Client
+
 	// Host, host/port -> client mapping
 	hmutex    sync.Mutex
 	hclients  map[string][]*Client
@@ -108,10 +238,29 @@ type Server struct {
 	numLogOps int
 	freezelog *freezer.Log
 
+	// Text message log. Nil unless enabled.
+	textlog *TextLog
+
+	// Until when voice is paused on the whole server. Only accessed
+	// by the handler goroutine. See PauseVoice.
+	voicePausedUntil time.Time
+
 	// Bans
 	banlock sync.RWMutex
 	Bans    []ban.Ban
 
+	// Temporary access tokens issued by the operator
+	tokenlock    sync.Mutex
+	accessTokens map[string]accessToken
+
+	// Looks up metadata about the addresses clients connect from.
+	// Nil unless set by the operator.
+	AddressResolver AddressResolver
+
+	// Filters that text messages are run through before they are
+	// delivered, in order. Empty unless set by the operator.
+	TextFilters []TextFilter
+
 	// Logging
 	*log.Logger
 }
@@ -136,6 +285,7 @@ func NewServer(id int64) (s *Server, err error) {
 	s.Id = id
 
 	s.cfg = serverconf.New(nil)
+	s.SetClock(systemClock{})
 
 	s.Users = make(map[uint32]*User)
 	s.UserCertMap = make(map[string]*User)
@@ -167,6 +317,25 @@ func (server *Server) RootChannel() *Channel {
 	return root
 }
 
+// Find a channel by its path, which lists the names of the channel and
+// its ancestors below the root channel, separated by slashes, as in
+// "/Lobby/Games". Names are matched like ChildByName does. Empty names
+// are skipped, so "/" and "" are the root channel. Returns nil if there
+// is no such channel.
+func (server *Server) ChannelByPath(path string) *Channel {
+	channel := server.RootChannel()
+	for _, name := range strings.Split(path, "/") {
+		if len(name) == 0 {
+			continue
+		}
+		channel = channel.ChildByName(name)
+		if channel == nil {
+			return nil
+		}
+	}
+	return channel
+}
+
 // Set password as the new SuperUser password
 func (server *Server) SetSuperUserPassword(password string) {
 	saltBytes := make([]byte, 24)
@@ -188,6 +357,57 @@ func (server *Server) SetSuperUserPassword(password string) {
 	server.cfgUpdate <- &KeyValuePair{Key: key, Value: val}
 }
 
+// Hand kvp, a config update, to the server's handler, which writes it to
+// the freeze log. Nothing is sent if the server isn't running, and the
+// send is given up on if the server stops before the handler takes it.
+// Must not be called on the handler goroutine.
+func (server *Server) sendConfigUpdate(kvp *KeyValuePair) {
+	server.stopLock.RLock()
+	update, bye := server.cfgUpdate, server.bye
+	running := server.running && !server.stopping
+	server.stopLock.RUnlock()
+	if !running {
+		return
+	}
+	select {
+	case update <- kvp:
+	case <-bye:
+	}
+}
+
+// Get the channel that newly connected clients join. This is the
+// channel set via the DefaultChannel config key, or the root channel
+// if no such channel exists.
+func (server *Server) DefaultChannel() *Channel {
+	channel, ok := server.Channels[server.cfg.IntValue("DefaultChannel")]
+	if !ok {
+		return server.RootChannel()
+	}
+	return channel
+}
+
+// Set the channel that newly connected clients join.
+func (server *Server) SetDefaultChannel(channel *Channel) {
+	key := "DefaultChannel"
+	val := strconv.Itoa(channel.Id)
+	server.cfg.Set(key, val)
+	server.cfgUpdate <- &KeyValuePair{Key: key, Value: val}
+}
+
+// Pick the channel a newly authenticated client should join.
+// Registered users return to the channel they were last in, if the
+// server is configured to remember it and the user can still enter it.
+// Everyone else joins the server's default channel.
+func (server *Server) joinChannel(client *Client) *Channel {
+	if client.IsRegistered() && server.cfg.BoolValue("RememberChannel") {
+		lastChannel, ok := server.Channels[client.user.LastChannelId]
+		if ok && lastChannel.CanEnter(client) {
+			return lastChannel
+		}
+	}
+	return server.DefaultChannel()
+}
+
 // Check whether password matches the set SuperUser password.
 func (server *Server) CheckSuperUserPassword(password string) bool {
 	parts := strings.Split(server.cfg.StringValue("SuperUserPassword"), "$")
@@ -246,21 +466,23 @@ func (server *Server) handleIncomingClient(conn net.Conn) (err error) {
 	client.tcpaddr = addr.(*net.TCPAddr)
 	client.server = server
 	client.conn = conn
-	client.reader = bufio.NewReader(client.conn)
+	client.reader = bufio.NewReaderSize(client.conn, server.cfg.IntValue("TCPReadBufferSize"))
+	client.connectTime = server.now()
+	client.logEvent("connect", "addr", addr)
 
 	client.state = StateClientConnected
 
 	client.udprecv = make(chan []byte)
 	client.voiceTargets = make(map[uint32]*VoiceTarget)
+	client.touchPing()
 
 	client.user = nil
 
 	// Extract user's cert hash
 	tlsconn := client.conn.(*tls.Conn)
-	err = tlsconn.Handshake()
+	err = server.handshakeTLS(tlsconn)
 	if err != nil {
-		client.Printf("TLS handshake failed: %v", err)
-		client.Disconnect()
+		client.Panicf("TLS handshake failed: %v", err)
 		return
 	}
 
@@ -271,23 +493,36 @@ func (server *Server) handleIncomingClient(conn net.Conn) (err error) {
 		sum := hash.Sum(nil)
 		client.certHash = hex.EncodeToString(sum)
 	}
+	client.strongCert = server.isStrongCertificate(state.PeerCertificates)
 
 	// Check whether the client's cert hash is banned
 	if server.IsCertHashBanned(client.CertHash()) {
-		client.Printf("Certificate hash is banned")
-		client.Disconnect()
+		client.Panicf("Certificate hash is banned")
 		return
 	}
 
 	// Launch network readers
-	go client.tlsRecvLoop()
-	go client.udpRecvLoop()
+	server.goServe(client.tlsRecvLoop)
+	server.goServe(client.udpRecvLoop)
 
 	return
 }
 
+// Perform the TLS handshake on conn, aborting it if it hasn't completed
+// within TLSHandshakeTimeout seconds, so a peer that stalls the handshake
+// doesn't hold on to its connection for good.
+func (server *Server) handshakeTLS(conn *tls.Conn) error {
+	if timeout := server.cfg.IntValue("TLSHandshakeTimeout"); timeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second)); err != nil {
+			return err
+		}
+		defer conn.SetDeadline(time.Time{})
+	}
+	return conn.Handshake()
+}
+
 // Remove a disconnected client from the server's
-// internal representation.
+// internal representation. Called on the server's handler goroutine.
 func (server *Server) RemoveClient(client *Client, kicked bool) {
 	server.hmutex.Lock()
 	host := client.tcpaddr.IP.String()
@@ -304,26 +539,104 @@ func (server *Server) RemoveClient(client *Client, kicked bool) {
 	}
 	server.hmutex.Unlock()
 
+	client.Debugf("voice packets relayed: %v", client.VoiceStats())
+
 	delete(server.clients, client.Session())
+	if client.state == StateClientReady {
+		atomic.AddInt32(&server.readyUsers, -1)
+	}
+	server.dequeueClient(client)
 	server.pool.Reclaim(client.Session())
+	server.updateClientBandwidth()
+
+	// Remember when a registered user was last seen, and where.
+	if client.IsRegistered() && client.Channel != nil {
+		server.UpdateFrozenUserLastChannel(client)
+	}
 
 	// Remove client from channel
 	channel := client.Channel
 	if channel != nil {
 		channel.RemoveClient(client)
+		if client.state > StateClientAuthenticated {
+			server.announceChannelMove(client, channel, false)
+		}
 	}
 
+	// Voice targets may have cached the client as a recipient.
+	server.ClearCaches()
+	server.stopTalking(client)
+
 	// If the user was not kicked, broadcast a UserRemove message.
 	// If the user is disconnect via a kick, the UserRemove message has already been sent
 	// at this point.
-	if !kicked && client.state > StateClientAuthenticated {
-		err := server.broadcastProtoMessage(&mumbleproto.UserRemove{
+	if !kicked && client.state > StateClientAuthenticated && channel != nil {
+		err := server.broadcastProtoMessageWithPredicate(&mumbleproto.UserRemove{
 			Session: proto.Uint32(client.Session()),
+		}, func(viewer *Client) bool {
+			return server.canSeeChannel(viewer, channel)
 		})
 		if err != nil {
 			server.Panic("Unable to broadcast UserRemove message for disconnected client.")
 		}
 	}
+
+	server.updateCodecVersions(nil)
+
+	// The client may have freed up a slot for a queued client.
+	server.promoteQueuedClients()
+}
+
+// Disconnect a client on behalf of a goroutine other than the handler.
+// See Client.requestDisconnect. A client that has already been kicked is
+// drained of what it sends until it closes its end of the connection.
+// Once its receiver reports that it has, the connection is closed.
+func (server *Server) handleDisconnectRequest(req disconnectRequest) {
+	client := req.client
+	if client.isDisconnected() {
+		client.conn.Close()
+		return
+	}
+	client.classifyDisconnect(req.class)
+	client.setDisconnectReason(req.reason)
+	client.Disconnect()
+}
+
+// Disconnect all clients that haven't sent us a ping (via either TCP
+// or UDP) within the server's configured timeout. Clients whose network
+// connectivity disappears without their TCP connection being reset are
+// only detectable this way.
+func (server *Server) removeTimedOutClients() {
+	timeout := int64(server.cfg.IntValue("Timeout"))
+	if timeout <= 0 {
+		return
+	}
+
+	for _, client := range server.clients {
+		if client.secondsSincePing() > timeout {
+			client.disconnectWith(DisconnectIdleTimeout, fmt.Sprintf("Timed out (no ping for %v seconds)", client.secondsSincePing()))
+		}
+	}
+}
+
+// Switch clients whose UDP packets have stopped arriving, for example
+// because a firewall started dropping them mid-session, to the TCP
+// tunnel. The client's TCP connection is still alive, or it would have
+// timed out. A client switches back to UDP as soon as we receive a valid
+// UDP packet from it again.
+func (server *Server) checkUDPTimeouts() {
+	timeout := int64(server.cfg.IntValue("UDPTimeout"))
+	if timeout <= 0 {
+		return
+	}
+
+	for _, client := range server.clients {
+		if client.usesUDP() && client.secondsSinceUDP() > timeout {
+			if atomic.CompareAndSwapInt32(&client.udp, 1, 0) {
+				client.Printf("No UDP packets for %v seconds. Falling back to TCP.", client.secondsSinceUDP())
+			}
+		}
+	}
 }
 
 // Add a new channel to the server. Automatically assign it a channel ID.
@@ -335,6 +648,42 @@ func (server *Server) AddChannel(name string) (channel *Channel) {
 	return
 }
 
+// Get the number of temporary channels created by client that still exist.
+func (server *Server) temporaryChannelCount(client *Client) int {
+	count := 0
+	for _, channel := range server.Channels {
+		if channel.IsTemporary() && channel.creator == client {
+			count += 1
+		}
+	}
+	return count
+}
+
+// Checks whether a channel, temporary or not, can be put in parent. A
+// temporary channel is removed once it is empty, so it can't hold
+// permanent channels. It can hold temporary channels if the server's
+// AllowTemporarySubchannels config key is set.
+func (server *Server) canNestChannel(parent *Channel, temporary bool) bool {
+	if !parent.IsTemporary() {
+		return true
+	}
+	return temporary && server.cfg.BoolValue("AllowTemporarySubchannels")
+}
+
+// Remove a temporary channel, if neither it nor its subchannels have any
+// clients left in them. Temporary parents of the channel that are left
+// unoccupied are removed with it.
+func (server *Server) removeTemporaryChannel(channel *Channel) {
+	for channel.IsTemporary() && channel.IsUnoccupied() {
+		if server.Channels[channel.Id] != channel {
+			return
+		}
+		parent := channel.parent
+		server.RemoveChannel(channel)
+		channel = parent
+	}
+}
+
 // Remove a channel from the server.
 func (server *Server) RemoveChanel(channel *Channel) {
 	if channel.Id == 0 {
@@ -349,19 +698,83 @@ func (server *Server) RemoveChanel(channel *Channel) {
 func (server *Server) LinkChannels(channel *Channel, other *Channel) {
 	channel.Links[other.Id] = other
 	other.Links[channel.Id] = channel
+
+	// Voice targets cache the clients in linked channels.
+	server.ClearCaches()
 }
 
 // Unlink two channels
 func (server *Server) UnlinkChannels(channel *Channel, other *Channel) {
 	delete(channel.Links, other.Id)
 	delete(other.Links, channel.Id)
+	server.ClearCaches()
+}
+
+// Relay vb, a voice packet, to the speaker's channel or to the
+// voice target it was sent to, unless the speaker's voice is paused.
+// Voice to a target is also kept out of channels that are paused.
+func (server *Server) relayVoice(vb *VoiceBroadcast) {
+	if server.isVoicePaused(vb.client) {
+		return
+	}
+	if !server.allowSpeakerBandwidth(vb.client, vb.buf) {
+		return
+	}
+	server.noteTalking(vb.client)
+	if vb.target == 0 { // Current channel
+		server.sendChannelVoice(vb)
+		return
+	}
+
+	target, ok := vb.client.voiceTargets[uint32(vb.target)]
+	if !ok {
+		return
+	}
+	if len(target.channels) > 0 {
+		vb.client.countVoiceTarget(VoiceTargetShout)
+	} else {
+		vb.client.countVoiceTarget(VoiceTargetWhisper)
+	}
+	target.SendVoiceBroadcast(vb)
+}
+
+// Relay vb, a voice packet sent to the speaker's current channel, to the
+// other clients in the channel, unless the channel already has as many
+// concurrent speakers as the server's MaxChannelSpeakers allows.
+func (server *Server) sendChannelVoice(vb *VoiceBroadcast) {
+	channel := vb.client.Channel
+	if !channel.allowSpeaker(vb.client, server.now(), server.cfg.IntValue("MaxChannelSpeakers")) {
+		return
+	}
+
+	vb.client.countVoiceTarget(VoiceTargetNormal)
+	for _, client := range channel.clients {
+		if client != vb.client {
+			err := client.sendVoice(vb.client, vb.buf)
+			if err != nil {
+				client.Panicf("Unable to send UDP: %v", err)
+			}
+		}
+	}
 }
 
 // This is the synchronous handler goroutine.
 // Important control channel messages are routed through this Goroutine
 // to keep server state synchronized.
+//
+// All message handlers run on this goroutine, one at a time, so they may
+// freely access and modify server state. In turn, they must not block:
+// a handler that blocks stalls every client on the server.
 func (server *Server) handlerLoop() {
-	regtick := time.Tick(time.Hour)
+	timeouttick := time.Tick(time.Second)
+
+	// Perform the first public server registration shortly after the
+	// server has started, and then every registerInterval. Failed
+	// registrations are retried with backoff. There is only ever one
+	// registration pending, so a retry never doubles up with the
+	// regular update.
+	regtimer := server.registerAfter(1 * time.Minute)
+	regfailures := 0
 	for {
 		select {
 		// We're done. Stop the server's event handler
@@ -373,29 +786,29 @@ func (server *Server) handlerLoop() {
 			server.handleIncomingMessage(client, msg)
 		// Voice broadcast
 		case vb := <-server.voicebroadcast:
-			if vb.target == 0 { // Current channel
-				channel := vb.client.Channel
-				for _, client := range channel.clients {
-					if client != vb.client {
-						err := client.SendUDP(vb.buf)
-						if err != nil {
-							client.Panicf("Unable to send UDP: %v", err)
-						}
-					}
-				}
-			} else {
-				target, ok := vb.client.voiceTargets[uint32(vb.target)]
-				if !ok {
-					continue
-				}
-
-				target.SendVoiceBroadcast(vb)
-			}
+			server.relayVoice(vb)
 		// Remove a temporary channel
 		case tempChannel := <-server.tempRemove:
-			if tempChannel.IsEmpty() {
-				server.RemoveChannel(tempChannel)
-			}
+			server.removeTemporaryChannel(tempChannel)
+		// Disconnect a client that sent too many abnormal packets
+		case client := <-server.abnormalClients:
+			server.removeAbnormalClient(client)
+		// Disconnect a client on behalf of its receivers
+		case req := <-server.disconnectRequests:
+			server.handleDisconnectRequest(req)
+		// Health check of the handler
+		case <-server.healthProbe:
+		// Metrics endpoint scrape
+		case reply := <-server.gaugeProbe:
+			reply <- server.gauges()
+		// Snapshots of the clients, of the whole state and of the
+		// whispers
+		case reply := <-server.clientsProbe:
+			reply <- server.clientInfos()
+		case reply := <-server.stateProbe:
+			reply <- server.state()
+		case reply := <-server.whispersProbe:
+			reply <- server.whispers()
 		// Finish client authentication. Send post-authentication
 		// server info.
 		case client := <-server.clientAuthenticated:
@@ -409,10 +822,39 @@ func (server *Server) handlerLoop() {
 				server.ResetConfig(kvp.Key)
 			}
 
-		// Server registration update
-		// Tick every hour + a minute offset based on the server id.
-		case <-regtick:
+		// Disk freeze ban list update
+		case <-server.banUpdate:
+			server.banlock.RLock()
+			server.UpdateFrozenBans(server.Bans)
+			server.banlock.RUnlock()
+
+		// Server-wide text message
+		case text := <-server.broadcasts:
+			server.broadcastText(text)
+
+		// Server registration update, or the retry of a failed one
+		case <-regtimer:
+			regtimer = server.registerAfter(registerInterval)
 			server.RegisterPublicServer()
+
+		// Outcome of a server registration
+		case err := <-server.registerResult:
+			if err != nil {
+				regfailures += 1
+				backoff := registerBackoff(regfailures)
+				server.Printf("register: retrying in %v", backoff)
+				regtimer = server.registerAfter(backoff)
+			} else {
+				regfailures = 0
+			}
+
+		// Disconnect clients that have stopped pinging us
+		case <-timeouttick:
+			server.removeTimedOutClients()
+			server.checkUDPTimeouts()
+			server.sweepAccessTokens()
+			server.checkTalking()
+			server.updateClientBandwidth()
 		}
 
 		// Check if its time to sync the server state and re-open the log
@@ -442,19 +884,45 @@ func (server *Server) handleAuthenticate(client *Client, msg *Message) {
 	}
 
 	auth := &mumbleproto.Authenticate{}
-	err := proto.Unmarshal(msg.buf, auth)
-	if err != nil {
-		client.Panic("Unable to unmarshal Authenticate message.")
+	if !client.unmarshalMessage(msg, auth) {
 		return
 	}
 
 	// Set access tokens. Clients can set their access tokens any time
 	// by sending an Authenticate message with he contents of their new
 	// access token list.
+	var seen map[*Client]bool
+	if client.state == StateClientReady {
+		seen = server.visibleUsers(client)
+	}
 	client.tokens = auth.Tokens
-	server.ClearCaches()
 
 	if client.state >= StateClientAuthenticated {
+		// Voice targets cache their recipients, which the tokens
+		// may change. Token updates arrive through the handler; a
+		// client that is still logging in isn't a recipient yet.
+		server.ClearCaches()
+		if client.state == StateClientReady {
+			server.updateClientTokens(client, seen)
+		}
+
+		// Clients may also change the codecs they support, for
+		// example after a codec plugin is loaded. A token update
+		// leaves the codec fields unset.
+		if client.state == StateClientReady && (len(auth.CeltVersions) > 0 || auth.Opus != nil) {
+			client.codecs = auth.CeltVersions
+			client.celt = len(client.codecs) > 0
+			if len(client.codecs) == 0 {
+				client.codecs = []int32{CeltCompatBitstream}
+			}
+			client.opus = auth.GetOpus()
+			server.updateCodecVersions(client)
+		}
+		return
+	}
+
+	if reason, ok := server.checkClientRelease(client); !ok {
+		client.disconnectWith(DisconnectWrongVersion, reason)
 		return
 	}
 
@@ -464,7 +932,20 @@ func (server *Server) handleAuthenticate(client *Client, msg *Message) {
 		return
 	}
 
-	client.Username = *auth.Username
+	username := *auth.Username
+	if server.cfg.BoolValue("TrimUsernameWhitespace") {
+		username = strings.TrimSpace(username)
+	}
+	if !server.isValidUserName(username) {
+		client.RejectAuth(mumbleproto.Reject_InvalidUsername, "Invalid username")
+		return
+	}
+	if isReservedUserName(username) {
+		client.RejectAuth(mumbleproto.Reject_InvalidUsername, "That username is reserved")
+		return
+	}
+
+	client.Username = username
 
 	if client.Username == "SuperUser" {
 		if auth.Password == nil {
@@ -504,80 +985,163 @@ func (server *Server) handleAuthenticate(client *Client, msg *Message) {
 		}
 	}
 
-	// Setup the cryptstate for the client.
-	err = client.crypt.GenerateKey(client.CryptoMode)
+	// Setup the cryptstate for the client. It is sent to the client
+	// once its login has been accepted, in finishAuthenticate.
+	err := client.crypt.GenerateKey(client.CryptoMode)
 	if err != nil {
 		client.Panicf("%v", err)
 		return
 	}
 
-	// Send CryptState information to the client so it can establish an UDP connection,
-	// if it wishes.
-	client.lastResync = time.Now().Unix()
-	err = client.sendMessage(&mumbleproto.CryptSetup{
-		Key:         client.crypt.Key,
-		ClientNonce: client.crypt.DecryptIV,
-		ServerNonce: client.crypt.EncryptIV,
-	})
-	if err != nil {
-		client.Panicf("%v", err)
-	}
-
 	// Add codecs
 	client.codecs = auth.CeltVersions
+	client.celt = len(client.codecs) > 0
 	client.opus = auth.GetOpus()
 
 	client.state = StateClientAuthenticated
-	server.clientAuthenticated <- client
+	client.logEvent("authenticate", "username", client.Username, "userid", client.UserId(), "certhash", client.CertHash())
+	select {
+	case server.clientAuthenticated <- client:
+	case <-server.bye:
+		// The server is stopping, so its handler won't finish the
+		// login. The client is still only known to its own goroutines,
+		// and is disconnected as one that never authenticated.
+		client.state = StateClientSentVersion
+		client.Disconnect()
+	}
+}
+
+// Check whether a client other than client is connected under name.
+// Names are compared case-insensitively, as clients that differ only
+// in case are hard to tell apart.
+func (server *Server) nameInUse(client *Client, name string) bool {
+	for _, connectedClient := range server.clients {
+		if connectedClient != client && strings.EqualFold(connectedClient.ShownName(), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Enforce the DuplicateNamePolicy on client, which is about to join the
+// server. Returns false if client was rejected.
+//
+// Registered users keep their names, so in "suffix" mode a registered
+// user whose name is in use by an unregistered client is let in as is.
+// Unregistered clients are renamed to the first free name, which must
+// not be that of a registered user either.
+func (server *Server) applyDuplicateNamePolicy(client *Client) bool {
+	policy := server.cfg.StringValue("DuplicateNamePolicy")
+	if policy != "reject" && policy != "suffix" {
+		return true
+	}
+	if !server.nameInUse(client, client.ShownName()) {
+		return true
+	}
+	if policy == "suffix" {
+		if client.IsRegistered() {
+			return true
+		}
+		// Each connected client and registered user rules out at most
+		// one of these names, so one of them is free.
+		for i := 2; i <= len(server.clients)+len(server.UserNameMap)+1; i++ {
+			name := client.Username + "(" + strconv.Itoa(i) + ")"
+			if _, registered := server.UserNameMap[name]; registered || server.nameInUse(client, name) {
+				continue
+			}
+			if !server.isValidUserName(name) {
+				break
+			}
+			client.Debugf("Name %v in use, renamed to %v", client.Username, name)
+			client.Username = name
+			return true
+		}
+	}
+	client.RejectAuth(mumbleproto.Reject_UsernameInUse, "Another user is already connected under that name.")
+	return false
 }
 
 // The last part of authentication runs in the server's synchronous handler.
+//
+// Once the login has been accepted, the client is sent the state of the
+// server. Clients expect this to happen in a fixed order, following the
+// Version message sent when the client connected: CryptSetup, CodecVersion,
+// the ChannelStates of the channel tree, the UserStates of the connected
+// users, ServerSync, and finally ServerConfig and SuggestConfig.
 func (server *Server) finishAuthenticate(client *Client) {
 	// If the client succeeded in proving to the server that it should be granted
-	// the credentials of a registered user, do some sanity checking to make sure
-	// that user isn't already connected.
+	// the credentials of a registered user, make sure that user isn't already
+	// connected. Registered users are identified by their certificate (or,
+	// for SuperUser, the password), not by their name.
 	//
-	// If the user is already connected, try to check whether this new client is
-	// connecting from the same IP address. If that's the case, disconnect the
-	// previous client and let the new guy in.
+	// Depending on the DuplicateUserPolicy, either the new client is rejected,
+	// or the client that is already connected is kicked to let the new one in.
 	if client.user != nil {
-		found := false
 		for _, connectedClient := range server.clients {
-			if connectedClient.UserId() == client.UserId() {
-				found = true
-				break
+			if connectedClient == client || connectedClient.UserId() != client.UserId() {
+				continue
+			}
+			if server.cfg.StringValue("DuplicateUserPolicy") != "kick" {
+				client.RejectAuth(mumbleproto.Reject_UsernameInUse, "A client is already connected using those credentials.")
+				return
 			}
+			server.kickDuplicateClient(connectedClient, client)
 		}
-		// The user is already present on the server.
-		if found {
-			// todo(mkrautz): Do the address checking.
-			client.RejectAuth(mumbleproto.Reject_UsernameInUse, "A client is already connected using those credentials.")
+	}
+
+	if !server.applyDuplicateNamePolicy(client) {
+		return
+	}
+
+	// Enforce the server's user limit. SuperUser can always log in.
+	// If the server has a queue channel, clients over the limit wait
+	// there instead of being turned away.
+	queued := false
+	if server.isFull() && !client.IsSuperUser() {
+		if server.queueChannel() == nil || server.isQueueFull() {
+			client.disconnectWith(DisconnectServerFull, "The server is full")
 			return
 		}
-
-		// No, that user isn't already connected. Move along.
+		queued = true
 	}
 
 	// Add the client to the connected list
 	server.clients[client.Session()] = client
 
+	// Send CryptState information to the client so it can establish an UDP connection,
+	// if it wishes.
+	client.lastResync = server.clockSeconds(server.now())
+	if !client.sendSyncMessage(&mumbleproto.CryptSetup{
+		Key:         client.crypt.Key,
+		ClientNonce: client.crypt.DecryptIV,
+		ServerNonce: client.crypt.EncryptIV,
+	}) {
+		return
+	}
+
 	// Warn clients without CELT support that they might not be able to talk to everyone else.
 	if len(client.codecs) == 0 {
 		client.codecs = []int32{CeltCompatBitstream}
 		server.Printf("Client %v connected without CELT codecs. Faking compat bitstream.", client.Session())
 		if server.Opus && !client.opus {
-			client.sendMessage(&mumbleproto.TextMessage{
+			if !client.sendSyncMessage(&mumbleproto.TextMessage{
 				Session: []uint32{client.Session()},
 				Message: proto.String("<strong>WARNING:</strong> Your client doesn't support the CELT codec, you won't be able to talk to or hear most clients. Please make sure your client was built with CELT support."),
-			})
+			}) {
+				return
+			}
 		}
 	}
 
 	// First, check whether we need to tell the other connected
 	// clients to switch to a codec so the new guy can actually speak.
+	// Either way, the new guy is told which codecs are in use.
 	server.updateCodecVersions(client)
 
-	client.sendChannelList()
+	if err := client.sendChannelList(); err != nil {
+		client.syncFailed(err)
+		return
+	}
 
 	// Add the client to the host slice for its host address.
 	host := client.tcpaddr.IP.String()
@@ -585,12 +1149,15 @@ func (server *Server) finishAuthenticate(client *Client) {
 	server.hclients[host] = append(server.hclients[host], client)
 	server.hmutex.Unlock()
 
-	channel := server.RootChannel()
-	if client.IsRegistered() {
-		lastChannel := server.Channels[client.user.LastChannelId]
-		if lastChannel != nil {
-			channel = lastChannel
-		}
+	channel := server.joinChannel(client)
+	if queued {
+		client.queued = true
+		server.queue = append(server.queue, client)
+		channel = server.queueChannel()
+	}
+
+	if server.cfg.BoolValue("SuppressNewUsers") && !client.IsSuperUser() {
+		client.unapproved = !client.IsRegistered() || !client.user.Approved
 	}
 
 	userstate := &mumbleproto.UserState{
@@ -634,16 +1201,24 @@ func (server *Server) finishAuthenticate(client *Client) {
 	}
 
 	server.userEnterChannel(client, channel, userstate)
-	if err := server.broadcastProtoMessage(userstate); err != nil {
+	if err := server.broadcastProtoMessageWithPredicate(userstate, server.userStateRecipients(client, nil)); err != nil {
 		// Server panic?
 	}
 
-	server.sendUserList(client)
+	if err := server.sendUserList(client); err != nil {
+		client.syncFailed(err)
+		return
+	}
+	if err := server.sendContextActions(client); err != nil {
+		client.syncFailed(err)
+		return
+	}
 
 	sync := &mumbleproto.ServerSync{}
 	sync.Session = proto.Uint32(client.Session())
-	sync.MaxBandwidth = proto.Uint32(server.cfg.Uint32Value("MaxBandwidth"))
-	sync.WelcomeText = proto.String(server.cfg.StringValue("WelcomeText"))
+	server.updateClientBandwidth()
+	sync.MaxBandwidth = proto.Uint32(server.advertisedBandwidth())
+	sync.WelcomeText = proto.String(server.welcomeText())
 	if client.IsSuperUser() {
 		sync.Permissions = proto.Uint64(uint64(acl.AllPermissions))
 	} else {
@@ -654,56 +1229,218 @@ func (server *Server) finishAuthenticate(client *Client) {
 		// own package.
 		sync.Permissions = nil
 	}
-	if err := client.sendMessage(sync); err != nil {
-		client.Panicf("%v", err)
+	if !client.sendSyncMessage(sync) {
 		return
 	}
 
-	err := client.sendMessage(&mumbleproto.ServerConfig{
+	if !client.sendSyncMessage(&mumbleproto.ServerConfig{
 		AllowHtml:          proto.Bool(server.cfg.BoolValue("AllowHTML")),
 		MessageLength:      proto.Uint32(server.cfg.Uint32Value("MaxTextMessageLength")),
 		ImageMessageLength: proto.Uint32(server.cfg.Uint32Value("MaxImageMessageLength")),
-	})
-	if err != nil {
-		client.Panicf("%v", err)
+	}) {
 		return
 	}
 
+	if suggest := server.suggestConfig(); suggest != nil {
+		if !client.sendSyncMessage(suggest) {
+			return
+		}
+	}
+
 	client.state = StateClientReady
+	atomic.AddInt32(&server.readyUsers, 1)
 	client.clientReady <- true
-}
 
-func (server *Server) updateCodecVersions(connecting *Client) {
-	codecusers := map[int32]int{}
-	var (
-		winner     int32
-		count      int
-		users      int
-		opus       int
-		enableOpus bool
-		txtMsg     *mumbleproto.TextMessage = &mumbleproto.TextMessage{
-			Message: proto.String("<strong>WARNING:</strong> Your client doesn't support the Opus codec the server is switching to, you won't be able to talk or hear anyone. Please upgrade to a client with Opus support."),
-		}
-	)
+	if client.queued {
+		client.sendQueueNotice("The server is full. You will be let in once a slot is free.")
+	}
+}
 
-	for _, client := range server.clients {
-		users++
-		if client.opus {
-			opus++
-		}
-		for _, codec := range client.codecs {
-			codecusers[codec] += 1
-		}
+// Tell client, which is or was queued, about its place on the server.
+func (client *Client) sendQueueNotice(text string) {
+	err := client.sendMessage(&mumbleproto.TextMessage{
+		Session: []uint32{client.Session()},
+		Message: proto.String(text),
+	})
+	if err != nil && err != errClientDisconnected {
+		client.Panicf("%v", err)
 	}
+}
 
-	for codec, users := range codecusers {
-		if users > count {
-			count = users
-			winner = codec
-		}
-		if users == count && codec > winner {
-			winner = codec
-		}
+// Get the channel clients wait in while the server is full, as set via
+// the QueueChannel config key, or nil if the server doesn't queue
+// clients.
+func (server *Server) queueChannel() *Channel {
+	str := server.cfg.StringValue("QueueChannel")
+	if str == "" {
+		return nil
+	}
+	id, err := strconv.Atoi(str)
+	if err != nil {
+		return nil
+	}
+	return server.Channels[id]
+}
+
+// Check whether all of the server's slots, as limited by the MaxUsers
+// config key, are taken. Queued clients don't take up a slot.
+func (server *Server) isFull() bool {
+	maxUsers := server.cfg.IntValue("MaxUsers")
+	return maxUsers > 0 && len(server.clients)-len(server.queue) >= maxUsers
+}
+
+// Check whether the server's queue holds as many clients as the
+// MaxQueueLength config key allows.
+func (server *Server) isQueueFull() bool {
+	maxQueue := server.cfg.IntValue("MaxQueueLength")
+	return maxQueue > 0 && len(server.queue) >= maxQueue
+}
+
+// Let queued clients in, first come first served, for as long as the
+// server has free slots. A promoted client is moved to the channel it
+// would have joined if the server hadn't been full.
+func (server *Server) promoteQueuedClients() {
+	for len(server.queue) > 0 && !server.isFull() {
+		client := server.queue[0]
+		server.queue = server.queue[1:]
+		client.queued = false
+
+		userstate := &mumbleproto.UserState{
+			Session: proto.Uint32(client.Session()),
+		}
+		oldchan := client.Channel
+		channel := server.joinChannel(client)
+		if channel != oldchan {
+			userstate.ChannelId = proto.Uint32(uint32(channel.Id))
+			server.userEnterChannel(client, channel, userstate)
+		} else {
+			server.updateSuppress(client, userstate)
+		}
+		if userstate.ChannelId != nil || userstate.Suppress != nil {
+			if err := server.broadcastProtoMessageWithPredicate(userstate, server.userStateRecipients(client, oldchan)); err != nil {
+				server.Panicf("%v", err)
+			}
+		}
+		client.logEvent("promote", "channel", channel.Id)
+		client.sendQueueNotice("A slot is free. Welcome!")
+	}
+}
+
+// Remove client from the server's queue, if it is waiting in it.
+func (server *Server) dequeueClient(client *Client) {
+	if !client.queued {
+		return
+	}
+	client.queued = false
+	for i, queued := range server.queue {
+		if queued == client {
+			server.queue = append(server.queue[:i], server.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// Build the SuggestConfig message sent to clients as they log in, from
+// the server's Suggest* config keys. Only the keys that are set are
+// included. Returns nil if none of them are set.
+func (server *Server) suggestConfig() *mumbleproto.SuggestConfig {
+	suggest := &mumbleproto.SuggestConfig{}
+	set := false
+
+	if str := server.cfg.StringValue("SuggestVersion"); len(str) > 0 {
+		version, err := parseVersion(str)
+		if err != nil {
+			server.Printf("Invalid SuggestVersion %q: %v", str, err)
+		} else {
+			suggest.Version = proto.Uint32(version)
+			set = true
+		}
+	}
+	if positional, err := strconv.ParseBool(server.cfg.StringValue("SuggestPositional")); err == nil {
+		suggest.Positional = proto.Bool(positional)
+		set = true
+	}
+	if ptt, err := strconv.ParseBool(server.cfg.StringValue("SuggestPushToTalk")); err == nil {
+		suggest.PushToTalk = proto.Bool(ptt)
+		set = true
+	}
+
+	if !set {
+		return nil
+	}
+	return suggest
+}
+
+// Parse a version string of the form major.minor.patch into the
+// encoding used by the Mumble protocol.
+func parseVersion(str string) (uint32, error) {
+	parts := strings.Split(str, ".")
+	if len(parts) != 3 {
+		return 0, errors.New("expected a version of the form major.minor.patch")
+	}
+	var version uint32
+	for _, part := range parts {
+		num, err := strconv.ParseUint(part, 10, 8)
+		if err != nil {
+			return 0, err
+		}
+		version = version<<8 | uint32(num)
+	}
+	return version, nil
+}
+
+// Kick old, a client logged in as the same registered user as client,
+// which is about to take its place.
+func (server *Server) kickDuplicateClient(old *Client, client *Client) {
+	old.Printf("Replaced by session %v", client.Session())
+	old.disconnectWith(DisconnectKicked, "Connected from another location")
+}
+
+// Get a CodecVersion message describing the codecs currently in use.
+func (server *Server) codecVersion() *mumbleproto.CodecVersion {
+	return &mumbleproto.CodecVersion{
+		Alpha:       proto.Int32(server.AlphaCodec),
+		Beta:        proto.Int32(server.BetaCodec),
+		PreferAlpha: proto.Bool(server.PreferAlphaCodec),
+		Opus:        proto.Bool(server.Opus),
+	}
+}
+
+// Pick the codecs the server's clients should use, and broadcast them if
+// they changed. A client that is connecting, or that has just changed its
+// codecs, is also told about the current codecs when they haven't changed.
+//
+// Opus is used if at least OpusThreshold percent of the clients support
+// it. Otherwise, the CELT codec most clients support is used. Clients
+// that can't use the codec the server settles on are warned.
+func (server *Server) updateCodecVersions(connecting *Client) {
+	codecusers := map[int32]int{}
+	var (
+		winner     int32
+		count      int
+		users      int
+		opus       int
+		enableOpus bool
+	)
+
+	for _, client := range server.clients {
+		users++
+		if client.opus {
+			opus++
+		}
+		for _, codec := range client.codecs {
+			codecusers[codec] += 1
+		}
+	}
+
+	for codec, users := range codecusers {
+		if users > count {
+			count = users
+			winner = codec
+		}
+		if users == count && codec > winner {
+			winner = codec
+		}
 	}
 
 	var current int32
@@ -713,7 +1450,8 @@ func (server *Server) updateCodecVersions(connecting *Client) {
 		current = server.BetaCodec
 	}
 
-	enableOpus = users == opus
+	threshold := server.cfg.IntValue("OpusThreshold")
+	enableOpus = users == 0 || opus*100 >= threshold*users
 
 	if winner != current {
 		if winner == CeltCompatBitstream {
@@ -728,143 +1466,221 @@ func (server *Server) updateCodecVersions(connecting *Client) {
 			server.BetaCodec = winner
 		}
 	} else if server.Opus == enableOpus {
-		if server.Opus && connecting != nil && !connecting.opus {
-			txtMsg.Session = []uint32{connecting.Session()}
-			connecting.sendMessage(txtMsg)
+		if connecting != nil {
+			connecting.sendMessage(server.codecVersion())
+			connecting.warnIncompatibleCodec()
 		}
 		return
 	}
 
 	server.Opus = enableOpus
 
-	err := server.broadcastProtoMessage(&mumbleproto.CodecVersion{
-		Alpha:       proto.Int32(server.AlphaCodec),
-		Beta:        proto.Int32(server.BetaCodec),
-		PreferAlpha: proto.Bool(server.PreferAlphaCodec),
-		Opus:        proto.Bool(server.Opus),
-	})
+	err := server.broadcastProtoMessage(server.codecVersion())
 	if err != nil {
 		server.Printf("Unable to broadcast.")
 		return
 	}
 
-	if server.Opus {
-		for _, client := range server.clients {
-			if !client.opus && client.state == StateClientReady {
-				txtMsg.Session = []uint32{connecting.Session()}
-				err := client.sendMessage(txtMsg)
-				if err != nil {
-					client.Panicf("%v", err)
-				}
+	for _, client := range server.clients {
+		if client.state == StateClientReady && client != connecting {
+			if err := client.warnIncompatibleCodec(); err != nil {
+				client.Panicf("%v", err)
 			}
 		}
-		if connecting != nil && !connecting.opus {
-			txtMsg.Session = []uint32{connecting.Session()}
-			connecting.sendMessage(txtMsg)
-		}
+	}
+	if connecting != nil {
+		connecting.warnIncompatibleCodec()
 	}
 
 	server.Printf("CELT codec switch %#x %#x (PreferAlpha %v) (Opus %v)", uint32(server.AlphaCodec), uint32(server.BetaCodec), server.PreferAlphaCodec, server.Opus)
 	return
 }
 
-func (server *Server) sendUserList(client *Client) {
+// Warn the client if it can't use the codec the server's clients have
+// settled on: Opus, or CELT for clients that only support Opus.
+func (client *Client) warnIncompatibleCodec() error {
+	var text string
+	if client.server.Opus && !client.opus {
+		text = "<strong>WARNING:</strong> Your client doesn't support the Opus codec the server is switching to, you won't be able to talk or hear anyone. Please upgrade to a client with Opus support."
+	} else if !client.server.Opus && !client.celt {
+		text = "<strong>WARNING:</strong> The server is switching to the CELT codec for clients that don't support Opus, and your client doesn't support CELT, so you won't be able to talk or hear anyone until they leave."
+	} else {
+		return nil
+	}
+	return client.sendMessage(&mumbleproto.TextMessage{
+		Session: []uint32{client.Session()},
+		Message: proto.String(text),
+	})
+}
+
+func (server *Server) sendUserList(client *Client) error {
 	for _, connectedClient := range server.clients {
 		if connectedClient.state != StateClientReady {
 			continue
 		}
-		if connectedClient == client {
+		if connectedClient == client || !server.canSeeUser(client, connectedClient) {
 			continue
 		}
 
-		userstate := &mumbleproto.UserState{
-			Session:   proto.Uint32(connectedClient.Session()),
-			Name:      proto.String(connectedClient.ShownName()),
-			ChannelId: proto.Uint32(uint32(connectedClient.Channel.Id)),
+		err := client.sendMessage(server.userStateOf(connectedClient, client))
+		if err != nil {
+			return err
 		}
+	}
 
-		if connectedClient.HasCertificate() {
-			userstate.Hash = proto.String(connectedClient.CertHash())
-		}
+	return nil
+}
 
-		if connectedClient.IsRegistered() {
-			userstate.UserId = proto.Uint32(uint32(connectedClient.UserId()))
+// Get a UserState describing the full state of subject, as it is sent
+// to client.
+func (server *Server) userStateOf(subject *Client, client *Client) *mumbleproto.UserState {
+	userstate := &mumbleproto.UserState{
+		Session:   proto.Uint32(subject.Session()),
+		Name:      proto.String(subject.ShownName()),
+		ChannelId: proto.Uint32(uint32(subject.Channel.Id)),
+	}
 
-			if connectedClient.user.HasTexture() {
-				// Does the client support blobs?
-				if client.Version >= 0x10203 {
-					userstate.TextureHash = connectedClient.user.TextureBlobHashBytes()
-				} else {
-					buf, err := blobStore.Get(connectedClient.user.TextureBlob)
-					if err != nil {
-						server.Panicf("Blobstore error: %v", err.Error())
-					}
-					userstate.Texture = buf
-				}
-			}
+	if subject.HasCertificate() {
+		userstate.Hash = proto.String(subject.CertHash())
+	}
+
+	if subject.IsRegistered() {
+		userstate.UserId = proto.Uint32(uint32(subject.UserId()))
 
-			if connectedClient.user.HasComment() {
-				// Does the client support blobs?
-				if client.Version >= 0x10203 {
-					userstate.CommentHash = connectedClient.user.CommentBlobHashBytes()
-				} else {
-					buf, err := blobStore.Get(connectedClient.user.CommentBlob)
-					if err != nil {
-						server.Panicf("Blobstore error: %v", err.Error())
-					}
-					userstate.Comment = proto.String(string(buf))
+		if subject.user.HasTexture() {
+			// Does the client support blobs?
+			if client.Version >= 0x10203 {
+				userstate.TextureHash = subject.user.TextureBlobHashBytes()
+			} else {
+				buf, err := blobStore.Get(subject.user.TextureBlob)
+				if err != nil {
+					server.Panicf("Blobstore error: %v", err.Error())
 				}
+				userstate.Texture = buf
 			}
 		}
 
-		if connectedClient.Mute {
-			userstate.Mute = proto.Bool(true)
-		}
-		if connectedClient.Suppress {
-			userstate.Suppress = proto.Bool(true)
-		}
-		if connectedClient.SelfMute {
-			userstate.SelfMute = proto.Bool(true)
-		}
-		if connectedClient.SelfDeaf {
-			userstate.SelfDeaf = proto.Bool(true)
-		}
-		if connectedClient.PrioritySpeaker {
-			userstate.PrioritySpeaker = proto.Bool(true)
-		}
-		if connectedClient.Recording {
-			userstate.Recording = proto.Bool(true)
-		}
-		if connectedClient.PluginContext != nil || len(connectedClient.PluginContext) > 0 {
-			userstate.PluginContext = connectedClient.PluginContext
-		}
-		if len(connectedClient.PluginIdentity) > 0 {
-			userstate.PluginIdentity = proto.String(connectedClient.PluginIdentity)
+		if subject.user.HasComment() {
+			// Does the client support blobs?
+			if client.Version >= 0x10203 {
+				userstate.CommentHash = subject.user.CommentBlobHashBytes()
+			} else {
+				buf, err := blobStore.Get(subject.user.CommentBlob)
+				if err != nil {
+					server.Panicf("Blobstore error: %v", err.Error())
+				}
+				userstate.Comment = proto.String(string(buf))
+			}
 		}
+	}
 
-		err := client.sendMessage(userstate)
-		if err != nil {
-			// Server panic?
-			continue
-		}
+	if subject.Mute {
+		userstate.Mute = proto.Bool(true)
+	}
+	if subject.Deaf {
+		userstate.Deaf = proto.Bool(true)
+	}
+	if subject.Suppress {
+		userstate.Suppress = proto.Bool(true)
+	}
+	if subject.SelfMute {
+		userstate.SelfMute = proto.Bool(true)
+	}
+	if subject.SelfDeaf {
+		userstate.SelfDeaf = proto.Bool(true)
+	}
+	if subject.PrioritySpeaker {
+		userstate.PrioritySpeaker = proto.Bool(true)
+	}
+	if subject.Recording {
+		userstate.Recording = proto.Bool(true)
 	}
+	if subject.PluginContext != nil || len(subject.PluginContext) > 0 {
+		userstate.PluginContext = subject.PluginContext
+	}
+	if len(subject.PluginIdentity) > 0 {
+		userstate.PluginIdentity = proto.String(subject.PluginIdentity)
+	}
+
+	return userstate
 }
 
-// Send a client its permissions for channel.
-func (server *Server) sendClientPermissions(client *Client, channel *Channel) {
-	// No caching for SuperUser
+// Send the client its effective permissions in channel, so that it can
+// reflect them in its UI. Unless force is set, the permissions are only
+// sent if they differ from the ones last sent to the client for channel.
+func (server *Server) sendClientPermissions(client *Client, channel *Channel, force bool) {
+	// SuperUser has all permissions, as announced in ServerSync.
 	if client.IsSuperUser() {
 		return
 	}
 
-	// fixme(mkrautz): re-add when we have ACL caching
-	return
+	perm := acl.EffectivePermissions(&channel.ACL, client)
+	if sent, ok := client.permissionsSent[channel.Id]; ok && sent == perm && !force {
+		return
+	}
+	if client.permissionsSent == nil {
+		client.permissionsSent = make(map[int]acl.Permission)
+	}
+	client.permissionsSent[channel.Id] = perm
 
-	perm := acl.Permission(acl.NonePermission)
-	client.sendMessage(&mumbleproto.PermissionQuery{
+	err := client.sendMessage(&mumbleproto.PermissionQuery{
 		ChannelId:   proto.Uint32(uint32(channel.Id)),
 		Permissions: proto.Uint32(uint32(perm)),
 	})
+	if err != nil && err != errClientDisconnected {
+		client.Panicf("Unable to send permissions: %v", err)
+	}
+}
+
+// Tell all clients to discard the permissions they have been sent, after
+// a change that may have changed them, and send each client its
+// permissions in its current channel.
+func (server *Server) flushClientPermissions() {
+	for _, client := range server.clients {
+		server.flushPermissions(client)
+	}
+}
+
+// Like flushClientPermissions, but only for the clients whose permissions
+// in channel or its subchannels are known to them, after a change that
+// can only have changed the permissions there, such as an ACL edit or a
+// move of channel.
+func (server *Server) flushChannelPermissions(channel *Channel) {
+	subtree := channel.AllSubChannels()
+	subtree[channel.Id] = channel
+	for _, client := range server.clients {
+		affected := client.Channel != nil && subtree[client.Channel.Id] != nil
+		for id := range client.permissionsSent {
+			if subtree[id] != nil {
+				affected = true
+				break
+			}
+		}
+		if affected {
+			server.flushPermissions(client)
+		}
+	}
+}
+
+// Tell client to discard the permissions it has been sent, after a change
+// that may have changed them, such as a change of the groups it is in,
+// and send it its permissions in its current channel.
+func (server *Server) flushPermissions(client *Client) {
+	if client.state < StateClientAuthenticated || client.IsSuperUser() {
+		return
+	}
+	client.permissionsSent = nil
+
+	err := client.sendMessage(&mumbleproto.PermissionQuery{
+		Flush: proto.Bool(true),
+	})
+	if err == errClientDisconnected {
+		return
+	} else if err != nil {
+		client.Panicf("Unable to flush permissions: %v", err)
+		return
+	}
+	server.sendClientPermissions(client, client.Channel, false)
 }
 
 type ClientPredicate func(client *Client) bool
@@ -878,7 +1694,9 @@ func (server *Server) broadcastProtoMessageWithPredicate(msg interface{}, client
 			continue
 		}
 		err := client.sendMessage(msg)
-		if err != nil {
+		if err == errClientDisconnected {
+			continue
+		} else if err != nil {
 			return err
 		}
 	}
@@ -891,7 +1709,75 @@ func (server *Server) broadcastProtoMessage(msg interface{}) (err error) {
 	return
 }
 
+// Broadcast a text message from the server to all connected clients,
+// regardless of the channel they are in. The message is sent without
+// an actor, and is subject to the server's text message filtering.
+//
+// The message is handed to the server's handler goroutine, which does
+// the sending. Broadcast fails if the server is not running.
+func (server *Server) Broadcast(text string) error {
+	filtered, err := server.FilterText(text)
+	if err != nil {
+		return err
+	}
+	if len(filtered) == 0 {
+		return nil
+	}
+
+	server.stopLock.RLock()
+	defer server.stopLock.RUnlock()
+	if !server.stopping && server.broadcasts != nil {
+		select {
+		case server.broadcasts <- filtered:
+			return nil
+		case <-time.After(healthProbeTimeout):
+		}
+	}
+	return errors.New("server not running")
+}
+
+// Send the filtered text message text to all ready clients. Called on
+// the handler goroutine.
+func (server *Server) broadcastText(text string) {
+	for _, client := range server.clients {
+		if client.state != StateClientReady {
+			continue
+		}
+		err := client.sendMessage(&mumbleproto.TextMessage{
+			Session: []uint32{client.Session()},
+			Message: proto.String(text),
+		})
+		if err != nil {
+			client.Panicf("%v", err)
+		}
+	}
+}
+
+// Dispatch a control channel message to the handler for its kind.
+// Called on the handler goroutine.
+//
+// Messages from clients that were disconnected while the message was
+// waiting to be handled are dropped, as are messages of unknown kinds and
+// messages that exceed the server's message rate limit.
+//
+// A handler that panics, for example because of a message that is missing
+// a field it relies on, only disconnects the client that sent the message.
 func (server *Server) handleIncomingMessage(client *Client, msg *Message) {
+	if client.isDisconnected() {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			client.Panicf("Unable to handle message of kind %v: %v", msg.kind, r)
+		}
+	}()
+	if msg.received.IsZero() {
+		msg.received = server.now()
+	}
+	if !server.allowMessage(client, msg.kind, msg.received) {
+		return
+	}
+
 	switch msg.kind {
 	case mumbleproto.MessageAuthenticate:
 		server.handleAuthenticate(msg.client, msg)
@@ -916,7 +1802,7 @@ func (server *Server) handleIncomingMessage(client *Client, msg *Message) {
 	case mumbleproto.MessageCryptSetup:
 		server.handleCryptSetup(msg.client, msg)
 	case mumbleproto.MessageContextAction:
-		server.Printf("MessageContextAction from client")
+		server.handleContextAction(msg.client, msg)
 	case mumbleproto.MessageUserList:
 		server.handleUserList(msg.client, msg)
 	case mumbleproto.MessageVoiceTarget:
@@ -932,17 +1818,22 @@ func (server *Server) handleIncomingMessage(client *Client, msg *Message) {
 
 // Send the content of buf as a UDP packet to addr.
 func (s *Server) SendUDP(buf []byte, addr *net.UDPAddr) (err error) {
-	_, err = s.udpconn.WriteTo(buf, addr)
+	_, err = s.udpConnFor(addr).WriteTo(buf, addr)
+	if err == nil {
+		atomic.AddUint64(&s.bytesOut, uint64(len(buf)))
+	}
 	return
 }
 
-// Listen for and handle UDP packets.
-func (server *Server) udpListenLoop() {
-	defer server.netwg.Done()
-
-	buf := make([]byte, UDPPacketSize)
+// Listen for and handle UDP packets on conn, one of the server's UDP
+// sockets.
+func (server *Server) udpListenLoop(conn *net.UDPConn) {
+	// The read buffer is one byte larger than the largest datagram we
+	// accept. ReadFrom silently truncates datagrams that do not fit, so
+	// this is what allows us to detect (and drop) oversized datagrams.
+	buf := make([]byte, UDPPacketSize+1)
 	for {
-		nread, remote, err := server.udpconn.ReadFrom(buf)
+		nread, remote, err := conn.ReadFrom(buf)
 		if err != nil {
 			if isTimeout(err) {
 				continue
@@ -951,6 +1842,11 @@ func (server *Server) udpListenLoop() {
 			}
 		}
 
+		atomic.AddUint64(&server.bytesIn, uint64(nread))
+		if nread > UDPPacketSize {
+			continue
+		}
+
 		udpaddr, ok := remote.(*net.UDPAddr)
 		if !ok {
 			server.Printf("No UDPAddr in read packet. Disabling UDP. (Windows?)")
@@ -958,23 +1854,9 @@ func (server *Server) udpListenLoop() {
 		}
 
 		// Length 12 is for ping datagrams from the ConnectDialog.
-		if nread == 12 {
-			readbuf := bytes.NewBuffer(buf)
-			var (
-				tmp32 uint32
-				rand  uint64
-			)
-			_ = binary.Read(readbuf, binary.BigEndian, &tmp32)
-			_ = binary.Read(readbuf, binary.BigEndian, &rand)
-
-			buffer := bytes.NewBuffer(make([]byte, 0, 24))
-			_ = binary.Write(buffer, binary.BigEndian, uint32((1<<16)|(2<<8)|2))
-			_ = binary.Write(buffer, binary.BigEndian, rand)
-			_ = binary.Write(buffer, binary.BigEndian, uint32(len(server.clients)))
-			_ = binary.Write(buffer, binary.BigEndian, server.cfg.Uint32Value("MaxUsers"))
-			_ = binary.Write(buffer, binary.BigEndian, server.cfg.Uint32Value("MaxBandwidth"))
-
-			err = server.SendUDP(buffer.Bytes(), udpaddr)
+		if nread == pingRequestSize {
+			ident := binary.BigEndian.Uint64(buf[4:pingRequestSize])
+			err = server.SendUDP(server.pingReply(ident), udpaddr)
 			if err != nil {
 				return
 			}
@@ -1001,27 +1883,54 @@ func (server *Server) handleUdpPacket(udpaddr *net.UDPAddr, buf []byte) {
 	if ok {
 		err := client.crypt.Decrypt(plain, buf)
 		if err != nil {
-			client.Debugf("unable to decrypt incoming packet, requesting resync: %v", err)
+			client.logRepeatedf("unable to decrypt incoming packet, requesting resync: %v", err)
 			client.cryptResync()
+			client.reportAbnormalPacket("undecryptable datagram")
 			return
 		}
 		match = client
 	} else {
+		// The packet could be from any of the clients on the host,
+		// so a packet that fails to decrypt for one of them is not
+		// an error. A failed decrypt leaves the CryptState untouched.
+		//
+		// Only a packet whose OCB2 tag verifies for a client's key is
+		// accepted. This is what allows a client whose source port
+		// changed (for example because of NAT rebinding) to continue
+		// using UDP, without allowing anyone else on the host to
+		// take over its address.
+		//
+		// Clients that haven't been given a key yet can't have sent
+		// the packet.
 		host := udpaddr.IP.String()
 		hostclients := server.hclients[host]
 		for _, client := range hostclients {
+			if !client.crypt.IsValid() {
+				continue
+			}
 			err := client.crypt.Decrypt(plain[0:], buf)
-			if err != nil {
-				client.Debugf("unable to decrypt incoming packet, requesting resync: %v", err)
-				client.cryptResync()
-				return
-			} else {
+			if err == nil {
 				match = client
+				break
 			}
 		}
 		if match != nil {
+			if match.udpaddr != nil {
+				match.Printf("UDP address changed from %v to %v", match.udpaddr, udpaddr)
+				delete(server.hpclients, match.udpaddr.String())
+			}
 			match.udpaddr = udpaddr
 			server.hpclients[udpaddr.String()] = match
+		} else {
+			// A client whose nonce went out of sync while its source
+			// port changed can't be matched until it resyncs. Ask
+			// the host's clients to. cryptResync only asks clients
+			// whose UDP has gone quiet, so the others aren't bothered.
+			for _, client := range hostclients {
+				if client.crypt.IsValid() {
+					client.cryptResync()
+				}
+			}
 		}
 	}
 
@@ -1033,11 +1942,13 @@ func (server *Server) handleUdpPacket(udpaddr *net.UDPAddr, buf []byte) {
 	// the true encryption overhead.
 	plain = plain[:len(plain)-match.crypt.Overhead()]
 
-	match.udp = true
+	match.touchUDP()
+	atomic.StoreInt32(&match.udp, 1)
 	match.udprecv <- plain
 }
 
-// Clear the Server's caches
+// Clear the Server's caches. Called on the server's handler goroutine,
+// which is the one that fills them.
 func (server *Server) ClearCaches() {
 	for _, client := range server.clients {
 		client.ClearCaches()
@@ -1051,28 +1962,195 @@ func (server *Server) userEnterChannel(client *Client, channel *Channel, usersta
 	}
 
 	oldchan := client.Channel
+	var seen map[*Client]bool
 	if oldchan != nil {
+		seen = server.visibleUsers(client)
 		oldchan.RemoveClient(client)
-		if oldchan.IsTemporary() && oldchan.IsEmpty() {
-			server.tempRemove <- oldchan
-		}
 	}
 	channel.AddClient(client)
 
+	// A temporary channel is kept while a client is in one of its
+	// subchannels. Channels that are being removed are already gone
+	// from the server's channel map.
+	if oldchan != nil && oldchan.IsTemporary() && oldchan.IsUnoccupied() && server.Channels[oldchan.Id] == oldchan {
+		server.tempRemove <- oldchan
+	}
+
 	server.ClearCaches()
 
+	if oldchan != nil {
+		client.logEvent("move", "from", oldchan.Id, "to", channel.Id)
+		server.announceChannelMove(client, oldchan, false)
+	} else {
+		client.logEvent("join", "channel", channel.Id)
+	}
+	server.announceChannelMove(client, channel, true)
+
 	server.UpdateFrozenUserLastChannel(client)
 
-	canspeak := acl.HasPermission(&channel.ACL, client, acl.SpeakPermission)
+	server.updateSuppress(client, userstate)
+	if oldchan != nil {
+		server.updateUserVisibility(client, oldchan, seen)
+	}
+
+	server.sendClientPermissions(client, channel, false)
+	if channel.parent != nil {
+		server.sendClientPermissions(client, channel.parent, false)
+	}
+}
+
+// Tell the occupants of channel that client has entered or left it,
+// if the server is configured to announce channel moves.
+func (server *Server) announceChannelMove(client *Client, channel *Channel, entered bool) {
+	if !server.cfg.BoolValue("AnnounceChannelMoves") {
+		return
+	}
+
+	name := html.EscapeString(client.ShownName())
+	if server.cfg.BoolValue("AllowHTML") {
+		name = "<b>" + name + "</b>"
+	}
+	text := name + " left the channel."
+	if entered {
+		text = name + " entered the channel."
+	}
+	limit := server.cfg.IntValue("MaxTextMessageLength")
+	if limit > 0 && len(text) > limit {
+		return
+	}
+
+	txtmsg := &mumbleproto.TextMessage{
+		ChannelId: []uint32{uint32(channel.Id)},
+		Message:   proto.String(text),
+	}
+	for _, occupant := range channel.clients {
+		if occupant == client {
+			continue
+		}
+		err := occupant.sendMessage(txtmsg)
+		if err != nil && err != errClientDisconnected {
+			occupant.Panicf("Unable to send channel announcement: %v", err)
+		}
+	}
+}
+
+// Suppress the client if it is not allowed to speak in its channel, if
+// it has not yet been approved, or if it is waiting for a slot. If the
+// client's suppressed state changes, the change is recorded in userstate.
+func (server *Server) updateSuppress(client *Client, userstate *mumbleproto.UserState) {
+	canspeak := acl.HasPermission(&client.Channel.ACL, client, acl.SpeakPermission) && !client.unapproved && !client.queued
 	if canspeak == client.Suppress {
 		client.Suppress = !canspeak
 		userstate.Suppress = proto.Bool(client.Suppress)
+		client.updateVoiceMuted()
 	}
+}
 
-	server.sendClientPermissions(client, channel)
-	if channel.parent != nil {
-		server.sendClientPermissions(client, channel.parent)
+// Re-evaluate the permissions of a ready client after it has changed its
+// access tokens, or one of them has expired. Tokens grant membership of
+// token groups in ACLs, so the client is told to discard the permissions
+// it has been sent, its view of the other clients is refreshed from seen,
+// what it could see before, and its suppression in its current channel
+// is broadcast if it changed.
+func (server *Server) updateClientTokens(client *Client, seen map[*Client]bool) {
+	server.flushPermissions(client)
+	if client.isDisconnected() {
+		return
+	}
+	server.refreshView(client, seen)
+
+	userstate := &mumbleproto.UserState{
+		Session: proto.Uint32(client.Session()),
+	}
+	server.updateSuppress(client, userstate)
+	if userstate.Suppress != nil {
+		if err := server.broadcastProtoMessageWithPredicate(userstate, server.userStateRecipients(client, nil)); err != nil {
+			server.Panicf("%v", err)
+		}
+	}
+}
+
+// Approve an unapproved client, lifting its suppression. The approval
+// is remembered for registered users, so they are not suppressed when
+// they join again.
+func (server *Server) ApproveClient(client *Client) {
+	if !client.unapproved {
+		return
+	}
+	client.unapproved = false
+
+	if client.IsRegistered() {
+		client.user.Approved = true
+		server.UpdateFrozenUserApproved(client.user)
+	}
+
+	userstate := &mumbleproto.UserState{
+		Session: proto.Uint32(client.Session()),
+	}
+	server.updateSuppress(client, userstate)
+	if userstate.Suppress != nil {
+		if err := server.broadcastProtoMessageWithPredicate(userstate, server.userStateRecipients(client, nil)); err != nil {
+			server.Panicf("%v", err)
+		}
+	}
+}
+
+// Check whether channel has reached its user limit. A channel's own
+// MaxUsers takes precedence over the server's per-channel user limit.
+func (server *Server) IsChannelFull(channel *Channel) bool {
+	maxChannelUsers := channel.MaxUsers
+	if maxChannelUsers == 0 {
+		maxChannelUsers = server.cfg.IntValue("MaxChannelUsers")
 	}
+	return maxChannelUsers != 0 && len(channel.clients) >= maxChannelUsers
+}
+
+// Move all clients in the source channel to the dest channel, broadcasting
+// a UserState message for each client that is moved. If actor is non-nil,
+// it is recorded as the actor of the moves.
+//
+// Clients that are not allowed to enter dest are skipped, as are
+// clients that would push dest over the server's per-channel user limit.
+// Returns the number of clients that were moved.
+func (server *Server) MoveAll(source *Channel, dest *Channel, actor *Client) int {
+	if source == dest {
+		return 0
+	}
+
+	clients := []*Client{}
+	for _, client := range source.clients {
+		clients = append(clients, client)
+	}
+
+	moved := 0
+	for _, client := range clients {
+		if client.queued {
+			client.Printf("Not moved to channel %v: waiting for a slot", dest.Id)
+			continue
+		}
+		if !dest.CanEnter(client) {
+			client.Printf("Not moved to channel %v: no enter permission", dest.Id)
+			continue
+		}
+		if server.IsChannelFull(dest) {
+			client.Printf("Not moved to channel %v: channel is full", dest.Id)
+			continue
+		}
+
+		userstate := &mumbleproto.UserState{}
+		userstate.Session = proto.Uint32(client.Session())
+		userstate.ChannelId = proto.Uint32(uint32(dest.Id))
+		if actor != nil {
+			userstate.Actor = proto.Uint32(actor.Session())
+		}
+		server.userEnterChannel(client, dest, userstate)
+		if err := server.broadcastProtoMessageWithPredicate(userstate, server.userStateRecipients(client, source)); err != nil {
+			server.Panicf("%v", err)
+		}
+		moved += 1
+	}
+
+	return moved
 }
 
 // Register a client on the server.
@@ -1090,12 +2168,15 @@ func (s *Server) RegisterClient(client *Client) (uid uint32, err error) {
 	}
 
 	// Grumble can only register users with certificates.
-	if client.HasCertificate() {
+	if !client.HasCertificate() {
 		return 0, errors.New("no cert hash")
 	}
 
 	user.Email = client.Email
 	user.CertHash = client.CertHash()
+	if client.Channel != nil {
+		user.LastChannelId = client.Channel.Id
+	}
 
 	uid = s.nextUserId
 	s.Users[uid] = user
@@ -1112,6 +2193,11 @@ func (s *Server) RemoveRegistration(uid uint32) (err error) {
 		return errors.New("Unknown user ID")
 	}
 
+	// The user is removed from ACLs, which may change what anyone
+	// can see.
+	views := s.allVisibleUsers()
+	defer s.refreshViews(views)
+
 	// Remove from user maps
 	delete(s.Users, uid)
 	delete(s.UserCertMap, user.CertHash)
@@ -1120,6 +2206,22 @@ func (s *Server) RemoveRegistration(uid uint32) (err error) {
 	// Remove from groups and ACLs.
 	s.removeRegisteredUserFromChannel(uid, s.RootChannel())
 
+	// A connected client of the user stays connected, but
+	// is no longer registered.
+	for _, client := range s.clients {
+		if client.user != user {
+			continue
+		}
+		client.user = nil
+		err = s.broadcastProtoMessageWithPredicate(&mumbleproto.UserState{
+			Session: proto.Uint32(client.Session()),
+			UserId:  proto.Uint32(math.MaxUint32),
+		}, s.userStateRecipients(client, nil))
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -1152,12 +2254,60 @@ func (s *Server) removeRegisteredUserFromChannel(uid uint32, channel *Channel) {
 	}
 }
 
+// Move client out of its channel and into the closest parent channel
+// that it is allowed to enter, falling back to the root channel.
+func (server *Server) moveToParent(client *Client) {
+	oldchan := client.Channel
+	target := oldchan.parent
+	for target.parent != nil && !target.CanEnter(client) {
+		target = target.parent
+	}
+
+	userstate := &mumbleproto.UserState{}
+	userstate.Session = proto.Uint32(client.Session())
+	userstate.ChannelId = proto.Uint32(uint32(target.Id))
+	server.userEnterChannel(client, target, userstate)
+	if err := server.broadcastProtoMessageWithPredicate(userstate, server.userStateRecipients(client, oldchan)); err != nil {
+		server.Panicf("%v", err)
+	}
+}
+
+// Set the enter token of a channel. An empty token lifts the channel's
+// enter restriction. If evict is true, clients in the channel that are no
+// longer allowed to enter it are moved to the closest parent channel that
+// they can enter.
+func (server *Server) SetChannelEnterToken(channel *Channel, token string, evict bool) {
+	channel.EnterToken = token
+	if !channel.IsTemporary() {
+		server.UpdateFrozenChannelEnterToken(channel)
+	}
+
+	if !evict || channel.parent == nil {
+		return
+	}
+	for _, client := range channel.clients {
+		if !channel.CanEnter(client) {
+			server.moveToParent(client)
+		}
+	}
+}
+
+// Set the number of text messages per minute each user may send to a
+// channel. Zero makes the server's ChannelTextMessageLimit apply.
+func (server *Server) SetChannelTextMessageLimit(channel *Channel, limit int) {
+	channel.TextMessageLimit = limit
+	if !channel.IsTemporary() {
+		server.UpdateFrozenChannelTextMessageLimit(channel)
+	}
+}
+
 // Remove a channel
 func (server *Server) RemoveChannel(channel *Channel) {
 	// Can't remove root
 	if channel == server.RootChannel() {
 		return
 	}
+	delete(server.Channels, channel.Id)
 
 	// Remove all links
 	for _, linkedChannel := range channel.Links {
@@ -1171,24 +2321,12 @@ func (server *Server) RemoveChannel(channel *Channel) {
 
 	// Remove all clients
 	for _, client := range channel.clients {
-		target := channel.parent
-		for target.parent != nil && !acl.HasPermission(&target.ACL, client, acl.EnterPermission) {
-			target = target.parent
-		}
-
-		userstate := &mumbleproto.UserState{}
-		userstate.Session = proto.Uint32(client.Session())
-		userstate.ChannelId = proto.Uint32(uint32(target.Id))
-		server.userEnterChannel(client, target, userstate)
-		if err := server.broadcastProtoMessage(userstate); err != nil {
-			server.Panicf("%v", err)
-		}
+		server.moveToParent(client)
 	}
 
 	// Remove the channel itself
 	parent := channel.parent
 	delete(parent.children, channel.Id)
-	delete(server.Channels, channel.Id)
 	chanremove := &mumbleproto.ChannelRemove{
 		ChannelId: proto.Uint32(uint32(channel.Id)),
 	}
@@ -1218,6 +2356,60 @@ func (server *Server) RemoveExpiredBans() {
 	}
 }
 
+// Export the server's ban list in the portable JSON format of
+// ban.Export.
+func (server *Server) ExportBans() ([]byte, error) {
+	server.banlock.RLock()
+	defer server.banlock.RUnlock()
+	return ban.Export(server.Bans)
+}
+
+// Merge bans exported by ban.Export, perhaps on another server, into the
+// server's ban list. Bans that ban the same thing as an existing ban are
+// skipped. Returns the number of bans added.
+//
+// The updated ban list is written to the freeze log by the server's
+// handler, if the server is running. Otherwise it is written along with
+// the rest of the server's state once the server is next frozen.
+func (server *Server) ImportBans(data []byte) (int, error) {
+	imported, err := ban.Import(data)
+	if err != nil {
+		return 0, err
+	}
+
+	server.banlock.Lock()
+	added := 0
+	for _, newBan := range imported {
+		duplicate := false
+		for _, existing := range server.Bans {
+			if existing.SameTarget(newBan) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			server.Bans = append(server.Bans, newBan)
+			added++
+		}
+	}
+
+	server.banlock.Unlock()
+
+	if added > 0 {
+		// The handler writes out the whole ban list, so an update that
+		// is already pending covers these bans as well. That keeps the
+		// send from blocking, on the handler goroutine too.
+		server.stopLock.RLock()
+		update := server.banUpdate
+		server.stopLock.RUnlock()
+		select {
+		case update <- true:
+		default:
+		}
+	}
+	return added, nil
+}
+
 // Is the incoming connection conn banned?
 func (server *Server) IsConnectionBanned(conn net.Conn) bool {
 	server.banlock.RLock()
@@ -1247,6 +2439,69 @@ func (server *Server) IsCertHashBanned(hash string) bool {
 	return false
 }
 
+// A name regex compiled from the pattern in a config key. The regex is
+// nil if the pattern doesn't compile.
+type nameRegex struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+// Check whether name matches the regular expression stored in the config
+// key regexKey in its entirety, and is at most as many characters long as
+// the config key lengthKey specifies. A length of zero means no limit.
+func (server *Server) isValidName(name string, regexKey string, lengthKey string) bool {
+	maxLength := server.cfg.IntValue(lengthKey)
+	if maxLength > 0 && utf8.RuneCountInString(name) > maxLength {
+		return false
+	}
+
+	re := server.nameRegexp(regexKey)
+	return re != nil && re.MatchString(name)
+}
+
+// Get the regex for the config key regexKey, anchored to match whole
+// names. The regex is compiled again only when the key's pattern has
+// changed. Returns nil if the pattern doesn't compile.
+func (server *Server) nameRegexp(regexKey string) *regexp.Regexp {
+	pattern := server.cfg.StringValue(regexKey)
+
+	server.nameRegexLock.Lock()
+	defer server.nameRegexLock.Unlock()
+	if cached, ok := server.nameRegexes[regexKey]; ok && cached.pattern == pattern {
+		return cached.re
+	}
+
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		server.Printf("Invalid %v: %v", regexKey, err)
+		re = nil
+	}
+	if server.nameRegexes == nil {
+		server.nameRegexes = make(map[string]*nameRegex)
+	}
+	server.nameRegexes[regexKey] = &nameRegex{pattern, re}
+	return re
+}
+
+// Check whether name is a valid channel name according to the server's
+// ChannelNameRegex and MaxChannelNameLength config keys.
+func (server *Server) isValidChannelName(name string) bool {
+	return server.isValidName(name, "ChannelNameRegex", "MaxChannelNameLength")
+}
+
+// Check whether name is a valid user name according to the server's
+// UsernameRegex and MaxUsernameLength config keys.
+func (server *Server) isValidUserName(name string) bool {
+	return server.isValidName(name, "UsernameRegex", "MaxUsernameLength")
+}
+
+// Check whether name can be mistaken for the name of the SuperUser.
+// Only the SuperUser itself may log in as "SuperUser", and it must
+// authenticate with the SuperUser password to do so.
+func isReservedUserName(name string) bool {
+	return name != "SuperUser" && strings.EqualFold(name, "SuperUser")
+}
+
 // Filter incoming text according to the server's current rules.
 func (server *Server) FilterText(text string) (filtered string, err error) {
 	options := &htmlfilter.Options{
@@ -1257,13 +2512,19 @@ func (server *Server) FilterText(text string) (filtered string, err error) {
 	return htmlfilter.Filter(text, options)
 }
 
-// The accept loop of the server.
-func (server *Server) acceptLoop() {
-	defer server.netwg.Done()
+// Check whether a channel description is short enough to be sent to
+// clients inline, rather than as a hash of its blob.
+func (server *Server) inlineDescription(description string) bool {
+	return len(description) < server.cfg.IntValue("ChannelDescriptionInlineThreshold")
+}
 
+// The accept loop of the server, accepting clients on l. Each connection
+// is served on a goroutine of its own, so a connection that is slow to
+// send its first bytes doesn't hold up the ones accepted after it.
+func (server *Server) acceptLoop(l net.Listener) {
 	for {
 		// New client connected
-		conn, err := server.tlsl.Accept()
+		conn, err := l.Accept()
 		if err != nil {
 			if isTimeout(err) {
 				continue
@@ -1275,26 +2536,58 @@ func (server *Server) acceptLoop() {
 		// Remove expired bans
 		server.RemoveExpiredBans()
 
-		// Is the client IP-banned?
-		if server.IsConnectionBanned(conn) {
-			server.Printf("Rejected client %v: Banned", conn.RemoteAddr())
-			err := conn.Close()
-			if err != nil {
-				server.Printf("Unable to close connection: %v", err)
-			}
-			continue
-		}
+		conn = server.trackConn(conn)
+		server.goServe(func() {
+			server.serveConn(conn)
+		})
+	}
+}
 
-		// Create a new client connection from our *tls.Conn
-		// which wraps net.TCPConn.
-		err = server.handleIncomingClient(conn)
+// Serve conn, a connection accepted on the TCP port, on its own
+// goroutine. Connections that survive prepareConn are wrapped in TLS and
+// handed on to become clients.
+func (server *Server) serveConn(conn net.Conn) {
+	conn = server.prepareConn(conn)
+	if conn == nil {
+		return
+	}
+
+	// Is the client IP-banned?
+	if server.IsConnectionBanned(conn) {
+		server.Printf("Rejected client %v: Banned", conn.RemoteAddr())
+		err := conn.Close()
 		if err != nil {
-			server.Printf("Unable to handle new client: %v", err)
-			continue
+			server.Printf("Unable to close connection: %v", err)
 		}
+		return
+	}
+
+	// Create a new client connection from our *tls.Conn
+	// which wraps net.TCPConn.
+	err := server.handleIncomingClient(tls.Server(conn, server.tlscfg))
+	if err != nil {
+		server.Printf("Unable to handle new client: %v", err)
 	}
 }
 
+// Read what comes in on conn, a connection accepted on the TCP port,
+// ahead of its TLS handshake. Connections from trusted proxies have their
+// PROXY protocol header read first. If StatsProbe is enabled, stats
+// probes are answered and closed. Returns nil for connections that were
+// closed, and otherwise the connection to hand on to the TLS handshake.
+func (server *Server) prepareConn(conn net.Conn) net.Conn {
+	proxied, err := server.readProxyHeader(conn)
+	if err != nil {
+		server.Printf("Rejected connection from %v: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return nil
+	}
+	if server.cfg.BoolValue("StatsProbe") {
+		return server.answerStatsProbe(proxied)
+	}
+	return proxied
+}
+
 // The isTimeout function checks whether a
 // network error is a timeout.
 func isTimeout(err error) bool {
@@ -1306,31 +2599,60 @@ func isTimeout(err error) bool {
 
 // Initialize the per-launch data
 func (server *Server) initPerLaunchData() {
+	server.stopLock.Lock()
+	defer server.stopLock.Unlock()
+
 	server.pool = sessionpool.New()
 	server.clients = make(map[uint32]*Client)
 	server.hclients = make(map[string][]*Client)
 	server.hpclients = make(map[string]*Client)
+	atomic.StoreInt32(&server.readyUsers, 0)
 
 	server.bye = make(chan bool)
+	server.handlerDone = make(chan struct{})
 	server.incoming = make(chan *Message)
 	server.voicebroadcast = make(chan *VoiceBroadcast)
 	server.cfgUpdate = make(chan *KeyValuePair)
+	server.banUpdate = make(chan bool, 1)
+	server.broadcasts = make(chan string)
 	server.tempRemove = make(chan *Channel, 1)
+	server.abnormalClients = make(chan *Client, 1)
+	server.disconnectRequests = make(chan disconnectRequest)
+	server.healthProbe = make(chan struct{})
+	server.gaugeProbe = make(chan chan serverGauges)
+	server.clientsProbe = make(chan chan []ClientInfo)
+	server.stateProbe = make(chan chan *StateDump)
+	server.whispersProbe = make(chan chan []Whisper)
+	server.registerResult = make(chan error, 1)
 	server.clientAuthenticated = make(chan *Client)
 }
 
 // Clean per-launch data
 func (server *Server) cleanPerLaunchData() {
+	server.stopLock.Lock()
+	defer server.stopLock.Unlock()
+
 	server.pool = nil
 	server.clients = nil
 	server.hclients = nil
 	server.hpclients = nil
 
 	server.bye = nil
+	server.handlerDone = nil
 	server.incoming = nil
 	server.voicebroadcast = nil
 	server.cfgUpdate = nil
+	server.banUpdate = nil
+	server.broadcasts = nil
 	server.tempRemove = nil
+	server.abnormalClients = nil
+	server.disconnectRequests = nil
+	server.healthProbe = nil
+	server.gaugeProbe = nil
+	server.clientsProbe = nil
+	server.stateProbe = nil
+	server.whispersProbe = nil
+	server.registerResult = nil
 	server.clientAuthenticated = nil
 }
 
@@ -1348,6 +2670,8 @@ func (server *Server) Port() int {
 // on.  If called when the server is not running,
 // this function returns -1.
 func (server *Server) CurrentPort() int {
+	server.stopLock.RLock()
+	defer server.stopLock.RUnlock()
 	if !server.running {
 		return -1
 	}
@@ -1355,6 +2679,13 @@ func (server *Server) CurrentPort() int {
 	return tcpaddr.Port
 }
 
+// Check whether the server is running. May be called from any goroutine.
+func (server *Server) isRunning() bool {
+	server.stopLock.RLock()
+	defer server.stopLock.RUnlock()
+	return server.running
+}
+
 // Returns the host address the server will listen on when
 // it is started. This must be an IP address, either IPv4
 // or IPv6.
@@ -1368,6 +2699,8 @@ func (server *Server) HostAddress() string {
 
 // Start the server.
 func (server *Server) Start() (err error) {
+	server.runLock.Lock()
+	defer server.runLock.Unlock()
 	if server.running {
 		return errors.New("already running")
 	}
@@ -1375,8 +2708,8 @@ func (server *Server) Start() (err error) {
 	host := server.HostAddress()
 	port := server.Port()
 
-	// Setup our UDP listener
-	server.udpconn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(host), Port: port})
+	// Setup our UDP listeners
+	server.udpconns, err = server.listenUDP(host, port)
 	if err != nil {
 		return err
 	}
@@ -1410,10 +2743,16 @@ func (server *Server) Start() (err error) {
 		Certificates: []tls.Certificate{cert},
 		ClientAuth:   tls.RequestClientCert,
 	}
-	server.tlsl = tls.NewListener(server.tcpl, server.tlscfg)
+	server.clientCAs, err = server.loadClientCAs()
+	if err != nil {
+		return err
+	}
 
 	server.Printf("Started: listening on %v", server.tcpl.Addr())
+	server.startTime = server.now()
+	server.stopLock.Lock()
 	server.running = true
+	server.stopLock.Unlock()
 
 	// Open a fresh freezer log
 	err = server.openFreezeLog()
@@ -1421,60 +2760,147 @@ func (server *Server) Start() (err error) {
 		server.Fatal(err)
 	}
 
+	// Open the text message log, if enabled
+	if server.cfg.BoolValue("LogTextMessages") {
+		dir := filepath.Join(Args.DataDir, "servers", strconv.FormatInt(server.Id, 10), "textlog")
+		server.textlog, err = OpenTextLog(dir, server.cfg.IntValue("TextMessageLogRetention"), server.Logger)
+		if err != nil {
+			server.Fatal(err)
+		}
+	}
+
 	// Reset the server's per-launch data to
 	// a clean state.
 	server.initPerLaunchData()
 
-	// Launch the event handler goroutine
-	go server.handlerLoop()
+	// Launch the event handler goroutine. It is restarted if it
+	// panics; handlerDone is closed once it has ended for good.
+	go func() {
+		defer close(server.handlerDone)
+		server.superviseWorker("handler", server.handlerLoop)
+	}()
+
+	server.stopLock.Lock()
+	server.stopping = false
+	server.stopLock.Unlock()
+	err = server.startHealthCheck()
+	if err != nil {
+		server.Printf("Unable to start health check: %v", err)
+	}
 
-	// Add the two network receiver goroutines to the net waitgroup
-	// and launch them.
+	// Add the network receiver goroutines, one for each UDP socket
+	// and one for TCP, to the net waitgroup and launch them.
 	//
 	// We use the waitgroup to provide a blocking Stop() method
 	// for the servers. Each network goroutine defers a call to
 	// netwg.Done(). In the Stop() we close all the connections
 	// and call netwg.Wait() to wait for the goroutines to end.
-	server.netwg.Add(2)
-	go server.udpListenLoop()
-	go server.acceptLoop()
+	server.startNetworkLoops(&tuningListener{server.tcpl, server}, server.udpconns)
+
+	return nil
+}
 
-	// Schedule a server registration update (if needed)
+// Launch the network receiver goroutines for the TCP listener l and
+// the UDP sockets udpconns.
+func (server *Server) startNetworkLoops(l net.Listener, udpconns []*net.UDPConn) {
+	server.netwg.Add(len(udpconns) + 1)
+	for _, conn := range udpconns {
+		conn := conn
+		go func() {
+			defer server.netwg.Done()
+			server.superviseWorker(fmt.Sprintf("UDP listener (%v)", conn.LocalAddr()), func() {
+				server.udpListenLoop(conn)
+			})
+		}()
+	}
 	go func() {
-		time.Sleep(1 * time.Minute)
-		server.RegisterPublicServer()
+		defer server.netwg.Done()
+		server.superviseWorker("TCP listener", func() {
+			server.acceptLoop(l)
+		})
 	}()
+}
 
-	return nil
+// Stop the server for good, such as when the process exits. Like Stop,
+// this disconnects the server's clients, which stores the channels
+// registered users were last in, and then freezes the server's state to
+// disk. Returns an error if that takes longer than timeout, so a slow
+// disk can't hold up exiting forever; the shutdown carries on in the
+// background.
+func (server *Server) Shutdown(timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Stop()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return errors.New("timed out shutting down")
+	}
+}
+
+// Get the time at which the server was started. Returns the zero
+// time if the server is not running.
+func (server *Server) StartTime() time.Time {
+	if !server.isRunning() {
+		return time.Time{}
+	}
+	return server.startTime
 }
 
-// Stop the server.
+// Get how long the server has been running. Returns zero if the
+// server is not running.
+func (server *Server) Uptime() time.Duration {
+	if !server.isRunning() {
+		return 0
+	}
+	return server.now().Sub(server.startTime)
+}
+
+// Stop the server. Stop may be called concurrently; only the first call
+// stops the server, and the others fail once it has stopped.
 func (server *Server) Stop() (err error) {
+	server.runLock.Lock()
+	defer server.runLock.Unlock()
 	if !server.running {
 		return errors.New("server not running")
 	}
 
+	// Report the server as unhealthy while it shuts down.
+	server.stopLock.Lock()
+	server.stopping = true
+	server.stopLock.Unlock()
+
 	// Stop the handler goroutine and disconnect all
-	// clients
-	server.bye <- true
+	// clients. The handler may already have been given
+	// up on, so bye is closed rather than sent on.
+	close(server.bye)
+	<-server.handlerDone
 	for _, client := range server.clients {
-		client.Disconnect()
+		client.shutdown("The server is shutting down")
 	}
 
-	// Close the TLS listener and the TCP listener
-	err = server.tlsl.Close()
-	if err != nil {
-		return err
+	// Close the text message log once all queued
+	// messages have been written to it.
+	if server.textlog != nil {
+		server.textlog.Close()
+		server.textlog = nil
 	}
+
+	// Close the TCP listener
 	err = server.tcpl.Close()
 	if err != nil {
 		return err
 	}
+	server.closeDrainingListeners()
 
-	// Close the UDP connection
-	err = server.udpconn.Close()
-	if err != nil {
-		return err
+	// Close the UDP connections
+	for _, conn := range server.udpconns {
+		err = conn.Close()
+		if err != nil {
+			return err
+		}
 	}
 
 	// Since we'll (on some OSes) have to wait for the network
@@ -1485,13 +2911,32 @@ func (server *Server) Stop() (err error) {
 		server.Fatal(err)
 	}
 
+	// FreezeToFile re-opens the freeze log of a running
+	// server, but nothing will be logged to it anymore.
+	if server.freezelog != nil {
+		err = server.freezelog.Close()
+		if err != nil {
+			server.Fatal(err)
+		}
+		server.freezelog = nil
+	}
+
 	// Wait for the two network receiver
 	// goroutines end.
 	server.netwg.Wait()
 
+	// Close the connections that are left, such as those of clients
+	// that were still logging in, and wait for the goroutines serving
+	// them to end, since they use the per-launch data.
+	server.closeConns()
+	server.connwg.Wait()
+
+	server.stopHealthCheck()
 	server.cleanPerLaunchData()
+	server.stopLock.Lock()
 	server.running = false
-	server.Printf("Stopped")
+	server.stopLock.Unlock()
+	server.Printf("Stopped after running for %v", server.now().Sub(server.startTime))
 
 	return nil
 }
@@ -0,0 +1,2061 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"mumble.info/grumble/pkg/acl"
+	"mumble.info/grumble/pkg/ban"
+	"mumble.info/grumble/pkg/blobstore"
+	"mumble.info/grumble/pkg/cryptstate"
+	"mumble.info/grumble/pkg/mumbleproto"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Create a server suitable for use in tests. The server is not
+// started, but its per-launch data is initialized.
+func newTestServer(t *testing.T) *Server {
+	server, err := NewServer(1)
+	if err != nil {
+		t.Fatalf("unable to create server: %v", err)
+	}
+	server.Logger = log.New(ioutil.Discard, "", 0)
+	server.initPerLaunchData()
+	return server
+}
+
+// A testPeer is the remote end of a test client's connection.
+// It decodes the messages written to the client by the server.
+type testPeer struct {
+	conn net.Conn
+	msgs chan *Message
+}
+
+func (peer *testPeer) readLoop() {
+	reader := bufio.NewReader(peer.conn)
+	for {
+		var (
+			kind   uint16
+			length uint32
+		)
+		if err := binary.Read(reader, binary.BigEndian, &kind); err != nil {
+			close(peer.msgs)
+			return
+		}
+		if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+			close(peer.msgs)
+			return
+		}
+		buf := make([]byte, length)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			close(peer.msgs)
+			return
+		}
+		peer.msgs <- &Message{buf: buf, kind: kind}
+	}
+}
+
+// Wait for the next message of the given kind, skipping messages of other
+// kinds, and unmarshal it into pb, unless pb is nil. Fails the test if no such
+// message arrives.
+func (peer *testPeer) expect(t *testing.T, kind uint16, pb proto.Message) *Message {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case msg, ok := <-peer.msgs:
+			if !ok {
+				t.Fatalf("connection closed while waiting for message kind %v", kind)
+			}
+			if msg.kind != kind {
+				continue
+			}
+			if pb != nil {
+				if err := proto.Unmarshal(msg.buf, pb); err != nil {
+					t.Fatalf("unable to unmarshal message kind %v: %v", kind, err)
+				}
+			}
+			return msg
+		case <-timeout:
+			t.Fatalf("timed out waiting for message kind %v", kind)
+		}
+	}
+}
+
+// Send pb to the test client, framed the way a Mumble client would.
+func (peer *testPeer) send(t *testing.T, pb proto.Message) {
+	if _, err := peer.conn.Write(encodeTestMessage(t, pb)); err != nil {
+		t.Fatalf("unable to write message: %v", err)
+	}
+}
+
+// Encode pb as a framed message: a 16-bit message kind and a 32-bit
+// length, both big-endian, followed by the marshalled message.
+func encodeTestMessage(t *testing.T, pb proto.Message) []byte {
+	data, err := proto.Marshal(pb)
+	if err != nil {
+		t.Fatalf("unable to marshal message: %v", err)
+	}
+	buf := make([]byte, 6+len(data))
+	binary.BigEndian.PutUint16(buf, mumbleproto.MessageType(pb))
+	binary.BigEndian.PutUint32(buf[2:], uint32(len(data)))
+	copy(buf[6:], data)
+	return buf
+}
+
+// Create a Message holding pb, as if it were received from client.
+func newTestMessage(t *testing.T, client *Client, pb proto.Message) *Message {
+	buf, err := proto.Marshal(pb)
+	if err != nil {
+		t.Fatalf("unable to marshal message: %v", err)
+	}
+	return &Message{
+		buf:    buf,
+		kind:   mumbleproto.MessageType(pb),
+		client: client,
+	}
+}
+
+// Unmarshal msg into pb, checking that it is of the given kind.
+func decodeTestMessage(t *testing.T, msg *Message, kind uint16, pb proto.Message) {
+	if msg.kind != kind {
+		t.Fatalf("expected message kind %v, got %v", kind, msg.kind)
+	}
+	if err := proto.Unmarshal(msg.buf, pb); err != nil {
+		t.Fatalf("unable to unmarshal message kind %v: %v", kind, err)
+	}
+}
+
+// Check that no message of the given kind is pending for the peer.
+func (peer *testPeer) expectNone(t *testing.T, kind uint16) {
+	for {
+		select {
+		case msg, ok := <-peer.msgs:
+			if !ok {
+				return
+			}
+			if msg.kind == kind {
+				t.Fatalf("unexpected message kind %v", kind)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// Answer server's probes and broadcasts, as its handler would, until
+// the returned function is called. For tests that don't run the handler.
+func answerTestProbes(server *Server) func() {
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case reply := <-server.gaugeProbe:
+				reply <- server.gauges()
+			case reply := <-server.clientsProbe:
+				reply <- server.clientInfos()
+			case reply := <-server.stateProbe:
+				reply <- server.state()
+			case reply := <-server.whispersProbe:
+				reply <- server.whispers()
+			case text := <-server.broadcasts:
+				server.broadcastText(text)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// Add a ready client to server. The client's connection is one end of
+// a net.Pipe; the other end is returned as a testPeer.
+func newTestClient(server *Server, name string) (*Client, *testPeer) {
+	conn, peerConn := net.Pipe()
+	peer := &testPeer{conn: peerConn, msgs: make(chan *Message, 1024)}
+	go peer.readLoop()
+
+	return addTestClient(server, name, conn), peer
+}
+
+// Add a ready client named name, connected via conn, to the server's
+// root channel.
+func addTestClient(server *Server, name string, conn net.Conn) *Client {
+	client := new(Client)
+	client.lf = &clientLogForwarder{client, server.Logger}
+	client.Logger = log.New(client.lf, "", 0)
+	client.session = server.pool.Get()
+	client.tcpaddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 64738}
+	client.server = server
+	client.conn = conn
+	client.reader = bufio.NewReader(conn)
+	client.udprecv = make(chan []byte)
+	client.voiceTargets = make(map[uint32]*VoiceTarget)
+	client.touchPing()
+	client.Username = name
+	client.state = StateClientReady
+	atomic.AddInt32(&server.readyUsers, 1)
+
+	server.clients[client.Session()] = client
+	server.RootChannel().AddClient(client)
+
+	return client
+}
+
+// Create a client that has been authenticated, but that has not yet
+// been added to the server and joined a channel.
+func newAuthenticatingClient(server *Server, name string) (*Client, *testPeer) {
+	client, peer := newTestClient(server, name)
+	client.Channel.RemoveClient(client)
+	delete(server.clients, client.Session())
+	atomic.AddInt32(&server.readyUsers, -1)
+	client.state = StateClientAuthenticated
+	client.clientReady = make(chan bool, 1)
+	return client, peer
+}
+
+func TestRemoveTimedOutClients(t *testing.T) {
+	server := newTestServer(t)
+	server.cfg.Set("Timeout", "30")
+
+	idle, _ := newTestClient(server, "idle")
+	active, _ := newTestClient(server, "active")
+
+	server.removeTimedOutClients()
+	if idle.isDisconnected() || active.isDisconnected() {
+		t.Fatalf("Clients were disconnected before the timeout")
+	}
+
+	// Pretend the idle client sent its last ping a minute ago.
+	idle.lastPing -= 60
+
+	server.removeTimedOutClients()
+	if !idle.isDisconnected() {
+		t.Errorf("Expected idle client to be disconnected")
+	}
+	if _, ok := server.clients[idle.Session()]; ok {
+		t.Errorf("Idle client still present in server's client map")
+	}
+	if active.isDisconnected() {
+		t.Errorf("Active client was disconnected")
+	}
+}
+
+// Add a new, empty channel to server as a child of parent.
+func newTestChannel(server *Server, parent *Channel, name string) *Channel {
+	channel := server.AddChannel(name)
+	parent.AddChild(channel)
+	return channel
+}
+
+func TestMoveAll(t *testing.T) {
+	server := newTestServer(t)
+	root := server.RootChannel()
+	dest := newTestChannel(server, root, "Stage")
+
+	clients := []*Client{}
+	for _, name := range []string{"alice", "bob", "carol"} {
+		client, _ := newTestClient(server, name)
+		clients = append(clients, client)
+	}
+
+	moved := server.MoveAll(root, dest, nil)
+	if moved != len(clients) {
+		t.Errorf("Unexpected number of moved clients. Got %v, expected %v", moved, len(clients))
+	}
+	for _, client := range clients {
+		if client.Channel != dest {
+			t.Errorf("Client %v was not moved", client.Username)
+		}
+	}
+	if !root.IsEmpty() {
+		t.Errorf("Expected source channel to be empty")
+	}
+}
+
+func TestMoveAllRespectsLimits(t *testing.T) {
+	server := newTestServer(t)
+	server.cfg.Set("MaxChannelUsers", "2")
+	root := server.RootChannel()
+	dest := newTestChannel(server, root, "Stage")
+
+	newTestClient(server, "alice")
+	newTestClient(server, "bob")
+	newTestClient(server, "carol")
+
+	moved := server.MoveAll(root, dest, nil)
+	if moved != 2 {
+		t.Errorf("Unexpected number of moved clients. Got %v, expected 2", moved)
+	}
+	if len(dest.clients) != 2 || len(root.clients) != 1 {
+		t.Errorf("Unexpected channel occupancy: %v in dest, %v in root", len(dest.clients), len(root.clients))
+	}
+}
+
+func TestHandlerLoopDispatch(t *testing.T) {
+	server := newTestServer(t)
+	alice, _ := newTestClient(server, "alice")
+	bob, bobPeer := newTestClient(server, "bob")
+
+	done := make(chan bool)
+	go func() {
+		server.handlerLoop()
+		close(done)
+	}()
+
+	buf, err := proto.Marshal(&mumbleproto.TextMessage{
+		Session: []uint32{bob.Session()},
+		Message: proto.String("hello"),
+	})
+	if err != nil {
+		t.Fatalf("unable to marshal message: %v", err)
+	}
+	server.incoming <- &Message{
+		buf:    buf,
+		kind:   mumbleproto.MessageTextMessage,
+		client: alice,
+	}
+
+	txtmsg := &mumbleproto.TextMessage{}
+	bobPeer.expect(t, mumbleproto.MessageTextMessage, txtmsg)
+	if txtmsg.GetActor() != alice.Session() {
+		t.Errorf("Expected actor %v, got %v", alice.Session(), txtmsg.GetActor())
+	}
+	if txtmsg.GetMessage() != "hello" {
+		t.Errorf("Expected message %q, got %q", "hello", txtmsg.GetMessage())
+	}
+
+	server.bye <- true
+	<-done
+}
+
+func TestHandlerLoopSurvivesMalformedMessage(t *testing.T) {
+	server := newTestServer(t)
+	mallory, _ := newTestClient(server, "mallory")
+	alice, _ := newTestClient(server, "alice")
+	bob, bobPeer := newTestClient(server, "bob")
+
+	done := make(chan bool)
+	go func() {
+		server.handlerLoop()
+		close(done)
+	}()
+
+	server.incoming <- &Message{
+		buf:    []byte{0xff, 0xff, 0xff},
+		kind:   mumbleproto.MessageChannelState,
+		client: mallory,
+	}
+	server.incoming <- newTestMessage(t, alice, &mumbleproto.TextMessage{
+		Session: []uint32{bob.Session()},
+		Message: proto.String("hello"),
+	})
+	bobPeer.expect(t, mumbleproto.MessageTextMessage, nil)
+
+	server.bye <- true
+	<-done
+
+	if !mallory.isDisconnected() {
+		t.Errorf("Expected client sending a malformed message to be disconnected")
+	}
+	if !strings.Contains(mallory.disconnectReason, "ChannelState") {
+		t.Errorf("Expected disconnect reason to name the message, got %q", mallory.disconnectReason)
+	}
+	if alice.isDisconnected() || bob.isDisconnected() {
+		t.Errorf("Expected other clients to stay connected")
+	}
+}
+
+func TestHandleMessageFromDisconnectedClient(t *testing.T) {
+	server := newTestServer(t)
+	alice, _ := newTestClient(server, "alice")
+	bob, bobPeer := newTestClient(server, "bob")
+
+	buf, err := proto.Marshal(&mumbleproto.TextMessage{
+		Session: []uint32{bob.Session()},
+		Message: proto.String("hello"),
+	})
+	if err != nil {
+		t.Fatalf("unable to marshal message: %v", err)
+	}
+	alice.Disconnect()
+	server.handleIncomingMessage(alice, &Message{
+		buf:    buf,
+		kind:   mumbleproto.MessageTextMessage,
+		client: alice,
+	})
+
+	bobPeer.expectNone(t, mumbleproto.MessageTextMessage)
+}
+
+func TestIsChannelFull(t *testing.T) {
+	server := newTestServer(t)
+	server.cfg.Set("MaxChannelUsers", "2")
+	root := server.RootChannel()
+
+	newTestClient(server, "alice")
+	if server.IsChannelFull(root) {
+		t.Errorf("Expected channel with 1 of 2 users not to be full")
+	}
+	newTestClient(server, "bob")
+	if !server.IsChannelFull(root) {
+		t.Errorf("Expected channel with 2 of 2 users to be full")
+	}
+
+	// A channel's own limit overrides the server's.
+	root.MaxUsers = 3
+	if server.IsChannelFull(root) {
+		t.Errorf("Expected channel with 2 of 3 users not to be full")
+	}
+	root.MaxUsers = 1
+	if !server.IsChannelFull(root) {
+		t.Errorf("Expected channel with 2 of 1 users to be full")
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	server := newTestServer(t)
+	root := server.RootChannel()
+	other := newTestChannel(server, root, "Other")
+
+	alice, alicePeer := newTestClient(server, "alice")
+	_, bobPeer := newTestClient(server, "bob")
+	server.userEnterChannel(alice, other, &mumbleproto.UserState{})
+
+	stop := answerTestProbes(server)
+	defer stop()
+	if err := server.Broadcast("Server restarting soon"); err != nil {
+		t.Fatalf("Broadcast failed: %v", err)
+	}
+
+	for _, peer := range []*testPeer{alicePeer, bobPeer} {
+		txtmsg := &mumbleproto.TextMessage{}
+		peer.expect(t, mumbleproto.MessageTextMessage, txtmsg)
+		if txtmsg.Actor != nil {
+			t.Errorf("Expected broadcast to have no actor")
+		}
+		if txtmsg.GetMessage() != "Server restarting soon" {
+			t.Errorf("Unexpected broadcast text: %v", txtmsg.GetMessage())
+		}
+	}
+}
+
+// Point Args.DataDir at a fresh temporary directory holding a
+// certificate and a data directory for server 1. Returns a function
+// that restores the previous DataDir and removes the directory.
+func setupTestDataDir(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "grumble-test")
+	if err != nil {
+		t.Fatalf("unable to create data dir: %v", err)
+	}
+	err = os.MkdirAll(filepath.Join(dir, "servers", "1"), 0700)
+	if err != nil {
+		t.Fatalf("unable to create server dir: %v", err)
+	}
+
+	// A small ECDSA certificate keeps the test fast; generating
+	// the RSA key GenerateSelfSignedCert uses takes a while.
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Grumble Test Certificate"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	certbuf, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("unable to create certificate: %v", err)
+	}
+	keybuf, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("unable to marshal key: %v", err)
+	}
+	certpem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certbuf})
+	keypem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keybuf})
+	if err := ioutil.WriteFile(filepath.Join(dir, "cert.pem"), certpem, 0600); err != nil {
+		t.Fatalf("unable to write certificate: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "key.pem"), keypem, 0600); err != nil {
+		t.Fatalf("unable to write key: %v", err)
+	}
+
+	olddir := Args.DataDir
+	Args.DataDir = dir
+	return func() {
+		Args.DataDir = olddir
+		os.RemoveAll(dir)
+	}
+}
+
+// Open a freeze log for server in a temporary data directory. Returns a
+// function that closes the log and removes the directory.
+func openTestFreezeLog(t *testing.T, server *Server) func() {
+	cleanup := setupTestDataDir(t)
+	if err := server.openFreezeLog(); err != nil {
+		cleanup()
+		t.Fatalf("unable to open freeze log: %v", err)
+	}
+	return func() {
+		if server.freezelog != nil {
+			server.freezelog.Close()
+		}
+		cleanup()
+	}
+}
+
+// Point the global blob store at a temporary directory. The returned
+// function restores the previous blob store and removes the directory.
+func openTestBlobStore(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "grumble-blobs")
+	if err != nil {
+		t.Fatalf("unable to create blob dir: %v", err)
+	}
+	oldBlobStore := blobStore
+	blobStore = blobstore.Open(dir)
+	return func() {
+		blobStore = oldBlobStore
+		os.RemoveAll(dir)
+	}
+}
+
+// Find a port on the loopback interface that is not currently in use.
+func freeTestPort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestLastChannelRecordedByHandler(t *testing.T) {
+	server := newTestServer(t)
+	defer openTestFreezeLog(t, server)()
+	server.disconnectRequests = make(chan disconnectRequest, 1)
+	games := newTestChannel(server, server.RootChannel(), "Games")
+	user := addTestUser(t, server, 1, "alice")
+
+	alice, _ := newTestClient(server, "alice")
+	alice.user = user
+	server.userEnterChannel(alice, games, &mumbleproto.UserState{})
+	user.LastChannelId = 0
+
+	// The receiver that notices the client hang up leaves recording
+	// where it was to the handler.
+	alice.handleReadError(io.EOF)
+	if user.LastChannelId != 0 {
+		t.Fatalf("Expected the receiver not to record the last channel")
+	}
+	server.handleDisconnectRequest(<-server.disconnectRequests)
+	if user.LastChannelId != games.Id {
+		t.Errorf("Expected last channel %v, got %v", games.Id, user.LastChannelId)
+	}
+}
+
+func TestServerStartStop(t *testing.T) {
+	defer setupTestDataDir(t)()
+
+	server := newTestServer(t)
+	port := freeTestPort(t)
+	server.cfg.Set("Address", "127.0.0.1")
+	server.cfg.Set("Port", strconv.Itoa(port))
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+
+	for i := 0; i < 2; i++ {
+		if err := server.Start(); err != nil {
+			t.Fatalf("unable to start server: %v", err)
+		}
+		if server.CurrentPort() != port {
+			t.Errorf("Expected server to listen on port %v, got %v", port, server.CurrentPort())
+		}
+		if err := server.Start(); err == nil {
+			t.Errorf("Expected starting a running server to fail")
+		}
+		if server.StartTime().IsZero() {
+			t.Errorf("Expected running server to have a start time")
+		}
+
+		// The server greets new clients with its version.
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("unable to connect: %v", err)
+		}
+		peer := &testPeer{conn: conn, msgs: make(chan *Message, 16)}
+		go peer.readLoop()
+		peer.expect(t, mumbleproto.MessageVersion, &mumbleproto.Version{})
+
+		// Hang up, and wait for the server to close its end of the
+		// connection, so the client is gone before the server stops.
+		if err := conn.CloseWrite(); err != nil {
+			t.Fatalf("unable to shut down connection: %v", err)
+		}
+		for range peer.msgs {
+		}
+		conn.Close()
+
+		if err := server.Stop(); err != nil {
+			t.Fatalf("unable to stop server: %v", err)
+		}
+		if server.CurrentPort() != -1 {
+			t.Errorf("Expected stopped server to have no port, got %v", server.CurrentPort())
+		}
+		if server.Uptime() != 0 {
+			t.Errorf("Expected stopped server to have no uptime")
+		}
+		if server.freezelog != nil {
+			t.Errorf("Expected stopped server to have closed its freeze log")
+		}
+		if _, err := net.Dial("tcp", addr); err == nil {
+			t.Errorf("Expected stopped server not to accept connections")
+		}
+	}
+
+	if err := server.Stop(); err == nil {
+		t.Errorf("Expected stopping a stopped server to fail")
+	}
+}
+
+func TestConcurrentStop(t *testing.T) {
+	defer setupTestDataDir(t)()
+
+	server := newTestServer(t)
+	server.cfg.Set("Address", "127.0.0.1")
+	server.cfg.Set("Port", strconv.Itoa(freeTestPort(t)))
+	if err := server.Start(); err != nil {
+		t.Fatalf("unable to start server: %v", err)
+	}
+
+	// Only one of the calls stops the server; the others find it
+	// stopped.
+	errs := make(chan error, 3)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			errs <- server.Stop()
+		}()
+	}
+	stopped := 0
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err == nil {
+			stopped++
+		}
+	}
+	if stopped != 1 {
+		t.Errorf("Expected exactly one Stop to succeed, got %v", stopped)
+	}
+	if server.isRunning() {
+		t.Errorf("Expected the server to be stopped")
+	}
+}
+
+func TestStopClosesConnections(t *testing.T) {
+	defer setupTestDataDir(t)()
+
+	server := newTestServer(t)
+	port := freeTestPort(t)
+	server.cfg.Set("Address", "127.0.0.1")
+	server.cfg.Set("Port", strconv.Itoa(port))
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	if err := server.Start(); err != nil {
+		t.Fatalf("unable to start server: %v", err)
+	}
+
+	// One peer stalls its TLS handshake, the other is greeted, but
+	// never logs in. Neither is known to the handler.
+	stalled, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("unable to connect: %v", err)
+	}
+	defer stalled.Close()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("unable to connect: %v", err)
+	}
+	defer conn.Close()
+	peer := &testPeer{conn: conn, msgs: make(chan *Message, 16)}
+	go peer.readLoop()
+	peer.expect(t, mumbleproto.MessageVersion, &mumbleproto.Version{})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Stop()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("unable to stop server: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the server to stop")
+	}
+
+	// Stop returns once the goroutines serving both are gone, and
+	// their connections are closed.
+	stalled.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := stalled.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the stalled connection to be closed, got %v", err)
+	}
+	for range peer.msgs {
+	}
+}
+
+func TestJoinDefaultChannel(t *testing.T) {
+	server := newTestServer(t)
+	lobby := newTestChannel(server, server.RootChannel(), "Lobby")
+
+	if server.DefaultChannel() != server.RootChannel() {
+		t.Errorf("Expected root to be the default channel")
+	}
+	server.cfg.Set("DefaultChannel", strconv.Itoa(lobby.Id))
+	if server.DefaultChannel() != lobby {
+		t.Errorf("Expected Lobby to be the default channel")
+	}
+
+	_, bobPeer := newTestClient(server, "bob")
+	alice, _ := newAuthenticatingClient(server, "alice")
+	server.finishAuthenticate(alice)
+
+	if alice.Channel != lobby {
+		t.Errorf("Expected unregistered user to join the default channel")
+	}
+	userstate := &mumbleproto.UserState{}
+	bobPeer.expect(t, mumbleproto.MessageUserState, userstate)
+	if userstate.GetSession() != alice.Session() || userstate.GetChannelId() != uint32(lobby.Id) {
+		t.Errorf("Expected UserState placing alice in Lobby, got %v", userstate)
+	}
+
+	// Fall back to root if the default channel goes away.
+	server.cfg.Set("DefaultChannel", "1234")
+	if server.DefaultChannel() != server.RootChannel() {
+		t.Errorf("Expected root to be the default channel")
+	}
+}
+
+func TestJoinLastChannel(t *testing.T) {
+	server := newTestServer(t)
+	defer openTestFreezeLog(t, server)()
+	lobby := newTestChannel(server, server.RootChannel(), "Lobby")
+	games := newTestChannel(server, server.RootChannel(), "Games")
+	server.cfg.Set("DefaultChannel", strconv.Itoa(lobby.Id))
+
+	user, err := NewUser(1, "alice")
+	if err != nil {
+		t.Fatalf("unable to create user: %v", err)
+	}
+
+	// Moving a registered user records the channel it was last in.
+	alice, _ := newTestClient(server, "alice")
+	alice.user = user
+	server.userEnterChannel(alice, games, &mumbleproto.UserState{})
+	alice.Disconnect()
+	if user.LastChannelId != games.Id {
+		t.Fatalf("Expected last channel %v, got %v", games.Id, user.LastChannelId)
+	}
+
+	// On reconnect, the user returns to that channel.
+	alice, _ = newAuthenticatingClient(server, "alice")
+	alice.user = user
+	server.finishAuthenticate(alice)
+	if alice.Channel != games {
+		t.Errorf("Expected returning user to join its last channel")
+	}
+	alice.Disconnect()
+
+	// Unless the server doesn't remember channels.
+	server.cfg.Set("RememberChannel", "false")
+	alice, _ = newAuthenticatingClient(server, "alice")
+	alice.user = user
+	server.finishAuthenticate(alice)
+	if alice.Channel != lobby {
+		t.Errorf("Expected user to join the default channel")
+	}
+}
+
+func TestEnterTokenChannel(t *testing.T) {
+	server := newTestServer(t)
+	locked := newTestChannel(server, server.RootChannel(), "Locked")
+	locked.EnterToken = "Secret"
+
+	alice, alicePeer := newTestClient(server, "alice")
+	server.handleUserStateMessage(alice, newTestMessage(t, alice, &mumbleproto.UserState{
+		ChannelId: proto.Uint32(uint32(locked.Id)),
+	}))
+	if alice.Channel != server.RootChannel() {
+		t.Errorf("Expected client without token to be denied entry")
+	}
+	alicePeer.expect(t, mumbleproto.MessagePermissionDenied, &mumbleproto.PermissionDenied{})
+
+	bob, _ := newTestClient(server, "bob")
+	bob.tokens = []string{"other", "secret"}
+	server.handleUserStateMessage(bob, newTestMessage(t, bob, &mumbleproto.UserState{
+		ChannelId: proto.Uint32(uint32(locked.Id)),
+	}))
+	if bob.Channel != locked {
+		t.Errorf("Expected client with token to enter the channel")
+	}
+}
+
+func TestEnterTokensConfig(t *testing.T) {
+	server := newTestServer(t)
+	locked := newTestChannel(server, server.RootChannel(), "Locked")
+	server.cfg.Set("EnterTokens", fmt.Sprintf("bogus, %v = Secret", locked.Id))
+
+	alice, alicePeer := newTestClient(server, "alice")
+	server.handleUserStateMessage(alice, newTestMessage(t, alice, &mumbleproto.UserState{
+		ChannelId: proto.Uint32(uint32(locked.Id)),
+	}))
+	if alice.Channel != server.RootChannel() {
+		t.Errorf("Expected client without token to be denied entry")
+	}
+	alicePeer.expect(t, mumbleproto.MessagePermissionDenied, &mumbleproto.PermissionDenied{})
+
+	bob, _ := newTestClient(server, "bob")
+	bob.tokens = []string{"secret"}
+	if !locked.CanEnter(bob) {
+		t.Errorf("Expected client with token to be allowed to enter")
+	}
+
+	// The channel's own token takes precedence.
+	locked.EnterToken = "other"
+	if locked.CanEnter(bob) {
+		t.Errorf("Expected the channel's own token to override EnterTokens")
+	}
+	locked.EnterToken = ""
+
+	server.cfg.Reset("EnterTokens")
+	if !locked.CanEnter(alice) {
+		t.Errorf("Expected the channel to be unrestricted once EnterTokens is reset")
+	}
+}
+
+func TestSetChannelEnterToken(t *testing.T) {
+	server := newTestServer(t)
+	defer openTestFreezeLog(t, server)()
+	root := server.RootChannel()
+	lobby := newTestChannel(server, root, "Lobby")
+	room := newTestChannel(server, lobby, "Room")
+
+	alice, _ := newTestClient(server, "alice")
+	alice.tokens = []string{"secret"}
+	bob, _ := newTestClient(server, "bob")
+	server.userEnterChannel(alice, room, &mumbleproto.UserState{})
+	server.userEnterChannel(bob, room, &mumbleproto.UserState{})
+
+	// Without evicting, residents stay put.
+	server.SetChannelEnterToken(room, "secret", false)
+	if room.EnterToken != "secret" {
+		t.Errorf("Expected enter token to be set")
+	}
+	if bob.Channel != room {
+		t.Errorf("Expected bob to stay in Room")
+	}
+
+	server.SetChannelEnterToken(room, "secret", true)
+	if alice.Channel != room {
+		t.Errorf("Expected alice, who has the token, to stay in Room")
+	}
+	if bob.Channel != lobby {
+		t.Errorf("Expected bob to be moved to Lobby")
+	}
+}
+
+// Send an Authenticate message with the given username on behalf of
+// a client that has just connected. Returns whether the client was
+// authenticated.
+func authenticateTestClient(t *testing.T, server *Server, username string) (*Client, *testPeer, bool) {
+	client, peer := newHandshakenTestClient(server)
+	return client, peer, sendTestAuthenticate(t, server, client, username)
+}
+
+// Create a client that has just finished its version exchange.
+func newHandshakenTestClient(server *Server) (*Client, *testPeer) {
+	client, peer := newAuthenticatingClient(server, "")
+	client.state = StateServerSentVersion
+	client.CryptoMode = "OCB2-AES128"
+	return client, peer
+}
+
+// Send an Authenticate message with the given username on behalf of
+// client. Returns whether the client was authenticated.
+func sendTestAuthenticate(t *testing.T, server *Server, client *Client, username string) bool {
+	return sendTestAuthenticateMessage(t, server, client, &mumbleproto.Authenticate{
+		Username: proto.String(username),
+	})
+}
+
+// Like sendTestAuthenticate, but sends the given Authenticate message.
+func sendTestAuthenticateMessage(t *testing.T, server *Server, client *Client, auth *mumbleproto.Authenticate) bool {
+	msg := newTestMessage(t, client, auth)
+	done := make(chan bool)
+	go func() {
+		server.handleAuthenticate(client, msg)
+		close(done)
+	}()
+
+	// A rejected client's authentication ends without signalling
+	// the handler goroutine.
+	select {
+	case authenticated := <-server.clientAuthenticated:
+		if authenticated != client {
+			t.Fatalf("unexpected client authenticated")
+		}
+		<-done
+		return true
+	case <-done:
+		return false
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for authentication")
+	}
+	return false
+}
+
+func TestAuthenticateUsername(t *testing.T) {
+	server := newTestServer(t)
+
+	client, _, ok := authenticateTestClient(t, server, "alice")
+	if !ok || client.Username != "alice" {
+		t.Errorf("Expected valid username to be accepted")
+	}
+
+	client, _, ok = authenticateTestClient(t, server, "  bob ")
+	if !ok || client.Username != "bob" {
+		t.Errorf("Expected surrounding whitespace to be trimmed, got %q", client.Username)
+	}
+
+	server.cfg.Set("TrimUsernameWhitespace", "false")
+	if _, _, ok = authenticateTestClient(t, server, "  bob "); ok {
+		t.Errorf("Expected untrimmed whitespace to be rejected")
+	}
+}
+
+func TestAuthenticateInvalidUsername(t *testing.T) {
+	server := newTestServer(t)
+
+	for _, username := range []string{"<b>alice</b>", "two words", "superuser", "SUPERUSER"} {
+		_, peer, ok := authenticateTestClient(t, server, username)
+		if ok {
+			t.Errorf("Expected username %q to be rejected", username)
+			continue
+		}
+		reject := &mumbleproto.Reject{}
+		peer.expect(t, mumbleproto.MessageReject, reject)
+		if reject.GetType() != mumbleproto.Reject_InvalidUsername {
+			t.Errorf("Expected InvalidUsername rejection for %q, got %v", username, reject.GetType())
+		}
+	}
+}
+
+// Set up client for UDP, and return the remote end of its CryptState.
+func setupTestUDPClient(t *testing.T, server *Server, client *Client) *cryptstate.CryptState {
+	err := client.crypt.GenerateKey("OCB2-AES128")
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	client.udprecv = make(chan []byte, 8)
+
+	host := client.tcpaddr.IP.String()
+	server.hclients[host] = append(server.hclients[host], client)
+
+	eiv := append([]byte(nil), client.crypt.DecryptIV...)
+	div := append([]byte(nil), client.crypt.EncryptIV...)
+	remote := new(cryptstate.CryptState)
+	err = remote.SetKey("OCB2-AES128", client.crypt.Key, eiv, div)
+	if err != nil {
+		t.Fatalf("unable to set key: %v", err)
+	}
+	return remote
+}
+
+func encryptTestDatagram(crypt *cryptstate.CryptState, plain []byte) []byte {
+	buf := make([]byte, len(plain)+crypt.Overhead())
+	crypt.Encrypt(buf, plain)
+	return buf
+}
+
+func TestCryptResync(t *testing.T) {
+	server := newTestServer(t)
+	client, peer := newTestClient(server, "client")
+	remote := setupTestUDPClient(t, server, client)
+	plain := make([]byte, 8)
+	decrypted := make([]byte, len(plain))
+
+	for i := 0; i < 3; i++ {
+		encryptTestDatagram(&client.crypt, plain)
+	}
+	nonce := append([]byte(nil), client.crypt.EncryptIV...)
+
+	// Many of the client's packets are lost, so the server can't
+	// follow its nonce anymore.
+	for i := 0; i < 300; i++ {
+		encryptTestDatagram(remote, plain)
+	}
+	if err := client.crypt.Decrypt(decrypted, encryptTestDatagram(remote, plain)); err == nil {
+		t.Fatalf("Expected decryption to fail after losing packets")
+	}
+
+	// The client tells the server its nonce. Only the server's
+	// decrypt nonce changes.
+	server.handleCryptSetup(client, newTestMessage(t, client, &mumbleproto.CryptSetup{
+		ClientNonce: remote.EncryptIV,
+	}))
+	if !bytes.Equal(client.crypt.EncryptIV, nonce) {
+		t.Errorf("Expected a client nonce not to change the encrypt nonce")
+	}
+	if err := client.crypt.Decrypt(decrypted, encryptTestDatagram(remote, plain)); err != nil {
+		t.Errorf("Expected decryption to succeed after a resync: %v", err)
+	}
+
+	// The client asks for the server's nonce. The server carries on
+	// from where it was rather than restarting.
+	server.handleCryptSetup(client, newTestMessage(t, client, &mumbleproto.CryptSetup{}))
+	reply := &mumbleproto.CryptSetup{}
+	peer.expect(t, mumbleproto.MessageCryptSetup, reply)
+	if !bytes.Equal(reply.ServerNonce, nonce) || len(reply.ClientNonce) != 0 {
+		t.Fatalf("Expected the server's current nonce, got %v", reply)
+	}
+	if err := remote.SetDecryptIV(reply.ServerNonce); err != nil {
+		t.Fatalf("unable to set decrypt nonce: %v", err)
+	}
+	buf := encryptTestDatagram(&client.crypt, plain)
+	if buf[0] != nonce[0]+1 {
+		t.Errorf("Expected the encrypt nonce to continue from %v, got %v", nonce[0], buf[0])
+	}
+	if err := remote.Decrypt(decrypted, buf); err != nil {
+		t.Errorf("Expected the client to follow the server after a resync: %v", err)
+	}
+}
+
+func TestUDPSourcePortChange(t *testing.T) {
+	server := newTestServer(t)
+
+	// Another client on the same host, whose key does not match
+	// the datagrams below.
+	other, _ := newTestClient(server, "other")
+	setupTestUDPClient(t, server, other)
+
+	client, _ := newTestClient(server, "client")
+	remote := setupTestUDPClient(t, server, client)
+
+	oldaddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+	newaddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50001}
+
+	expectReceived := func(addr *net.UDPAddr, plain string) {
+		t.Helper()
+		server.handleUdpPacket(addr, encryptTestDatagram(remote, []byte(plain)))
+		select {
+		case buf := <-client.udprecv:
+			if string(buf) != plain {
+				t.Fatalf("got datagram %q, want %q", buf, plain)
+			}
+		default:
+			t.Fatalf("datagram %q from %v was not received", plain, addr)
+		}
+		if client.udpaddr.String() != addr.String() {
+			t.Fatalf("client udpaddr is %v, want %v", client.udpaddr, addr)
+		}
+		if server.hpclients[addr.String()] != client {
+			t.Fatalf("%v is not mapped to client", addr)
+		}
+	}
+
+	expectReceived(oldaddr, "first")
+	expectReceived(oldaddr, "second")
+
+	// The NAT picks a new source port for the client.
+	expectReceived(newaddr, "third")
+	if _, ok := server.hpclients[oldaddr.String()]; ok {
+		t.Errorf("old address %v is still mapped", oldaddr)
+	}
+	if len(other.udprecv) != 0 || other.udpaddr != nil {
+		t.Errorf("datagram was routed to the wrong client")
+	}
+
+	// A datagram from a third port that does not verify with the
+	// client's key must not take over its address.
+	forged := make([]byte, 64)
+	copy(forged, encryptTestDatagram(remote, []byte("fourth")))
+	forged[len(forged)-1] ^= 0xff
+	attacker := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50002}
+	server.handleUdpPacket(attacker, forged)
+	if len(client.udprecv) != 0 {
+		t.Errorf("forged datagram was received")
+	}
+	if client.udpaddr.String() != newaddr.String() {
+		t.Errorf("client udpaddr changed to %v", client.udpaddr)
+	}
+	if _, ok := server.hpclients[attacker.String()]; ok {
+		t.Errorf("forged datagram's address was mapped")
+	}
+}
+
+func TestCryptResyncNewAddress(t *testing.T) {
+	server := newTestServer(t)
+	clock := newFakeClock()
+	server.SetClock(clock)
+	client, peer := newTestClient(server, "client")
+	remote := setupTestUDPClient(t, server, client)
+	oldaddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+	newaddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50001}
+	plain := []byte{0x20, 0x01}
+
+	server.handleUdpPacket(oldaddr, encryptTestDatagram(remote, plain))
+	<-client.udprecv
+
+	// The client's source port changes after many of its packets
+	// are lost, so its datagrams match no client.
+	for i := 0; i < 300; i++ {
+		encryptTestDatagram(remote, plain)
+	}
+	clock.advance(20 * time.Second)
+	server.handleUdpPacket(newaddr, encryptTestDatagram(remote, plain))
+	if len(client.udprecv) != 0 || client.udpaddr.String() != oldaddr.String() {
+		t.Fatalf("Expected the datagram not to be matched to the client")
+	}
+	peer.expect(t, mumbleproto.MessageCryptSetup, nil)
+}
+
+// Wait for a UserState message about client.
+func expectUserState(t *testing.T, peer *testPeer, client *Client) *mumbleproto.UserState {
+	for {
+		userstate := &mumbleproto.UserState{}
+		peer.expect(t, mumbleproto.MessageUserState, userstate)
+		if userstate.GetSession() == client.Session() {
+			return userstate
+		}
+	}
+}
+
+func TestSuppressNewUsers(t *testing.T) {
+	server := newTestServer(t)
+	server.cfg.Set("SuppressNewUsers", "true")
+	moderator, moderatorPeer := newTestSuperUser(t, server)
+
+	client, _ := newAuthenticatingClient(server, "alice")
+	server.finishAuthenticate(client)
+	if !client.Suppress {
+		t.Errorf("Expected new user to be suppressed")
+	}
+	if userstate := expectUserState(t, moderatorPeer, client); !userstate.GetSuppress() {
+		t.Errorf("Expected new user to be announced as suppressed")
+	}
+
+	// Moving to another channel does not lift the suppression.
+	lobby := newTestChannel(server, server.RootChannel(), "Lobby")
+	server.userEnterChannel(client, lobby, &mumbleproto.UserState{})
+	if !client.Suppress {
+		t.Errorf("Expected unapproved user to stay suppressed after moving")
+	}
+
+	server.handleContextAction(moderator, newTestMessage(t, moderator, &mumbleproto.ContextAction{
+		Action:  proto.String("grumble.approve"),
+		Session: proto.Uint32(client.Session()),
+	}))
+	if client.Suppress {
+		t.Errorf("Expected approved user to be unsuppressed")
+	}
+	userstate := expectUserState(t, moderatorPeer, client)
+	if userstate.Suppress == nil || userstate.GetSuppress() {
+		t.Errorf("Expected approval to be announced")
+	}
+
+	server.cfg.Set("SuppressNewUsers", "false")
+	client, _ = newAuthenticatingClient(server, "bob")
+	server.finishAuthenticate(client)
+	if client.Suppress {
+		t.Errorf("Expected new user not to be suppressed with SuppressNewUsers disabled")
+	}
+}
+
+func TestApproveRegisteredUser(t *testing.T) {
+	server := newTestServer(t)
+	defer openTestFreezeLog(t, server)()
+
+	client, _ := newTestClient(server, "alice")
+	client.user = addTestUser(t, server, 1, "alice")
+	client.unapproved = true
+	client.Suppress = true
+
+	server.ApproveClient(client)
+	if client.Suppress || !client.user.Approved {
+		t.Fatalf("Expected user to be approved")
+	}
+
+	fu, err := client.user.Freeze()
+	if err != nil {
+		t.Fatalf("unable to freeze user: %v", err)
+	}
+	user, _ := NewUser(1, "alice")
+	user.Unfreeze(fu)
+	if !user.Approved {
+		t.Errorf("Expected approval to survive a freeze round trip")
+	}
+}
+
+func TestUDPTimeoutFallsBackToTCP(t *testing.T) {
+	server := newTestServer(t)
+	server.cfg.Set("UDPTimeout", "15")
+	client, peer := newTestClient(server, "client")
+	remote := setupTestUDPClient(t, server, client)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+
+	// UDP works.
+	ping := []byte{mumbleproto.UDPMessagePing << 5, 0x01}
+	server.handleUdpPacket(addr, encryptTestDatagram(remote, ping))
+	<-client.udprecv
+	if !client.usesUDP() {
+		t.Fatalf("Expected client to use UDP")
+	}
+	server.checkUDPTimeouts()
+	if !client.usesUDP() {
+		t.Fatalf("Expected client to keep using UDP while packets arrive")
+	}
+
+	// UDP packets stop arriving.
+	atomic.AddInt64(&client.lastUDP, -20)
+	server.checkUDPTimeouts()
+	if client.usesUDP() {
+		t.Fatalf("Expected client to fall back to TCP")
+	}
+	voice := []byte{mumbleproto.UDPMessageVoiceOpus << 5, 0x01, 0x02, 0xaa, 0xbb}
+	if err := client.SendUDP(voice); err != nil {
+		t.Fatalf("unable to send voice: %v", err)
+	}
+	msg := peer.expect(t, mumbleproto.MessageUDPTunnel, nil)
+	if !bytes.Equal(msg.buf, voice) {
+		t.Errorf("Expected voice to be tunneled over TCP")
+	}
+
+	// A valid UDP ping brings the client back to UDP.
+	server.handleUdpPacket(addr, encryptTestDatagram(remote, ping))
+	<-client.udprecv
+	if !client.usesUDP() {
+		t.Errorf("Expected client to recover to UDP")
+	}
+}
+
+func TestServerUptime(t *testing.T) {
+	server := newTestServer(t)
+	if server.Uptime() != 0 || !server.StartTime().IsZero() {
+		t.Errorf("Expected no uptime for a server that is not running")
+	}
+
+	server.running = true
+	server.startTime = time.Now()
+	first := server.Uptime()
+	time.Sleep(10 * time.Millisecond)
+	second := server.Uptime()
+	if second <= first || second < 10*time.Millisecond {
+		t.Errorf("Expected uptime to increase, got %v and %v", first, second)
+	}
+	if server.StartTime() != server.startTime {
+		t.Errorf("Expected start time to be reported")
+	}
+}
+
+func TestAnnounceChannelMoves(t *testing.T) {
+	server := newTestServer(t)
+	lobby := newTestChannel(server, server.RootChannel(), "Lobby")
+	games := newTestChannel(server, server.RootChannel(), "Games")
+
+	alice, alicePeer := newTestClient(server, "alice")
+	_, rootPeer := newTestClient(server, "dave")
+	bob, bobPeer := newTestClient(server, "bob")
+	server.userEnterChannel(bob, lobby, &mumbleproto.UserState{})
+	carol, carolPeer := newTestClient(server, "carol")
+	server.userEnterChannel(carol, games, &mumbleproto.UserState{})
+
+	// Announcements are off by default.
+	server.userEnterChannel(alice, lobby, &mumbleproto.UserState{})
+	bobPeer.expectNone(t, mumbleproto.MessageTextMessage)
+	server.userEnterChannel(alice, server.RootChannel(), &mumbleproto.UserState{})
+
+	server.cfg.Set("AnnounceChannelMoves", "true")
+	server.cfg.Set("AllowHTML", "false")
+	server.userEnterChannel(alice, lobby, &mumbleproto.UserState{})
+
+	entered := &mumbleproto.TextMessage{}
+	bobPeer.expect(t, mumbleproto.MessageTextMessage, entered)
+	if entered.GetMessage() != "alice entered the channel." {
+		t.Errorf("Unexpected announcement %q", entered.GetMessage())
+	}
+	if len(entered.ChannelId) != 1 || entered.ChannelId[0] != uint32(lobby.Id) {
+		t.Errorf("Expected announcement to be sent to Lobby, got %v", entered.ChannelId)
+	}
+	left := &mumbleproto.TextMessage{}
+	rootPeer.expect(t, mumbleproto.MessageTextMessage, left)
+	if left.GetMessage() != "alice left the channel." {
+		t.Errorf("Unexpected announcement %q", left.GetMessage())
+	}
+	carolPeer.expectNone(t, mumbleproto.MessageTextMessage)
+	alicePeer.expectNone(t, mumbleproto.MessageTextMessage)
+
+	// Leaving the server is announced, too.
+	server.cfg.Set("AllowHTML", "true")
+	bob.Username = "b<o>b"
+	bob.Disconnect()
+	left = &mumbleproto.TextMessage{}
+	alicePeer.expect(t, mumbleproto.MessageTextMessage, left)
+	if left.GetMessage() != "<b>b&lt;o&gt;b</b> left the channel." {
+		t.Errorf("Unexpected announcement %q", left.GetMessage())
+	}
+
+	// Announcements that would exceed the text message length limit
+	// are not sent.
+	server.cfg.Set("MaxTextMessageLength", "10")
+	server.userEnterChannel(carol, lobby, &mumbleproto.UserState{})
+	alicePeer.expectNone(t, mumbleproto.MessageTextMessage)
+}
+
+func TestMessageRateLimit(t *testing.T) {
+	server := newTestServer(t)
+	server.cfg.Set("MessageLimit", "1")
+	server.cfg.Set("MessageBurst", "5")
+	alice, alicePeer := newTestClient(server, "alice")
+	_, bobPeer := newTestClient(server, "bob")
+
+	for i := 0; i < 10; i++ {
+		server.handleIncomingMessage(alice, newTestMessage(t, alice, &mumbleproto.TextMessage{
+			ChannelId: []uint32{0},
+			Message:   proto.String("spam"),
+		}))
+	}
+	// Pings are exempt.
+	server.handleIncomingMessage(alice, newTestMessage(t, alice, &mumbleproto.Ping{}))
+	alicePeer.expect(t, mumbleproto.MessagePing, nil)
+
+	received := 0
+	for {
+		select {
+		case msg := <-bobPeer.msgs:
+			if msg.kind == mumbleproto.MessageTextMessage {
+				received++
+			}
+			continue
+		case <-time.After(100 * time.Millisecond):
+		}
+		break
+	}
+	if received != 5 {
+		t.Errorf("Expected a burst of 5 messages to be delivered, got %v", received)
+	}
+	if server.ThrottleEvents() != 1 {
+		t.Errorf("Expected 1 throttle event, got %v", server.ThrottleEvents())
+	}
+	if !alice.throttled {
+		t.Errorf("Expected alice to be throttled")
+	}
+}
+
+func TestLeakyBucket(t *testing.T) {
+	var lb leakyBucket
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if !lb.allow(now, 2, 3) {
+			t.Fatalf("Expected event %v of the burst to be allowed", i)
+		}
+	}
+	if lb.allow(now, 2, 3) {
+		t.Errorf("Expected event beyond the burst to be rejected")
+	}
+	// The bucket drains two events per second.
+	now = now.Add(time.Second)
+	if !lb.allow(now, 2, 3) || !lb.allow(now, 2, 3) {
+		t.Errorf("Expected events to be allowed after the bucket drained")
+	}
+	if lb.allow(now, 2, 3) {
+		t.Errorf("Expected the bucket to be full again")
+	}
+}
+
+// A syncBuffer is a bytes.Buffer that can be written to by several
+// goroutines at once.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.Write(p)
+}
+
+func (sb *syncBuffer) String() string {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.String()
+}
+
+func TestLogConnectionEvents(t *testing.T) {
+	defer setupTestDataDir(t)()
+
+	server := newTestServer(t)
+	logbuf := new(syncBuffer)
+	server.Logger = log.New(logbuf, "", 0)
+	port := freeTestPort(t)
+	server.cfg.Set("Address", "127.0.0.1")
+	server.cfg.Set("Port", strconv.Itoa(port))
+	server.cfg.Set("LogConnectionEvents", "true")
+	if err := server.Start(); err != nil {
+		t.Fatalf("unable to start server: %v", err)
+	}
+
+	conn, err := tls.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("unable to connect: %v", err)
+	}
+	peer := &testPeer{conn: conn, msgs: make(chan *Message, 64)}
+	go peer.readLoop()
+	peer.expect(t, mumbleproto.MessageVersion, nil)
+	peer.send(t, &mumbleproto.Version{
+		Version: proto.Uint32(0x10205),
+		Release: proto.String("Test Client"),
+		Os:      proto.String("test"),
+	})
+	peer.send(t, &mumbleproto.Authenticate{
+		Username: proto.String("alice"),
+	})
+	peer.expect(t, mumbleproto.MessageServerSync, nil)
+
+	if err := conn.CloseWrite(); err != nil {
+		t.Fatalf("unable to shut down connection: %v", err)
+	}
+	for range peer.msgs {
+	}
+	conn.Close()
+	if err := server.Stop(); err != nil {
+		t.Fatalf("unable to stop server: %v", err)
+	}
+
+	var events []string
+	for _, line := range strings.Split(logbuf.String(), "\n") {
+		if i := strings.Index(line, "event="); i >= 0 {
+			events = append(events, line[i:])
+		}
+	}
+	expected := []string{
+		"event=connect session=1 addr=127.0.0.1:",
+		`event=handshake session=1 release="Test Client" os=test crypto=OCB2-AES128`,
+		`event=authenticate session=1 username=alice userid=-1 certhash=""`,
+		"event=join session=1 channel=0",
+		`event=disconnect session=1 reason="connection closed by client" duration=0s`,
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %v events, got %v: %v", len(expected), len(events), events)
+	}
+	for i, event := range events {
+		if !strings.HasPrefix(event, expected[i]) {
+			t.Errorf("Expected event %q, got %q", expected[i], event)
+		}
+	}
+}
+
+func TestCodecUpdateAfterLogin(t *testing.T) {
+	server := newTestServer(t)
+	alice, alicePeer := newTestClient(server, "alice")
+	_, bobPeer := newTestClient(server, "bob")
+	for _, client := range server.clients {
+		client.codecs = []int32{CeltCompatBitstream}
+		client.opus = true
+	}
+	server.updateCodecVersions(nil)
+	if !server.Opus {
+		t.Fatalf("Expected server to use Opus")
+	}
+	for _, peer := range []*testPeer{alicePeer, bobPeer} {
+		peer.expect(t, mumbleproto.MessageCodecVersion, nil)
+	}
+
+	// A token update doesn't touch the client's codecs.
+	server.handleIncomingMessage(alice, newTestMessage(t, alice, &mumbleproto.Authenticate{
+		Tokens: []string{"secret"},
+	}))
+	if !alice.opus || len(alice.codecs) != 1 {
+		t.Errorf("Expected token update to keep alice's codecs")
+	}
+
+	// Alice loses Opus support, so the server must switch to CELT.
+	server.handleIncomingMessage(alice, newTestMessage(t, alice, &mumbleproto.Authenticate{
+		CeltVersions: []int32{CeltCompatBitstream},
+		Opus:         proto.Bool(false),
+	}))
+	if alice.opus {
+		t.Errorf("Expected alice's Opus support to be updated")
+	}
+	for _, peer := range []*testPeer{alicePeer, bobPeer} {
+		codecs := &mumbleproto.CodecVersion{}
+		peer.expect(t, mumbleproto.MessageCodecVersion, codecs)
+		if codecs.GetOpus() {
+			t.Errorf("Expected CodecVersion disabling Opus, got %v", codecs)
+		}
+	}
+}
+
+func TestOpusNegotiation(t *testing.T) {
+	// Log in clients with the given Opus support, that all support
+	// the CELT compat bitstream, and one that only some support.
+	login := func(server *Server, opus ...bool) {
+		for i, supported := range opus {
+			client, _ := newHandshakenTestClient(server)
+			celt := []int32{CeltCompatBitstream}
+			if i == 0 {
+				celt = append(celt, -2147483632) // CELT 0.11.0
+			}
+			if !sendTestAuthenticateMessage(t, server, client, &mumbleproto.Authenticate{
+				Username:     proto.String(fmt.Sprintf("user%v", i)),
+				CeltVersions: celt,
+				Opus:         proto.Bool(supported),
+			}) {
+				t.Fatalf("unable to authenticate client %v", i)
+			}
+			if client.opus != supported {
+				t.Fatalf("Expected the client's Opus capability to be %v", supported)
+			}
+			server.finishAuthenticate(client)
+		}
+	}
+
+	server := newTestServer(t)
+	login(server, true, false)
+	if server.Opus {
+		t.Errorf("Expected a client without Opus support to disable Opus")
+	}
+	codec := server.BetaCodec
+	if server.PreferAlphaCodec {
+		codec = server.AlphaCodec
+	}
+	if codec != CeltCompatBitstream {
+		t.Errorf("Expected the common CELT codec %#x, got %#x", CeltCompatBitstream, codec)
+	}
+
+	server = newTestServer(t)
+	login(server, true, true)
+	if !server.Opus {
+		t.Errorf("Expected two Opus clients to negotiate Opus")
+	}
+}
+
+func TestIncompatibleCodecs(t *testing.T) {
+	server := newTestServer(t)
+	peers := []*testPeer{}
+	for _, name := range []string{"alice", "bob", "carol"} {
+		client, peer := newTestClient(server, name)
+		client.opus = true
+		client.codecs = []int32{CeltCompatBitstream}
+		peers = append(peers, peer)
+	}
+	legacy, legacyPeer := newTestClient(server, "legacy")
+	legacy.celt = true
+	legacy.codecs = []int32{CeltCompatBitstream}
+
+	// Check that peer is sent a warning, or not.
+	expectWarning := func(peer *testPeer, warned bool) {
+		if warned {
+			txtmsg := &mumbleproto.TextMessage{}
+			peer.expect(t, mumbleproto.MessageTextMessage, txtmsg)
+			if !strings.Contains(txtmsg.GetMessage(), "WARNING") {
+				t.Errorf("Expected a codec warning, got %q", txtmsg.GetMessage())
+			}
+		} else {
+			peer.expect(t, mumbleproto.MessageCodecVersion, nil)
+			peer.expectNone(t, mumbleproto.MessageTextMessage)
+		}
+	}
+
+	// By default, the legacy client keeps everyone on CELT, which the
+	// others are told they can't use.
+	server.Opus = true
+	server.updateCodecVersions(nil)
+	if server.Opus {
+		t.Fatalf("Expected a client without Opus support to disable Opus")
+	}
+	for _, peer := range peers {
+		expectWarning(peer, true)
+	}
+	expectWarning(legacyPeer, false)
+
+	// With a lower OpusThreshold, the majority keeps Opus, and only the
+	// legacy client is warned.
+	server.cfg.Set("OpusThreshold", "75")
+	server.updateCodecVersions(nil)
+	if !server.Opus {
+		t.Fatalf("Expected the majority to negotiate Opus")
+	}
+	for _, peer := range peers {
+		expectWarning(peer, false)
+	}
+	expectWarning(legacyPeer, true)
+}
+
+func TestSuggestConfig(t *testing.T) {
+	server := newTestServer(t)
+
+	alice, alicePeer := newAuthenticatingClient(server, "alice")
+	server.finishAuthenticate(alice)
+	alicePeer.expect(t, mumbleproto.MessageServerConfig, nil)
+	alicePeer.expectNone(t, mumbleproto.MessageSuggestConfig)
+
+	server.cfg.Set("SuggestVersion", "1.3.0")
+	server.cfg.Set("SuggestPushToTalk", "true")
+	bob, bobPeer := newAuthenticatingClient(server, "bob")
+	server.finishAuthenticate(bob)
+	suggest := &mumbleproto.SuggestConfig{}
+	bobPeer.expect(t, mumbleproto.MessageSuggestConfig, suggest)
+	expected := &mumbleproto.SuggestConfig{
+		Version:    proto.Uint32(0x10300),
+		PushToTalk: proto.Bool(true),
+	}
+	if !proto.Equal(suggest, expected) {
+		t.Errorf("Expected SuggestConfig %v, got %v", expected, suggest)
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	version, err := parseVersion("1.2.4")
+	if err != nil || version != 0x10204 {
+		t.Errorf("Expected 1.2.4 to parse as 0x10204, got %#x (%v)", version, err)
+	}
+	for _, str := range []string{"1.2", "1.2.3.4", "1.x.0", "1.256.0"} {
+		if _, err := parseVersion(str); err == nil {
+			t.Errorf("Expected %q to be an invalid version", str)
+		}
+	}
+}
+
+func TestLoginMessageOrder(t *testing.T) {
+	server := newTestServer(t)
+	server.cfg.Set("SuggestPushToTalk", "true")
+	newTestChannel(server, server.RootChannel(), "Lobby")
+	newTestClient(server, "bob")
+
+	alice, peer, ok := authenticateTestClient(t, server, "alice")
+	if !ok {
+		t.Fatalf("Expected alice to be authenticated")
+	}
+	server.finishAuthenticate(alice)
+
+	// Collect the kinds of the login messages, collapsing the runs of
+	// ChannelStates and UserStates. Other messages, such as permission
+	// updates, may be interleaved.
+	login := map[uint16]bool{
+		mumbleproto.MessageCryptSetup:    true,
+		mumbleproto.MessageCodecVersion:  true,
+		mumbleproto.MessageChannelState:  true,
+		mumbleproto.MessageUserState:     true,
+		mumbleproto.MessageServerSync:    true,
+		mumbleproto.MessageServerConfig:  true,
+		mumbleproto.MessageSuggestConfig: true,
+	}
+	var kinds []uint16
+	for len(kinds) == 0 || kinds[len(kinds)-1] != mumbleproto.MessageSuggestConfig {
+		select {
+		case msg := <-peer.msgs:
+			if !login[msg.kind] {
+				continue
+			}
+			if len(kinds) > 0 && kinds[len(kinds)-1] == msg.kind {
+				continue
+			}
+			kinds = append(kinds, msg.kind)
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for login messages, got %v", kinds)
+		}
+	}
+
+	expected := []uint16{
+		mumbleproto.MessageCryptSetup,
+		mumbleproto.MessageCodecVersion,
+		mumbleproto.MessageChannelState,
+		mumbleproto.MessageUserState,
+		mumbleproto.MessageServerSync,
+		mumbleproto.MessageServerConfig,
+		mumbleproto.MessageSuggestConfig,
+	}
+	if len(kinds) != len(expected) {
+		t.Fatalf("Expected login message kinds %v, got %v", expected, kinds)
+	}
+	for i := range kinds {
+		if kinds[i] != expected[i] {
+			t.Fatalf("Expected login message kinds %v, got %v", expected, kinds)
+		}
+	}
+}
+
+func TestDuplicateUserRejected(t *testing.T) {
+	server := newTestServer(t)
+	user, err := NewUser(1, "alice")
+	if err != nil {
+		t.Fatalf("unable to create user: %v", err)
+	}
+	server.Users[1] = user
+
+	first, _ := newTestClient(server, "alice")
+	first.user = user
+
+	second, peer := newAuthenticatingClient(server, "alice")
+	second.user = user
+	server.finishAuthenticate(second)
+
+	reject := &mumbleproto.Reject{}
+	peer.expect(t, mumbleproto.MessageReject, reject)
+	if reject.GetType() != mumbleproto.Reject_UsernameInUse {
+		t.Errorf("Expected UsernameInUse rejection, got %v", reject.GetType())
+	}
+	if !second.isDisconnected() || first.isDisconnected() {
+		t.Errorf("Expected the new session to be rejected, and the old one to be kept")
+	}
+}
+
+func TestDuplicateUserKicksOld(t *testing.T) {
+	server := newTestServer(t)
+	server.cfg.Set("DuplicateUserPolicy", "kick")
+	defer openTestFreezeLog(t, server)()
+	user, err := NewUser(1, "alice")
+	if err != nil {
+		t.Fatalf("unable to create user: %v", err)
+	}
+	server.Users[1] = user
+
+	first, firstPeer := newTestClient(server, "alice")
+	first.user = user
+	_, bobPeer := newTestClient(server, "bob")
+
+	second, _ := newAuthenticatingClient(server, "alice")
+	second.user = user
+	server.finishAuthenticate(second)
+
+	if !first.isDisconnected() || second.isDisconnected() {
+		t.Fatalf("Expected the old session to be kicked, and the new one to be let in")
+	}
+	if _, ok := server.clients[second.Session()]; !ok {
+		t.Errorf("Expected the new session to be connected")
+	}
+	for _, peer := range []*testPeer{firstPeer, bobPeer} {
+		userremove := &mumbleproto.UserRemove{}
+		peer.expect(t, mumbleproto.MessageUserRemove, userremove)
+		if userremove.GetSession() != first.Session() {
+			t.Errorf("Expected UserRemove for session %v, got %v", first.Session(), userremove.GetSession())
+		}
+	}
+
+	// Unregistered users with the same name are not affected.
+	guest, _ := newTestClient(server, "carol")
+	other, _ := newAuthenticatingClient(server, "carol")
+	server.finishAuthenticate(other)
+	if guest.isDisconnected() || other.isDisconnected() {
+		t.Errorf("Expected unregistered users not to be treated as duplicates")
+	}
+}
+
+func TestDuplicateNameRejected(t *testing.T) {
+	server := newTestServer(t)
+	server.cfg.Set("DuplicateNamePolicy", "reject")
+
+	first, _ := newTestClient(server, "carol")
+	second, peer := newAuthenticatingClient(server, "Carol")
+	server.finishAuthenticate(second)
+
+	reject := &mumbleproto.Reject{}
+	peer.expect(t, mumbleproto.MessageReject, reject)
+	if reject.GetType() != mumbleproto.Reject_UsernameInUse {
+		t.Errorf("Expected UsernameInUse rejection, got %v", reject.GetType())
+	}
+	if !second.isDisconnected() || first.isDisconnected() {
+		t.Errorf("Expected the new client to be rejected, and the old one to be kept")
+	}
+}
+
+func TestDuplicateNameSuffixed(t *testing.T) {
+	server := newTestServer(t)
+	server.cfg.Set("DuplicateNamePolicy", "suffix")
+	user, err := NewUser(1, "carol(2)")
+	if err != nil {
+		t.Fatalf("unable to create user: %v", err)
+	}
+	server.Users[1] = user
+	server.UserNameMap[user.Name] = user
+
+	first, _ := newTestClient(server, "carol")
+	second, _ := newAuthenticatingClient(server, "carol")
+	server.finishAuthenticate(second)
+
+	if first.isDisconnected() || second.isDisconnected() {
+		t.Fatalf("Expected both clients to be let in")
+	}
+	if first.ShownName() != "carol" {
+		t.Errorf("Expected the first client to keep its name, got %v", first.ShownName())
+	}
+	// carol(2) is registered, so the next free name is used instead.
+	if second.ShownName() != "carol(3)" {
+		t.Errorf("Expected the second client to be renamed to carol(3), got %v", second.ShownName())
+	}
+}
+
+func TestQueueChannel(t *testing.T) {
+	server := newTestServer(t)
+	defer openTestFreezeLog(t, server)()
+	queue := newTestChannel(server, server.RootChannel(), "Queue")
+	server.cfg.Set("MaxUsers", "1")
+	server.cfg.Set("QueueChannel", strconv.Itoa(queue.Id))
+
+	alice, _ := newTestClient(server, "alice")
+	bob, _ := newAuthenticatingClient(server, "bob")
+	server.finishAuthenticate(bob)
+	carol, _ := newAuthenticatingClient(server, "carol")
+	server.finishAuthenticate(carol)
+
+	for _, client := range []*Client{bob, carol} {
+		if client.isDisconnected() {
+			t.Fatalf("Expected %v to be queued, not rejected", client.ShownName())
+		}
+		if client.Channel != queue || !client.Suppress {
+			t.Errorf("Expected %v to wait suppressed in the queue channel", client.ShownName())
+		}
+	}
+
+	// Waiting clients can't leave the queue channel.
+	server.handleUserStateMessage(bob, newTestMessage(t, bob, &mumbleproto.UserState{
+		ChannelId: proto.Uint32(0),
+	}))
+	if bob.Channel != queue {
+		t.Errorf("Expected a queued client not to leave the queue channel")
+	}
+
+	// Once alice leaves, the first client in the queue is let in.
+	alice.Disconnect()
+	if bob.Channel != server.RootChannel() || bob.Suppress {
+		t.Errorf("Expected bob to be promoted to the root channel")
+	}
+	if carol.Channel != queue || !carol.Suppress {
+		t.Errorf("Expected carol to keep waiting in the queue channel")
+	}
+}
+
+func TestMaxQueueLength(t *testing.T) {
+	server := newTestServer(t)
+	defer openTestFreezeLog(t, server)()
+	queue := newTestChannel(server, server.RootChannel(), "Queue")
+	server.cfg.Set("MaxUsers", "1")
+	server.cfg.Set("QueueChannel", strconv.Itoa(queue.Id))
+	server.cfg.Set("MaxQueueLength", "1")
+
+	newTestClient(server, "alice")
+	bob, _ := newAuthenticatingClient(server, "bob")
+	server.finishAuthenticate(bob)
+	if bob.isDisconnected() || !bob.queued {
+		t.Fatalf("Expected bob to be queued")
+	}
+
+	// The queue is full, so carol is turned away.
+	carol, carolPeer := newAuthenticatingClient(server, "carol")
+	server.finishAuthenticate(carol)
+	if !carol.isDisconnected() {
+		t.Fatalf("Expected carol to be rejected from a full queue")
+	}
+	reject := &mumbleproto.Reject{}
+	carolPeer.expect(t, mumbleproto.MessageReject, reject)
+	if reject.GetType() != mumbleproto.Reject_ServerFull {
+		t.Errorf("Expected a ServerFull rejection, got %v", reject)
+	}
+	if len(server.queue) != 1 {
+		t.Errorf("Expected one queued client, got %v", len(server.queue))
+	}
+}
+
+func TestImportBans(t *testing.T) {
+	server := newTestServer(t)
+	defer openTestFreezeLog(t, server)()
+	server.Bans = []ban.Ban{
+		{IP: net.ParseIP("10.0.0.1"), Mask: 128, Reason: "spam", Actor: "admin"},
+		{IP: net.ParseIP("10.1.0.0"), Mask: 96 + 16, Reason: "abuse"},
+	}
+	data, err := server.ExportBans()
+	if err != nil {
+		t.Fatalf("unable to export bans: %v", err)
+	}
+
+	// Importing into a server that already has the bans adds nothing.
+	added, err := server.ImportBans(data)
+	if err != nil {
+		t.Fatalf("unable to import bans: %v", err)
+	}
+	if added != 0 || len(server.Bans) != 2 {
+		t.Errorf("Expected no bans to be added, added %v and have %v", added, len(server.Bans))
+	}
+	if len(server.banUpdate) != 0 {
+		t.Errorf("Expected no ban list update without new bans")
+	}
+
+	// Only the missing bans are added to a partial ban list.
+	server.Bans = server.Bans[:1]
+	added, err = server.ImportBans(data)
+	if err != nil {
+		t.Fatalf("unable to import bans: %v", err)
+	}
+	if added != 1 || len(server.Bans) != 2 {
+		t.Errorf("Expected 1 ban to be added, added %v and have %v", added, len(server.Bans))
+	}
+	if server.Bans[1].Reason != "abuse" || !server.Bans[1].Match(net.ParseIP("10.1.2.3")) {
+		t.Errorf("Unexpected imported ban: %+v", server.Bans[1])
+	}
+
+	// The handler writes the new ban list to the freeze log.
+	if len(server.banUpdate) != 1 {
+		t.Errorf("Expected the handler to be asked to update the ban list")
+	}
+
+	// Further updates are folded into the pending one, rather than
+	// blocking until the handler gets to it.
+	server.Bans = server.Bans[:1]
+	if _, err := server.ImportBans(data); err != nil {
+		t.Fatalf("unable to import bans: %v", err)
+	}
+	if len(server.banUpdate) != 1 {
+		t.Errorf("Expected a single pending ban list update")
+	}
+
+	if _, err := server.ImportBans([]byte("not json")); err == nil {
+		t.Errorf("Expected invalid data to be rejected")
+	}
+
+	// A stopped server has no handler to ask.
+	server.cleanPerLaunchData()
+	server.Bans = server.Bans[:1]
+	if added, err := server.ImportBans(data); err != nil || added != 1 {
+		t.Errorf("Expected a stopped server to import bans, added %v (%v)", added, err)
+	}
+}
+
+func TestStalledTLSHandshake(t *testing.T) {
+	server := newTestServer(t)
+	server.cfg.Set("TLSHandshakeTimeout", "1")
+
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer l.Close()
+
+	// The peer connects, but never sends a ClientHello.
+	peer, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("unable to dial: %v", err)
+	}
+	defer peer.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("unable to accept: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		server.handleIncomingClient(tls.Server(conn, &tls.Config{}))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the stalled handshake to be aborted")
+	}
+
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the connection to be closed, got %v", err)
+	}
+	if len(server.clients) != 0 {
+		t.Errorf("Expected no client to be added, got %v", len(server.clients))
+	}
+}
+
+func TestShutdownPersistsChannels(t *testing.T) {
+	defer setupTestDataDir(t)()
+
+	server := newTestServer(t)
+	port := freeTestPort(t)
+	server.cfg.Set("Address", "127.0.0.1")
+	server.cfg.Set("Port", strconv.Itoa(port))
+	server.RootChannel().ACL.ACLs = append(server.RootChannel().ACL.ACLs, acl.ACL{
+		UserId:    -1,
+		Group:     "all",
+		ApplyHere: true,
+		ApplySubs: true,
+		Allow:     acl.Permission(acl.MakeChannelPermission),
+	})
+	if err := server.Start(); err != nil {
+		t.Fatalf("unable to start server: %v", err)
+	}
+
+	// Create a channel through a connected client, which needs a
+	// certificate to be allowed to.
+	cert, key := newTestCert(t, "alice", false, nil, nil)
+	conn, err := tls.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}},
+	})
+	if err != nil {
+		t.Fatalf("unable to connect: %v", err)
+	}
+	defer conn.Close()
+	peer := &testPeer{conn: conn, msgs: make(chan *Message, 64)}
+	go peer.readLoop()
+	peer.expect(t, mumbleproto.MessageVersion, nil)
+	peer.send(t, &mumbleproto.Version{Version: proto.Uint32(0x10205)})
+	peer.send(t, &mumbleproto.Authenticate{Username: proto.String("alice")})
+	peer.expect(t, mumbleproto.MessageServerSync, nil)
+	peer.send(t, &mumbleproto.ChannelState{
+		Parent: proto.Uint32(0),
+		Name:   proto.String("Games"),
+	})
+	chanstate := &mumbleproto.ChannelState{}
+	peer.expect(t, mumbleproto.MessageChannelState, chanstate)
+	if chanstate.GetName() != "Games" {
+		t.Fatalf("Expected the channel to be created, got %v", chanstate)
+	}
+
+	if err := server.Shutdown(5 * time.Second); err != nil {
+		t.Fatalf("unable to shut down server: %v", err)
+	}
+
+	// Load the server from the store, as if the process had been
+	// restarted.
+	server, err = NewServerFromFrozen("1")
+	if err != nil {
+		t.Fatalf("unable to load server: %v", err)
+	}
+	found := false
+	for _, channel := range server.Channels {
+		if channel.Name == "Games" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected the channel created at runtime to be stored")
+	}
+}
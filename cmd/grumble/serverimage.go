@@ -0,0 +1,80 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"image/png"
+)
+
+// Set the server's image, such as a logo, to buf, which must hold a PNG
+// image of at most MaxServerImageSize bytes. The image is stored in the
+// blobstore, and the ServerImage config key is set to its hash. An empty
+// buf removes the image.
+//
+// The Mumble protocol has no message that carries a server image, so
+// clients are sent it inline in the welcome text when they log in.
+//
+// Like the other config setters, this leaves writing the new config
+// value to the freeze log to the server's handler. A server that isn't
+// running writes it along with the rest of its state once it is next
+// frozen.
+func (server *Server) SetServerImage(buf []byte) error {
+	key := ""
+	if len(buf) > 0 {
+		max := server.cfg.IntValue("MaxServerImageSize")
+		if max > 0 && len(buf) > max {
+			return errors.New("server image is too large")
+		}
+		if _, err := png.DecodeConfig(bytes.NewReader(buf)); err != nil {
+			return errors.New("server image is not a PNG image: " + err.Error())
+		}
+		var err error
+		key, err = blobStore.Put(buf)
+		if err != nil {
+			return err
+		}
+	}
+
+	server.cfg.Set("ServerImage", key)
+	server.sendConfigUpdate(&KeyValuePair{Key: "ServerImage", Value: key})
+	return nil
+}
+
+// Get the server's image, or nil if it doesn't have one.
+func (server *Server) ServerImage() ([]byte, error) {
+	key := server.cfg.StringValue("ServerImage")
+	if key == "" {
+		return nil, nil
+	}
+	return blobStore.Get(key)
+}
+
+// Get the hash of the server's image, as hex-encoded SHA-1, or an empty
+// string if it doesn't have one.
+func (server *Server) ServerImageHash() string {
+	return server.cfg.StringValue("ServerImage")
+}
+
+// Get the welcome text sent to clients that log in, with the server's
+// image, if it has one, in front of it.
+func (server *Server) welcomeText() string {
+	text := server.cfg.StringValue("WelcomeText")
+	buf, err := server.ServerImage()
+	if err != nil {
+		server.Printf("Unable to load server image: %v", err)
+		return text
+	}
+	if len(buf) == 0 {
+		return text
+	}
+	img := `<img src="data:image/png;base64,` + base64.StdEncoding.EncodeToString(buf) + `"/>`
+	if text == "" {
+		return img
+	}
+	return img + "<br />" + text
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"image"
+	"image/color"
+	"image/png"
+	"mumble.info/grumble/pkg/mumbleproto"
+	"strings"
+	"testing"
+)
+
+func TestServerImage(t *testing.T) {
+	server := newTestServer(t)
+	defer openTestFreezeLog(t, server)()
+	defer openTestBlobStore(t)()
+	server.cfgUpdate = make(chan *KeyValuePair, 2)
+	server.running = true
+
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	img.Set(3, 4, color.RGBA{R: 0xff, A: 0xff})
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatalf("unable to encode image: %v", err)
+	}
+	logo := buf.Bytes()
+
+	if err := server.SetServerImage(logo); err != nil {
+		t.Fatalf("unable to set server image: %v", err)
+	}
+	stored, err := server.ServerImage()
+	if err != nil {
+		t.Fatalf("unable to get server image: %v", err)
+	}
+	if !bytes.Equal(stored, logo) {
+		t.Errorf("Expected the server image to be returned unchanged")
+	}
+	digest := sha1.Sum(logo)
+	if hash := server.ServerImageHash(); hash != hex.EncodeToString(digest[:]) {
+		t.Errorf("Expected the image's SHA-1 as its hash, got %v", hash)
+	}
+	if kvp := <-server.cfgUpdate; kvp.Key != "ServerImage" || kvp.Value != hex.EncodeToString(digest[:]) {
+		t.Errorf("Expected the handler to be asked to store the image's hash, got %+v", kvp)
+	}
+
+	// Clients are sent the image in their welcome text.
+	client, peer := newAuthenticatingClient(server, "alice")
+	server.finishAuthenticate(client)
+	sync := &mumbleproto.ServerSync{}
+	peer.expect(t, mumbleproto.MessageServerSync, sync)
+	if !strings.Contains(sync.GetWelcomeText(), base64.StdEncoding.EncodeToString(logo)) {
+		t.Errorf("Expected the server image in the welcome text, got %q", sync.GetWelcomeText())
+	}
+
+	if err := server.SetServerImage([]byte("not a png")); err == nil {
+		t.Errorf("Expected an image that isn't a PNG to be rejected")
+	}
+	server.cfg.Set("MaxServerImageSize", "16")
+	if err := server.SetServerImage(logo); err == nil {
+		t.Errorf("Expected an image over MaxServerImageSize to be rejected")
+	}
+	if server.ServerImageHash() != hex.EncodeToString(digest[:]) {
+		t.Errorf("Expected rejected images to leave the server image alone")
+	}
+
+	if err := server.SetServerImage(nil); err != nil {
+		t.Fatalf("unable to remove server image: %v", err)
+	}
+	if stored, err := server.ServerImage(); stored != nil || err != nil {
+		t.Errorf("Expected no server image, got %v bytes (%v)", len(stored), err)
+	}
+	if kvp := <-server.cfgUpdate; kvp.Key != "ServerImage" || kvp.Value != "" {
+		t.Errorf("Expected the handler to be asked to clear the image, got %+v", kvp)
+	}
+
+	// The image can be set on a server that isn't running, which has
+	// no handler to ask.
+	server.running = false
+	server.cleanPerLaunchData()
+	server.cfg.Reset("MaxServerImageSize")
+	if err := server.SetServerImage(logo); err != nil {
+		t.Fatalf("unable to set server image: %v", err)
+	}
+	if server.ServerImageHash() != hex.EncodeToString(digest[:]) {
+		t.Errorf("Expected the image to be set on a stopped server")
+	}
+}
@@ -26,6 +26,7 @@ func SignalHandler() {
 			continue
 		}
 		if sig == syscall.SIGINT || sig == syscall.SIGTERM {
+			shutdownServers()
 			os.Exit(0)
 		}
 	}
@@ -0,0 +1,49 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"time"
+)
+
+// A speaker is considered active in a channel while its voice packets
+// are at most this far apart.
+const speakerActiveTimeout = 500 * time.Millisecond
+
+// Check whether voice from client may be relayed to the channel, given
+// that at most limit clients may speak in it at once. Clients that are
+// already speaking keep the floor; others are dropped until one of them
+// falls silent. Priority speakers are always relayed, and do not count
+// towards the limit. A limit of zero or less means no limit.
+//
+// Called on the server's handler goroutine.
+func (channel *Channel) allowSpeaker(client *Client, now time.Time, limit int) bool {
+	if limit <= 0 || client.PrioritySpeaker {
+		return true
+	}
+
+	if channel.speakers == nil {
+		channel.speakers = make(map[uint32]time.Time)
+	}
+
+	session := client.Session()
+	last, ok := channel.speakers[session]
+	if !ok || now.Sub(last) > speakerActiveTimeout {
+		active := 0
+		for other, last := range channel.speakers {
+			if now.Sub(last) > speakerActiveTimeout {
+				delete(channel.speakers, other)
+			} else if other != session {
+				active++
+			}
+		}
+		if active >= limit {
+			return false
+		}
+	}
+
+	channel.speakers[session] = now
+	return true
+}
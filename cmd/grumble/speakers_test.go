@@ -0,0 +1,66 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"mumble.info/grumble/pkg/mumbleproto"
+	"testing"
+	"time"
+)
+
+func TestMaxChannelSpeakers(t *testing.T) {
+	server := newTestServer(t)
+	server.cfg.Set("MaxChannelSpeakers", "2")
+	_, peer := newTestClient(server, "listener")
+	speakers := []*Client{}
+	for _, name := range []string{"alice", "bob", "carol"} {
+		speaker, _ := newTestClient(server, name)
+		speakers = append(speakers, speaker)
+	}
+
+	// Send a voice packet from speaker to its channel, and return
+	// whether the listener received it.
+	speak := func(speaker *Client) bool {
+		buf, ok := relayedVoicePacket(speaker.Session(), []byte{mumbleproto.UDPMessageVoiceOpus << 5, 0x01, 0x00})
+		if !ok {
+			t.Fatalf("unable to construct voice packet")
+		}
+		server.sendChannelVoice(&VoiceBroadcast{client: speaker, buf: buf})
+		select {
+		case msg := <-peer.msgs:
+			return msg.kind == mumbleproto.MessageUDPTunnel
+		case <-time.After(50 * time.Millisecond):
+			return false
+		}
+	}
+
+	alice, bob, carol := speakers[0], speakers[1], speakers[2]
+	if !speak(alice) || !speak(bob) {
+		t.Fatalf("Expected the first two speakers to be relayed")
+	}
+	if speak(carol) {
+		t.Errorf("Expected the third concurrent speaker to be dropped")
+	}
+	if !speak(alice) {
+		t.Errorf("Expected an active speaker to keep the floor")
+	}
+
+	carol.PrioritySpeaker = true
+	if !speak(carol) {
+		t.Errorf("Expected a priority speaker to be relayed")
+	}
+	carol.PrioritySpeaker = false
+
+	// Once a speaker falls silent, or leaves, another one can speak.
+	server.RootChannel().speakers[bob.Session()] = time.Now().Add(-time.Second)
+	if !speak(carol) {
+		t.Errorf("Expected a speaker to be relayed after another one fell silent")
+	}
+	server.RootChannel().RemoveClient(alice)
+	server.RootChannel().AddClient(alice)
+	if !speak(bob) {
+		t.Errorf("Expected a speaker to be relayed after another one left")
+	}
+}
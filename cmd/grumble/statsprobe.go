@@ -0,0 +1,89 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// The length of a ping request from the Mumble connect dialog: four
+// zero bytes followed by an opaque 64-bit ident chosen by the client.
+const pingRequestSize = 12
+
+// How long a connection on the TCP port has to send its first bytes
+// before it is handed on to the TLS handshake, when stats probes are
+// enabled.
+const statsProbeTimeout = 2 * time.Second
+
+// The first byte of a TLS handshake record.
+const tlsRecordHandshake = 0x16
+
+// Build the reply to a ping request carrying ident. The reply only holds
+// public information: the server's version, the number of connected
+// users, the maximum number of users and the maximum bandwidth.
+func (server *Server) pingReply(ident uint64) []byte {
+	users := atomic.LoadInt32(&server.readyUsers)
+	buffer := bytes.NewBuffer(make([]byte, 0, 24))
+	_ = binary.Write(buffer, binary.BigEndian, uint32((1<<16)|(2<<8)|2))
+	_ = binary.Write(buffer, binary.BigEndian, ident)
+	_ = binary.Write(buffer, binary.BigEndian, uint32(users))
+	_ = binary.Write(buffer, binary.BigEndian, server.cfg.Uint32Value("MaxUsers"))
+	_ = binary.Write(buffer, binary.BigEndian, server.cfg.Uint32Value("MaxBandwidth"))
+	return buffer.Bytes()
+}
+
+// A peekedConn is a connection whose first bytes have been peeked at.
+// Reads go through the reader that holds them.
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *peekedConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
+
+// Check whether conn, a connection accepted on the TCP port, is a stats
+// probe: a ping request, as sent to the UDP port, sent in place of a TLS
+// handshake. Probes are answered, within the StatsProbeLimit rate limit,
+// and closed, without creating a client. Returns nil for probes, and
+// otherwise the connection to hand on to the TLS handshake.
+//
+// Called on the connection's own goroutine, so a client that is slow to
+// send its first bytes only holds up itself.
+func (server *Server) answerStatsProbe(conn net.Conn) net.Conn {
+	reader := bufio.NewReaderSize(conn, pingRequestSize)
+	peeked := &peekedConn{conn, reader}
+
+	_ = conn.SetReadDeadline(time.Now().Add(statsProbeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	first, err := reader.Peek(1)
+	if err != nil || first[0] == tlsRecordHandshake {
+		return peeked
+	}
+	buf, err := reader.Peek(pingRequestSize)
+	if err != nil || binary.BigEndian.Uint32(buf) != 0 {
+		return peeked
+	}
+
+	rate := server.cfg.IntValue("StatsProbeLimit")
+	burst := server.cfg.IntValue("StatsProbeBurst")
+	server.probeLock.Lock()
+	allowed := server.probeLimiter.allow(server.now(), rate, burst)
+	server.probeLock.Unlock()
+	if allowed {
+		reply := server.pingReply(binary.BigEndian.Uint64(buf[4:]))
+		_ = conn.SetWriteDeadline(time.Now().Add(statsProbeTimeout))
+		_, _ = conn.Write(reply)
+	}
+	conn.Close()
+	return nil
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Start accepting connections on a tuningListener for server. Accepted
+// connections are prepared, as the accept loop does, and those that are
+// to be handed on to TLS are sent on the returned channel.
+func newTestProbeListener(t *testing.T, server *Server) (*tuningListener, chan net.Conn) {
+	tcpl, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	l := &tuningListener{tcpl, server}
+	accepted := make(chan net.Conn, 8)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				if conn := server.prepareConn(conn); conn != nil {
+					accepted <- conn
+				}
+			}()
+		}
+	}()
+	return l, accepted
+}
+
+// Send a stats probe carrying ident to l, and return the reply.
+func sendTestProbe(t *testing.T, l *tuningListener, ident uint64) []byte {
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("unable to dial: %v", err)
+	}
+	defer conn.Close()
+
+	req := make([]byte, pingRequestSize)
+	binary.BigEndian.PutUint64(req[4:], ident)
+	if _, err := conn.Write(req); err != nil {
+		t.Fatalf("unable to send probe: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("unable to read probe reply: %v", err)
+	}
+	return reply
+}
+
+func TestStatsProbe(t *testing.T) {
+	server := newTestServer(t)
+	server.SetClock(newFakeClock())
+	server.cfg.Set("StatsProbe", "true")
+	server.cfg.Set("StatsProbeLimit", "1")
+	server.cfg.Set("StatsProbeBurst", "1")
+	server.cfg.Set("MaxUsers", "42")
+	server.cfg.Set("MaxBandwidth", "72000")
+	newTestClient(server, "alice")
+	newTestClient(server, "bob")
+
+	l, accepted := newTestProbeListener(t, server)
+	defer l.Close()
+
+	reply := sendTestProbe(t, l, 0x0102030405060708)
+	if len(reply) != 24 {
+		t.Fatalf("Expected a 24-byte reply, got %v bytes", len(reply))
+	}
+	if version := binary.BigEndian.Uint32(reply[0:]); version != (1<<16)|(2<<8)|2 {
+		t.Errorf("Unexpected version %#x", version)
+	}
+	if ident := binary.BigEndian.Uint64(reply[4:]); ident != 0x0102030405060708 {
+		t.Errorf("Expected the ident to be echoed, got %#x", ident)
+	}
+	if users := binary.BigEndian.Uint32(reply[12:]); users != 2 {
+		t.Errorf("Expected 2 users, got %v", users)
+	}
+	if max := binary.BigEndian.Uint32(reply[16:]); max != 42 {
+		t.Errorf("Expected max users of 42, got %v", max)
+	}
+	if bw := binary.BigEndian.Uint32(reply[20:]); bw != 72000 {
+		t.Errorf("Expected max bandwidth of 72000, got %v", bw)
+	}
+
+	// The clock doesn't move, so the rate limit is used up.
+	if reply := sendTestProbe(t, l, 1); len(reply) != 0 {
+		t.Errorf("Expected a rate limited probe to be closed without a reply, got %v bytes", len(reply))
+	}
+
+	// Probes are never handed on to TLS, but a TLS handshake is, with
+	// the bytes that were peeked at.
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("unable to dial: %v", err)
+	}
+	defer conn.Close()
+	hello := []byte{tlsRecordHandshake, 0x03, 0x01}
+	conn.Write(hello)
+	select {
+	case peer := <-accepted:
+		defer peer.Close()
+		buf := make([]byte, len(hello))
+		if _, err := io.ReadFull(peer, buf); err != nil || !bytes.Equal(buf, hello) {
+			t.Errorf("Expected the handshake bytes to be passed on, got %v (%v)", buf, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the connection to be accepted")
+	}
+}
+
+func TestPingReplyUsers(t *testing.T) {
+	server := newTestServer(t)
+	alice, _ := newTestClient(server, "alice")
+	newAuthenticatingClient(server, "bob")
+
+	users := func() uint32 {
+		return binary.BigEndian.Uint32(server.pingReply(0)[12:])
+	}
+	if n := users(); n != 1 {
+		t.Errorf("Expected only the ready client to be counted, got %v", n)
+	}
+	alice.Disconnect()
+	if n := users(); n != 0 {
+		t.Errorf("Expected a disconnected client not to be counted, got %v", n)
+	}
+}
+
+func TestStatsProbeDisabled(t *testing.T) {
+	server := newTestServer(t)
+	l, accepted := newTestProbeListener(t, server)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("unable to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(make([]byte, pingRequestSize))
+
+	// The probe is handed on to TLS as is, where its handshake fails.
+	select {
+	case peer := <-accepted:
+		defer peer.Close()
+		if _, ok := peer.(*net.TCPConn); !ok {
+			t.Errorf("Expected a *net.TCPConn, got %T", peer)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the probe to be accepted")
+	}
+}
+
+func TestStatsProbeSilentConnection(t *testing.T) {
+	server := newTestServer(t)
+	server.cfg.Set("StatsProbe", "true")
+
+	tcpl, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	l := &tuningListener{tcpl, server}
+	defer l.Close()
+	go server.acceptLoop(l)
+
+	// A connection that sends nothing is sniffed on its own goroutine,
+	// so a probe after it is answered without waiting for it to time out.
+	silent, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("unable to dial: %v", err)
+	}
+	defer silent.Close()
+
+	start := time.Now()
+	if reply := sendTestProbe(t, l, 1); len(reply) != 24 {
+		t.Fatalf("Expected a 24-byte reply, got %v bytes", len(reply))
+	}
+	if elapsed := time.Since(start); elapsed >= statsProbeTimeout {
+		t.Errorf("Expected the probe to be answered right away, took %v", elapsed)
+	}
+}
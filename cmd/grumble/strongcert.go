@@ -0,0 +1,56 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+// Load the pool of CAs that client certificates are verified against:
+// the system's CAs, plus the PEM-encoded certificates in the file named
+// by the ClientCAFile config key, if set. Returns a nil pool, which means
+// the system's CAs, if ClientCAFile isn't set.
+func (server *Server) loadClientCAs() (*x509.CertPool, error) {
+	fn := server.cfg.StringValue("ClientCAFile")
+	if fn == "" {
+		return nil, nil
+	}
+
+	pem, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in " + fn)
+	}
+	return pool, nil
+}
+
+// Check whether certs, the certificate chain presented by a client,
+// is a strong certificate: one that is signed by one of the server's
+// client CAs, rather than self-signed. The chain's first certificate is
+// the client's, and the others are used as intermediates.
+func (server *Server) isStrongCertificate(certs []*x509.Certificate) bool {
+	if len(certs) == 0 {
+		return false
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         server.clientCAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err == nil
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/golang/protobuf/proto"
+	"math/big"
+	"mumble.info/grumble/pkg/mumbleproto"
+	"testing"
+	"time"
+)
+
+// Create a certificate named name, signed by parent, or self-signed if
+// parent is nil. CA certificates can sign other certificates, and the
+// others are client certificates.
+func newTestCert(t *testing.T, name string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(now.UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if isCA {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("unable to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("unable to parse certificate: %v", err)
+	}
+	return cert, key
+}
+
+func TestStrongCertificate(t *testing.T) {
+	server := newTestServer(t)
+	ca, caKey := newTestCert(t, "Test CA", true, nil, nil)
+	signed, _ := newTestCert(t, "alice", false, ca, caKey)
+	selfSigned, _ := newTestCert(t, "bob", false, nil, nil)
+
+	server.clientCAs = x509.NewCertPool()
+	server.clientCAs.AddCert(ca)
+
+	if !server.isStrongCertificate([]*x509.Certificate{signed}) {
+		t.Errorf("Expected a CA-signed certificate to be strong")
+	}
+	if server.isStrongCertificate([]*x509.Certificate{selfSigned}) {
+		t.Errorf("Expected a self-signed certificate not to be strong")
+	}
+	if server.isStrongCertificate(nil) {
+		t.Errorf("Expected no certificate not to be strong")
+	}
+
+	// A chain through an intermediate CA is verified too.
+	intermediate, intermediateKey := newTestCert(t, "Test Intermediate", true, ca, caKey)
+	chained, _ := newTestCert(t, "carol", false, intermediate, intermediateKey)
+	if !server.isStrongCertificate([]*x509.Certificate{chained, intermediate}) {
+		t.Errorf("Expected a certificate signed through an intermediate to be strong")
+	}
+	if server.isStrongCertificate([]*x509.Certificate{chained}) {
+		t.Errorf("Expected a chain missing its intermediate not to be strong")
+	}
+}
+
+func TestUserStatsStrongCertificate(t *testing.T) {
+	server := newTestServer(t)
+	admin, adminPeer := newTestSuperUser(t, server)
+	strong, _ := newTestClient(server, "strong")
+	strong.strongCert = true
+	weak, _ := newTestClient(server, "weak")
+
+	for _, client := range []*Client{strong, weak} {
+		server.handleUserStatsMessage(admin, newTestMessage(t, admin, &mumbleproto.UserStats{
+			Session: proto.Uint32(client.Session()),
+		}))
+		stats := &mumbleproto.UserStats{}
+		adminPeer.expect(t, mumbleproto.MessageUserStats, stats)
+		if stats.StrongCertificate == nil || stats.GetStrongCertificate() != client.strongCert {
+			t.Errorf("Expected StrongCertificate %v for %v, got %v", client.strongCert, client.ShownName(), stats.StrongCertificate)
+		}
+	}
+}
+
+func TestRegisterRequiresStrongCertificate(t *testing.T) {
+	server := newTestServer(t)
+	defer openTestFreezeLog(t, server)()
+	server.cfg.Set("RegisterRequiresStrongCertificate", "true")
+	admin, adminPeer := newTestSuperUser(t, server)
+	weak, _ := newTestClient(server, "weak")
+	weak.certHash = "0bad"
+	strong, _ := newTestClient(server, "strong")
+	strong.certHash = "600d"
+	strong.strongCert = true
+
+	register := func(client *Client) {
+		server.handleUserStateMessage(admin, newTestMessage(t, admin, &mumbleproto.UserState{
+			Session: proto.Uint32(client.Session()),
+			UserId:  proto.Uint32(0),
+		}))
+	}
+
+	register(weak)
+	if weak.IsRegistered() {
+		t.Errorf("Expected a client without a strong certificate not to be registered")
+	}
+	denied := &mumbleproto.PermissionDenied{}
+	adminPeer.expect(t, mumbleproto.MessagePermissionDenied, denied)
+	if denied.GetType() != mumbleproto.PermissionDenied_Text {
+		t.Errorf("Expected a textual denial, got %v", denied.GetType())
+	}
+
+	register(strong)
+	if !strong.IsRegistered() {
+		t.Errorf("Expected a client with a strong certificate to be registered")
+	}
+}
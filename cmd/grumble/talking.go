@@ -0,0 +1,113 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"html"
+	"mumble.info/grumble/pkg/acl"
+	"mumble.info/grumble/pkg/mumbleproto"
+	"time"
+)
+
+// This file implements the TalkingNotifications, which tell moderators
+// who is talking in the channels they aren't in. The Mumble protocol has
+// no message for a user's talking state, so the notifications are sent
+// as text messages from the server. No voice is sent along.
+
+// How long after its last voice packet a client is considered to have
+// stopped talking. Silent clients are checked for once a second, so
+// watchers are told a client stopped talking up to a second later.
+const talkingTimeout = 500 * time.Millisecond
+
+// Record that voice from client is being relayed, and tell the watchers
+// if it has started talking, or is now talking in another channel.
+//
+// Called on the server's handler goroutine.
+func (server *Server) noteTalking(client *Client) {
+	if !server.cfg.BoolValue("TalkingNotifications") {
+		return
+	}
+	client.lastVoice = server.now()
+	if client.talkingChannel == client.Channel {
+		return
+	}
+	server.stopTalking(client)
+	client.talkingChannel = client.Channel
+	server.notifyTalking(client, client.Channel, true)
+}
+
+// Tell the watchers that the clients that have sent no voice for the
+// talkingTimeout have stopped talking.
+func (server *Server) checkTalking() {
+	now := server.now()
+	for _, client := range server.clients {
+		if client.talkingChannel != nil && now.Sub(client.lastVoice) > talkingTimeout {
+			server.stopTalking(client)
+		}
+	}
+}
+
+// Tell the watchers that client has stopped talking, if it is talking.
+// Called on the server's handler goroutine, like the rest of this file.
+func (server *Server) stopTalking(client *Client) {
+	channel := client.talkingChannel
+	if channel == nil {
+		return
+	}
+	client.talkingChannel = nil
+	server.notifyTalking(client, channel, false)
+}
+
+// Tell the clients watching who is talking that speaker has started, or
+// stopped, talking in channel. Watchers are only told about the channels
+// they can see, and only while they may mute users in the root channel.
+// Text messages are HTML, so the names in the notice are escaped.
+func (server *Server) notifyTalking(speaker *Client, channel *Channel, started bool) {
+	name, channelName := html.EscapeString(speaker.ShownName()), html.EscapeString(channel.Name)
+	text := fmt.Sprintf("%v stopped talking in %v", name, channelName)
+	if started {
+		text = fmt.Sprintf("%v started talking in %v", name, channelName)
+	}
+
+	rootChan := server.RootChannel()
+	for _, watcher := range server.clients {
+		if !watcher.watchTalking || watcher == speaker || watcher.state != StateClientReady {
+			continue
+		}
+		if !server.canSeeChannel(watcher, channel) || !acl.HasPermission(&rootChan.ACL, watcher, acl.MuteDeafenPermission) {
+			continue
+		}
+		err := watcher.sendMessage(&mumbleproto.TextMessage{
+			Session: []uint32{watcher.Session()},
+			Message: proto.String(text),
+		})
+		if err != nil && err != errClientDisconnected {
+			watcher.Panicf("Unable to send talking notification: %v", err)
+		}
+	}
+}
+
+// Start telling the actor who is talking, if the server's
+// TalkingNotifications are enabled.
+func handleWatchTalkingAction(server *Server, actor *Client, action *mumbleproto.ContextAction) {
+	if !server.cfg.BoolValue("TalkingNotifications") {
+		actor.sendPermissionDeniedText("Talking notifications are disabled on this server")
+		return
+	}
+	rootChan := server.RootChannel()
+	if !acl.HasPermission(&rootChan.ACL, actor, acl.MuteDeafenPermission) {
+		actor.sendPermissionDenied(actor, rootChan, acl.MuteDeafenPermission)
+		return
+	}
+	actor.watchTalking = true
+	actor.Printf("Watching who is talking")
+}
+
+// Stop telling the actor who is talking.
+func handleUnwatchTalkingAction(server *Server, actor *Client, action *mumbleproto.ContextAction) {
+	actor.watchTalking = false
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"github.com/golang/protobuf/proto"
+	"mumble.info/grumble/pkg/mumbleproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTalkingNotifications(t *testing.T) {
+	server := newTestServer(t)
+	server.cfg.Set("TalkingNotifications", "true")
+	clock := newFakeClock()
+	server.SetClock(clock)
+	admin, adminPeer := newTestSuperUser(t, server)
+	user, userPeer := newTestClient(server, "user")
+	stage := newTestChannel(server, server.RootChannel(), "Stage")
+	speaker, _ := newTestClient(server, "speaker")
+	server.RootChannel().RemoveClient(speaker)
+	stage.AddClient(speaker)
+
+	// Users that may not mute others can't watch who is talking.
+	server.handleContextAction(user, newTestMessage(t, user, &mumbleproto.ContextAction{
+		Action: proto.String("grumble.watchtalking"),
+	}))
+	userPeer.expect(t, mumbleproto.MessagePermissionDenied, nil)
+	server.handleContextAction(admin, newTestMessage(t, admin, &mumbleproto.ContextAction{
+		Action: proto.String("grumble.watchtalking"),
+	}))
+
+	speak := func() {
+		buf, ok := relayedVoicePacket(speaker.Session(), []byte{mumbleproto.UDPMessageVoiceOpus << 5, 0x01, 0x00})
+		if !ok {
+			t.Fatalf("unable to construct voice packet")
+		}
+		server.relayVoice(&VoiceBroadcast{client: speaker, buf: buf})
+	}
+	expectNotice := func(want string) {
+		txtmsg := &mumbleproto.TextMessage{}
+		adminPeer.expect(t, mumbleproto.MessageTextMessage, txtmsg)
+		if !strings.Contains(txtmsg.GetMessage(), want) {
+			t.Errorf("Expected a notice containing %q, got %q", want, txtmsg.GetMessage())
+		}
+	}
+
+	speak()
+	expectNotice("speaker started talking in Stage")
+
+	// Further packets don't repeat the notice, and neither does the
+	// silence check while the speaker keeps talking.
+	clock.advance(100 * time.Millisecond)
+	speak()
+	server.checkTalking()
+	adminPeer.expectNone(t, mumbleproto.MessageTextMessage)
+
+	clock.advance(time.Second)
+	server.checkTalking()
+	expectNotice("speaker stopped talking in Stage")
+
+	// Once the admin stops watching, no more notices are sent.
+	server.handleContextAction(admin, newTestMessage(t, admin, &mumbleproto.ContextAction{
+		Action: proto.String("grumble.unwatchtalking"),
+	}))
+	speak()
+	adminPeer.expectNone(t, mumbleproto.MessageTextMessage)
+	userPeer.expectNone(t, mumbleproto.MessageTextMessage)
+}
+
+func TestTalkingNotificationsEscaped(t *testing.T) {
+	server := newTestServer(t)
+	server.cfg.Set("TalkingNotifications", "true")
+	admin, adminPeer := newTestSuperUser(t, server)
+	admin.watchTalking = true
+	stage := newTestChannel(server, server.RootChannel(), "Q&A")
+	speaker, _ := newTestClient(server, "<b>speaker</b>")
+	server.RootChannel().RemoveClient(speaker)
+	stage.AddClient(speaker)
+
+	server.noteTalking(speaker)
+	txtmsg := &mumbleproto.TextMessage{}
+	adminPeer.expect(t, mumbleproto.MessageTextMessage, txtmsg)
+	want := "&lt;b&gt;speaker&lt;/b&gt; started talking in Q&amp;A"
+	if txtmsg.GetMessage() != want {
+		t.Errorf("Expected %q, got %q", want, txtmsg.GetMessage())
+	}
+}
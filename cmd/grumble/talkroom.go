@@ -0,0 +1,56 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"mumble.info/grumble/pkg/mumbleproto"
+	"strconv"
+)
+
+// Get the channel a user who is moved into channel ends up in.
+//
+// If channel is the server's TalkRoomChannel, a new temporary talk room
+// is created in it, named after TalkRoomPrefix and the lowest number not
+// in use by one of its subchannels, such as "Room 1". The room inherits
+// the ACLs of channel, and is removed like any other temporary channel
+// once it's empty. Otherwise, or if the server's channel limit has been
+// reached, channel itself is returned.
+//
+// Called on the server's handler goroutine.
+func (server *Server) talkRoomFor(channel *Channel) *Channel {
+	id, err := strconv.Atoi(server.cfg.StringValue("TalkRoomChannel"))
+	if err != nil || id != channel.Id {
+		return channel
+	}
+	maxChannels := server.cfg.IntValue("MaxChannels")
+	if maxChannels > 0 && len(server.Channels) >= maxChannels {
+		return channel
+	}
+
+	prefix := server.cfg.StringValue("TalkRoomPrefix")
+	name := ""
+	for n := 1; ; n++ {
+		name = fmt.Sprintf("%v %v", prefix, n)
+		if channel.ChildByName(name) == nil {
+			break
+		}
+	}
+
+	room := server.AddChannel(name)
+	room.temporary = true
+	room.ACL.InheritACL = true
+	channel.AddChild(room)
+	server.ClearCaches()
+
+	server.broadcastChannelUpdate(room, &mumbleproto.ChannelState{
+		ChannelId: proto.Uint32(uint32(room.Id)),
+		Parent:    proto.Uint32(uint32(channel.Id)),
+		Name:      proto.String(room.Name),
+		Temporary: proto.Bool(true),
+	})
+	return room
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"net"
+)
+
+// The socket options the server sets on accepted client connections.
+// Implemented by *net.TCPConn.
+type tunableConn interface {
+	SetNoDelay(noDelay bool) error
+	SetWriteBuffer(bytes int) error
+}
+
+// A tuningListener is a TCP listener that applies the server's socket
+// options to the connections it accepts, before they are wrapped in TLS.
+type tuningListener struct {
+	*net.TCPListener
+	server *Server
+}
+
+func (l *tuningListener) Accept() (net.Conn, error) {
+	conn, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	l.server.tuneConn(conn)
+	return conn, nil
+}
+
+// Apply the TCPNoDelay and TCPSendBufferSize config keys to conn, an
+// accepted client connection. Failures are logged, but otherwise ignored,
+// since the connection still works with the system's defaults.
+//
+// Control messages are written to the connection whole, each in a single
+// write, so disabling Nagle's algorithm sends them right away.
+func (server *Server) tuneConn(conn tunableConn) {
+	if err := conn.SetNoDelay(server.cfg.BoolValue("TCPNoDelay")); err != nil {
+		server.Printf("Unable to set TCP_NODELAY: %v", err)
+	}
+	if size := server.cfg.IntValue("TCPSendBufferSize"); size > 0 {
+		if err := conn.SetWriteBuffer(size); err != nil {
+			server.Printf("Unable to set TCP send buffer size: %v", err)
+		}
+	}
+}
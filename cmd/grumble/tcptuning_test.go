@@ -0,0 +1,74 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+type testTunableConn struct {
+	noDelay     []bool
+	writeBuffer []int
+}
+
+func (c *testTunableConn) SetNoDelay(noDelay bool) error {
+	c.noDelay = append(c.noDelay, noDelay)
+	return nil
+}
+
+func (c *testTunableConn) SetWriteBuffer(bytes int) error {
+	c.writeBuffer = append(c.writeBuffer, bytes)
+	return nil
+}
+
+func TestTuneConn(t *testing.T) {
+	server := newTestServer(t)
+
+	conn := &testTunableConn{}
+	server.tuneConn(conn)
+	if len(conn.noDelay) != 1 || !conn.noDelay[0] {
+		t.Errorf("Expected TCP_NODELAY to be enabled by default, got %v", conn.noDelay)
+	}
+	if len(conn.writeBuffer) != 0 {
+		t.Errorf("Expected the send buffer size to be left alone by default, got %v", conn.writeBuffer)
+	}
+
+	server.cfg.Set("TCPNoDelay", "false")
+	server.cfg.Set("TCPSendBufferSize", "65536")
+	conn = &testTunableConn{}
+	server.tuneConn(conn)
+	if len(conn.noDelay) != 1 || conn.noDelay[0] {
+		t.Errorf("Expected TCP_NODELAY to be disabled, got %v", conn.noDelay)
+	}
+	if len(conn.writeBuffer) != 1 || conn.writeBuffer[0] != 65536 {
+		t.Errorf("Expected a send buffer of 65536 bytes, got %v", conn.writeBuffer)
+	}
+}
+
+func TestTuningListener(t *testing.T) {
+	server := newTestServer(t)
+	tcpl, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	l := &tuningListener{tcpl, server}
+	defer l.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", tcpl.Addr().String())
+		if err == nil {
+			defer conn.Close()
+		}
+	}()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("unable to accept: %v", err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(*net.TCPConn); !ok {
+		t.Errorf("Expected a *net.TCPConn, got %T", conn)
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// A TextFilter inspects the text messages users send before the server
+// delivers them, for example to filter profanity or to relay messages to
+// a bridge.
+//
+// FilterTextMessage is given the sender and the message's body, which has
+// already been through the server's HTML filter. It returns the body to
+// deliver, which may be rewritten. To stop the message from being
+// delivered, it sets drop instead. The sender is then sent notice, as a
+// permission denied message, unless it is empty.
+//
+// The server doesn't ship with any filters; operators add their own to
+// the server's TextFilters. Filters are called on the server's handler
+// goroutine, so they must not block.
+type TextFilter interface {
+	FilterTextMessage(sender *Client, text string) (filtered string, drop bool, notice string)
+}
+
+// Run text, a message sent by client, through the server's TextFilters,
+// in order. Returns the text to deliver, and false if a filter dropped
+// the message.
+func (server *Server) runTextFilters(client *Client, text string) (string, bool) {
+	for _, filter := range server.TextFilters {
+		filtered, drop, notice := filter.FilterTextMessage(client, text)
+		if drop {
+			if notice != "" {
+				client.sendPermissionDeniedText(notice)
+			}
+			return "", false
+		}
+		text = filtered
+	}
+	return text, len(text) > 0
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"github.com/golang/protobuf/proto"
+	"mumble.info/grumble/pkg/mumbleproto"
+	"strings"
+	"testing"
+)
+
+type upperTextFilter struct{}
+
+func (upperTextFilter) FilterTextMessage(sender *Client, text string) (string, bool, string) {
+	return strings.ToUpper(text), false, ""
+}
+
+// Drops messages that contain word, in any case.
+type bannedWordTextFilter struct {
+	word string
+}
+
+func (f bannedWordTextFilter) FilterTextMessage(sender *Client, text string) (string, bool, string) {
+	if strings.Contains(strings.ToLower(text), f.word) {
+		return "", true, "Your message contains a banned word"
+	}
+	return text, false, ""
+}
+
+func TestTextFilters(t *testing.T) {
+	server := newTestServer(t)
+	alice, alicePeer := newTestClient(server, "alice")
+	_, bobPeer := newTestClient(server, "bob")
+
+	send := func(text string) {
+		server.handleTextMessage(alice, newTestMessage(t, alice, &mumbleproto.TextMessage{
+			ChannelId: []uint32{0},
+			Message:   proto.String(text),
+		}))
+	}
+
+	// Without filters, messages are delivered as they are.
+	send("hello")
+	txtmsg := &mumbleproto.TextMessage{}
+	bobPeer.expect(t, mumbleproto.MessageTextMessage, txtmsg)
+	if txtmsg.GetMessage() != "hello" {
+		t.Errorf("Expected the message to be delivered unchanged, got %q", txtmsg.GetMessage())
+	}
+
+	// Filters run in order: the banned word is caught after the body
+	// has been uppercased.
+	server.TextFilters = []TextFilter{upperTextFilter{}, bannedWordTextFilter{"darn"}}
+	send("hello")
+	bobPeer.expect(t, mumbleproto.MessageTextMessage, txtmsg)
+	if txtmsg.GetMessage() != "HELLO" {
+		t.Errorf("Expected the message to be uppercased, got %q", txtmsg.GetMessage())
+	}
+
+	send("darn it")
+	denied := &mumbleproto.PermissionDenied{}
+	alicePeer.expect(t, mumbleproto.MessagePermissionDenied, denied)
+	if denied.GetReason() != "Your message contains a banned word" {
+		t.Errorf("Expected the filter's notice, got %q", denied.GetReason())
+	}
+	bobPeer.expectNone(t, mumbleproto.MessageTextMessage)
+}
@@ -0,0 +1,200 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"mumble.info/grumble/pkg/mumbleproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// This file implements the optional text message log. When the
+// LogTextMessages config key is enabled, every text message handled by
+// the server is recorded, one JSON object per line, in a log file per
+// day. Log files older than TextMessageLogRetention days are removed.
+
+// The number of entries that can be waiting to be written before
+// further entries are dropped.
+const textLogQueueSize = 1024
+
+// The layout of the date in a text message log file's name.
+const textLogDateLayout = "2006-01-02"
+
+// A single entry in the text message log.
+type TextLogEntry struct {
+	Time     time.Time `json:"time"`
+	Session  uint32    `json:"session"`
+	UserId   int       `json:"userid"`
+	Username string    `json:"username"`
+	Channels []uint32  `json:"channels,omitempty"`
+	Trees    []uint32  `json:"trees,omitempty"`
+	Sessions []uint32  `json:"sessions,omitempty"`
+	Message  string    `json:"message"`
+}
+
+// A TextLog writes TextLogEntries to log files in a directory.
+// Entries are written by a separate goroutine, so logging an
+// entry never blocks.
+type TextLog struct {
+	dir       string
+	retention int
+	logger    *log.Logger
+
+	entries chan *TextLogEntry
+	done    chan bool
+
+	// Only accessed by the writer goroutine.
+	file *os.File
+	day  string
+}
+
+// Open a text message log in dir. Log files older than retention days
+// are removed; if retention is zero, log files are kept forever. Errors
+// that happen while writing the log are reported to logger.
+func OpenTextLog(dir string, retention int, logger *log.Logger) (*TextLog, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	tl := &TextLog{
+		dir:       dir,
+		retention: retention,
+		logger:    logger,
+		entries:   make(chan *TextLogEntry, textLogQueueSize),
+		done:      make(chan bool),
+	}
+	go tl.writeLoop()
+
+	return tl, nil
+}
+
+// Queue entry to be written to the log. If too many entries are
+// already waiting to be written, entry is dropped and false is returned.
+func (tl *TextLog) Log(entry *TextLogEntry) bool {
+	select {
+	case tl.entries <- entry:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close the log, after writing all queued entries. The log
+// must not be used after it has been closed.
+func (tl *TextLog) Close() {
+	close(tl.entries)
+	<-tl.done
+}
+
+func (tl *TextLog) writeLoop() {
+	defer close(tl.done)
+
+	for entry := range tl.entries {
+		err := tl.write(entry)
+		if err != nil {
+			tl.logger.Printf("Unable to write text message log: %v", err)
+		}
+	}
+
+	if tl.file != nil {
+		tl.file.Close()
+	}
+}
+
+// Write a single entry to the log file for the day it was logged,
+// rotating the log file if necessary.
+func (tl *TextLog) write(entry *TextLogEntry) error {
+	day := entry.Time.Format(textLogDateLayout)
+	if tl.file == nil || day != tl.day {
+		err := tl.rotate(day)
+		if err != nil {
+			return err
+		}
+	}
+
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = tl.file.Write(append(buf, '\n'))
+	return err
+}
+
+// Switch to the log file for day, and remove expired log files.
+func (tl *TextLog) rotate(day string) error {
+	if tl.file != nil {
+		tl.file.Close()
+		tl.file = nil
+	}
+
+	fn := filepath.Join(tl.dir, day+".log")
+	file, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	tl.file = file
+	tl.day = day
+
+	return tl.removeExpired(day)
+}
+
+// Remove log files that are more than tl.retention days older than day.
+func (tl *TextLog) removeExpired(day string) error {
+	if tl.retention <= 0 {
+		return nil
+	}
+
+	today, err := time.Parse(textLogDateLayout, day)
+	if err != nil {
+		return err
+	}
+	cutoff := today.AddDate(0, 0, -tl.retention)
+
+	fns, err := filepath.Glob(filepath.Join(tl.dir, "*.log"))
+	if err != nil {
+		return err
+	}
+	for _, fn := range fns {
+		logday, err := time.Parse(textLogDateLayout, strings.TrimSuffix(filepath.Base(fn), ".log"))
+		if err != nil {
+			continue
+		}
+		if logday.Before(cutoff) {
+			err = os.Remove(fn)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Record a text message sent by client in the server's text message
+// log, if it is enabled.
+func (server *Server) logTextMessage(client *Client, txtmsg *mumbleproto.TextMessage) {
+	if server.textlog == nil {
+		return
+	}
+
+	entry := &TextLogEntry{
+		Time:     time.Now(),
+		Session:  client.Session(),
+		UserId:   client.UserId(),
+		Username: client.ShownName(),
+		Channels: txtmsg.ChannelId,
+		Trees:    txtmsg.TreeId,
+		Sessions: txtmsg.Session,
+		Message:  txtmsg.GetMessage(),
+	}
+	if !server.textlog.Log(entry) {
+		server.Printf("Text message log queue is full. Dropped message from %v.", client.Session())
+	}
+}
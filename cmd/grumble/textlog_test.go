@@ -0,0 +1,109 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/golang/protobuf/proto"
+	"io/ioutil"
+	"log"
+	"mumble.info/grumble/pkg/mumbleproto"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readTextLog(t *testing.T, fn string) []*TextLogEntry {
+	f, err := os.Open(fn)
+	if err != nil {
+		t.Fatalf("unable to open text log: %v", err)
+	}
+	defer f.Close()
+
+	entries := []*TextLogEntry{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		entry := &TextLogEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			t.Fatalf("unable to decode text log entry: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestTextLogMessage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grumble-textlog")
+	if err != nil {
+		t.Fatalf("unable to create dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := newTestServer(t)
+	server.textlog, err = OpenTextLog(dir, 0, server.Logger)
+	if err != nil {
+		t.Fatalf("unable to open text log: %v", err)
+	}
+
+	alice, _ := newTestClient(server, "alice")
+	bob, _ := newTestClient(server, "bob")
+	server.handleTextMessage(alice, newTestMessage(t, alice, &mumbleproto.TextMessage{
+		Session: []uint32{bob.Session()},
+		Message: proto.String("hello bob"),
+	}))
+	server.textlog.Close()
+
+	fn := filepath.Join(dir, time.Now().Format(textLogDateLayout)+".log")
+	entries := readTextLog(t, fn)
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 log entry, got %v", len(entries))
+	}
+	entry := entries[0]
+	if entry.Session != alice.Session() || entry.Username != "alice" {
+		t.Errorf("Expected entry from alice, got %v (%v)", entry.Username, entry.Session)
+	}
+	if len(entry.Sessions) != 1 || entry.Sessions[0] != bob.Session() {
+		t.Errorf("Expected entry targeting bob, got %v", entry.Sessions)
+	}
+	if entry.Message != "hello bob" {
+		t.Errorf("Expected message %q, got %q", "hello bob", entry.Message)
+	}
+}
+
+func TestTextLogRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grumble-textlog")
+	if err != nil {
+		t.Fatalf("unable to create dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	old := filepath.Join(dir, "2026-03-01.log")
+	recent := filepath.Join(dir, "2026-03-05.log")
+	for _, fn := range []string{old, recent} {
+		if err := ioutil.WriteFile(fn, nil, 0600); err != nil {
+			t.Fatalf("unable to create log file: %v", err)
+		}
+	}
+
+	tl, err := OpenTextLog(dir, 7, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("unable to open text log: %v", err)
+	}
+	tl.Log(&TextLogEntry{Time: now, Message: "hi"})
+	tl.Close()
+
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("Expected expired log file to be removed")
+	}
+	if _, err := os.Stat(recent); err != nil {
+		t.Errorf("Expected recent log file to be kept: %v", err)
+	}
+	if entries := readTextLog(t, filepath.Join(dir, "2026-03-10.log")); len(entries) != 1 {
+		t.Errorf("Expected 1 log entry, got %v", len(entries))
+	}
+}
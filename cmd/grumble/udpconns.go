@@ -0,0 +1,76 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// Open the server's UDP sockets on port: one on host, the server's
+// Address, and one on each of the addresses in the ExtraUDPAddresses
+// config key.
+//
+// Extra addresses are opened for a single address family, so that, for
+// example, an IPv6 socket on "::" can be opened alongside an IPv4 one on
+// "0.0.0.0" on the same port.
+func (server *Server) listenUDP(host string, port int) ([]*net.UDPConn, error) {
+	primary, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(host), Port: port})
+	if err != nil {
+		return nil, err
+	}
+	conns := []*net.UDPConn{primary}
+
+	for _, host := range strings.Split(server.cfg.StringValue("ExtraUDPAddresses"), ",") {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			err = errors.New("invalid UDP address " + host)
+			break
+		}
+		network := "udp6"
+		if ip.To4() != nil {
+			network = "udp4"
+		}
+		var conn *net.UDPConn
+		conn, err = net.ListenUDP(network, &net.UDPAddr{IP: ip, Port: port})
+		if err != nil {
+			break
+		}
+		conns = append(conns, conn)
+	}
+
+	if err != nil {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		return nil, err
+	}
+	return conns, nil
+}
+
+// Get the UDP socket to send a datagram to addr from.
+//
+// Replies must come from the address family the client sent its
+// datagrams to, or NATs and firewalls on the way drop them, so this is
+// the first socket of addr's address family. IPv4-mapped IPv6 addresses
+// count as IPv4. If there is none, for example because the only socket
+// is a dual-stack one, the datagram is sent from the first socket.
+func (server *Server) udpConnFor(addr *net.UDPAddr) *net.UDPConn {
+	server.udplock.RLock()
+	defer server.udplock.RUnlock()
+	ipv4 := addr.IP.To4() != nil
+	for _, conn := range server.udpconns {
+		local, ok := conn.LocalAddr().(*net.UDPAddr)
+		if ok && (local.IP.To4() != nil) == ipv4 {
+			return conn
+		}
+	}
+	return server.udpconns[0]
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// Open an IPv4 and an IPv6 loopback socket for server, and start its UDP
+// listeners on them. Skips the test if IPv6 is unavailable.
+func openTestUDPConns(t *testing.T, server *Server) (v4, v6 *net.UDPConn) {
+	v4, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unable to listen on IPv4: %v", err)
+	}
+	v6, err = net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		v4.Close()
+		t.Skipf("IPv6 is unavailable: %v", err)
+	}
+	server.udpconns = []*net.UDPConn{v4, v6}
+	go server.udpListenLoop(v4)
+	go server.udpListenLoop(v6)
+	return v4, v6
+}
+
+// Send a ping datagram from a new socket of the given network to addr,
+// and return the address the reply came from.
+func sendTestUDPPing(t *testing.T, network string, addr *net.UDPAddr) *net.UDPAddr {
+	conn, err := net.ListenUDP(network, &net.UDPAddr{IP: addr.IP})
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.WriteToUDP(make([]byte, pingRequestSize), addr); err != nil {
+		t.Fatalf("unable to send ping: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 64)
+	n, from, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("unable to read ping reply: %v", err)
+	}
+	if n != 24 {
+		t.Errorf("Expected a 24-byte ping reply, got %v bytes", n)
+	}
+	return from
+}
+
+func TestUDPReplySocket(t *testing.T) {
+	server := newTestServer(t)
+	v4, v6 := openTestUDPConns(t, server)
+	defer v4.Close()
+	defer v6.Close()
+
+	for _, test := range []struct {
+		network string
+		conn    *net.UDPConn
+	}{
+		{"udp6", v6},
+		{"udp4", v4},
+	} {
+		local := test.conn.LocalAddr().(*net.UDPAddr)
+		from := sendTestUDPPing(t, test.network, local)
+		if !from.IP.Equal(local.IP) || from.Port != local.Port {
+			t.Errorf("Expected the %v reply to come from %v, got %v", test.network, local, from)
+		}
+	}
+
+	// IPv4-mapped addresses are sent to from the IPv4 socket.
+	mapped := &net.UDPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 64738}
+	if server.udpConnFor(mapped) != v4 {
+		t.Errorf("Expected an IPv4-mapped address to use the IPv4 socket")
+	}
+}
+
+func TestListenUDPExtraAddresses(t *testing.T) {
+	server := newTestServer(t)
+	server.cfg.Set("Address", "127.0.0.1")
+	server.cfg.Set("ExtraUDPAddresses", "::1")
+
+	conns, err := server.listenUDP(server.HostAddress(), 0)
+	if err != nil {
+		t.Skipf("IPv6 is unavailable: %v", err)
+	}
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	if len(conns) != 2 {
+		t.Fatalf("Expected 2 UDP sockets, got %v", len(conns))
+	}
+	if ip := conns[1].LocalAddr().(*net.UDPAddr).IP; !ip.Equal(net.IPv6loopback) {
+		t.Errorf("Expected the extra socket on ::1, got %v", ip)
+	}
+
+	server.cfg.Set("ExtraUDPAddresses", "not-an-address")
+	if _, err := server.listenUDP(server.HostAddress(), 0); err == nil {
+		t.Errorf("Expected an invalid extra address to be an error")
+	}
+}
@@ -23,6 +23,7 @@ type User struct {
 	CommentBlob   string
 	LastChannelId int
 	LastActive    uint64
+	Approved      bool
 }
 
 // Create a new User
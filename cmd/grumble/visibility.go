@@ -0,0 +1,137 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"github.com/golang/protobuf/proto"
+	"mumble.info/grumble/pkg/acl"
+	"mumble.info/grumble/pkg/mumbleproto"
+)
+
+// Check whether viewer can see the users in channel. Channels that deny
+// viewer traverse permission, themselves or through one of their parents,
+// are hidden from it.
+func (server *Server) canSeeChannel(viewer *Client, channel *Channel) bool {
+	return acl.HasPermission(&channel.ACL, viewer, acl.TraversePermission)
+}
+
+// Check whether viewer can see subject. Clients can always see themselves.
+func (server *Server) canSeeUser(viewer *Client, subject *Client) bool {
+	return viewer == subject || server.canSeeChannel(viewer, subject.Channel)
+}
+
+// Get a predicate that selects the clients a UserState describing subject
+// is broadcast to: the clients that can see it. If subject has just moved
+// out of oldchan, the clients that couldn't see it there are left out as
+// well; userEnterChannel has already sent them subject's full state.
+func (server *Server) userStateRecipients(subject *Client, oldchan *Channel) ClientPredicate {
+	return func(client *Client) bool {
+		if !server.canSeeUser(client, subject) {
+			return false
+		}
+		return client == subject || oldchan == nil || server.canSeeChannel(client, oldchan)
+	}
+}
+
+// Tell the clients whose view of client changed when it moved out of
+// oldchan: clients that can only see it now are sent its full state, and
+// clients that could only see it before are sent a UserRemove. Client's
+// own view of the others is brought up to date as well, from seen, what
+// it could see before it moved.
+func (server *Server) updateUserVisibility(client *Client, oldchan *Channel, seen map[*Client]bool) {
+	for _, viewer := range server.clients {
+		if viewer == client || viewer.state != StateClientReady {
+			continue
+		}
+		saw := server.canSeeChannel(viewer, oldchan)
+		sees := server.canSeeChannel(viewer, client.Channel)
+		if saw == sees {
+			continue
+		}
+
+		var err error
+		if sees {
+			err = viewer.sendMessage(server.userStateOf(client, viewer))
+		} else {
+			err = viewer.sendMessage(&mumbleproto.UserRemove{
+				Session: proto.Uint32(client.Session()),
+			})
+		}
+		if err != nil && err != errClientDisconnected {
+			viewer.Panicf("Unable to update user visibility: %v", err)
+		}
+	}
+	server.refreshView(client, seen)
+}
+
+// Get the ready clients that viewer can see, other than itself. Viewer is
+// usually a client, but may stand in for one as it was before a change to
+// its permissions.
+func (server *Server) visibleUsers(viewer acl.User) map[*Client]bool {
+	visible := make(map[*Client]bool)
+	channels := make(map[*Channel]bool)
+	for _, subject := range server.clients {
+		if subject.Session() == viewer.Session() || subject.state != StateClientReady || subject.Channel == nil {
+			continue
+		}
+		sees, ok := channels[subject.Channel]
+		if !ok {
+			sees = acl.HasPermission(&subject.Channel.ACL, viewer, acl.TraversePermission)
+			channels[subject.Channel] = sees
+		}
+		if sees {
+			visible[subject] = true
+		}
+	}
+	return visible
+}
+
+// Get what each ready client can see, as visibleUsers does, ahead of a
+// change that may change it for any of them, such as an ACL edit.
+func (server *Server) allVisibleUsers() map[*Client]map[*Client]bool {
+	views := make(map[*Client]map[*Client]bool)
+	for _, viewer := range server.clients {
+		if viewer.state == StateClientReady {
+			views[viewer] = server.visibleUsers(viewer)
+		}
+	}
+	return views
+}
+
+// Bring viewer's view of the other clients up to date after a change to
+// what it can see, given seen, what it could see before the change, as
+// returned by visibleUsers. Clients it can only see now are sent in full,
+// and clients it could only see before are removed.
+func (server *Server) refreshView(viewer *Client, seen map[*Client]bool) {
+	if viewer.state != StateClientReady || viewer.isDisconnected() {
+		return
+	}
+
+	var err error
+	sees := server.visibleUsers(viewer)
+	for subject := range sees {
+		if !seen[subject] && err == nil {
+			err = viewer.sendMessage(server.userStateOf(subject, viewer))
+		}
+	}
+	for subject := range seen {
+		if !sees[subject] && server.clients[subject.Session()] == subject && err == nil {
+			err = viewer.sendMessage(&mumbleproto.UserRemove{
+				Session: proto.Uint32(subject.Session()),
+			})
+		}
+	}
+	if err != nil && err != errClientDisconnected {
+		viewer.Panicf("Unable to update user visibility: %v", err)
+	}
+}
+
+// Like refreshView, for each of the clients in views, as returned by
+// allVisibleUsers.
+func (server *Server) refreshViews(views map[*Client]map[*Client]bool) {
+	for viewer, seen := range views {
+		server.refreshView(viewer, seen)
+	}
+}
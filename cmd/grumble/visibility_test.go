@@ -0,0 +1,203 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"github.com/golang/protobuf/proto"
+	"mumble.info/grumble/pkg/acl"
+	"mumble.info/grumble/pkg/mumbleproto"
+	"testing"
+	"time"
+)
+
+func TestHiddenChannelUsers(t *testing.T) {
+	server := newTestServer(t)
+	hidden := newTestChannel(server, server.RootChannel(), "Hidden")
+	hidden.ACL.InheritACL = true
+	hidden.ACL.ACLs = append(hidden.ACL.ACLs, acl.ACL{
+		UserId:    -1,
+		Group:     "all",
+		ApplyHere: true,
+		ApplySubs: true,
+		Deny:      acl.Permission(acl.TraversePermission),
+	}, acl.ACL{
+		UserId:    -1,
+		Group:     "#staff",
+		ApplyHere: true,
+		ApplySubs: true,
+		Allow:     acl.Permission(acl.TraversePermission | acl.EnterPermission),
+	})
+
+	alice, _ := newTestClient(server, "alice")
+	alice.tokens = []string{"staff"}
+	carol, carolPeer := newTestClient(server, "carol")
+	carol.tokens = []string{"staff"}
+	bob, bobPeer := newTestClient(server, "bob")
+
+	move := func(channel *Channel) {
+		server.handleUserStateMessage(alice, newTestMessage(t, alice, &mumbleproto.UserState{
+			ChannelId: proto.Uint32(uint32(channel.Id)),
+		}))
+		if alice.Channel != channel {
+			t.Fatalf("Expected alice to be moved to %v", channel.Name)
+		}
+	}
+
+	// Moving into the hidden channel removes alice from bob's view,
+	// but not from carol's.
+	move(hidden)
+	userstate := &mumbleproto.UserState{}
+	carolPeer.expect(t, mumbleproto.MessageUserState, userstate)
+	if userstate.GetSession() != alice.Session() || userstate.GetChannelId() != uint32(hidden.Id) {
+		t.Errorf("Expected carol to see alice move, got %v", userstate)
+	}
+	userremove := &mumbleproto.UserRemove{}
+	bobPeer.expect(t, mumbleproto.MessageUserRemove, userremove)
+	if userremove.GetSession() != alice.Session() {
+		t.Errorf("Expected alice to be removed from bob's view, got %v", userremove)
+	}
+	bobPeer.expectNone(t, mumbleproto.MessageUserState)
+
+	// Bob isn't told about changes to alice's state, and alice is left
+	// out of the user list bob is sent.
+	server.handleUserStateMessage(alice, newTestMessage(t, alice, &mumbleproto.UserState{
+		SelfDeaf: proto.Bool(true),
+	}))
+	carolPeer.expect(t, mumbleproto.MessageUserState, nil)
+	bobPeer.expectNone(t, mumbleproto.MessageUserState)
+
+	if err := server.sendUserList(bob); err != nil {
+		t.Fatalf("unable to send user list: %v", err)
+	}
+	bobPeer.expect(t, mumbleproto.MessageUserState, userstate)
+	if userstate.GetSession() != carol.Session() {
+		t.Errorf("Expected only carol in bob's user list, got %v", userstate)
+	}
+	bobPeer.expectNone(t, mumbleproto.MessageUserState)
+
+	// Leaving the hidden channel, alice reappears to bob in full.
+	move(server.RootChannel())
+	userstate.Reset()
+	bobPeer.expect(t, mumbleproto.MessageUserState, userstate)
+	if userstate.GetSession() != alice.Session() || userstate.GetName() != "alice" || !userstate.GetSelfDeaf() {
+		t.Errorf("Expected bob to be sent alice's full state, got %v", userstate)
+	}
+	bobPeer.expectNone(t, mumbleproto.MessageUserState)
+}
+
+// Add a channel to server that hides its occupants from everyone but the
+// members of group.
+func newTestHiddenChannel(server *Server, name string, group string) *Channel {
+	hidden := newTestChannel(server, server.RootChannel(), name)
+	hidden.ACL.InheritACL = true
+	hidden.ACL.ACLs = append(hidden.ACL.ACLs, acl.ACL{
+		UserId:    -1,
+		Group:     "all",
+		ApplyHere: true,
+		Deny:      acl.Permission(acl.TraversePermission),
+	}, acl.ACL{
+		UserId:    -1,
+		Group:     group,
+		ApplyHere: true,
+		Allow:     acl.Permission(acl.TraversePermission | acl.EnterPermission),
+	})
+	return hidden
+}
+
+// Check that the next UserState or UserRemove peer is sent is of the
+// given kind, and about session.
+func expectTestVisibility(t *testing.T, peer *testPeer, kind uint16, session uint32) {
+	msg := peer.expect(t, kind, nil)
+	var got uint32
+	if kind == mumbleproto.MessageUserState {
+		userstate := &mumbleproto.UserState{}
+		proto.Unmarshal(msg.buf, userstate)
+		got = userstate.GetSession()
+	} else {
+		userremove := &mumbleproto.UserRemove{}
+		proto.Unmarshal(msg.buf, userremove)
+		got = userremove.GetSession()
+	}
+	if got != session {
+		t.Errorf("Expected message kind %v about session %v, got %v", kind, session, got)
+	}
+}
+
+func TestMoverSeesHiddenUsers(t *testing.T) {
+	server := newTestServer(t)
+	hidden := newTestHiddenChannel(server, "Hidden", "in")
+	bob, _ := newTestClient(server, "bob")
+	server.userEnterChannel(bob, hidden, &mumbleproto.UserState{})
+	alice, alicePeer := newTestClient(server, "alice")
+
+	// Only the occupants of the channel can see into it, so alice sees
+	// bob once she joins him, and loses sight of him once she leaves.
+	server.userEnterChannel(alice, hidden, &mumbleproto.UserState{})
+	expectTestVisibility(t, alicePeer, mumbleproto.MessageUserState, bob.Session())
+	server.userEnterChannel(alice, server.RootChannel(), &mumbleproto.UserState{})
+	expectTestVisibility(t, alicePeer, mumbleproto.MessageUserRemove, bob.Session())
+}
+
+func TestTokensRevealHiddenUsers(t *testing.T) {
+	server := newTestServer(t)
+	hidden := newTestHiddenChannel(server, "Hidden", "#staff")
+	bob, _ := newTestClient(server, "bob")
+	server.userEnterChannel(bob, hidden, &mumbleproto.UserState{})
+	alice, alicePeer := newTestClient(server, "alice")
+
+	server.handleIncomingMessage(alice, newTestMessage(t, alice, &mumbleproto.Authenticate{
+		Tokens: []string{"staff"},
+	}))
+	expectTestVisibility(t, alicePeer, mumbleproto.MessageUserState, bob.Session())
+	server.handleIncomingMessage(alice, newTestMessage(t, alice, &mumbleproto.Authenticate{}))
+	expectTestVisibility(t, alicePeer, mumbleproto.MessageUserRemove, bob.Session())
+}
+
+func TestExpiredTokenHidesUsers(t *testing.T) {
+	server := newTestServer(t)
+	hidden := newTestHiddenChannel(server, "Hidden", "event")
+	bob, _ := newTestClient(server, "bob")
+	server.userEnterChannel(bob, hidden, &mumbleproto.UserState{})
+	alice, alicePeer := newTestClient(server, "alice")
+
+	token, err := server.IssueAccessToken("event", time.Hour)
+	if err != nil {
+		t.Fatalf("unable to issue token: %v", err)
+	}
+	server.handleIncomingMessage(alice, newTestMessage(t, alice, &mumbleproto.Authenticate{
+		Tokens: []string{token},
+	}))
+	expectTestVisibility(t, alicePeer, mumbleproto.MessageUserState, bob.Session())
+
+	server.tokenlock.Lock()
+	issued := server.accessTokens[token]
+	issued.expires = time.Now().Add(-time.Second)
+	server.accessTokens[token] = issued
+	server.tokenlock.Unlock()
+	server.sweepAccessTokens()
+	expectTestVisibility(t, alicePeer, mumbleproto.MessageUserRemove, bob.Session())
+}
+
+func TestACLEditHidesUsers(t *testing.T) {
+	server := newTestServer(t)
+	defer openTestFreezeLog(t, server)()
+	lobby := newTestChannel(server, server.RootChannel(), "Lobby")
+	bob, _ := newTestClient(server, "bob")
+	server.userEnterChannel(bob, lobby, &mumbleproto.UserState{})
+	_, alicePeer := newTestClient(server, "alice")
+	admin, _ := newTestClient(server, "SuperUser")
+	admin.user = addTestUser(t, server, 0, "SuperUser")
+
+	server.handleAclMessage(admin, newTestMessage(t, admin, &mumbleproto.ACL{
+		ChannelId:   proto.Uint32(uint32(lobby.Id)),
+		InheritAcls: proto.Bool(true),
+		Acls: []*mumbleproto.ACL_ChanACL{{
+			Group:     proto.String("all"),
+			ApplyHere: proto.Bool(true),
+			Deny:      proto.Uint32(uint32(acl.TraversePermission)),
+		}},
+	}))
+	expectTestVisibility(t, alicePeer, mumbleproto.MessageUserRemove, bob.Session())
+}
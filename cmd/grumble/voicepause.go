@@ -0,0 +1,138 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"mumble.info/grumble/pkg/acl"
+	"mumble.info/grumble/pkg/mumbleproto"
+	"time"
+)
+
+// Pause voice, for example while a moderator makes an announcement. If
+// channel is nil, voice is paused on the whole server; otherwise only the
+// voice of the users in channel is. While voice is paused, only priority
+// speakers are relayed.
+//
+// The pause is lifted after duration, or after the server's
+// VoicePauseDuration if duration isn't positive, or when ResumeVoice is
+// called. If notice isn't empty, it is sent as a text message to the
+// users whose voice is paused.
+//
+// Called on the server's handler goroutine.
+func (server *Server) PauseVoice(channel *Channel, duration time.Duration, notice string) {
+	if duration <= 0 {
+		duration = time.Duration(server.cfg.IntValue("VoicePauseDuration")) * time.Second
+	}
+	until := server.now().Add(duration)
+
+	txtmsg := &mumbleproto.TextMessage{
+		Message: proto.String(notice),
+	}
+	clients := server.clients
+	if channel == nil {
+		server.voicePausedUntil = until
+		txtmsg.TreeId = []uint32{0}
+	} else {
+		channel.voicePausedUntil = until
+		clients = channel.clients
+		txtmsg.ChannelId = []uint32{uint32(channel.Id)}
+	}
+
+	if notice == "" {
+		return
+	}
+	for _, client := range clients {
+		if client.state != StateClientReady {
+			continue
+		}
+		if err := client.sendMessage(txtmsg); err != nil && err != errClientDisconnected {
+			client.Panicf("Unable to send voice pause notice: %v", err)
+		}
+	}
+}
+
+// Lift a pause set by PauseVoice, on the whole server if channel is nil,
+// or in channel. Called on the server's handler goroutine.
+func (server *Server) ResumeVoice(channel *Channel) {
+	if channel == nil {
+		server.voicePausedUntil = time.Time{}
+	} else {
+		channel.voicePausedUntil = time.Time{}
+	}
+}
+
+// Check whether the voice of client is paused, on the whole server or in
+// its channel. Priority speakers are never paused.
+func (server *Server) isVoicePaused(client *Client) bool {
+	if client.PrioritySpeaker {
+		return false
+	}
+	return server.now().Before(server.voicePausedUntil) || server.isChannelVoicePaused(client.Channel)
+}
+
+// Check whether voice from speaker to recipient is paused in the
+// recipient's channel. This covers voice that reaches a paused channel
+// from outside it, through a shout, a whisper or a linked channel.
+func (server *Server) isVoicePausedFor(speaker *Client, recipient *Client) bool {
+	return !speaker.PrioritySpeaker && server.isChannelVoicePaused(recipient.Channel)
+}
+
+// Check whether voice is paused in channel, which may be nil.
+func (server *Server) isChannelVoicePaused(channel *Channel) bool {
+	return channel != nil && server.now().Before(channel.voicePausedUntil)
+}
+
+// Pause voice in the channel the action was invoked on, or on the whole
+// server if it was invoked on the server.
+func handlePauseVoiceAction(server *Server, actor *Client, action *mumbleproto.ContextAction) {
+	channel, ok := voicePauseActionChannel(server, actor, action)
+	if !ok {
+		return
+	}
+	duration := time.Duration(server.cfg.IntValue("VoicePauseDuration")) * time.Second
+	notice := fmt.Sprintf("Voice has been paused by %v for %v.", actor.ShownName(), duration)
+	server.PauseVoice(channel, duration, notice)
+	actor.Printf("Paused voice in %v", voicePauseScope(channel))
+}
+
+// Lift a pause set by handlePauseVoiceAction.
+func handleResumeVoiceAction(server *Server, actor *Client, action *mumbleproto.ContextAction) {
+	channel, ok := voicePauseActionChannel(server, actor, action)
+	if !ok {
+		return
+	}
+	server.ResumeVoice(channel)
+	actor.Printf("Resumed voice in %v", voicePauseScope(channel))
+}
+
+// Get the channel a voice pause action applies to, or nil for the whole
+// server, and check that the actor may mute the users in it.
+func voicePauseActionChannel(server *Server, actor *Client, action *mumbleproto.ContextAction) (*Channel, bool) {
+	var channel *Channel
+	permChan := server.RootChannel()
+	if action.ChannelId != nil {
+		var ok bool
+		channel, ok = server.Channels[int(*action.ChannelId)]
+		if !ok {
+			return nil, false
+		}
+		permChan = channel
+	}
+	if !acl.HasPermission(&permChan.ACL, actor, acl.MuteDeafenPermission) {
+		actor.sendPermissionDenied(actor, permChan, acl.MuteDeafenPermission)
+		return nil, false
+	}
+	return channel, true
+}
+
+// Describe where a voice pause applies, for the log.
+func voicePauseScope(channel *Channel) string {
+	if channel == nil {
+		return "the whole server"
+	}
+	return fmt.Sprintf("channel %v", channel.Id)
+}
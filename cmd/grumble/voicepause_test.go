@@ -0,0 +1,146 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"github.com/golang/protobuf/proto"
+	"mumble.info/grumble/pkg/mumbleproto"
+	"testing"
+	"time"
+)
+
+func TestPauseVoice(t *testing.T) {
+	server := newTestServer(t)
+	clock := newFakeClock()
+	server.SetClock(clock)
+	_, peer := newTestClient(server, "listener")
+	speaker, _ := newTestClient(server, "speaker")
+	announcer, _ := newTestClient(server, "announcer")
+	announcer.PrioritySpeaker = true
+
+	// Send a voice packet from client to its channel, and return whether
+	// the listener received it.
+	speak := func(client *Client) bool {
+		buf, ok := relayedVoicePacket(client.Session(), []byte{mumbleproto.UDPMessageVoiceOpus << 5, 0x01, 0x00})
+		if !ok {
+			t.Fatalf("unable to construct voice packet")
+		}
+		server.relayVoice(&VoiceBroadcast{client: client, buf: buf})
+		select {
+		case msg := <-peer.msgs:
+			return msg.kind == mumbleproto.MessageUDPTunnel
+		case <-time.After(50 * time.Millisecond):
+			return false
+		}
+	}
+
+	if !speak(speaker) {
+		t.Fatalf("Expected voice to be relayed before the pause")
+	}
+
+	server.PauseVoice(nil, time.Minute, "")
+	if speak(speaker) {
+		t.Errorf("Expected voice to be dropped while paused")
+	}
+	if !speak(announcer) {
+		t.Errorf("Expected a priority speaker to be relayed while paused")
+	}
+
+	// The pause lifts by itself.
+	clock.advance(time.Minute)
+	if !speak(speaker) {
+		t.Errorf("Expected voice to be relayed after the pause expired")
+	}
+
+	// A channel pause only applies to the channel, and can be lifted
+	// early.
+	server.PauseVoice(server.RootChannel(), time.Minute, "")
+	if speak(speaker) {
+		t.Errorf("Expected voice to be dropped while the channel is paused")
+	}
+	if !speak(announcer) {
+		t.Errorf("Expected a priority speaker to be relayed while the channel is paused")
+	}
+	other := newTestChannel(server, server.RootChannel(), "Other")
+	server.RootChannel().RemoveClient(speaker)
+	other.AddClient(speaker)
+	if server.isVoicePaused(speaker) {
+		t.Errorf("Expected voice in other channels not to be paused")
+	}
+	other.RemoveClient(speaker)
+	server.RootChannel().AddClient(speaker)
+	server.ResumeVoice(server.RootChannel())
+	if !speak(speaker) {
+		t.Errorf("Expected voice to be relayed after the pause was lifted")
+	}
+}
+
+func TestPauseVoiceAction(t *testing.T) {
+	server := newTestServer(t)
+	admin, _ := newTestSuperUser(t, server)
+	user, userPeer := newTestClient(server, "user")
+
+	server.handleContextAction(user, newTestMessage(t, user, &mumbleproto.ContextAction{
+		Action: proto.String("grumble.pausevoice"),
+	}))
+	userPeer.expect(t, mumbleproto.MessagePermissionDenied, nil)
+	if server.isVoicePaused(user) {
+		t.Fatalf("Expected a user without permission not to pause voice")
+	}
+
+	server.handleContextAction(admin, newTestMessage(t, admin, &mumbleproto.ContextAction{
+		Action: proto.String("grumble.pausevoice"),
+	}))
+	if !server.isVoicePaused(user) {
+		t.Errorf("Expected voice to be paused")
+	}
+	txtmsg := &mumbleproto.TextMessage{}
+	userPeer.expect(t, mumbleproto.MessageTextMessage, txtmsg)
+	if len(txtmsg.GetMessage()) == 0 {
+		t.Errorf("Expected a notice of the pause")
+	}
+
+	server.handleContextAction(admin, newTestMessage(t, admin, &mumbleproto.ContextAction{
+		Action: proto.String("grumble.resumevoice"),
+	}))
+	if server.isVoicePaused(user) {
+		t.Errorf("Expected voice to be resumed")
+	}
+}
+
+func TestPauseVoiceTargets(t *testing.T) {
+	server := newTestServer(t)
+	paused := newTestChannel(server, server.RootChannel(), "Paused")
+	speaker, _ := newTestClient(server, "speaker")
+	listener, listenerPeer := newTestClient(server, "listener")
+	server.RootChannel().RemoveClient(listener)
+	paused.AddClient(listener)
+	server.PauseVoice(paused, time.Minute, "")
+
+	// Voice from outside the paused channel, shouted into it or
+	// whispered to a user in it, is dropped.
+	shout := &VoiceTarget{}
+	shout.AddChannel(uint32(paused.Id), false, false, "")
+	speaker.voiceTargets[1] = shout
+	whisper := &VoiceTarget{}
+	whisper.AddSession(listener.Session())
+	speaker.voiceTargets[2] = whisper
+
+	for _, target := range []byte{1, 2} {
+		vb := &VoiceBroadcast{
+			client: speaker,
+			buf:    []byte{mumbleproto.UDPMessageVoiceOpus<<5 | target, 0x01, 0x00},
+			target: target,
+		}
+		server.relayVoice(vb)
+		listenerPeer.expectNone(t, mumbleproto.MessageUDPTunnel)
+
+		// Priority speakers are still heard.
+		speaker.PrioritySpeaker = true
+		server.relayVoice(vb)
+		listenerPeer.expect(t, mumbleproto.MessageUDPTunnel, nil)
+		speaker.PrioritySpeaker = false
+	}
+}
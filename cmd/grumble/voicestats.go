@@ -0,0 +1,104 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"fmt"
+	"mumble.info/grumble/pkg/mumbleproto"
+	"sync/atomic"
+)
+
+// The classes of targets a voice packet can be sent to.
+const (
+	// The speaker's current channel (target 0).
+	VoiceTargetNormal = iota
+	// A voice target that only addresses users.
+	VoiceTargetWhisper
+	// A voice target that addresses one or more channels.
+	VoiceTargetShout
+	// The server loopback target (target 31).
+	VoiceTargetLoopback
+
+	numVoiceTargetClasses
+)
+
+var voiceTargetClassNames = [numVoiceTargetClasses]string{
+	VoiceTargetNormal:   "normal",
+	VoiceTargetWhisper:  "whisper",
+	VoiceTargetShout:    "shout",
+	VoiceTargetLoopback: "loopback",
+}
+
+// The voice codecs, in the order they are shown by VoiceStats.String.
+var voiceCodecs = []struct {
+	kind byte
+	name string
+}{
+	{mumbleproto.UDPMessageVoiceCELTAlpha, "celt-alpha"},
+	{mumbleproto.UDPMessageVoiceCELTBeta, "celt-beta"},
+	{mumbleproto.UDPMessageVoiceSpeex, "speex"},
+	{mumbleproto.UDPMessageVoiceOpus, "opus"},
+}
+
+// VoiceStats counts the voice packets relayed by the server, by codec
+// and by target class. The counters are updated atomically, so they can
+// be updated from the UDP receivers and the server's handler at the
+// same time. A VoiceStats must be 64-bit aligned.
+type VoiceStats struct {
+	// Indexed by the UDP message kind of the packet.
+	codecs  [8]uint64
+	targets [numVoiceTargetClasses]uint64
+}
+
+func (vs *VoiceStats) countCodec(kind byte) {
+	atomic.AddUint64(&vs.codecs[kind&0x07], 1)
+}
+
+func (vs *VoiceStats) countTarget(class int) {
+	atomic.AddUint64(&vs.targets[class], 1)
+}
+
+// Get the number of voice packets seen with the given UDP message kind.
+func (vs *VoiceStats) Codec(kind byte) uint64 {
+	return atomic.LoadUint64(&vs.codecs[kind&0x07])
+}
+
+// Get the number of voice packets seen for the given target class.
+func (vs *VoiceStats) Target(class int) uint64 {
+	return atomic.LoadUint64(&vs.targets[class])
+}
+
+func (vs *VoiceStats) String() string {
+	str := ""
+	for _, codec := range voiceCodecs {
+		str += fmt.Sprintf("%v=%v ", codec.name, vs.Codec(codec.kind))
+	}
+	for class, name := range voiceTargetClassNames {
+		str += fmt.Sprintf("%v=%v ", name, vs.Target(class))
+	}
+	return str[:len(str)-1]
+}
+
+// Count a voice packet of the given kind sent by client.
+func (client *Client) countVoiceCodec(kind byte) {
+	client.voiceStats.countCodec(kind)
+	client.server.voiceStats.countCodec(kind)
+}
+
+// Count a voice packet relayed from client to a target of the given class.
+func (client *Client) countVoiceTarget(class int) {
+	client.voiceStats.countTarget(class)
+	client.server.voiceStats.countTarget(class)
+}
+
+// Get the voice packet counters for the client.
+func (client *Client) VoiceStats() *VoiceStats {
+	return &client.voiceStats
+}
+
+// Get the voice packet counters for all clients on the server.
+func (server *Server) VoiceStats() *VoiceStats {
+	return &server.voiceStats
+}
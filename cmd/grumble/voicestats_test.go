@@ -0,0 +1,57 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"mumble.info/grumble/pkg/mumbleproto"
+	"testing"
+	"time"
+)
+
+func TestVoiceStats(t *testing.T) {
+	server := newTestServer(t)
+	client, peer := newTestClient(server, "client")
+	server.voicebroadcast = make(chan *VoiceBroadcast, 1)
+
+	done := make(chan bool)
+	go func() {
+		client.udpRecvLoop()
+		close(done)
+	}()
+
+	// A CELT packet to the current channel, and an Opus packet to
+	// the server loopback target.
+	client.udprecv <- []byte{mumbleproto.UDPMessageVoiceCELTAlpha << 5, 0x01, 0x03, 0xaa, 0xbb, 0xcc}
+	client.udprecv <- []byte{mumbleproto.UDPMessageVoiceOpus<<5 | 0x1f, 0x01, 0x02, 0xaa, 0xbb}
+	close(client.udprecv)
+	<-done
+
+	select {
+	case <-server.voicebroadcast:
+	case <-time.After(time.Second):
+		t.Fatalf("CELT packet was not broadcast")
+	}
+	peer.expect(t, mumbleproto.MessageUDPTunnel, nil)
+
+	for _, stats := range []*VoiceStats{client.VoiceStats(), server.VoiceStats()} {
+		if n := stats.Codec(mumbleproto.UDPMessageVoiceCELTAlpha); n != 1 {
+			t.Errorf("Expected 1 CELT packet, got %v", n)
+		}
+		if n := stats.Codec(mumbleproto.UDPMessageVoiceOpus); n != 1 {
+			t.Errorf("Expected 1 Opus packet, got %v", n)
+		}
+		if n := stats.Codec(mumbleproto.UDPMessageVoiceSpeex); n != 0 {
+			t.Errorf("Expected no Speex packets, got %v", n)
+		}
+		if n := stats.Target(VoiceTargetLoopback); n != 1 {
+			t.Errorf("Expected 1 loopback packet, got %v", n)
+		}
+	}
+
+	expected := "celt-alpha=1 celt-beta=0 speex=0 opus=1 normal=0 whisper=0 shout=0 loopback=1"
+	if str := client.VoiceStats().String(); str != expected {
+		t.Errorf("Expected %q, got %q", expected, str)
+	}
+}
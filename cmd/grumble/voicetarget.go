@@ -4,7 +4,15 @@
 
 package main
 
-import "mumble.info/grumble/pkg/acl"
+import (
+	"mumble.info/grumble/pkg/acl"
+	"sort"
+	"time"
+)
+
+// How long after its last voice packet a client is considered to
+// still be whispering to a voice target.
+const whisperActiveTimeout = time.Second
 
 // A VoiceTarget holds information about a single
 // VoiceTarget entry of a Client.
@@ -47,6 +55,50 @@ func (vt *VoiceTarget) IsEmpty() bool {
 	return len(vt.sessions) == 0 && len(vt.channels) == 0
 }
 
+// Get the number of sessions and channels the VoiceTarget addresses,
+// counting the subchannels and linked channels its channels cover.
+func (vt *VoiceTarget) Size(server *Server) int {
+	channels := make(map[int]bool)
+	for _, vtc := range vt.channels {
+		for id := range vtc.expand(server) {
+			channels[id] = true
+		}
+	}
+	return len(vt.sessions) + len(channels)
+}
+
+// Get the channels a voice target channel entry covers, keyed by id.
+// As in Murmur, the links flag adds the channels linked to the entry's
+// channel, directly or through other linked channels, and the children
+// flag then adds all the subchannels of each of those channels.
+func (vtc *voiceTargetChannel) expand(server *Server) map[int]*Channel {
+	channels := make(map[int]*Channel)
+	channel := server.Channels[int(vtc.id)]
+	if channel == nil {
+		return channels
+	}
+	channels[channel.Id] = channel
+	if vtc.links {
+		for id, linked := range channel.AllLinks() {
+			channels[id] = linked
+		}
+	}
+	if vtc.subChannels {
+		// Collect the subchannels apart, since a map that is added to
+		// while it is ranged over may or may not yield the additions.
+		subchans := make(map[int]*Channel)
+		for _, parent := range channels {
+			for id, subchan := range parent.AllSubChannels() {
+				subchans[id] = subchan
+			}
+		}
+		for id, subchan := range subchans {
+			channels[id] = subchan
+		}
+	}
+	return channels
+}
+
 // Clear the VoiceTarget's cache.
 func (vt *VoiceTarget) ClearCache() {
 	vt.directCache = nil
@@ -54,52 +106,70 @@ func (vt *VoiceTarget) ClearCache() {
 }
 
 // Send the contents of the VoiceBroadcast to all targets specified in the
-// VoiceTarget.
+// VoiceTarget. Recipients in channels whose voice is paused are skipped.
 func (vt *VoiceTarget) SendVoiceBroadcast(vb *VoiceBroadcast) {
+	server := vb.client.server
 	buf := vb.buf
-	client := vb.client
+	direct, fromChannels := vt.recipients(vb.client)
+
+	// If all of the target's recipients have left (or it never had
+	// any), the packet is silently dropped.
+	if len(direct) == 0 && len(fromChannels) == 0 {
+		return
+	}
+
+	vb.client.whisperTarget = uint32(vb.target)
+	vb.client.whisperTime = server.now()
+
+	// The relayed packet carries the speaker's session. Its target tells
+	// the recipient whether it was reached through a channel (1) or
+	// directly (2), which clients use to pick a reply target.
+	kind := buf[0] & 0xe0
+
+	for _, target := range fromChannels {
+		if server.isVoicePausedFor(vb.client, target) {
+			continue
+		}
+		buf[0] = kind | 1
+		err := target.sendVoice(vb.client, buf)
+		if err != nil {
+			target.Panicf("Unable to send UDP packet: %v", err.Error())
+		}
+	}
+
+	for _, target := range direct {
+		if server.isVoicePausedFor(vb.client, target) {
+			continue
+		}
+		buf[0] = kind | 2
+		err := target.sendVoice(vb.client, buf)
+		if err != nil {
+			target.Panicf("Unable to send UDP packet: %v", err.Error())
+		}
+	}
+}
+
+// Get the clients that voice sent by client to the VoiceTarget reaches.
+// Clients targeted by session are returned in direct, clients reached
+// through the target's channels in fromChannels.
+func (vt *VoiceTarget) recipients(client *Client) (direct map[uint32]*Client, fromChannels map[uint32]*Client) {
 	server := client.server
 
-	direct := vt.directCache
-	fromChannels := vt.fromChannelsCache
+	direct = vt.directCache
+	fromChannels = vt.fromChannelsCache
 
 	if direct == nil || fromChannels == nil {
 		direct = make(map[uint32]*Client)
 		fromChannels = make(map[uint32]*Client)
 
 		for _, vtc := range vt.channels {
-			channel := server.Channels[int(vtc.id)]
-			if channel == nil {
-				continue
-			}
-
-			if !vtc.subChannels && !vtc.links && vtc.onlyGroup == "" {
-				if acl.HasPermission(&channel.ACL, client, acl.WhisperPermission) {
-					for _, target := range channel.clients {
-						fromChannels[target.Session()] = target
-					}
-				}
-			} else {
-				server.Printf("%v", vtc)
-				newchans := make(map[int]*Channel)
-				if vtc.links {
-					newchans = channel.AllLinks()
-				} else {
-					newchans[channel.Id] = channel
+			for _, channel := range vtc.expand(server) {
+				if !acl.HasPermission(&channel.ACL, client, acl.WhisperPermission) {
+					continue
 				}
-				if vtc.subChannels {
-					subchans := channel.AllSubChannels()
-					for k, v := range subchans {
-						newchans[k] = v
-					}
-				}
-				for _, newchan := range newchans {
-					if acl.HasPermission(&newchan.ACL, client, acl.WhisperPermission) {
-						for _, target := range newchan.clients {
-							if vtc.onlyGroup == "" || acl.GroupMemberCheck(&newchan.ACL, &newchan.ACL, vtc.onlyGroup, target) {
-								fromChannels[target.Session()] = target
-							}
-						}
+				for _, target := range channel.clients {
+					if vtc.onlyGroup == "" || acl.GroupMemberCheck(&channel.ACL, &channel.ACL, vtc.onlyGroup, target) {
+						fromChannels[target.Session()] = target
 					}
 				}
 			}
@@ -127,26 +197,71 @@ func (vt *VoiceTarget) SendVoiceBroadcast(vb *VoiceBroadcast) {
 		}
 	}
 
-	kind := buf[0] & 0xe0
+	return
+}
 
-	if len(fromChannels) > 0 {
-		for _, target := range fromChannels {
-			buf[0] = kind | 2
-			err := target.SendUDP(buf)
-			if err != nil {
-				target.Panicf("Unable to send UDP packet: %v", err.Error())
-			}
-		}
+// A Whisper describes a client whispering or shouting to one of its
+// voice targets.
+type Whisper struct {
+	// The session of the speaker.
+	Speaker uint32
+	// The speaker's voice target.
+	Target uint32
+	// The sessions of the clients that hear the speaker.
+	Recipients []uint32
+}
+
+// Get the whispers that are currently going on, ordered by speaker.
+//
+// The whispers are collected by the server's handler. Returns nil if the
+// server isn't running, or its handler doesn't answer within
+// healthProbeTimeout.
+func (server *Server) Whispers() []Whisper {
+	server.stopLock.RLock()
+	defer server.stopLock.RUnlock()
+	if server.stopping || server.whispersProbe == nil {
+		return nil
+	}
+	reply := make(chan []Whisper, 1)
+	select {
+	case server.whispersProbe <- reply:
+		return <-reply
+	case <-time.After(healthProbeTimeout):
+		return nil
 	}
+}
 
-	if len(direct) > 0 {
-		for _, target := range direct {
-			buf[0] = kind | 2
-			target.SendUDP(buf)
-			err := target.SendUDP(buf)
-			if err != nil {
-				target.Panicf("Unable to send UDP packet: %v", err.Error())
-			}
+// Like Whispers, but called on the server's handler goroutine.
+func (server *Server) whispers() []Whisper {
+	whispers := []Whisper{}
+	for _, client := range server.clients {
+		if client.whisperTime.IsZero() || server.now().Sub(client.whisperTime) > whisperActiveTimeout {
+			continue
+		}
+		vt, ok := client.voiceTargets[client.whisperTarget]
+		if !ok {
+			continue
 		}
+
+		whisper := Whisper{
+			Speaker: client.Session(),
+			Target:  client.whisperTarget,
+		}
+		direct, fromChannels := vt.recipients(client)
+		for session := range direct {
+			whisper.Recipients = append(whisper.Recipients, session)
+		}
+		for session := range fromChannels {
+			whisper.Recipients = append(whisper.Recipients, session)
+		}
+		sort.Slice(whisper.Recipients, func(i, j int) bool {
+			return whisper.Recipients[i] < whisper.Recipients[j]
+		})
+		whispers = append(whispers, whisper)
 	}
+
+	sort.Slice(whispers, func(i, j int) bool {
+		return whispers[i].Speaker < whispers[j].Speaker
+	})
+	return whispers
 }
@@ -0,0 +1,297 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"github.com/golang/protobuf/proto"
+	"mumble.info/grumble/pkg/acl"
+	"mumble.info/grumble/pkg/mumbleproto"
+	"mumble.info/grumble/pkg/packetdata"
+	"testing"
+	"time"
+)
+
+func TestWhisperToEmptyTarget(t *testing.T) {
+	server := newTestServer(t)
+	alice, _ := newTestClient(server, "alice")
+	bob, bobPeer := newTestClient(server, "bob")
+	carol, carolPeer := newTestClient(server, "carol")
+
+	vt := &VoiceTarget{}
+	vt.AddSession(bob.Session())
+	vt.AddSession(carol.Session())
+	alice.voiceTargets[1] = vt
+
+	// An Opus packet whispered to target 1.
+	vb := &VoiceBroadcast{
+		client: alice,
+		buf:    []byte{mumbleproto.UDPMessageVoiceOpus<<5 | 1, 0x01, 0x00},
+		target: 1,
+	}
+	vt.SendVoiceBroadcast(vb)
+	bobPeer.expect(t, mumbleproto.MessageUDPTunnel, nil)
+	carolPeer.expect(t, mumbleproto.MessageUDPTunnel, nil)
+
+	// Once bob has left and carol has been taken off the target, it has
+	// no recipients; the voice packet must not reach anyone.
+	bob.Disconnect()
+	vt.sessions = vt.sessions[:1]
+	vt.ClearCache()
+	direct, fromChannels := vt.recipients(alice)
+	if len(direct) != 0 || len(fromChannels) != 0 {
+		t.Errorf("Expected target to have no recipients, got %v and %v", direct, fromChannels)
+	}
+	vt.SendVoiceBroadcast(vb)
+	carolPeer.expectNone(t, mumbleproto.MessageUDPTunnel)
+}
+
+func TestWhisperOrigin(t *testing.T) {
+	server := newTestServer(t)
+	defer answerTestProbes(server)()
+	lobby := newTestChannel(server, server.RootChannel(), "Lobby")
+	alice, _ := newTestClient(server, "alice")
+	bob, bobPeer := newTestClient(server, "bob")
+	carol, carolPeer := newTestClient(server, "carol")
+	server.RootChannel().RemoveClient(carol)
+	lobby.AddClient(carol)
+
+	vt := &VoiceTarget{}
+	vt.AddSession(bob.Session())
+	vt.AddChannel(uint32(lobby.Id), false, false, "")
+	alice.voiceTargets[1] = vt
+
+	if len(server.Whispers()) != 0 {
+		t.Errorf("Expected no whispers before alice speaks")
+	}
+
+	// An Opus packet from alice, as relayed by udpRecvLoop.
+	buf, ok := relayedVoicePacket(alice.Session(), []byte{mumbleproto.UDPMessageVoiceOpus<<5 | 1, 0x01, 0x00})
+	if !ok {
+		t.Fatalf("unable to build voice packet")
+	}
+	vt.SendVoiceBroadcast(&VoiceBroadcast{client: alice, buf: buf, target: 1})
+
+	// The whispered packet tells bob who sent it, and that bob was
+	// whispered to directly; carol was reached through a channel.
+	for _, recipient := range []struct {
+		peer   *testPeer
+		target byte
+	}{{bobPeer, 2}, {carolPeer, 1}} {
+		msg := recipient.peer.expect(t, mumbleproto.MessageUDPTunnel, nil)
+		if msg.buf[0]&0x1f != recipient.target {
+			t.Errorf("Expected relayed target %v, got %v", recipient.target, msg.buf[0]&0x1f)
+		}
+		session := packetdata.New(msg.buf[1:]).GetUint32()
+		if session != alice.Session() {
+			t.Errorf("Expected relayed packet from session %v, got %v", alice.Session(), session)
+		}
+	}
+
+	whispers := server.Whispers()
+	if len(whispers) != 1 {
+		t.Fatalf("Expected 1 whisper, got %v", whispers)
+	}
+	whisper := whispers[0]
+	if whisper.Speaker != alice.Session() || whisper.Target != 1 || len(whisper.Recipients) != 2 ||
+		whisper.Recipients[0] != bob.Session() || whisper.Recipients[1] != carol.Session() {
+		t.Errorf("Expected alice whispering to bob and carol, got %+v", whisper)
+	}
+}
+
+func TestWhispersStopped(t *testing.T) {
+	server := newTestServer(t)
+	server.cleanPerLaunchData()
+	if whispers := server.Whispers(); whispers != nil {
+		t.Errorf("Expected no whispers from a stopped server, got %+v", whispers)
+	}
+}
+
+func TestMaxVoiceTargetSize(t *testing.T) {
+	server := newTestServer(t)
+	server.cfg.Set("MaxVoiceTargetSize", "3")
+	lobby := newTestChannel(server, server.RootChannel(), "Lobby")
+	newTestChannel(server, lobby, "Games")
+	newTestChannel(server, lobby, "Music")
+	alice, alicePeer := newTestClient(server, "alice")
+	bob, _ := newTestClient(server, "bob")
+	setVoiceTarget := func(targets ...*mumbleproto.VoiceTarget_Target) {
+		server.handleVoiceTarget(alice, newTestMessage(t, alice, &mumbleproto.VoiceTarget{
+			Id:      proto.Uint32(1),
+			Targets: targets,
+		}))
+	}
+
+	// All of the message's entries make up the target.
+	setVoiceTarget(&mumbleproto.VoiceTarget_Target{
+		Session: []uint32{bob.Session()},
+	}, &mumbleproto.VoiceTarget_Target{
+		ChannelId: proto.Uint32(uint32(lobby.Id)),
+	})
+	if vt, ok := alice.voiceTargets[1]; !ok || vt.Size(server) != 2 {
+		t.Fatalf("Expected a target of bob and Lobby")
+	}
+
+	// Lobby and its two subchannels, plus bob, is one too many.
+	setVoiceTarget(&mumbleproto.VoiceTarget_Target{
+		Session: []uint32{bob.Session()},
+	}, &mumbleproto.VoiceTarget_Target{
+		ChannelId: proto.Uint32(uint32(lobby.Id)),
+		Children:  proto.Bool(true),
+	})
+	if _, ok := alice.voiceTargets[1]; ok {
+		t.Errorf("Expected over-large target to be rejected")
+	}
+	denied := &mumbleproto.PermissionDenied{}
+	alicePeer.expect(t, mumbleproto.MessagePermissionDenied, denied)
+	if denied.GetType() != mumbleproto.PermissionDenied_Text {
+		t.Errorf("Expected a textual denial, got %v", denied.GetType())
+	}
+
+	server.cfg.Set("MaxVoiceTargetSize", "0")
+	setVoiceTarget(&mumbleproto.VoiceTarget_Target{
+		Session: []uint32{bob.Session()},
+	}, &mumbleproto.VoiceTarget_Target{
+		ChannelId: proto.Uint32(uint32(lobby.Id)),
+		Children:  proto.Bool(true),
+	})
+	if vt, ok := alice.voiceTargets[1]; !ok || vt.Size(server) != 4 {
+		t.Errorf("Expected target to be accepted without a limit")
+	}
+}
+
+func TestVoiceTargetLimits(t *testing.T) {
+	server := newTestServer(t)
+	clock := newFakeClock()
+	server.SetClock(clock)
+	server.cfg.Set("MaxVoiceTargets", "2")
+	server.cfg.Set("VoiceTargetLimit", "1")
+	server.cfg.Set("VoiceTargetBurst", "4")
+	alice, alicePeer := newTestClient(server, "alice")
+	bob, _ := newTestClient(server, "bob")
+	setVoiceTarget := func(id uint32, session uint32) {
+		server.handleVoiceTarget(alice, newTestMessage(t, alice, &mumbleproto.VoiceTarget{
+			Id: proto.Uint32(id),
+			Targets: []*mumbleproto.VoiceTarget_Target{{
+				Session: []uint32{session},
+			}},
+		}))
+	}
+
+	// Slots outside of the protocol's range are ignored.
+	setVoiceTarget(0, bob.Session())
+	setVoiceTarget(31, bob.Session())
+	setVoiceTarget(1000, bob.Session())
+	if len(alice.voiceTargets) != 0 {
+		t.Errorf("Expected out-of-range targets to be ignored, got %v", len(alice.voiceTargets))
+	}
+
+	// Only MaxVoiceTargets slots can be defined, but those can still be
+	// updated.
+	setVoiceTarget(1, bob.Session())
+	setVoiceTarget(2, bob.Session())
+	setVoiceTarget(3, bob.Session())
+	if _, ok := alice.voiceTargets[3]; ok || len(alice.voiceTargets) != 2 {
+		t.Errorf("Expected a third target to be refused, got %v targets", len(alice.voiceTargets))
+	}
+	alicePeer.expect(t, mumbleproto.MessagePermissionDenied, nil)
+	setVoiceTarget(2, alice.Session())
+	if vt := alice.voiceTargets[2]; vt == nil || vt.sessions[0] != alice.Session() {
+		t.Errorf("Expected an existing target to be updated")
+	}
+
+	// That was the fourth update; a flood of updates is refused until
+	// the limit drains, and the target is dropped rather than left as
+	// it was.
+	for i := 0; i < 100; i++ {
+		setVoiceTarget(1, alice.Session())
+	}
+	if _, ok := alice.voiceTargets[1]; ok {
+		t.Errorf("Expected a target updated over the rate limit to be dropped")
+	}
+	clock.advance(time.Second)
+	setVoiceTarget(1, alice.Session())
+	if vt := alice.voiceTargets[1]; vt.sessions[0] != alice.Session() {
+		t.Errorf("Expected an update to be accepted once the limit drained")
+	}
+
+	// Repeating a channel doesn't add to the target's size, but each
+	// entry is still counted against MaxVoiceTargetSize.
+	clock.advance(time.Second)
+	server.cfg.Set("MaxVoiceTargetSize", "100")
+	repeated := []*mumbleproto.VoiceTarget_Target{}
+	for i := 0; i < 200; i++ {
+		repeated = append(repeated, &mumbleproto.VoiceTarget_Target{
+			ChannelId: proto.Uint32(0),
+		})
+	}
+	server.handleVoiceTarget(alice, newTestMessage(t, alice, &mumbleproto.VoiceTarget{
+		Id:      proto.Uint32(1),
+		Targets: repeated,
+	}))
+	if _, ok := alice.voiceTargets[1]; ok {
+		t.Errorf("Expected a target with too many entries to be rejected")
+	}
+}
+
+func TestVoiceTargetExpansion(t *testing.T) {
+	server := newTestServer(t)
+	root := server.RootChannel()
+	stage := newTestChannel(server, root, "Stage")
+	backstage := newTestChannel(server, stage, "Backstage")
+	lobby := newTestChannel(server, root, "Lobby")
+	foyer := newTestChannel(server, lobby, "Foyer")
+	stage.Links[lobby.Id] = lobby
+	lobby.Links[stage.Id] = stage
+
+	alice, _ := newTestClient(server, "alice")
+	others := map[*Channel]*Client{}
+	for _, c := range []struct {
+		name    string
+		channel *Channel
+	}{{"bob", stage}, {"carol", backstage}, {"dave", lobby}, {"erin", foyer}} {
+		client, _ := newTestClient(server, c.name)
+		root.RemoveClient(client)
+		c.channel.AddClient(client)
+		others[c.channel] = client
+	}
+
+	user, err := NewUser(1, "dave")
+	if err != nil {
+		t.Fatalf("unable to create user: %v", err)
+	}
+	others[lobby].user = user
+	group := acl.EmptyGroupWithName("members")
+	group.Add[int(user.Id)] = true
+	lobby.ACL.Groups["members"] = group
+
+	for _, test := range []struct {
+		subchannels bool
+		links       bool
+		group       string
+		want        []*Channel
+	}{
+		{false, false, "", []*Channel{stage}},
+		{false, true, "", []*Channel{stage, lobby}},
+		{true, false, "", []*Channel{stage, backstage}},
+		{true, true, "", []*Channel{stage, backstage, lobby, foyer}},
+		{true, true, "members", []*Channel{lobby}},
+	} {
+		vt := &VoiceTarget{}
+		vt.AddChannel(uint32(stage.Id), test.subchannels, test.links, test.group)
+		_, fromChannels := vt.recipients(alice)
+		if len(fromChannels) != len(test.want) {
+			t.Errorf("Expected %v recipients for subchannels=%v links=%v group=%q, got %v", len(test.want), test.subchannels, test.links, test.group, len(fromChannels))
+		}
+		for _, channel := range test.want {
+			if _, ok := fromChannels[others[channel].Session()]; !ok {
+				t.Errorf("Expected %v to be reached for subchannels=%v links=%v group=%q", others[channel].ShownName(), test.subchannels, test.links, test.group)
+			}
+		}
+		// The group filter doesn't change the channels a target covers.
+		if size := vt.Size(server); test.group == "" && size != len(test.want) {
+			t.Errorf("Expected size %v for subchannels=%v links=%v, got %v", len(test.want), test.subchannels, test.links, size)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"runtime/debug"
+	"time"
+)
+
+const (
+	// A worker that panics more than workerPanicLimit times within
+	// workerPanicWindow is given up on, and the server is stopped.
+	workerPanicLimit  = 5
+	workerPanicWindow = time.Minute
+	// How long to wait before restarting a worker after its first
+	// panic. The delay grows with each panic within the window.
+	workerRestartDelay = 50 * time.Millisecond
+)
+
+// Run fn, one of the server's long-running worker loops, restarting it
+// whenever it panics, so that a bug triggered by a single packet or
+// message doesn't take the worker down for good. Panics are logged with
+// the worker's name and a stack trace.
+//
+// Returns once fn returns. Returns true if the worker was given up on,
+// because it panicked too often.
+func (server *Server) runWorker(name string, fn func()) (gaveUp bool) {
+	panics := []time.Time{}
+	for server.runRecovered(name, fn) {
+		now := time.Now()
+		recent := panics[:0]
+		for _, t := range panics {
+			if now.Sub(t) < workerPanicWindow {
+				recent = append(recent, t)
+			}
+		}
+		panics = append(recent, now)
+		if len(panics) > workerPanicLimit {
+			return true
+		}
+
+		time.Sleep(workerRestartDelay * time.Duration(len(panics)))
+		server.Printf("Restarting %v", name)
+	}
+	return false
+}
+
+// Run fn, recovering from and logging a panic. Returns whether fn
+// panicked.
+func (server *Server) runRecovered(name string, fn func()) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			server.Printf("Panic in %v: %v\n%s", name, r, debug.Stack())
+			panicked = true
+		}
+	}()
+	fn()
+	return false
+}
+
+// Like runWorker, but stops the server if the worker is given up on.
+func (server *Server) superviseWorker(name string, fn func()) {
+	if server.runWorker(name, fn) {
+		server.Printf("The %v keeps panicking. Stopping the server.", name)
+		go server.Stop()
+	}
+}
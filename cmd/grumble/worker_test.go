@@ -0,0 +1,67 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"mumble.info/grumble/pkg/mumbleproto"
+	"testing"
+)
+
+func TestRunWorkerRestartsAfterPanic(t *testing.T) {
+	server := newTestServer(t)
+	runs := 0
+	gaveUp := server.runWorker("test worker", func() {
+		runs++
+		if runs < 3 {
+			panic("bad packet")
+		}
+	})
+	if gaveUp {
+		t.Errorf("Expected worker not to be given up on")
+	}
+	if runs != 3 {
+		t.Errorf("Expected worker to run 3 times, ran %v times", runs)
+	}
+}
+
+func TestRunWorkerGivesUp(t *testing.T) {
+	server := newTestServer(t)
+	runs := 0
+	gaveUp := server.runWorker("test worker", func() {
+		runs++
+		panic("bad packet")
+	})
+	if !gaveUp {
+		t.Errorf("Expected a worker that keeps panicking to be given up on")
+	}
+	if runs != workerPanicLimit+1 {
+		t.Errorf("Expected worker to run %v times, ran %v times", workerPanicLimit+1, runs)
+	}
+}
+
+func TestHandlerLoopRestartsAfterPanic(t *testing.T) {
+	server := newTestServer(t)
+	alice, _ := newTestClient(server, "alice")
+	_, bobPeer := newTestClient(server, "bob")
+	ghost, _ := newTestClient(server, "ghost")
+
+	done := make(chan bool)
+	go func() {
+		server.superviseWorker("handler", server.handlerLoop)
+		close(done)
+	}()
+
+	// Voice from a client that is in no channel makes the handler
+	// panic. It is restarted, and goes on to relay alice's voice.
+	ghost.Channel.RemoveClient(ghost)
+	ghost.Channel = nil
+	packet := []byte{mumbleproto.UDPMessageVoiceOpus << 5, 0x01, 0x00}
+	server.voicebroadcast <- &VoiceBroadcast{client: ghost, buf: packet}
+	server.voicebroadcast <- &VoiceBroadcast{client: alice, buf: packet}
+	bobPeer.expect(t, mumbleproto.MessageUDPTunnel, nil)
+
+	close(server.bye)
+	<-done
+}
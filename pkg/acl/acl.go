@@ -167,3 +167,18 @@ func HasPermission(ctx *Context, user User, perm Permission) bool {
 
 	return false
 }
+
+// EffectivePermissions returns the set of permissions that HasPermission
+// grants user in the context ctx.
+func EffectivePermissions(ctx *Context, user User) Permission {
+	granted := Permission(NonePermission)
+	for perm := Permission(1); perm <= AllPermissions; perm <<= 1 {
+		if perm&AllPermissions == NonePermission {
+			continue
+		}
+		if HasPermission(ctx, user, perm) {
+			granted |= perm
+		}
+	}
+	return granted
+}
@@ -116,6 +116,24 @@ func (group *Group) MembersInContext(ctx *Context) map[int]bool {
 	return members
 }
 
+// LookupGroup finds the group with the given name that applies in ctx.
+// This is the group defined on ctx itself or, if there is none, the
+// closest group with that name defined on one of ctx's ancestors,
+// provided that group is inheritable.
+func (ctx *Context) LookupGroup(name string) (Group, bool) {
+	for iter := ctx; iter != nil; iter = iter.Parent {
+		group, ok := iter.Groups[name]
+		if !ok {
+			continue
+		}
+		if iter != ctx && !group.Inheritable {
+			return Group{}, false
+		}
+		return group, true
+	}
+	return Group{}, false
+}
+
 // GroupMemberCheck checks whether a user is a member
 // of the group as defined in the given context.
 //
@@ -321,7 +339,7 @@ func GroupMemberCheck(current *Context, acl *Context, name string, user User) (o
 			iter = iter.Parent
 		}
 
-		isMember := false
+		isMember := isGrantedGroup(user, name) || isGrantedGroupIn(user, channel, name)
 		for _, group := range groups {
 			if group.AddContains(user.UserId()) || group.TemporaryContains(user.UserId()) || group.TemporaryContains(-int(user.Session())) {
 				isMember = true
@@ -336,6 +354,36 @@ func GroupMemberCheck(current *Context, acl *Context, name string, user User) (o
 	return false
 }
 
+// Check whether user has been granted membership of the named group,
+// if it is a GroupGrantee.
+func isGrantedGroup(user User, name string) bool {
+	grantee, ok := user.(GroupGrantee)
+	if !ok {
+		return false
+	}
+	for _, granted := range grantee.GrantedGroups() {
+		if granted == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether user has been granted membership of the named group in
+// ctx, if it is a ContextGroupGrantee.
+func isGrantedGroupIn(user User, ctx *Context, name string) bool {
+	grantee, ok := user.(ContextGroupGrantee)
+	if !ok {
+		return false
+	}
+	for _, granted := range grantee.GrantedGroupsIn(ctx) {
+		if granted == name {
+			return true
+		}
+	}
+	return false
+}
+
 // Get the list of group names for the given ACL context.
 //
 // This function walks the through the context chain to figure
@@ -344,7 +392,7 @@ func GroupMemberCheck(current *Context, acl *Context, name string, user User) (o
 func (ctx *Context) GroupNames() []string {
 	names := map[string]bool{}
 	origCtx := ctx
-	contexts := []*Context{}
+	contexts := buildChain(ctx)
 
 	// Walk through the whole context chain and all groups in it.
 	for _, ctx := range contexts {
@@ -0,0 +1,187 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package acl
+
+import (
+	"sort"
+	"testing"
+)
+
+type testUser struct {
+	id  int
+	ctx *Context
+}
+
+func (u *testUser) Session() uint32      { return uint32(u.id) + 1 }
+func (u *testUser) UserId() int          { return u.id }
+func (u *testUser) CertHash() string     { return "" }
+func (u *testUser) Tokens() []string     { return nil }
+func (u *testUser) ACLContext() *Context { return u.ctx }
+
+// Create a context chain root -> child -> grandchild.
+func newTestContexts() (root, child, grandchild *Context) {
+	root = &Context{Groups: map[string]Group{}}
+	child = &Context{Parent: root, Groups: map[string]Group{}, InheritACL: true}
+	grandchild = &Context{Parent: child, Groups: map[string]Group{}, InheritACL: true}
+	return
+}
+
+func newTestGroup(name string, inherit, inheritable bool, add []int, remove []int) Group {
+	group := EmptyGroupWithName(name)
+	group.Inherit = inherit
+	group.Inheritable = inheritable
+	for _, uid := range add {
+		group.Add[uid] = true
+	}
+	for _, uid := range remove {
+		group.Remove[uid] = true
+	}
+	return group
+}
+
+func checkMembers(t *testing.T, where string, ctx *Context, name string, members map[int]bool) {
+	for uid, member := range members {
+		user := &testUser{id: uid, ctx: ctx}
+		if GroupMemberCheck(ctx, ctx, name, user) != member {
+			t.Errorf("%v: expected membership of user %v in %v to be %v", where, uid, name, member)
+		}
+	}
+}
+
+func TestGroupDefinedAtRoot(t *testing.T) {
+	root, child, grandchild := newTestContexts()
+	root.Groups["admin"] = newTestGroup("admin", true, true, []int{1}, nil)
+
+	checkMembers(t, "root", root, "admin", map[int]bool{1: true, 2: false})
+	checkMembers(t, "child", child, "admin", map[int]bool{1: true, 2: false})
+	checkMembers(t, "grandchild", grandchild, "admin", map[int]bool{1: true, 2: false})
+
+	// A group that is not inheritable only applies where it is defined.
+	root.Groups["admin"] = newTestGroup("admin", true, false, []int{1}, nil)
+	checkMembers(t, "root", root, "admin", map[int]bool{1: true})
+	checkMembers(t, "child", child, "admin", map[int]bool{1: false})
+	if _, ok := child.LookupGroup("admin"); ok {
+		t.Errorf("Expected non-inheritable group not to apply in child")
+	}
+}
+
+func TestGroupMembersAddedAtChild(t *testing.T) {
+	root, child, grandchild := newTestContexts()
+	root.Groups["admin"] = newTestGroup("admin", true, true, []int{1, 2}, nil)
+	child.Groups["admin"] = newTestGroup("admin", true, true, []int{3}, []int{2})
+
+	checkMembers(t, "root", root, "admin", map[int]bool{1: true, 2: true, 3: false})
+	checkMembers(t, "child", child, "admin", map[int]bool{1: true, 2: false, 3: true})
+	checkMembers(t, "grandchild", grandchild, "admin", map[int]bool{1: true, 2: false, 3: true})
+
+	group := child.Groups["admin"]
+	members := group.MembersInContext(grandchild)
+	if len(members) != 2 || !members[1] || !members[3] {
+		t.Errorf("Expected members 1 and 3 in grandchild, got %v", members)
+	}
+
+	group, ok := grandchild.LookupGroup("admin")
+	if !ok || !group.AddContains(3) {
+		t.Errorf("Expected grandchild to use the child's group")
+	}
+
+	// Permissions granted to the group follow its membership.
+	root.ACLs = append(root.ACLs, ACL{
+		UserId:    -1,
+		Group:     "admin",
+		ApplyHere: true,
+		ApplySubs: true,
+		Allow:     MovePermission,
+	})
+	for uid, expected := range map[int]bool{1: true, 2: false, 3: true} {
+		user := &testUser{id: uid, ctx: grandchild}
+		if HasPermission(grandchild, user, MovePermission) != expected {
+			t.Errorf("Expected move permission of user %v in grandchild to be %v", uid, expected)
+		}
+	}
+}
+
+func TestGroupBreakInheritance(t *testing.T) {
+	root, child, grandchild := newTestContexts()
+	root.Groups["admin"] = newTestGroup("admin", true, true, []int{1}, nil)
+	child.Groups["admin"] = newTestGroup("admin", false, true, []int{2}, nil)
+
+	checkMembers(t, "root", root, "admin", map[int]bool{1: true, 2: false})
+	checkMembers(t, "child", child, "admin", map[int]bool{1: false, 2: true})
+	checkMembers(t, "grandchild", grandchild, "admin", map[int]bool{1: false, 2: true})
+
+	group := child.Groups["admin"]
+	members := group.MembersInContext(child)
+	if len(members) != 1 || !members[2] {
+		t.Errorf("Expected only member 2 in child, got %v", members)
+	}
+}
+
+func TestGroupNames(t *testing.T) {
+	root, child, _ := newTestContexts()
+	root.Groups["admin"] = newTestGroup("admin", true, true, nil, nil)
+	root.Groups["private"] = newTestGroup("private", true, false, nil, nil)
+	child.Groups["mods"] = newTestGroup("mods", true, true, nil, nil)
+
+	names := child.GroupNames()
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "admin" || names[1] != "mods" {
+		t.Errorf("Expected groups admin and mods in child, got %v", names)
+	}
+}
+
+type testGrantee struct {
+	testUser
+	granted []string
+}
+
+func (u *testGrantee) GrantedGroups() []string { return u.granted }
+
+func TestGrantedGroup(t *testing.T) {
+	root, child, _ := newTestContexts()
+	child.Groups["event"] = newTestGroup("event", true, true, nil, []int{2})
+
+	member := &testGrantee{testUser{id: 1, ctx: child}, []string{"event"}}
+	if !GroupMemberCheck(child, child, "event", member) || !GroupMemberCheck(root, root, "event", member) {
+		t.Errorf("Expected granted user to be a member of the event group")
+	}
+	removed := &testGrantee{testUser{id: 2, ctx: child}, []string{"event"}}
+	if GroupMemberCheck(child, child, "event", removed) {
+		t.Errorf("Expected removed user not to be a member of the event group")
+	}
+	if GroupMemberCheck(child, child, "other", member) {
+		t.Errorf("Expected granted user not to be a member of other groups")
+	}
+}
+
+type testContextGrantee struct {
+	testUser
+	grantedIn *Context
+	granted   []string
+}
+
+func (u *testContextGrantee) GrantedGroupsIn(ctx *Context) []string {
+	if ctx == u.grantedIn {
+		return u.granted
+	}
+	return nil
+}
+
+func TestGrantedGroupIn(t *testing.T) {
+	root, child, _ := newTestContexts()
+	child.Groups["members"] = newTestGroup("members", true, true, nil, []int{2})
+
+	member := &testContextGrantee{testUser{id: 1, ctx: root}, child, []string{"members"}}
+	if !GroupMemberCheck(child, child, "members", member) {
+		t.Errorf("Expected granted user to be a member of the members group in child")
+	}
+	if GroupMemberCheck(root, root, "members", member) {
+		t.Errorf("Expected granted user not to be a member of the members group in root")
+	}
+	removed := &testContextGrantee{testUser{id: 2, ctx: root}, child, []string{"members"}}
+	if GroupMemberCheck(child, child, "members", removed) {
+		t.Errorf("Expected removed user not to be a member of the members group")
+	}
+}
@@ -21,3 +21,20 @@ type User interface {
 type Channel interface {
 	ChannelId() int
 }
+
+// GroupGrantee is implemented by Users that can be granted membership
+// of groups outside of the groups' member lists, for example through
+// temporary access tokens. Such a user is a member of each of the named
+// groups returned by GrantedGroups, unless a group removes the user.
+type GroupGrantee interface {
+	GrantedGroups() []string
+}
+
+// ContextGroupGrantee is implemented by Users that are granted membership
+// of groups in some contexts only, for example by default in parts of the
+// channel tree. Such a user is a member of each of the named groups
+// returned by GrantedGroupsIn for the context a group is evaluated in,
+// unless the group removes the user.
+type ContextGroupGrantee interface {
+	GrantedGroupsIn(ctx *Context) []string
+}
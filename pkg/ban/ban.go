@@ -21,6 +21,8 @@ type Ban struct {
 	Reason   string
 	Start    int64
 	Duration uint32
+	// The name of the user who created the ban, if known.
+	Actor string
 }
 
 // Create a net.IPMask from a specified amount of mask bits
@@ -136,3 +136,49 @@ func TestNotExpired(t *testing.T) {
 		t.Errorf("Should expire in 24 hours")
 	}
 }
+
+func TestExportImport(t *testing.T) {
+	bans := []Ban{
+		{
+			IP:       net.ParseIP("192.168.1.1"),
+			Mask:     24 + 96,
+			Username: "alice",
+			Reason:   "spam",
+			Start:    time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC).Unix(),
+			Duration: 3600,
+			Actor:    "admin",
+		},
+		{
+			IP:       net.ParseIP("2001:db8::1"),
+			Mask:     128,
+			CertHash: "0123456789abcdef",
+			Start:    time.Date(2026, 2, 3, 4, 5, 6, 0, time.UTC).Unix(),
+		},
+	}
+
+	original := append([]Ban{}, bans...)
+
+	data, err := Export(bans)
+	if err != nil {
+		t.Fatalf("unable to export bans: %v", err)
+	}
+	bans = nil
+
+	bans, err = Import(data)
+	if err != nil {
+		t.Fatalf("unable to import bans: %v", err)
+	}
+	if len(bans) != len(original) {
+		t.Fatalf("Expected %v bans, got %v", len(original), len(bans))
+	}
+	for i, ban := range bans {
+		exp := original[i]
+		if !ban.IP.Equal(exp.IP) {
+			t.Errorf("IP mismatch: %v, %v", ban.IP, exp.IP)
+		}
+		if ban.Mask != exp.Mask || ban.Username != exp.Username || ban.CertHash != exp.CertHash ||
+			ban.Reason != exp.Reason || ban.Start != exp.Start || ban.Duration != exp.Duration || ban.Actor != exp.Actor {
+			t.Errorf("Ban mismatch: %+v, %+v", ban, exp)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2026 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package ban
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+)
+
+// The portable JSON form of a ban, used to share ban lists between
+// servers.
+type exportedBan struct {
+	Address  string `json:"address"`
+	Mask     int    `json:"mask"`
+	Username string `json:"username,omitempty"`
+	CertHash string `json:"certhash,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	Start    string `json:"start"`
+	Duration uint32 `json:"duration"`
+	Actor    string `json:"actor,omitempty"`
+}
+
+// Export bans in a portable JSON format. Start dates are written as ISO
+// 8601 dates (in UTC), and durations in seconds, with 0 meaning forever.
+func Export(bans []Ban) ([]byte, error) {
+	exported := make([]exportedBan, 0, len(bans))
+	for _, ban := range bans {
+		exported = append(exported, exportedBan{
+			Address:  ban.IP.String(),
+			Mask:     ban.Mask,
+			Username: ban.Username,
+			CertHash: ban.CertHash,
+			Reason:   ban.Reason,
+			Start:    ban.ISOStartDate(),
+			Duration: ban.Duration,
+			Actor:    ban.Actor,
+		})
+	}
+	return json.MarshalIndent(exported, "", "\t")
+}
+
+// Import bans from the JSON format written by Export.
+func Import(data []byte) ([]Ban, error) {
+	exported := []exportedBan{}
+	if err := json.Unmarshal(data, &exported); err != nil {
+		return nil, err
+	}
+
+	bans := make([]Ban, 0, len(exported))
+	for _, eb := range exported {
+		ip := net.ParseIP(eb.Address)
+		if ip == nil {
+			return nil, errors.New("ban: invalid address " + eb.Address)
+		}
+		if eb.Mask < 0 || eb.Mask > 128 {
+			return nil, errors.New("ban: invalid mask for " + eb.Address)
+		}
+		ban := Ban{
+			IP:       ip,
+			Mask:     eb.Mask,
+			Username: eb.Username,
+			CertHash: eb.CertHash,
+			Reason:   eb.Reason,
+			Duration: eb.Duration,
+			Actor:    eb.Actor,
+		}
+		ban.SetISOStartDate(eb.Start)
+		bans = append(bans, ban)
+	}
+	return bans, nil
+}
+
+// Check whether two bans ban the same thing: the same network and the
+// same certificate hash.
+func (ban Ban) SameTarget(other Ban) bool {
+	return ban.Mask == other.Mask && ban.CertHash == other.CertHash && ban.Match(other.IP)
+}
@@ -111,6 +111,23 @@ func (cs *CryptState) SetKey(mode string, key []byte, eiv []byte, div []byte) er
 	return nil
 }
 
+// SetDecryptIV sets the nonce that the CryptState expects the remote end
+// to encrypt its next packet with, to resynchronize with it after packet
+// loss. The encrypt nonce is left alone, so that it never repeats.
+func (cs *CryptState) SetDecryptIV(iv []byte) error {
+	if len(iv) != len(cs.DecryptIV) {
+		return errors.New("cryptstate: invalid nonce size")
+	}
+	copy(cs.DecryptIV, iv)
+	return nil
+}
+
+// IsValid returns whether the CryptState has been set up with a key,
+// using GenerateKey or SetKey.
+func (cs *CryptState) IsValid() bool {
+	return cs.mode != nil
+}
+
 // Overhead returns the length, in bytes, that a ciphertext
 // is longer than a plaintext.
 func (cs *CryptState) Overhead() int {
@@ -64,6 +64,7 @@ type Ban struct {
 	Reason           *string `protobuf:"bytes,5,opt,name=reason" json:"reason,omitempty"`
 	Start            *int64  `protobuf:"varint,6,opt,name=start" json:"start,omitempty"`
 	Duration         *uint32 `protobuf:"varint,7,opt,name=duration" json:"duration,omitempty"`
+	Actor            *string `protobuf:"bytes,8,opt,name=actor" json:"actor,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
@@ -120,6 +121,13 @@ func (this *Ban) GetDuration() uint32 {
 	return 0
 }
 
+func (this *Ban) GetActor() string {
+	if this != nil && this.Actor != nil {
+		return *this.Actor
+	}
+	return ""
+}
+
 type BanList struct {
 	Bans             []*Ban `protobuf:"bytes,1,rep,name=bans" json:"bans,omitempty"`
 	XXX_unrecognized []byte `json:"-"`
@@ -139,6 +147,7 @@ type User struct {
 	CommentBlob      *string `protobuf:"bytes,7,opt,name=comment_blob" json:"comment_blob,omitempty"`
 	LastChannelId    *uint32 `protobuf:"varint,8,opt,name=last_channel_id" json:"last_channel_id,omitempty"`
 	LastActive       *uint64 `protobuf:"varint,9,opt,name=last_active" json:"last_active,omitempty"`
+	Approved         *bool   `protobuf:"varint,10,opt,name=approved" json:"approved,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
@@ -209,6 +218,13 @@ func (this *User) GetLastActive() uint64 {
 	return 0
 }
 
+func (this *User) GetApproved() bool {
+	if this != nil && this.Approved != nil {
+		return *this.Approved
+	}
+	return false
+}
+
 type UserRemove struct {
 	Id               *uint32 `protobuf:"varint,1,opt,name=id" json:"id,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
@@ -235,6 +251,9 @@ type Channel struct {
 	Acl              []*ACL   `protobuf:"bytes,7,rep,name=acl" json:"acl,omitempty"`
 	Groups           []*Group `protobuf:"bytes,8,rep,name=groups" json:"groups,omitempty"`
 	DescriptionBlob  *string  `protobuf:"bytes,9,opt,name=description_blob" json:"description_blob,omitempty"`
+	MaxUsers         *uint32  `protobuf:"varint,10,opt,name=max_users" json:"max_users,omitempty"`
+	EnterToken       *string  `protobuf:"bytes,11,opt,name=enter_token" json:"enter_token,omitempty"`
+	TextMessageLimit *uint32  `protobuf:"varint,12,opt,name=text_message_limit" json:"text_message_limit,omitempty"`
 	XXX_unrecognized []byte   `json:"-"`
 }
 
@@ -284,6 +303,27 @@ func (this *Channel) GetDescriptionBlob() string {
 	return ""
 }
 
+func (this *Channel) GetMaxUsers() uint32 {
+	if this != nil && this.MaxUsers != nil {
+		return *this.MaxUsers
+	}
+	return 0
+}
+
+func (this *Channel) GetEnterToken() string {
+	if this != nil && this.EnterToken != nil {
+		return *this.EnterToken
+	}
+	return ""
+}
+
+func (this *Channel) GetTextMessageLimit() uint32 {
+	if this != nil && this.TextMessageLimit != nil {
+		return *this.TextMessageLimit
+	}
+	return 0
+}
+
 type ChannelRemove struct {
 	Id               *uint32 `protobuf:"varint,1,opt,name=id" json:"id,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
@@ -30,6 +30,7 @@ const (
 	MessageUserStats
 	MessageRequestBlob
 	MessageServerConfig
+	MessageSuggestConfig
 )
 
 const (
@@ -94,6 +95,8 @@ func MessageType(msg interface{}) uint16 {
 		return MessageRequestBlob
 	case *ServerConfig:
 		return MessageServerConfig
+	case *SuggestConfig:
+		return MessageSuggestConfig
 	}
 	panic("unknown type")
 }
@@ -30,7 +30,7 @@ func (pds *PacketData) IsValid() bool {
 }
 
 func (pds *PacketData) Skip(skip int) {
-	if pds.Left() >= skip {
+	if skip >= 0 && pds.Left() >= skip {
 		pds.offset += skip
 	} else {
 		pds.ok = false
@@ -142,3 +142,17 @@ func TestSelfBytes(t *testing.T) {
 		}
 	}
 }
+
+func TestNegativeSkip(t *testing.T) {
+	buf := make([]byte, 10)
+	pds := New(buf)
+
+	pds.Skip(5)
+	pds.Skip(-3)
+	if pds.IsValid() {
+		t.Errorf("Expected negative skip to invalidate PDS")
+	}
+	if pds.Size() != 5 {
+		t.Errorf("Negative skip moved offset. Got %v, expected 5", pds.Size())
+	}
+}
@@ -20,6 +20,241 @@ var defaultCfg = map[string]string{
 	"RememberChannel":       "true",
 	"WelcomeText":           "Welcome to this server running <b>Grumble</b>.",
 	"SendVersion":           "true",
+	"Timeout":               "30",
+	"UDPTimeout":            "15",
+
+	// The blobstore hash of a PNG image, such as a logo, that is shown
+	// in front of the welcome text, and the largest image, in bytes,
+	// that can be set.
+	"ServerImage":        "",
+	"MaxServerImageSize": "131072",
+
+	// The id of the channel clients wait in when the server has reached
+	// MaxUsers, or empty to turn those clients away. Waiting clients are
+	// suppressed and can't leave the channel. As slots free up, they are
+	// let in in the order they arrived.
+	"QueueChannel": "",
+
+	// The most clients that may wait in the QueueChannel at once. Once
+	// the queue is full, further clients are turned away as if the
+	// server had no queue. Zero means no limit.
+	"MaxQueueLength": "100",
+
+	// How long, in seconds, a client has to complete the TLS handshake
+	// before its connection is dropped. Zero means no limit.
+	"TLSHandshakeTimeout": "10",
+
+	// Socket tuning of client connections: whether to disable Nagle's
+	// algorithm, the size of the buffer control messages are read into,
+	// and the size of the socket's send buffer. A send buffer size of
+	// zero uses the system's default.
+	"TCPNoDelay":        "true",
+	"TCPReadBufferSize": "4096",
+	"TCPSendBufferSize": "0",
+
+	// The peers, as a comma-separated list of IP addresses and CIDR
+	// networks, that are load balancers sending a PROXY protocol header,
+	// version 1 or 2, in front of each connection they relay. The client
+	// address in the header is used in place of the peer's. Empty trusts
+	// no peers.
+	"TrustedProxies": "",
+
+	// Whether to answer stats probes on the TCP port, which carry the
+	// same 12-byte request as the UDP ping, and the number of probes per
+	// second the server answers, in bursts of up to StatsProbeBurst.
+	"StatsProbe":      "false",
+	"StatsProbeLimit": "5",
+	"StatsProbeBurst": "20",
+
+	// The maximum bandwidth, in bits per second, of the voice relayed
+	// to each client. Zero means no limit.
+	"MaxSendBandwidth": "0",
+
+	// The total bandwidth, in bits per second, that the voice of all
+	// clients should stay within. If set, it is shared evenly between
+	// the clients that are speaking, up to MaxBandwidth each. Clients
+	// are told when their share changes, and voice over it is dropped.
+	// Zero advertises MaxBandwidth.
+	"TotalBandwidth": "0",
+
+	// The number of clients that can speak in a channel at once.
+	// Others are not relayed until one of them stops speaking.
+	// Priority speakers are always relayed. Zero means no limit.
+	"MaxChannelSpeakers": "0",
+
+	// The percentage of clients that must support the Opus codec for
+	// the server to use it. Clients without Opus support are warned
+	// that they can't talk when it is used, and clients that only
+	// support Opus when it isn't.
+	"OpusThreshold": "100",
+
+	// How long, in seconds, a moderator's pause of voice lasts, unless
+	// it is lifted earlier. Priority speakers are heard while voice is
+	// paused.
+	"VoicePauseDuration": "60",
+
+	// Whether moderators, who may mute users in the root channel, can
+	// have the server tell them when users start and stop talking, in
+	// any channel they can see.
+	"TalkingNotifications": "false",
+
+	// The number of control messages per second a client may send,
+	// and the size of the bursts it may send them in.
+	"MessageLimit": "20",
+	"MessageBurst": "100",
+
+	// The number of text messages per minute each user may send to a
+	// channel, unless the channel sets its own limit. Users with write
+	// permission on the channel are exempt. Zero means no limit.
+	"ChannelTextMessageLimit": "0",
+
+	// Clients that send more than AbnormalPacketLimit malformed packets
+	// within AbnormalPacketWindow seconds are disconnected, and banned
+	// for AbnormalPacketBanDuration seconds if it isn't zero.
+	"AbnormalPacketLimit":       "50",
+	"AbnormalPacketWindow":      "10",
+	"AbnormalPacketBanDuration": "0",
+
+	// Limits on the number of channels on the server, and on the number
+	// of temporary channels a single user can create. Zero means no limit.
+	"MaxChannels":                 "0",
+	"MaxTemporaryChannelsPerUser": "0",
+
+	// The number of permanent and temporary channels a client may create
+	// within ChannelCreateInterval seconds. Zero means no limit.
+	"ChannelCreateLimit":          "0",
+	"TemporaryChannelCreateLimit": "0",
+	"ChannelCreateInterval":       "60",
+
+	// Allow temporary channels inside temporary channels. Permanent
+	// channels are never allowed inside temporary ones.
+	"AllowTemporarySubchannels": "false",
+
+	// The number of sessions and channels, including the subchannels
+	// and linked channels it covers, a voice target can address. Zero
+	// means no limit.
+	"MaxVoiceTargetSize": "0",
+
+	// The number of voice targets each client can define, out of the
+	// 30 the protocol has room for, and the number of voice target
+	// updates per second a client may send, in bursts of up to
+	// VoiceTargetBurst. Updates over the limit are ignored.
+	"MaxVoiceTargets":  "30",
+	"VoiceTargetLimit": "10",
+	"VoiceTargetBurst": "30",
+
+	// The number of blobs, such as comments and textures, a client is
+	// sent for a single blob request, and the number of blob requests
+	// per second a client may send, in bursts of up to
+	// RequestBlobBurst. Blobs and requests over the limits are ignored.
+	"MaxBlobsPerRequest": "64",
+	"RequestBlobLimit":   "5",
+	"RequestBlobBurst":   "20",
+
+	// The number of seconds a client must wait between requests to have
+	// the server resend its channels and users. Requests made sooner are
+	// ignored. Zero means no limit.
+	"ResyncInterval": "10",
+
+	// The id of a channel that hands out talk rooms: users moving into
+	// it are placed in a new temporary subchannel, named TalkRoomPrefix
+	// followed by a number. Empty disables talk rooms.
+	"TalkRoomChannel": "",
+	"TalkRoomPrefix":  "Room",
+
+	// Enter tokens for channels that don't have one of their own, as a
+	// comma-separated list of channel=token entries, for example
+	// "5=secret,7=backstage". Clients must have presented the token as
+	// one of their access tokens to enter the channel with that id.
+	// Clients already in the channel when the key changes stay there.
+	"EnterTokens": "",
+
+	// Murmur's default channel name regex, [ \-=\w\#\[\]\{\}\(\)\@\|]+,
+	// but with \w spelled out to include Unicode letters and digits,
+	// as it does in Qt regexes, but not in Go's.
+	"ChannelNameRegex":     `[ \-=\p{L}\p{M}\p{N}_\#\[\]\{\}\(\)\@\|]+`,
+	"MaxChannelNameLength": "128",
+
+	// The longest channel description, in bytes, users may set. Zero
+	// means only MaxTextMessageLength applies. Descriptions shorter than
+	// ChannelDescriptionInlineThreshold are sent to clients along with
+	// the channel; longer ones are only sent as a hash, for clients to
+	// request when they need them. Clients too old to request them are
+	// always sent the description itself.
+	"MaxChannelDescriptionLength":       "0",
+	"ChannelDescriptionInlineThreshold": "128",
+
+	// Murmur's default user name regex, [-=\w\[\]\{\}\(\)\@\|\.]+,
+	// with \w spelled out as above.
+	"UsernameRegex":          `[-=\p{L}\p{M}\p{N}_\[\]\{\}\(\)\@\|\.]+`,
+	"MaxUsernameLength":      "128",
+	"TrimUsernameWhitespace": "true",
+
+	// Send a text message to the occupants of a channel when
+	// a user enters or leaves it.
+	"AnnounceChannelMoves": "false",
+
+	// Log connects, authentications, channel moves and
+	// disconnects as parseable key=value events.
+	"LogConnectionEvents": "false",
+
+	"LogTextMessages":         "false",
+	"TextMessageLogRetention": "30",
+
+	// Groups that users are members of by default, as a comma-separated
+	// list of group=criterion entries. The criterion is "all" for every
+	// user, "registered" for registered users, or "strongcert" for users
+	// with a strong certificate. An entry written group@channel=criterion
+	// only applies in the channel with that id and its subchannels, for
+	// example "members=registered,verified@5=strongcert". Groups that
+	// remove a user take precedence.
+	"DefaultGroups": "",
+
+	// Suppress users when they join, until a moderator approves them.
+	"SuppressNewUsers": "false",
+
+	// Settings suggested to clients, which warn their users if they
+	// don't follow them: a minimum client version, such as 1.2.4, and
+	// whether to use positional audio and push-to-talk. Empty values
+	// aren't suggested.
+	"SuggestVersion":    "",
+	"SuggestPositional": "",
+	"SuggestPushToTalk": "",
+
+	// What to do when a registered user logs in while already connected:
+	// "reject" the new session, or "kick" the one that is connected.
+	"DuplicateUserPolicy": "reject",
+
+	// What to do when a client logs in with the name of a user that is
+	// already connected: "" lets both in under the same name, "reject"
+	// turns the new client away, and "suffix" lets an unregistered client
+	// in under its name with a number appended, such as "alice(2)".
+	"DuplicateNamePolicy": "",
+
+	// Comma-separated lists of the client builds that are allowed on
+	// the server, and of those that aren't. If AllowedClients is set,
+	// only the builds it matches are allowed. Entries are versions, such
+	// as 1.2.4, version ranges, such as 1.2.4-1.2.19, 1.3.0- or -1.2.19,
+	// or glob patterns matched against the client's release string.
+	"AllowedClients": "",
+	"DeniedClients":  "",
+
+	// Additional addresses to receive UDP on, on the server's port,
+	// separated by commas. Use this to open an IPv6 socket alongside an
+	// IPv4 Address (or the other way around) when the system doesn't
+	// give the server a dual-stack socket. Replies to a client are sent
+	// from the socket of the client's address family.
+	"ExtraUDPAddresses": "",
+
+	// A file of PEM-encoded CAs that strong client certificates may be
+	// signed by, in addition to the system's CAs, and whether users
+	// need a strong certificate to be registered.
+	"ClientCAFile":                      "",
+	"RegisterRequiresStrongCertificate": "false",
+
+	// The port of a plain HTTP health check endpoint for load
+	// balancers, on the server's address. Zero disables it.
+	"HealthCheckPort": "0",
 }
 
 type Config struct {